@@ -0,0 +1,114 @@
+package bloom
+
+// A Bloom filter records a set of keys in a small bit array, and can say for certain that a key
+// is not in the set. It may wrongly say that a key is in the set, with a probability that falls
+// as more bits are used for each key: around 1% at 10 bits per key.
+//
+// Each key is hashed once, and the k bit positions are derived from that hash by double
+// hashing, as in LevelDB.
+
+import (
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+const DEFAULT_BITS_PER_KEY = 10
+
+// MAX_HASHES caps the number of bits set for each key, as beyond this the filter gets slower
+// without getting much more accurate
+const MAX_HASHES = 30
+
+type Filter struct {
+	bits   []byte
+	hashes uint8 // the number of bits set for each key
+}
+
+// Builder collects the keys for a filter, which can only be sized once every key is known
+type Builder struct {
+	bitsPerKey int
+	keyHashes  []uint64
+}
+
+func NewBuilder(bitsPerKey int) *Builder {
+	return &Builder{bitsPerKey: bitsPerKey}
+}
+
+func (b *Builder) Add(key string) {
+	b.keyHashes = append(b.keyHashes, hash(key))
+}
+
+// Build returns a filter containing every key added so far
+func (b *Builder) Build() *Filter {
+	// the number of hashes that minimises the false positive rate is bitsPerKey * ln(2)
+	hashes := int(math.Round(float64(b.bitsPerKey) * math.Ln2))
+	if hashes < 1 {
+		hashes = 1
+	} else if hashes > MAX_HASHES {
+		hashes = MAX_HASHES
+	}
+
+	// very small filters have a high false positive rate, so always use at least 64 bits
+	numBits := len(b.keyHashes) * b.bitsPerKey
+	if numBits < 64 {
+		numBits = 64
+	}
+	f := &Filter{bits: make([]byte, (numBits+7)/8), hashes: uint8(hashes)}
+	for _, h := range b.keyHashes {
+		f.add(h)
+	}
+	return f
+}
+
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// positions calls fn with each bit position for a key's hash, stopping early if fn returns false
+func (f *Filter) positions(h uint64, fn func(bit uint64) bool) {
+	numBits := uint64(len(f.bits)) * 8
+	h1, h2 := h&0xffffffff, h>>32|1 // never step by zero, which would set the same bit every time
+	for i := uint64(0); i < uint64(f.hashes); i++ {
+		if !fn((h1 + i*h2) % numBits) {
+			return
+		}
+	}
+}
+
+func (f *Filter) add(h uint64) {
+	f.positions(h, func(bit uint64) bool {
+		f.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+// MayContain returns false if key was definitely not added to the filter
+func (f *Filter) MayContain(key string) bool {
+	found := true
+	f.positions(hash(key), func(bit uint64) bool {
+		found = f.bits[bit/8]&(1<<(bit%8)) != 0
+		return found
+	})
+	return found
+}
+
+// Encode returns the filter's bits followed by a single byte holding the number of hashes
+func (f *Filter) Encode() []byte {
+	return append(append(make([]byte, 0, len(f.bits)+1), f.bits...), f.hashes)
+}
+
+// Decode reads a filter written by Encode
+func Decode(b []byte) (*Filter, error) {
+	if len(b) < 2 {
+		return nil, errors.New("filter is too short")
+	}
+	hashes := b[len(b)-1]
+	if hashes < 1 || hashes > MAX_HASHES {
+		return nil, errors.New("filter has an invalid number of hashes")
+	}
+	bits := make([]byte, len(b)-1)
+	copy(bits, b)
+	return &Filter{bits: bits, hashes: hashes}, nil
+}
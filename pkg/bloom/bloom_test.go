@@ -0,0 +1,68 @@
+package bloom
+
+import (
+	"strconv"
+	"testing"
+)
+
+func Test_Filter_MayContain_FindsEveryAddedKey(t *testing.T) {
+	b := NewBuilder(DEFAULT_BITS_PER_KEY)
+	for i := 0; i < 1000; i++ {
+		b.Add("key" + strconv.Itoa(i))
+	}
+	f := b.Build()
+
+	for i := 0; i < 1000; i++ {
+		if !f.MayContain("key" + strconv.Itoa(i)) {
+			t.Fatalf("Expected filter to contain 'key%d'", i)
+		}
+	}
+}
+
+func Test_Filter_MayContain_RarelyFindsMissingKeys(t *testing.T) {
+	b := NewBuilder(DEFAULT_BITS_PER_KEY)
+	for i := 0; i < 10000; i++ {
+		b.Add("key" + strconv.Itoa(i))
+	}
+	f := b.Build()
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContain("missing" + strconv.Itoa(i)) {
+			falsePositives++
+		}
+	}
+	// around 1% is expected at 10 bits per key
+	if falsePositives > 200 {
+		t.Fatalf("Expected a false positive rate of around 1%%, got %d in 10000", falsePositives)
+	}
+}
+
+func Test_Filter_MayContain_EmptyFilterContainsNothing(t *testing.T) {
+	f := NewBuilder(DEFAULT_BITS_PER_KEY).Build()
+	if f.MayContain("key") {
+		t.Fatal("Expected an empty filter to contain nothing")
+	}
+}
+
+func Test_Decode_RoundTripsEncodedFilter(t *testing.T) {
+	b := NewBuilder(DEFAULT_BITS_PER_KEY)
+	b.Add("a")
+	b.Add("b")
+
+	f, err := Decode(b.Build().Encode())
+	if err != nil {
+		t.Fatalf("Unexpected error decoding filter: %v", err)
+	}
+	if !f.MayContain("a") || !f.MayContain("b") {
+		t.Fatal("Expected decoded filter to contain the added keys")
+	}
+}
+
+func Test_Decode_RejectsInvalidFilter(t *testing.T) {
+	for _, b := range [][]byte{{}, {0xff}, {0xff, 0}, {0xff, MAX_HASHES + 1}} {
+		if _, err := Decode(b); err == nil {
+			t.Fatalf("Expected error decoding %v", b)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package bst
+
+// AVLTree is a binary search tree that rebalances itself after every insert, so that the heights
+// of the two subtrees of any node differ by at most one. This keeps the tree's height within
+// about 1.44*log2(n), even when keys are inserted in order.
+type AVLTree struct {
+	tree
+}
+
+func (t *AVLTree) Insert(key string, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var previous string
+	var replaced bool
+	t.root, previous, replaced = avlInsert(t.root, key, value)
+	t.inserted(key, value, previous, replaced)
+}
+
+func (t *AVLTree) Delete(key string) bool {
+	return t.delete(key, rebalance)
+}
+
+func (t *AVLTree) DeleteRange(start string, end string) uint {
+	return t.deleteRange(start, end, rebalance)
+}
+
+// avlInsert adds the key to the subtree rooted at n, or replaces its value, returning the new
+// root of the subtree and the value it replaced
+func avlInsert(n *BinaryNode, key string, value string) (*BinaryNode, string, bool) {
+	if n == nil {
+		return &BinaryNode{key: key, value: value, height: 1, count: 1}, "", false
+	}
+
+	var previous string
+	var replaced bool
+	if key < n.key {
+		n.left, previous, replaced = avlInsert(n.left, key, value)
+	} else if key > n.key {
+		n.right, previous, replaced = avlInsert(n.right, key, value)
+	} else {
+		previous = n.value
+		n.value = value
+		return n, previous, true
+	}
+	return rebalance(n), previous, replaced
+}
+
+func height(n *BinaryNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.height
+}
+
+// update recomputes the height and count of n from its children
+func update(n *BinaryNode) {
+	resize(n)
+	n.height = height(n.left) + 1
+	if right := height(n.right) + 1; right > n.height {
+		n.height = right
+	}
+}
+
+// rebalance restores the balance of n after one of its subtrees has grown or shrunk by one,
+// returning the new root of the subtree
+func rebalance(n *BinaryNode) *BinaryNode {
+	update(n)
+	balance := height(n.left) - height(n.right)
+	if balance > 1 {
+		if height(n.left.left) < height(n.left.right) {
+			n.left = rotateLeft(n.left)
+		}
+		return rotateRight(n)
+	} else if balance < -1 {
+		if height(n.right.right) < height(n.right.left) {
+			n.right = rotateRight(n.right)
+		}
+		return rotateLeft(n)
+	}
+	return n
+}
+
+func rotateLeft(n *BinaryNode) *BinaryNode {
+	r := n.right
+	n.right = r.left
+	r.left = n
+	update(n)
+	update(r)
+	return r
+}
+
+func rotateRight(n *BinaryNode) *BinaryNode {
+	l := n.left
+	n.left = l.right
+	l.right = n
+	update(n)
+	update(l)
+	return l
+}
@@ -0,0 +1,86 @@
+package bst
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func Test_AVLTree_MatchesMapForRandomInserts(t *testing.T) {
+	tree := AVLTree{}
+	expected := make(map[string]string)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(rng.Intn(2000))
+		tree.Insert(key, strconv.Itoa(i))
+		expected[key] = strconv.Itoa(i)
+	}
+
+	bytes := 0
+	keys := make([]string, 0, len(expected))
+	for key, value := range expected {
+		if result, exists := tree.Search(key); !exists || result != value {
+			t.Fatalf("Expected '%s' to be '%s', got '%s'", key, value, result)
+		}
+		bytes += len(key) + len(value)
+		keys = append(keys, key)
+	}
+	if tree.Size() != uint(len(expected)) || tree.Bytes() != uint(bytes) {
+		t.Fatalf("Expected %d keys and %d bytes, got %d and %d", len(expected), bytes, tree.Size(), tree.Bytes())
+	}
+
+	sort.Strings(keys)
+	iter := NewInOrderTraversalIterator(&tree)
+	for i, key := range keys {
+		if !iter.Next() || iter.Value().Key() != key {
+			t.Fatalf("Expected key %d to be '%s'", i, key)
+		}
+	}
+	if iter.Next() {
+		t.Fatal("Expected the iterator to finish after every key")
+	}
+}
+
+func Test_AVLTree_StaysBalancedForSequentialInserts(t *testing.T) {
+	tree := AVLTree{}
+	n := 10000
+	for i := 0; i < n; i++ {
+		tree.Insert(fmt.Sprintf("%08d", i), "value")
+	}
+
+	limit := int(1.44*math.Log2(float64(n+2))) + 1
+	if h := height(tree.root); h > limit {
+		t.Fatalf("Expected a height of at most %d for %d keys, got %d", limit, n, h)
+	}
+	if result, exists := tree.Search("00004242"); !exists || result != "value" {
+		t.Fatal("Expected to find a key after sequential inserts")
+	}
+}
+
+func Test_AVLTree_IsSafeForConcurrentUse(t *testing.T) {
+	tree := AVLTree{}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(g*100 + i)
+				tree.Insert(key, key)
+				if result, exists := tree.Search(key); !exists || result != key {
+					t.Errorf("Expected to find '%s' after inserting it", key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if tree.Size() != 800 {
+		t.Fatalf("Expected 800 keys to be counted, got %d", tree.Size())
+	}
+}
@@ -0,0 +1,70 @@
+package bst
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// the number of keys inserted into a fresh tree by each iteration of the benchmarks
+const BENCHMARK_TREE_SIZE = 10000
+
+var benchmarkTrees = map[string]func() Tree{
+	"Unbalanced": func() Tree { return &BinarySearchTree{} },
+	"AVL":        func() Tree { return &AVLTree{} },
+}
+
+// sequentialKeys are in insertion order, like timestamps
+func sequentialKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%020d", i)
+	}
+	return keys
+}
+
+func randomKeys(n int) []string {
+	keys := sequentialKeys(n)
+	rand.New(rand.NewSource(1)).Shuffle(len(keys), func(i, j int) {
+		keys[i], keys[j] = keys[j], keys[i]
+	})
+	return keys
+}
+
+var benchmarkPatterns = map[string]func(n int) []string{"Sequential": sequentialKeys, "Random": randomKeys}
+
+// Compares building a tree of each kind from keys inserted in order, and in a random order
+func Benchmark_Tree_Insert(b *testing.B) {
+	for treeName, newTree := range benchmarkTrees {
+		for patternName, pattern := range benchmarkPatterns {
+			newTree, keys := newTree, pattern(BENCHMARK_TREE_SIZE)
+			b.Run(treeName+"/"+patternName, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					tree := newTree()
+					for _, key := range keys {
+						tree.Insert(key, "value")
+					}
+				}
+			})
+		}
+	}
+}
+
+// Compares looking up every key in a tree of each kind built from keys inserted in order, and in
+// a random order
+func Benchmark_Tree_Search(b *testing.B) {
+	for treeName, newTree := range benchmarkTrees {
+		for patternName, pattern := range benchmarkPatterns {
+			keys := pattern(BENCHMARK_TREE_SIZE)
+			tree := newTree()
+			for _, key := range keys {
+				tree.Insert(key, "value")
+			}
+			b.Run(treeName+"/"+patternName, func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					tree.Search(keys[i%len(keys)])
+				}
+			})
+		}
+	}
+}
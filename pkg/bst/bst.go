@@ -1,42 +1,123 @@
 package bst
 
-// For now, we'll use a BST to store the sorted KV pairs. This is not ideal, because
-// BSTs are not necessarily very well balanced. This leads to worst case time complexity
-// of O(n) for Searches and Inserts. Ideally we'd use Red-Black trees or AVL trees.
-// This would give O(log(n)) complexity.
+import "sync"
+
+// BinarySearchTree makes no attempt to stay balanced, so keys inserted in order leave it as a
+// linked list, with O(n) Searches and Inserts. AVLTree keeps itself balanced, for O(log(n))
+// Searches, Inserts and Deletes whatever order keys arrive in. Both store their keys in
+// BinaryNodes, which also count the nodes below them, so either can be iterated over and queried
+// by rank in the same way.
+
+// Tree is implemented by every tree in this package
+type Tree interface {
+	Insert(key string, value string)
+	Search(key string) (string, bool)
+	Size() uint
+	Bytes() uint
+	// Delete removes the key from the tree, returning false if it wasn't there
+	Delete(key string) bool
+	// DeleteRange removes the keys from start up to but not including end, or every key from
+	// start if end is empty, returning how many were removed
+	DeleteRange(start string, end string) uint
+
+	Min() (string, string, bool)
+	Max() (string, string, bool)
+	Floor(key string) (string, string, bool)
+	Ceiling(key string) (string, string, bool)
+	Rank(key string) uint
+	Select(rank uint) (string, string, bool)
+
+	base() *tree
+}
+
+// tree holds what every tree in the package has in common. Trees are safe for concurrent use,
+// with searches able to run in parallel.
+type tree struct {
+	mu    sync.RWMutex
+	root  *BinaryNode
+	size  uint // the number of distinct keys
+	bytes uint // the combined length of every key and value
+}
+
+func (t *tree) base() *tree {
+	return t
+}
+
+func (t *tree) Search(key string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := t.root
+	for n != nil {
+		if key < n.key {
+			n = n.left
+		} else if key > n.key {
+			n = n.right
+		} else {
+			return n.value, true
+		}
+	}
+	return "", false
+}
+
+// Size returns the number of distinct keys in the tree, so replacing the value of a key doesn't
+// change it
+func (t *tree) Size() uint {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.size
+}
+
+// Bytes returns the combined length of every key and value in the tree
+func (t *tree) Bytes() uint {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.bytes
+}
+
+// inserted updates the size of the tree after a key is inserted. It must be called with mu
+// held for writing.
+func (t *tree) inserted(key string, value string, previous string, replaced bool) {
+	if replaced {
+		t.bytes = t.bytes - uint(len(previous)) + uint(len(value))
+	} else {
+		t.size += 1
+		t.bytes += uint(len(key) + len(value))
+	}
+}
 
 // BinarySearchTree is a thin wrapper around BinaryNode to help with initialisation
 type BinarySearchTree struct {
-	root *BinaryNode
-	size uint
+	tree
 }
 
 func (t *BinarySearchTree) Insert(key string, value string) {
-	t.size += 1
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	if t.root == nil {
-		t.root = &BinaryNode{key: key, value: value}
-	} else {
-		t.root.Insert(key, value)
+		t.root = &BinaryNode{key: key, value: value, count: 1}
+		t.inserted(key, value, "", false)
+		return
 	}
+
+	previous, replaced := t.root.insert(key, value)
+	t.inserted(key, value, previous, replaced)
 }
 
-func (t *BinarySearchTree) Search(key string) (string, bool) {
-	if t.root == nil {
-		return "", false
-	} else {
-		return t.root.Search(key)
-	}
+func (t *BinarySearchTree) Delete(key string) bool {
+	return t.delete(key, resize)
 }
 
-func (t *BinarySearchTree) Size() uint {
-	return t.size
+func (t *BinarySearchTree) DeleteRange(start string, end string) uint {
+	return t.deleteRange(start, end, resize)
 }
 
 type BinaryNode struct {
-	key   string
-	value string
-	left  *BinaryNode
-	right *BinaryNode
+	key    string
+	value  string
+	left   *BinaryNode
+	right  *BinaryNode
+	height int // only kept up to date by AVLTree
+	count  int // the number of nodes in the subtree rooted here, including this one
 }
 
 func (n *BinaryNode) Key() string {
@@ -48,21 +129,34 @@ func (n *BinaryNode) Value() string {
 }
 
 func (n *BinaryNode) Insert(key string, value string) {
+	n.insert(key, value)
+}
+
+// insert adds the key to the tree below n, or replaces its value, returning the value it replaced
+func (n *BinaryNode) insert(key string, value string) (string, bool) {
+	var previous string
+	var replaced bool
 	if key < n.key {
 		if n.left != nil {
-			n.left.Insert(key, value)
+			previous, replaced = n.left.insert(key, value)
 		} else {
-			n.left = &BinaryNode{key: key, value: value}
+			n.left = &BinaryNode{key: key, value: value, count: 1}
 		}
 	} else if key > n.key {
 		if n.right != nil {
-			n.right.Insert(key, value)
+			previous, replaced = n.right.insert(key, value)
 		} else {
-			n.right = &BinaryNode{key: key, value: value}
+			n.right = &BinaryNode{key: key, value: value, count: 1}
 		}
 	} else {
+		previous = n.value
 		n.value = value
+		return previous, true
+	}
+	if !replaced {
+		n.count++
 	}
+	return previous, replaced
 }
 
 func (n *BinaryNode) Search(key string) (string, bool) {
@@ -76,41 +170,3 @@ func (n *BinaryNode) Search(key string) (string, bool) {
 		return "", false
 	}
 }
-
-type InOrderTraversalIterator struct {
-	q    []*BinaryNode
-	curr *BinaryNode
-}
-
-func NewInOrderTraversalIterator(tree *BinarySearchTree) *InOrderTraversalIterator {
-	i := &InOrderTraversalIterator{
-		q: make([]*BinaryNode, 0, tree.Size()),
-	}
-	i.addNode(tree.root)
-	return i
-}
-
-func (i *InOrderTraversalIterator) addNode(root *BinaryNode) {
-	if root.left != nil {
-		i.addNode(root.left)
-	}
-	if root != nil {
-		i.q = append(i.q, root)
-	}
-	if root.right != nil {
-		i.addNode(root.right)
-	}
-}
-
-func (i *InOrderTraversalIterator) Value() *BinaryNode {
-	return i.curr
-}
-
-func (i *InOrderTraversalIterator) Next() bool {
-	if len(i.q) == 0 {
-		return false
-	}
-	i.curr = i.q[0]
-	i.q = i.q[1:]
-	return true
-}
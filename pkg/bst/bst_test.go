@@ -1,6 +1,8 @@
 package bst
 
 import (
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -113,3 +115,53 @@ func Test_BinarySearchTree(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_BinarySearchTree_IsSafeForConcurrentUse(t *testing.T) {
+	tree := BinarySearchTree{}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				key := strconv.Itoa(g*100 + i)
+				tree.Insert(key, key)
+				if result, exists := tree.Search(key); !exists || result != key {
+					t.Errorf("Expected to find '%s' after inserting it", key)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if tree.Size() != 800 {
+		t.Fatalf("Expected 800 keys to be counted, got %d", tree.Size())
+	}
+}
+
+func Test_BinarySearchTree_Size_CountsDistinctKeys(t *testing.T) {
+	tree := BinarySearchTree{}
+	for i := 0; i < 100; i++ {
+		tree.Insert("hot", strconv.Itoa(i))
+	}
+	tree.Insert("cold", "value")
+
+	if tree.Size() != 2 {
+		t.Fatalf("Expected 2 distinct keys, got %d", tree.Size())
+	}
+}
+
+func Test_BinarySearchTree_Bytes_TracksReplacedValues(t *testing.T) {
+	tree := BinarySearchTree{}
+	tree.Insert("key", "value")
+	tree.Insert("other", "v")
+	if tree.Bytes() != 14 {
+		t.Fatalf("Expected 14 bytes, got %d", tree.Bytes())
+	}
+
+	tree.Insert("key", "a much longer value")
+	if tree.Bytes() != 28 {
+		t.Fatalf("Expected 28 bytes after replacing a value, got %d", tree.Bytes())
+	}
+}
@@ -0,0 +1,106 @@
+package bst
+
+// Removing a node with two children moves its successor, the first node in its right subtree,
+// into its place. Every node on the path to a removed node is then fixed up on the way back up,
+// by resizing it in a BinarySearchTree, or by rebalancing it in an AVLTree.
+
+func count(n *BinaryNode) int {
+	if n == nil {
+		return 0
+	}
+	return n.count
+}
+
+// resize recomputes the count of n from its children, returning n
+func resize(n *BinaryNode) *BinaryNode {
+	n.count = count(n.left) + count(n.right) + 1
+	return n
+}
+
+func (t *tree) delete(key string, fix func(*BinaryNode) *BinaryNode) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.deleteLocked(key, fix)
+}
+
+// deleteLocked removes the key and updates the size of the tree. It must be called with mu held
+// for writing.
+func (t *tree) deleteLocked(key string, fix func(*BinaryNode) *BinaryNode) bool {
+	var value string
+	var found bool
+	t.root, value, found = remove(t.root, key, fix)
+	if found {
+		t.size -= 1
+		t.bytes -= uint(len(key) + len(value))
+	}
+	return found
+}
+
+func (t *tree) deleteRange(start string, end string, fix func(*BinaryNode) *BinaryNode) uint {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := t.root.keysBetween(start, end, nil)
+	for _, key := range keys {
+		t.deleteLocked(key, fix)
+	}
+	return uint(len(keys))
+}
+
+// remove deletes the key from the subtree rooted at n, returning the new root of the subtree and
+// the value that was removed
+func remove(n *BinaryNode, key string, fix func(*BinaryNode) *BinaryNode) (*BinaryNode, string, bool) {
+	if n == nil {
+		return nil, "", false
+	}
+
+	var value string
+	var found bool
+	if key < n.key {
+		n.left, value, found = remove(n.left, key, fix)
+	} else if key > n.key {
+		n.right, value, found = remove(n.right, key, fix)
+	} else {
+		value, found = n.value, true
+		if n.left == nil {
+			return n.right, value, found
+		} else if n.right == nil {
+			return n.left, value, found
+		}
+		right, successor := removeMin(n.right, fix)
+		successor.left, successor.right = n.left, right
+		n = successor
+	}
+	if !found {
+		return n, "", false
+	}
+	return fix(n), value, found
+}
+
+// removeMin unlinks the first node in the subtree rooted at n, returning the new root of the
+// subtree and the node that was unlinked
+func removeMin(n *BinaryNode, fix func(*BinaryNode) *BinaryNode) (*BinaryNode, *BinaryNode) {
+	if n.left == nil {
+		return n.right, n
+	}
+	var min *BinaryNode
+	n.left, min = removeMin(n.left, fix)
+	return fix(n), min
+}
+
+// keysBetween appends the keys below n from start up to but not including end, or every key from
+// start if end is empty, in order
+func (n *BinaryNode) keysBetween(start string, end string, keys []string) []string {
+	if n == nil {
+		return keys
+	}
+	if n.key > start {
+		keys = n.left.keysBetween(start, end, keys)
+	}
+	if n.key >= start && (end == "" || n.key < end) {
+		keys = append(keys, n.key)
+	}
+	if end == "" || n.key < end {
+		keys = n.right.keysBetween(start, end, keys)
+	}
+	return keys
+}
@@ -0,0 +1,117 @@
+package bst
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+// checkNode fails the test if the count of any node below n is wrong, or if balanced and the
+// heights of any node's subtrees differ by more than one. It returns the height of n.
+func checkNode(t *testing.T, n *BinaryNode, balanced bool) int {
+	if n == nil {
+		return 0
+	}
+	left, right := checkNode(t, n.left, balanced), checkNode(t, n.right, balanced)
+	if n.count != count(n.left)+count(n.right)+1 {
+		t.Fatalf("Expected node '%s' to count %d nodes, got %d", n.key, count(n.left)+count(n.right)+1, n.count)
+	}
+	if balanced && (left-right > 1 || right-left > 1) {
+		t.Fatalf("Expected node '%s' to be balanced, got subtrees of height %d and %d", n.key, left, right)
+	}
+	if left > right {
+		return left + 1
+	}
+	return right + 1
+}
+
+func Test_Delete_MatchesMapForRandomInsertsAndDeletes(t *testing.T) {
+	for name, tree := range map[string]Tree{"Unbalanced": &BinarySearchTree{}, "AVL": &AVLTree{}} {
+		expected := make(map[string]string)
+		rng := rand.New(rand.NewSource(1))
+		for i := 0; i < 5000; i++ {
+			key := strconv.Itoa(rng.Intn(500))
+			if rng.Intn(3) == 0 {
+				_, exists := expected[key]
+				if deleted := tree.Delete(key); deleted != exists {
+					t.Fatalf("%s: expected deleting '%s' to return %v", name, key, exists)
+				}
+				delete(expected, key)
+			} else {
+				tree.Insert(key, strconv.Itoa(i))
+				expected[key] = strconv.Itoa(i)
+			}
+		}
+		checkNode(t, tree.base().root, name == "AVL")
+
+		bytes := 0
+		keys := make([]string, 0, len(expected))
+		for key, value := range expected {
+			bytes += len(key) + len(value)
+			keys = append(keys, key)
+		}
+		if tree.Size() != uint(len(expected)) || tree.Bytes() != uint(bytes) {
+			t.Fatalf("%s: expected %d keys and %d bytes, got %d and %d", name, len(expected), bytes, tree.Size(), tree.Bytes())
+		}
+		sort.Strings(keys)
+		if got := collect(NewInOrderTraversalIterator(tree)); fmt.Sprint(got) != fmt.Sprint(keys) {
+			t.Fatalf("%s: expected keys %v, got %v", name, keys, got)
+		}
+	}
+}
+
+func Test_Delete_ReplacesNodeWithSuccessor(t *testing.T) {
+	tree := BinarySearchTree{}
+	for _, key := range []string{"4", "2", "6", "1", "3", "5", "7"} {
+		tree.Insert(key, key)
+	}
+
+	tree.Delete("4")
+	if tree.root.key != "5" || tree.root.left.key != "2" || tree.root.right.key != "6" || tree.root.right.left != nil {
+		t.Fatalf("Expected '5' to take the place of '4', got root '%s'", tree.root.key)
+	}
+	if _, exists := tree.Search("4"); exists {
+		t.Fatal("Expected '4' to be deleted")
+	}
+	checkNode(t, tree.root, false)
+}
+
+func Test_Delete_MissingKeyChangesNothing(t *testing.T) {
+	tree := AVLTree{}
+	if tree.Delete("a") {
+		t.Fatal("Expected nothing to delete in an empty tree")
+	}
+	tree.Insert("a", "value")
+	if tree.Delete("b") || tree.Size() != 1 || tree.Bytes() != 6 {
+		t.Fatalf("Expected deleting a missing key to change nothing, got %d keys and %d bytes", tree.Size(), tree.Bytes())
+	}
+}
+
+func Test_DeleteRange_RemovesKeysInRange(t *testing.T) {
+	for name, tree := range map[string]Tree{"Unbalanced": &BinarySearchTree{}, "AVL": &AVLTree{}} {
+		for i := 0; i < 100; i++ {
+			tree.Insert(fmt.Sprintf("%02d", i), "value")
+		}
+
+		if deleted := tree.DeleteRange("10", "20"); deleted != 10 {
+			t.Fatalf("%s: expected 10 keys to be deleted, got %d", name, deleted)
+		}
+		if deleted := tree.DeleteRange("90", ""); deleted != 10 {
+			t.Fatalf("%s: expected every key from '90' to be deleted, got %d", name, deleted)
+		}
+		if deleted := tree.DeleteRange("50", "50"); deleted != 0 {
+			t.Fatalf("%s: expected an empty range to delete nothing, got %d", name, deleted)
+		}
+		for key, exists := range map[string]bool{"09": true, "10": false, "19": false, "20": true, "89": true, "90": false, "99": false} {
+			if _, found := tree.Search(key); found != exists {
+				t.Fatalf("%s: expected '%s' to exist: %v", name, key, exists)
+			}
+		}
+		if tree.Size() != 80 || tree.Bytes() != 80*7 {
+			t.Fatalf("%s: expected 80 keys left, got %d and %d bytes", name, tree.Size(), tree.Bytes())
+		}
+		checkNode(t, tree.base().root, name == "AVL")
+	}
+}
@@ -0,0 +1,124 @@
+package bst
+
+// InOrderTraversalIterator walks the keys of a tree in order, either ascending or descending,
+// optionally within a range. It holds only the path from the root to the next node, so it
+// never needs more than O(height) memory, and Seek moves it to any key in O(height) time.
+//
+// Each step takes the tree's read lock, but the tree must not be changed while the iterator is
+// in use, as inserts can move nodes around the path it holds.
+type InOrderTraversalIterator struct {
+	tree    *tree
+	stack   []*BinaryNode // the next node is on top, above the ancestors still to be returned
+	curr    *BinaryNode
+	start   string
+	end     string // empty if the range has no upper bound
+	reverse bool
+}
+
+// NewInOrderTraversalIterator walks every key in the tree in ascending order
+func NewInOrderTraversalIterator(tree Tree) *InOrderTraversalIterator {
+	return NewRangeIterator(tree, "", "")
+}
+
+// NewRangeIterator walks the keys from start up to but not including end, in ascending order.
+// An empty end leaves the range unbounded.
+func NewRangeIterator(tree Tree, start string, end string) *InOrderTraversalIterator {
+	i := &InOrderTraversalIterator{tree: tree.base(), start: start, end: end}
+	i.Seek(start)
+	return i
+}
+
+// NewReverseRangeIterator walks the same keys as NewRangeIterator, in descending order
+func NewReverseRangeIterator(tree Tree, start string, end string) *InOrderTraversalIterator {
+	i := &InOrderTraversalIterator{tree: tree.base(), start: start, end: end, reverse: true}
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	if end == "" {
+		for n := i.tree.root; n != nil; n = n.right {
+			i.stack = append(i.stack, n)
+		}
+	} else {
+		i.seekBefore(end, false)
+	}
+	return i
+}
+
+// Seek moves the iterator so that the next call to Next returns the first key in the range at
+// or after key, or the last key at or before key when iterating in reverse
+func (i *InOrderTraversalIterator) Seek(key string) {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	if i.reverse {
+		if i.end != "" && key >= i.end {
+			i.seekBefore(i.end, false)
+		} else {
+			i.seekBefore(key, true)
+		}
+		return
+	}
+
+	if key < i.start {
+		key = i.start
+	}
+	i.stack, i.curr = i.stack[:0], nil
+	// keep every node at or after key on the way down, as they follow key in order
+	for n := i.tree.root; n != nil; {
+		if n.key >= key {
+			i.stack = append(i.stack, n)
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+}
+
+// seekBefore keeps every node before key, or at it if inclusive, on the way down, as they
+// follow key in reverse order. It must be called with the read lock held.
+func (i *InOrderTraversalIterator) seekBefore(key string, inclusive bool) {
+	i.stack, i.curr = i.stack[:0], nil
+	for n := i.tree.root; n != nil; {
+		if n.key < key || (inclusive && n.key == key) {
+			i.stack = append(i.stack, n)
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+}
+
+// Next moves to the next key, returning false once there are no more keys in the range
+func (i *InOrderTraversalIterator) Next() bool {
+	i.tree.mu.RLock()
+	defer i.tree.mu.RUnlock()
+	if len(i.stack) == 0 {
+		i.curr = nil
+		return false
+	}
+	n := i.stack[len(i.stack)-1]
+	i.stack = i.stack[:len(i.stack)-1]
+
+	if !i.reverse {
+		if i.end != "" && n.key >= i.end {
+			i.stack, i.curr = i.stack[:0], nil
+			return false
+		}
+		for c := n.right; c != nil; c = c.left {
+			i.stack = append(i.stack, c)
+		}
+	} else {
+		if n.key < i.start {
+			i.stack, i.curr = i.stack[:0], nil
+			return false
+		}
+		for c := n.left; c != nil; c = c.right {
+			i.stack = append(i.stack, c)
+		}
+	}
+	i.curr = n
+	return true
+}
+
+// Value returns the node the iterator is at, or nil before the first call to Next and after the last
+func (i *InOrderTraversalIterator) Value() *BinaryNode {
+	return i.curr
+}
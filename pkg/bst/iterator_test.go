@@ -0,0 +1,131 @@
+package bst
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func Test_InOrderTraversalIterator_IsEmptyForEmptyTree(t *testing.T) {
+	for _, iter := range []*InOrderTraversalIterator{
+		NewInOrderTraversalIterator(&BinarySearchTree{}),
+		NewRangeIterator(&AVLTree{}, "a", "z"),
+		NewReverseRangeIterator(&AVLTree{}, "", ""),
+	} {
+		iter.Seek("m")
+		if iter.Next() || iter.Value() != nil {
+			t.Fatal("Expected no keys in an empty tree")
+		}
+	}
+}
+
+// collect returns the keys left in the iterator
+func collect(iter *InOrderTraversalIterator) []string {
+	keys := make([]string, 0)
+	for iter.Next() {
+		keys = append(keys, iter.Value().Key())
+	}
+	return keys
+}
+
+// between returns the keys from start up to but not including end, or every key from start if
+// end is empty
+func between(keys []string, start string, end string) []string {
+	result := make([]string, 0)
+	for _, key := range keys {
+		if key >= start && (end == "" || key < end) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+func reversed(keys []string) []string {
+	result := make([]string, len(keys))
+	for i, key := range keys {
+		result[len(keys)-1-i] = key
+	}
+	return result
+}
+
+func Test_InOrderTraversalIterator_MatchesSortedKeys(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	inserted := make(map[string]bool)
+	trees := []Tree{&BinarySearchTree{}, &AVLTree{}}
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("%03d", rng.Intn(1000))
+		for _, tree := range trees {
+			tree.Insert(key, "value")
+		}
+		inserted[key] = true
+	}
+	keys := make([]string, 0, len(inserted))
+	for key := range inserted {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	bounds := []string{"", "000", "250", "251", "500", "999", "a"}
+	for _, tree := range trees {
+		for _, start := range bounds {
+			for _, end := range bounds {
+				expected := between(keys, start, end)
+				if got := collect(NewRangeIterator(tree, start, end)); !reflect.DeepEqual(got, expected) {
+					t.Fatalf("Expected [%s, %s) to hold %v, got %v", start, end, expected, got)
+				}
+				if got := collect(NewReverseRangeIterator(tree, start, end)); !reflect.DeepEqual(got, reversed(expected)) {
+					t.Fatalf("Expected [%s, %s) in reverse to hold %v, got %v", start, end, reversed(expected), got)
+				}
+
+				for _, seek := range bounds {
+					iter := NewRangeIterator(tree, start, end)
+					iter.Seek(seek)
+					if got, expected := collect(iter), between(expected, seek, ""); !reflect.DeepEqual(got, expected) {
+						t.Fatalf("Expected [%s, %s) after seeking to '%s' to hold %v, got %v", start, end, seek, expected, got)
+					}
+
+					iter = NewReverseRangeIterator(tree, start, end)
+					iter.Seek(seek)
+					expected := reversed(between(expected, "", seek+"\x00"))
+					if got := collect(iter); !reflect.DeepEqual(got, expected) {
+						t.Fatalf("Expected [%s, %s) in reverse after seeking to '%s' to hold %v, got %v", start, end, seek, expected, got)
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_InOrderTraversalIterator_SeeksBackwards(t *testing.T) {
+	tree := AVLTree{}
+	for _, key := range []string{"a", "b", "c", "d"} {
+		tree.Insert(key, key)
+	}
+	iter := NewInOrderTraversalIterator(&tree)
+	collect(iter)
+	iter.Seek("b")
+	if got := collect(iter); !reflect.DeepEqual(got, []string{"b", "c", "d"}) {
+		t.Fatalf("Expected to restart from 'b', got %v", got)
+	}
+}
+
+func Test_InOrderTraversalIterator_OnlyHoldsPathToNextNode(t *testing.T) {
+	tree := AVLTree{}
+	for i := 0; i < 10000; i++ {
+		tree.Insert(fmt.Sprintf("%05d", i), "value")
+	}
+
+	iter := NewInOrderTraversalIterator(&tree)
+	count := 0
+	for iter.Next() {
+		count++
+		if len(iter.stack) > height(tree.root) {
+			t.Fatalf("Expected at most %d nodes to be held, got %d", height(tree.root), len(iter.stack))
+		}
+	}
+	if count != 10000 {
+		t.Fatalf("Expected 10000 keys, got %d", count)
+	}
+}
@@ -0,0 +1,106 @@
+package bst
+
+// Ordered queries each follow a single path down from the root, so they take O(height) time.
+// Each returns the key and value it finds, or false if there is no such key.
+
+// Min returns the first key in the tree
+func (t *tree) Min() (string, string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := t.root
+	if n == nil {
+		return "", "", false
+	}
+	for n.left != nil {
+		n = n.left
+	}
+	return n.key, n.value, true
+}
+
+// Max returns the last key in the tree
+func (t *tree) Max() (string, string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	n := t.root
+	if n == nil {
+		return "", "", false
+	}
+	for n.right != nil {
+		n = n.right
+	}
+	return n.key, n.value, true
+}
+
+// Floor returns the last key at or before key
+func (t *tree) Floor(key string) (string, string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var floor *BinaryNode
+	for n := t.root; n != nil; {
+		if n.key <= key {
+			floor = n
+			n = n.right
+		} else {
+			n = n.left
+		}
+	}
+	if floor == nil {
+		return "", "", false
+	}
+	return floor.key, floor.value, true
+}
+
+// Ceiling returns the first key at or after key
+func (t *tree) Ceiling(key string) (string, string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var ceiling *BinaryNode
+	for n := t.root; n != nil; {
+		if n.key >= key {
+			ceiling = n
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	if ceiling == nil {
+		return "", "", false
+	}
+	return ceiling.key, ceiling.value, true
+}
+
+// Rank returns the number of keys in the tree before key, which is the rank of key if it is in
+// the tree
+func (t *tree) Rank(key string) uint {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rank := 0
+	for n := t.root; n != nil; {
+		if key <= n.key {
+			n = n.left
+		} else {
+			rank += count(n.left) + 1
+			n = n.right
+		}
+	}
+	return uint(rank)
+}
+
+// Select returns the key with the given rank, counting from 0, so Select(0) is the same as Min
+func (t *tree) Select(rank uint) (string, string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	r := int(rank)
+	for n := t.root; n != nil; {
+		left := count(n.left)
+		if r < left {
+			n = n.left
+		} else if r > left {
+			r -= left + 1
+			n = n.right
+		} else {
+			return n.key, n.value, true
+		}
+	}
+	return "", "", false
+}
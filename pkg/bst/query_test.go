@@ -0,0 +1,82 @@
+package bst
+
+import (
+	"fmt"
+	"testing"
+)
+
+func Test_Queries_FailOnEmptyTree(t *testing.T) {
+	tree := AVLTree{}
+	if _, _, exists := tree.Min(); exists {
+		t.Fatal("Expected no minimum in an empty tree")
+	}
+	if _, _, exists := tree.Max(); exists {
+		t.Fatal("Expected no maximum in an empty tree")
+	}
+	if _, _, exists := tree.Floor("a"); exists {
+		t.Fatal("Expected no floor in an empty tree")
+	}
+	if _, _, exists := tree.Ceiling("a"); exists {
+		t.Fatal("Expected no ceiling in an empty tree")
+	}
+	if _, _, exists := tree.Select(0); exists {
+		t.Fatal("Expected nothing to select in an empty tree")
+	}
+	if rank := tree.Rank("a"); rank != 0 {
+		t.Fatalf("Expected a rank of 0 in an empty tree, got %d", rank)
+	}
+}
+
+func Test_Queries_MatchSortedKeys(t *testing.T) {
+	for name, tree := range map[string]Tree{"Unbalanced": &BinarySearchTree{}, "AVL": &AVLTree{}} {
+		// the even numbers from 10 to 98, inserted out of order
+		keys := make([]string, 0)
+		for i := 10; i < 100; i += 2 {
+			keys = append(keys, fmt.Sprint(i))
+		}
+		for i := range keys {
+			key := keys[(i*7)%len(keys)]
+			tree.Insert(key, "value"+key)
+		}
+		tree.Delete("50")
+		keys = append(keys[:20], keys[21:]...)
+
+		if key, value, _ := tree.Min(); key != "10" || value != "value10" {
+			t.Fatalf("%s: expected a minimum of '10', got '%s'", name, key)
+		}
+		if key, _, _ := tree.Max(); key != "98" {
+			t.Fatalf("%s: expected a maximum of '98', got '%s'", name, key)
+		}
+		for query, expected := range map[string]string{"10": "10", "11": "10", "50": "48", "51": "48", "53": "52", "99": "98"} {
+			if key, value, _ := tree.Floor(query); key != expected || value != "value"+expected {
+				t.Fatalf("%s: expected the floor of '%s' to be '%s', got '%s'", name, query, expected, key)
+			}
+		}
+		if _, _, exists := tree.Floor("09"); exists {
+			t.Fatalf("%s: expected no floor before the first key", name)
+		}
+		for query, expected := range map[string]string{"0": "10", "10": "10", "11": "12", "49": "52", "98": "98"} {
+			if key, _, _ := tree.Ceiling(query); key != expected {
+				t.Fatalf("%s: expected the ceiling of '%s' to be '%s', got '%s'", name, query, expected, key)
+			}
+		}
+		if _, _, exists := tree.Ceiling("99"); exists {
+			t.Fatalf("%s: expected no ceiling after the last key", name)
+		}
+
+		for rank, key := range keys {
+			if got := tree.Rank(key); got != uint(rank) {
+				t.Fatalf("%s: expected '%s' to have rank %d, got %d", name, key, rank, got)
+			}
+			if got, _, _ := tree.Select(uint(rank)); got != key {
+				t.Fatalf("%s: expected rank %d to be '%s', got '%s'", name, rank, key, got)
+			}
+		}
+		if rank := tree.Rank("50"); rank != 20 {
+			t.Fatalf("%s: expected a deleted key to rank after the keys before it, got %d", name, rank)
+		}
+		if _, _, exists := tree.Select(uint(len(keys))); exists {
+			t.Fatalf("%s: expected nothing to select past the last key", name)
+		}
+	}
+}
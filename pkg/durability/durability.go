@@ -0,0 +1,167 @@
+package durability
+
+// Storage engines acknowledge a write once it has been handed to the operating system, but
+// the data can still be lost on power failure until the file has been fsynced. A Policy
+// decides how often that happens, trading write throughput against how many acknowledged
+// writes can be lost.
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type mode int
+
+const (
+	never mode = iota
+	always
+	interval
+)
+
+type Policy struct {
+	mode     mode
+	interval time.Duration
+}
+
+// Never leaves flushing written data to disk up to the operating system
+func Never() Policy {
+	return Policy{mode: never}
+}
+
+// Always fsyncs after every write before it is acknowledged
+func Always() Policy {
+	return Policy{mode: always}
+}
+
+// Interval fsyncs in the background every d, if anything has been written since the last sync
+func Interval(d time.Duration) Policy {
+	return Policy{mode: interval, interval: d}
+}
+
+// Parse reads a policy from a string of the form "never", "always" or "interval:<duration>"
+func Parse(s string) (Policy, error) {
+	switch {
+	case s == "never":
+		return Never(), nil
+	case s == "always":
+		return Always(), nil
+	case strings.HasPrefix(s, "interval:"):
+		d, err := time.ParseDuration(strings.TrimPrefix(s, "interval:"))
+		if err != nil || d <= 0 {
+			return Policy{}, fmt.Errorf("invalid sync interval in '%s'", s)
+		}
+		return Interval(d), nil
+	default:
+		return Policy{}, fmt.Errorf("unknown durability policy '%s'", s)
+	}
+}
+
+func (p Policy) String() string {
+	switch p.mode {
+	case always:
+		return "always"
+	case interval:
+		return "interval:" + p.interval.String()
+	default:
+		return "never"
+	}
+}
+
+// SyncOnFlush reports whether files written in one go, rather than appended to over time,
+// should be fsynced once they are complete
+func (p Policy) SyncOnFlush() bool {
+	return p.mode != never
+}
+
+// SyncOnWrite reports whether every write is fsynced before it is acknowledged
+func (p Policy) SyncOnWrite() bool {
+	return p.mode == always
+}
+
+type syncable interface {
+	Sync() error
+}
+
+// Syncer applies a Policy to a file that is being appended to
+type Syncer struct {
+	f      syncable
+	policy Policy
+	dirty  int32
+
+	mu  sync.Mutex
+	err error // the first error from a background sync
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewSyncer(f syncable, p Policy) *Syncer {
+	s := &Syncer{f: f, policy: p}
+	if p.mode == interval {
+		s.stop = make(chan struct{})
+		s.done = make(chan struct{})
+		go s.syncPeriodically()
+	}
+	return s
+}
+
+// Written must be called after each write to the file. With the Always policy it doesn't
+// return until the write is on disk. An error from an earlier background sync is returned
+// here, as it means earlier writes may not have been persisted.
+func (s *Syncer) Written() error {
+	switch s.policy.mode {
+	case always:
+		return s.f.Sync()
+	case interval:
+		atomic.StoreInt32(&s.dirty, 1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// Close stops any background syncing, and syncs anything written since the last sync
+func (s *Syncer) Close() error {
+	if s.policy.mode != interval {
+		return nil
+	}
+	close(s.stop)
+	<-s.done
+	s.sync()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Syncer) syncPeriodically() {
+	defer close(s.done)
+	ticker := time.NewTicker(s.policy.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sync()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+func (s *Syncer) sync() {
+	if !atomic.CompareAndSwapInt32(&s.dirty, 1, 0) {
+		return
+	}
+	err := s.f.Sync()
+	if err != nil {
+		s.mu.Lock()
+		if s.err == nil {
+			s.err = fmt.Errorf("background sync failed: %v", err)
+		}
+		s.mu.Unlock()
+	}
+}
@@ -0,0 +1,79 @@
+package durability
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type countingFile struct {
+	syncs int32
+}
+
+func (f *countingFile) Sync() error {
+	atomic.AddInt32(&f.syncs, 1)
+	return nil
+}
+
+func Test_Syncer_Always_SyncsEveryWrite(t *testing.T) {
+	f := &countingFile{}
+	s := NewSyncer(f, Always())
+
+	for i := 0; i < 3; i++ {
+		s.Written()
+	}
+
+	if f.syncs != 3 {
+		t.Fatalf("Expected 3 syncs, got %d", f.syncs)
+	}
+}
+
+func Test_Syncer_Never_DoesNotSync(t *testing.T) {
+	f := &countingFile{}
+	s := NewSyncer(f, Never())
+
+	s.Written()
+	s.Close()
+
+	if f.syncs != 0 {
+		t.Fatalf("Expected no syncs, got %d", f.syncs)
+	}
+}
+
+func Test_Syncer_Interval_SyncsInBackgroundAndOnClose(t *testing.T) {
+	f := &countingFile{}
+	s := NewSyncer(f, Interval(time.Millisecond))
+
+	s.Written()
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&f.syncs) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt32(&f.syncs) != 1 {
+		t.Fatal("Expected a background sync after writing")
+	}
+
+	s.Written()
+	s.Close()
+	if f.syncs != 2 {
+		t.Fatalf("Expected close to sync outstanding writes, got %d syncs", f.syncs)
+	}
+}
+
+func Test_Parse(t *testing.T) {
+	for _, s := range []string{"never", "always", "interval:50ms"} {
+		p, err := Parse(s)
+		if err != nil {
+			t.Fatalf("Unexpected error parsing '%s': %v", s, err)
+		}
+		if p.String() != s {
+			t.Fatalf("Expected '%s' to round trip, got '%s'", s, p.String())
+		}
+	}
+
+	for _, s := range []string{"sometimes", "interval:", "interval:-1s"} {
+		if _, err := Parse(s); err == nil {
+			t.Fatalf("Expected error parsing '%s'", s)
+		}
+	}
+}
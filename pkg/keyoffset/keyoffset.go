@@ -1,37 +1,194 @@
 package keyoffset
 
-func getInterval(index []KeyOffset, key string) (*KeyOffset, *KeyOffset) {
-	if len(index) == 0 {
-		return nil, nil
-	}
-	
-	if len(index) == 1 {
-		if key < index[0].Key {
-			return nil, &index[0]
-		} else {
-			return &index[0], nil
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A sparse index holds a few keys from a sorted file, each leading to the section of the file
+// around it, so that finding a key only needs a small part of the file to be read. An index is
+// built from entries in key order, and never changes once built, so lookups are binary searches.
+//
+// Each entry is encoded as a sequence of fields: the length of the key as a uvarint, the key,
+// then the offset and size of its section as uvarints.
+
+type KeyOffset struct {
+	Key    string
+	Offset int64
+	Size   int64 // the size of the section at Offset, or 0 if it isn't known
+}
+
+// Index is a sparse index, safe for concurrent use once built
+type Index struct {
+	entries []KeyOffset
+}
+
+// Builder builds an index from entries added in key order
+type Builder struct {
+	entries []KeyOffset
+}
+
+func NewBuilder() *Builder {
+	return &Builder{entries: make([]KeyOffset, 0)}
+}
+
+// Add adds an entry after every entry so far. Its key must come after theirs, and its section
+// must start after theirs ends.
+func (b *Builder) Add(key string, offset int64, size int64) error {
+	if offset < 0 || size < 0 {
+		return fmt.Errorf("entry for key '%s' has a negative offset or size", key)
+	}
+	if n := len(b.entries); n > 0 {
+		last := b.entries[n-1]
+		if key <= last.Key {
+			return fmt.Errorf("entry for key '%s' is out of order after '%s'", key, last.Key)
+		}
+		if offset < last.Offset+last.Size {
+			return fmt.Errorf("entry for key '%s' overlaps the section for '%s'", key, last.Key)
 		}
 	}
+	b.entries = append(b.entries, KeyOffset{Key: key, Offset: offset, Size: size})
+	return nil
+}
+
+// Len returns the number of entries added so far
+func (b *Builder) Len() int {
+	return len(b.entries)
+}
+
+// Build returns the index, after which the builder must not be used
+func (b *Builder) Build() *Index {
+	return &Index{entries: b.entries}
+}
+
+// Len returns the number of entries in the index
+func (i *Index) Len() int {
+	return len(i.entries)
+}
 
-	mid := len(index) / 2
+// At returns the nth entry in the index
+func (i *Index) At(n int) KeyOffset {
+	return i.entries[n]
+}
+
+// search returns the position of the first entry at or after key, or Len if there isn't one
+func (i *Index) search(key string) int {
+	return sort.Search(len(i.entries), func(n int) bool {
+		return i.entries[n].Key >= key
+	})
+}
 
+// Floor returns the last entry at or before key
+func (i *Index) Floor(key string) (KeyOffset, bool) {
+	n := i.search(key)
+	if n < len(i.entries) && i.entries[n].Key == key {
+		return i.entries[n], true
+	} else if n == 0 {
+		return KeyOffset{}, false
+	}
+	return i.entries[n-1], true
+}
+
+// Ceiling returns the first entry at or after key
+func (i *Index) Ceiling(key string) (KeyOffset, bool) {
+	n := i.search(key)
+	if n == len(i.entries) {
+		return KeyOffset{}, false
+	}
+	return i.entries[n], true
+}
+
+// Interval returns the last entry at or before key, and the entry after it. In an index of the
+// first key in each section, these are the section that could hold key, and the one after it.
+// Either is nil if there is no such entry.
+func (i *Index) Interval(key string) (*KeyOffset, *KeyOffset) {
+	n := i.search(key)
+	if n < len(i.entries) && i.entries[n].Key == key {
+		n++
+	}
 	var l, r *KeyOffset
-	if key < index[mid].Key {
-		l, r = getInterval(index[:mid], key)
-		if r == nil {
-			r = &index[mid]
+	if n > 0 {
+		l = &i.entries[n-1]
+	}
+	if n < len(i.entries) {
+		r = &i.entries[n]
+	}
+	return l, r
+}
+
+// Range returns the positions from the first entry at or after start, up to but not including
+// the first entry at or after end. An empty end leaves the range unbounded.
+func (i *Index) Range(start string, end string) (int, int) {
+	from, to := i.search(start), len(i.entries)
+	if end != "" {
+		to = i.search(end)
+	}
+	if to < from {
+		to = from
+	}
+	return from, to
+}
+
+// Encode returns the entries of the index, as read by Decode
+func (i *Index) Encode() []byte {
+	buf := make([]byte, 0)
+	scratch := make([]byte, binary.MaxVarintLen64)
+	for _, e := range i.entries {
+		buf = append(buf, scratch[:binary.PutUvarint(scratch, uint64(len(e.Key)))]...)
+		buf = append(buf, e.Key...)
+		buf = append(buf, scratch[:binary.PutUvarint(scratch, uint64(e.Offset))]...)
+		buf = append(buf, scratch[:binary.PutUvarint(scratch, uint64(e.Size))]...)
+	}
+	return buf
+}
+
+// WriteTo writes the encoded index to w, so that it can be read back with ReadSection
+func (i *Index) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(i.Encode())
+	return int64(n), err
+}
+
+// Decode reads an index written by Encode, checking that its entries are in order
+func Decode(b []byte) (*Index, error) {
+	builder := NewBuilder()
+	for len(b) > 0 {
+		length, n := binary.Uvarint(b)
+		if n <= 0 || length > uint64(len(b)-n) {
+			return nil, errors.New("index entry is malformed")
 		}
-	} else {
-		l, r = getInterval(index[mid:], key)
-		if l == nil && mid > 0 {
-			l = &index[mid-1]
+		key := string(b[n : n+int(length)])
+		b = b[n+int(length):]
+
+		offset, n := binary.Uvarint(b)
+		if n <= 0 || offset > 1<<62 {
+			return nil, errors.New("index entry is malformed")
 		}
-	}
+		b = b[n:]
+		size, n := binary.Uvarint(b)
+		if n <= 0 || size > 1<<62 {
+			return nil, errors.New("index entry is malformed")
+		}
+		b = b[n:]
 
-	return l, r
+		err := builder.Add(key, int64(offset), int64(size))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return builder.Build(), nil
 }
 
-type KeyOffset struct {
-	Key    string
-	Offset int64
-}
\ No newline at end of file
+// ReadSection reads an index written with WriteTo from the size bytes of r at offset
+func ReadSection(r io.ReaderAt, offset int64, size int64) (*Index, error) {
+	b := make([]byte, size)
+	_, err := r.ReadAt(b, offset)
+	if err == io.EOF {
+		return nil, errors.New("index ends past the end of the file")
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read index: %v", err)
+	}
+	return Decode(b)
+}
@@ -1,43 +1,46 @@
 package keyoffset
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
-func Test_getInterval_EmptySlice(t *testing.T) {
+func Test_Index_Interval_EmptySlice(t *testing.T) {
 	data := []KeyOffset{}
 
 	var l, r *KeyOffset
 
-	l, r = getInterval(data, "b")
+	l, r = (&Index{entries: data}).Interval("b")
 	if l != nil || r != nil {
 		t.Fail()
 	}
 }
 
-func Test_getInterval_LengthOne(t *testing.T) {
+func Test_Index_Interval_LengthOne(t *testing.T) {
 	data := []KeyOffset{
 		{Key: "f"},
 	}
 
 	var l, r *KeyOffset
 
-	l, r = getInterval(data, "b")
+	l, r = (&Index{entries: data}).Interval("b")
 	if l != nil || r != &data[0] {
 		t.Fail()
 	}
 
-	l, r = getInterval(data, "g")
+	l, r = (&Index{entries: data}).Interval("g")
 	if l != &data[0] || r != nil {
 		t.Fail()
 	}
 
-	l, r = getInterval(data, "f")
+	l, r = (&Index{entries: data}).Interval("f")
 	if l != &data[0] || r != nil {
 		t.Fail()
 	}
 }
 
 
-func Test_getInterval(t *testing.T) {
+func Test_Index_Interval(t *testing.T) {
 	data := []KeyOffset{
 		{Key: "b"},
 		{Key: "e"},
@@ -48,40 +51,155 @@ func Test_getInterval(t *testing.T) {
 
 	var l, r *KeyOffset
 
-	l, r = getInterval(data, "a")
+	l, r = (&Index{entries: data}).Interval("a")
 	if l != nil || r != &data[0] {
 		t.Fail()
 	}
 
-	l, r = getInterval(data, "b")
+	l, r = (&Index{entries: data}).Interval("b")
 	if l != &data[0] || r != &data[1] {
 		t.Fail()
 	}
 
-	l, r = getInterval(data, "c")
+	l, r = (&Index{entries: data}).Interval("c")
 	if l != &data[0] || r != &data[1] {
 		t.Fail()
 	}
 
-	l, r = getInterval(data, "e")
+	l, r = (&Index{entries: data}).Interval("e")
 	if l != &data[1] || r != &data[2] {
 		t.Fail()
 	}
 
-	l, r = getInterval(data, "f")
+	l, r = (&Index{entries: data}).Interval("f")
 	if l != &data[2] || r != &data[3] {
 		t.Fail()
 	}
 
-	l, r = getInterval(data, "m")
+	l, r = (&Index{entries: data}).Interval("m")
 	if l != &data[3] || r != &data[4] {
 		t.Fail()
 	}
 
-	l, r = getInterval(data, "z")
+	l, r = (&Index{entries: data}).Interval("z")
 	if l != &data[4] || r != nil {
 		t.Fail()
 	}
 }
 
 
+
+func buildTestIndex(t *testing.T, keys ...string) *Index {
+	b := NewBuilder()
+	for i, key := range keys {
+		if err := b.Add(key, int64(i*10), 10); err != nil {
+			t.Fatalf("Failed to add '%s': %v", key, err)
+		}
+	}
+	return b.Build()
+}
+
+func Test_Builder_Add_ErrorsForOutOfOrderEntries(t *testing.T) {
+	b := NewBuilder()
+	b.Add("b", 0, 10)
+	if err := b.Add("a", 10, 10); err == nil {
+		t.Fatal("Expected an error adding a key before the last one")
+	}
+	if err := b.Add("b", 10, 10); err == nil {
+		t.Fatal("Expected an error adding the same key twice")
+	}
+	if err := b.Add("c", 5, 10); err == nil {
+		t.Fatal("Expected an error adding a section that overlaps the last one")
+	}
+	if err := b.Add("c", 10, 10); err != nil || b.Len() != 2 {
+		t.Fatalf("Expected the next entry to be added, got %v", err)
+	}
+}
+
+func Test_Index_FloorAndCeiling(t *testing.T) {
+	index := buildTestIndex(t, "b", "e", "f", "k")
+
+	for key, expected := range map[string]string{"a": "", "b": "b", "c": "b", "f": "f", "j": "f", "z": "k"} {
+		e, found := index.Floor(key)
+		if found != (expected != "") || e.Key != expected {
+			t.Fatalf("Expected the floor of '%s' to be '%s', got '%s'", key, expected, e.Key)
+		}
+	}
+	for key, expected := range map[string]string{"a": "b", "b": "b", "c": "e", "f": "f", "j": "k", "z": ""} {
+		e, found := index.Ceiling(key)
+		if found != (expected != "") || e.Key != expected {
+			t.Fatalf("Expected the ceiling of '%s' to be '%s', got '%s'", key, expected, e.Key)
+		}
+	}
+	if e, _ := index.Ceiling("c"); e.Offset != 10 || e.Size != 10 {
+		t.Fatalf("Expected the section of 'e' to be at offset 10, got %d", e.Offset)
+	}
+}
+
+func Test_Index_Range(t *testing.T) {
+	index := buildTestIndex(t, "b", "e", "f", "k")
+
+	for _, c := range []struct {
+		start, end string
+		from, to   int
+	}{
+		{"", "", 0, 4},
+		{"c", "", 1, 4},
+		{"c", "g", 1, 3},
+		{"e", "f", 1, 2},
+		{"e", "e", 1, 1},
+		{"g", "c", 3, 3},
+		{"z", "", 4, 4},
+	} {
+		if from, to := index.Range(c.start, c.end); from != c.from || to != c.to {
+			t.Fatalf("Expected [%s, %s) to be entries %d to %d, got %d to %d", c.start, c.end, c.from, c.to, from, to)
+		}
+	}
+}
+
+func Test_Decode_RoundTripsEncodedIndex(t *testing.T) {
+	index := buildTestIndex(t, "b", "e", "f", "k")
+
+	decoded, err := Decode(index.Encode())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.Len() != index.Len() {
+		t.Fatalf("Expected %d entries, got %d", index.Len(), decoded.Len())
+	}
+	for n := 0; n < index.Len(); n++ {
+		if decoded.At(n) != index.At(n) {
+			t.Fatalf("Expected entry %d to be %v, got %v", n, index.At(n), decoded.At(n))
+		}
+	}
+}
+
+func Test_Decode_ErrorsForMalformedIndex(t *testing.T) {
+	encoded := buildTestIndex(t, "b", "e").Encode()
+	outOfOrder := append(append([]byte{}, encoded...), buildTestIndex(t, "a").Encode()...)
+
+	for _, b := range [][]byte{encoded[:len(encoded)-1], encoded[:3], outOfOrder} {
+		if _, err := Decode(b); err == nil {
+			t.Fatalf("Expected an error decoding %v", b)
+		}
+	}
+}
+
+func Test_ReadSection_ReadsIndexWrittenWithWriteTo(t *testing.T) {
+	index := buildTestIndex(t, "b", "e", "f")
+	var buf bytes.Buffer
+	buf.WriteString("header")
+	n, err := index.WriteTo(&buf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	buf.WriteString("footer")
+
+	read, err := ReadSection(bytes.NewReader(buf.Bytes()), 6, n)
+	if err != nil || read.Len() != 3 || read.At(2) != index.At(2) {
+		t.Fatalf("Expected the index to be read back, got %v", err)
+	}
+	if _, err := ReadSection(bytes.NewReader(buf.Bytes()), 6, int64(buf.Len())); err == nil {
+		t.Fatal("Expected an error reading past the end of the file")
+	}
+}
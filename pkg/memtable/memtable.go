@@ -0,0 +1,87 @@
+package memtable
+
+import (
+	"github.com/haydenjeune/kvstore/pkg/bst"
+	"github.com/haydenjeune/kvstore/pkg/skiplist"
+)
+
+// A memtable holds the most recent writes to a store in memory, sorted by key, so that they can
+// be searched and then written out in order. The trees in the bst package take a lock around
+// every insert, while the skip list lets inserts run in parallel, and never makes a reader wait.
+
+// Memtable is implemented by every kind of memtable, and is safe for concurrent use
+type Memtable interface {
+	Insert(key string, value string)
+	Search(key string) (string, bool)
+	// Delete removes the key from the memtable, returning false if it wasn't there
+	Delete(key string) bool
+	// Size returns the number of distinct keys in the memtable
+	Size() uint
+	// Bytes returns the combined length of every key and value in the memtable
+	Bytes() uint
+	// Iterator walks the keys of the memtable in order. It must only be used once the memtable
+	// is no longer being written to.
+	Iterator() Iterator
+}
+
+type Iterator interface {
+	Next() bool
+	Key() string
+	Value() string
+}
+
+// Kind chooses which memtable New returns
+type Kind int
+
+const (
+	// AVLTree is a bst.AVLTree
+	AVLTree Kind = iota
+	// UnbalancedTree is a bst.BinarySearchTree
+	UnbalancedTree
+	// SkipList is a skiplist.SkipList
+	SkipList
+)
+
+// New returns an empty memtable of the given kind
+func New(kind Kind) Memtable {
+	switch kind {
+	case UnbalancedTree:
+		return &treeMemtable{&bst.BinarySearchTree{}}
+	case SkipList:
+		return &skipListMemtable{skiplist.New()}
+	default:
+		return &treeMemtable{&bst.AVLTree{}}
+	}
+}
+
+type treeMemtable struct {
+	bst.Tree
+}
+
+func (m *treeMemtable) Iterator() Iterator {
+	return &treeIterator{bst.NewInOrderTraversalIterator(m.Tree)}
+}
+
+type treeIterator struct {
+	iter *bst.InOrderTraversalIterator
+}
+
+func (i *treeIterator) Next() bool {
+	return i.iter.Next()
+}
+
+func (i *treeIterator) Key() string {
+	return i.iter.Value().Key()
+}
+
+func (i *treeIterator) Value() string {
+	return i.iter.Value().Value()
+}
+
+type skipListMemtable struct {
+	*skiplist.SkipList
+}
+
+func (m *skipListMemtable) Iterator() Iterator {
+	return m.NewIterator()
+}
@@ -0,0 +1,158 @@
+package memtable
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/bst"
+)
+
+var kinds = map[string]Kind{"AVLTree": AVLTree, "UnbalancedTree": UnbalancedTree, "SkipList": SkipList}
+
+func Test_New_ReturnsMemtableOfKind(t *testing.T) {
+	if m, ok := New(AVLTree).(*treeMemtable); !ok {
+		t.Fatal("Expected a tree")
+	} else if _, ok := m.Tree.(*bst.AVLTree); !ok {
+		t.Fatal("Expected an AVL tree")
+	}
+	if m, ok := New(UnbalancedTree).(*treeMemtable); !ok {
+		t.Fatal("Expected a tree")
+	} else if _, ok := m.Tree.(*bst.BinarySearchTree); !ok {
+		t.Fatal("Expected an unbalanced tree")
+	}
+	if m, ok := New(SkipList).(*skipListMemtable); !ok || m.SkipList == nil {
+		t.Fatal("Expected a skip list")
+	}
+}
+
+func Test_Memtable_IteratesInOrder(t *testing.T) {
+	for name, kind := range kinds {
+		m := New(kind)
+		keys := []string{"5", "3", "8", "1", "4", "7", "9", "2", "6"}
+		for _, key := range keys {
+			m.Insert(key, "old")
+			m.Insert(key, "value"+key)
+		}
+		sort.Strings(keys)
+
+		if m.Size() != uint(len(keys)) || m.Bytes() != uint(len(keys)*7) {
+			t.Fatalf("%s: expected %d keys and %d bytes, got %d and %d", name, len(keys), len(keys)*7, m.Size(), m.Bytes())
+		}
+		iter := m.Iterator()
+		for i, key := range keys {
+			if !iter.Next() || iter.Key() != key || iter.Value() != "value"+key {
+				t.Fatalf("%s: expected key %d to be '%s'", name, i, key)
+			}
+		}
+		if iter.Next() {
+			t.Fatalf("%s: expected no more keys", name)
+		}
+	}
+}
+
+func Test_Memtable_Delete_RemovesKey(t *testing.T) {
+	for name, kind := range kinds {
+		m := New(kind)
+		for _, key := range []string{"a", "b", "c"} {
+			m.Insert(key, "value")
+		}
+
+		if !m.Delete("b") || m.Delete("b") {
+			t.Fatalf("%s: expected only the first delete of 'b' to succeed", name)
+		}
+		if _, exists := m.Search("b"); exists || m.Size() != 2 || m.Bytes() != 12 {
+			t.Fatalf("%s: expected 'b' to be deleted, leaving 2 keys and 12 bytes, got %d and %d", name, m.Size(), m.Bytes())
+		}
+		keys := make([]string, 0)
+		for iter := m.Iterator(); iter.Next(); {
+			keys = append(keys, iter.Key())
+		}
+		if fmt.Sprint(keys) != "[a c]" {
+			t.Fatalf("%s: expected to iterate over 'a' and 'c', got %v", name, keys)
+		}
+	}
+}
+
+func Test_Memtable_IsSafeForConcurrentInserts(t *testing.T) {
+	for name, kind := range kinds {
+		m := New(kind)
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					key := fmt.Sprintf("%d-%d", g, i)
+					m.Insert(key, key)
+					if result, exists := m.Search(key); !exists || result != key {
+						t.Errorf("%s: expected to find '%s' after inserting it", name, key)
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		if m.Size() != 800 {
+			t.Fatalf("%s: expected 800 keys, got %d", name, m.Size())
+		}
+	}
+}
+
+// Compares inserting random keys into each kind of memtable from every available processor at
+// once. The trees serialise inserts behind a lock, while the skip list doesn't.
+func Benchmark_Memtable_ParallelInsert(b *testing.B) {
+	keys := make([]string, 1<<16)
+	rng := rand.New(rand.NewSource(1))
+	for i := range keys {
+		keys[i] = fmt.Sprintf("%020d", rng.Int63())
+	}
+
+	for name, kind := range kinds {
+		if kind == UnbalancedTree {
+			continue // no faster than the AVL tree for random keys
+		}
+		kind := kind
+		b.Run(name, func(b *testing.B) {
+			m := New(kind)
+			var next uint64
+			var mu sync.Mutex
+			b.RunParallel(func(pb *testing.PB) {
+				mu.Lock()
+				i := next
+				next += 1 << 12
+				mu.Unlock()
+				for pb.Next() {
+					m.Insert(keys[i%uint64(len(keys))], "value")
+					i++
+				}
+			})
+		})
+	}
+}
+
+// Compares searching each kind of memtable from every available processor at once
+func Benchmark_Memtable_ParallelSearch(b *testing.B) {
+	for name, kind := range kinds {
+		if kind == UnbalancedTree {
+			continue
+		}
+		m := New(kind)
+		keys := make([]string, 1<<16)
+		for i := range keys {
+			keys[i] = fmt.Sprintf("%020d", rand.Int63())
+			m.Insert(keys[i], "value")
+		}
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := rand.Int()
+				for pb.Next() {
+					m.Search(keys[i%len(keys)])
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package record
+
+// Records are the unit of storage shared by the file based storage engines. Each record is
+// laid out as:
+//
+//	crc32 (4 bytes) | key length (4 bytes) | value length (4 bytes) | header crc32 (4 bytes) | key | value
+//
+// The first checksum covers everything after it, so a record that was only partially written,
+// or that has been damaged since, can be detected when it is read back. The header checksum
+// covers just the two lengths, so that a damaged length is caught before it is trusted: a
+// record that runs past the end of the data is only reported as torn if its lengths are
+// intact, and otherwise as corrupt. A record marking the deletion of a key (a tombstone) has a
+// value length of TOMBSTONE and no value.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+const HEADER_SIZE = 16
+const TOMBSTONE uint32 = 0xffffffff
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type Record struct {
+	Key     string
+	Value   string
+	Deleted bool // if set, the record is a tombstone and Value is empty
+}
+
+// ErrCorrupt is returned when a record fails its checksum or is otherwise unreadable
+type ErrCorrupt struct {
+	Offset int64
+	Reason string
+}
+
+func (e *ErrCorrupt) Error() string {
+	return fmt.Sprintf("corrupt record at offset %d: %s", e.Offset, e.Reason)
+}
+
+// Size returns the number of bytes the record takes up once encoded
+func (r Record) Size() int64 {
+	return int64(HEADER_SIZE + len(r.Key) + len(r.Value))
+}
+
+func (r Record) Encode() []byte {
+	b := make([]byte, r.Size())
+	binary.BigEndian.PutUint32(b[4:], uint32(len(r.Key)))
+	if r.Deleted {
+		binary.BigEndian.PutUint32(b[8:], TOMBSTONE)
+	} else {
+		binary.BigEndian.PutUint32(b[8:], uint32(len(r.Value)))
+	}
+	binary.BigEndian.PutUint32(b[12:], crc32.Checksum(b[4:12], crcTable))
+	copy(b[HEADER_SIZE:], r.Key)
+	copy(b[HEADER_SIZE+len(r.Key):], r.Value)
+	binary.BigEndian.PutUint32(b, crc32.Checksum(b[4:], crcTable))
+	return b
+}
+
+// Decode parses a single record that occupies the whole of b, which was read from offset
+func Decode(b []byte, offset int64) (Record, error) {
+	if len(b) < HEADER_SIZE {
+		return Record{}, &ErrCorrupt{Offset: offset, Reason: "record is shorter than its header"}
+	}
+	if !validHeader(b) {
+		return Record{}, &ErrCorrupt{Offset: offset, Reason: "header checksum mismatch"}
+	}
+	keyLength, valueLength, deleted := lengths(b)
+	if HEADER_SIZE+keyLength+valueLength != int64(len(b)) {
+		return Record{}, &ErrCorrupt{Offset: offset, Reason: "record length doesn't match its header"}
+	}
+	if crc32.Checksum(b[4:], crcTable) != binary.BigEndian.Uint32(b) {
+		return Record{}, &ErrCorrupt{Offset: offset, Reason: "checksum mismatch"}
+	}
+	return Record{
+		Key:     string(b[HEADER_SIZE : HEADER_SIZE+keyLength]),
+		Value:   string(b[HEADER_SIZE+keyLength:]),
+		Deleted: deleted,
+	}, nil
+}
+
+// PeekKey returns the key of the encoded record at the start of b, and the size of the whole
+// record, without checking it, so that a search can skip over records without decoding them.
+// It returns false if b is too short to hold the record.
+func PeekKey(b []byte) ([]byte, int64, bool) {
+	if len(b) < HEADER_SIZE {
+		return nil, 0, false
+	}
+	keyLength, valueLength, _ := lengths(b)
+	size := HEADER_SIZE + keyLength + valueLength
+	if size > int64(len(b)) {
+		return nil, 0, false
+	}
+	return b[HEADER_SIZE : HEADER_SIZE+keyLength], size, true
+}
+
+// lengths reads the key and value lengths from a record header
+func lengths(header []byte) (int64, int64, bool) {
+	keyLength := int64(binary.BigEndian.Uint32(header[4:]))
+	valueLength := binary.BigEndian.Uint32(header[8:])
+	if valueLength == TOMBSTONE {
+		return keyLength, 0, true
+	}
+	return keyLength, int64(valueLength), false
+}
+
+// validHeader reports whether the lengths in a record header match its header checksum
+func validHeader(header []byte) bool {
+	return crc32.Checksum(header[4:12], crcTable) == binary.BigEndian.Uint32(header[12:])
+}
+
+// Reader reads a sequence of records from an underlying reader
+type Reader struct {
+	r      *bufio.Reader
+	offset int64
+}
+
+// NewReader returns a Reader for records starting at offset in the underlying data. The
+// offset is only used to track record positions for reporting.
+func NewReader(r io.Reader, offset int64) *Reader {
+	return &Reader{r: bufio.NewReader(r), offset: offset}
+}
+
+// Offset returns the offset of the next record to be read
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+// Next reads the next record. It returns io.EOF if there are no more records, and
+// io.ErrUnexpectedEOF if the data ends part of the way through a record whose header is
+// intact, or through its header. If a record's header fails its checksum, or a complete record
+// fails validation, a *ErrCorrupt is returned.
+func (r *Reader) Next() (Record, error) {
+	header := make([]byte, HEADER_SIZE)
+	_, err := io.ReadFull(r.r, header)
+	if err == io.EOF {
+		return Record{}, io.EOF
+	} else if errors.Is(err, io.ErrUnexpectedEOF) {
+		return Record{}, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return Record{}, err
+	}
+	if !validHeader(header) {
+		return Record{}, &ErrCorrupt{Offset: r.offset, Reason: "header checksum mismatch"}
+	}
+
+	// Copy the body rather than allocating it up front, so a damaged length can't cause a huge
+	// allocation before the end of the data is reached
+	keyLength, valueLength, _ := lengths(header)
+	bodyLength := keyLength + valueLength
+	buf := bytes.NewBuffer(header)
+	copied, err := io.CopyN(buf, r.r, bodyLength)
+	if copied < bodyLength && (err == nil || err == io.EOF) {
+		return Record{}, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return Record{}, err
+	}
+	b := buf.Bytes()
+
+	record, err := Decode(b, r.offset)
+	if err != nil {
+		return Record{}, err
+	}
+	r.offset += int64(len(b))
+	return record, nil
+}
+
+// AtEOF reports whether there is no data left after the last record that was read
+func (r *Reader) AtEOF() bool {
+	_, err := r.r.Peek(1)
+	return err == io.EOF
+}
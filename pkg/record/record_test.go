@@ -0,0 +1,116 @@
+package record
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func Test_Decode_AfterEncode_ReturnsSameRecord(t *testing.T) {
+	r := Record{Key: "a key, with a comma", Value: "a value\nwith a newline"}
+
+	result, err := Decode(r.Encode(), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error decoding record: %v", err)
+	}
+	if result != r {
+		t.Fatalf("Decoded record %v doesn't match encoded record %v", result, r)
+	}
+}
+
+func Test_Decode_ReturnsErrCorruptForBadChecksum(t *testing.T) {
+	b := Record{Key: "key", Value: "value"}.Encode()
+	b[len(b)-1] ^= 0xff
+
+	_, err := Decode(b, 42)
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected *ErrCorrupt, got %v", err)
+	}
+	if corrupt.Offset != 42 {
+		t.Fatalf("Expected corruption at offset 42, got %d", corrupt.Offset)
+	}
+}
+
+func Test_Reader_ReadsAllRecordsThenEOF(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(Record{Key: "a", Value: "1"}.Encode())
+	buf.Write(Record{Key: "b", Value: ""}.Encode())
+
+	reader := NewReader(&buf, 0)
+	for _, key := range []string{"a", "b"} {
+		r, err := reader.Next()
+		if err != nil {
+			t.Fatalf("Unexpected error reading record: %v", err)
+		}
+		if r.Key != key {
+			t.Fatalf("Expected key '%s', got '%s'", key, r.Key)
+		}
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Fatalf("Expected io.EOF after last record, got %v", err)
+	}
+	expectedOffset := Record{Key: "a", Value: "1"}.Size() + Record{Key: "b"}.Size()
+	if reader.Offset() != expectedOffset {
+		t.Fatalf("Unexpected final offset %d", reader.Offset())
+	}
+}
+
+func Test_Reader_ReturnsUnexpectedEOFForTornRecord(t *testing.T) {
+	b := Record{Key: "key", Value: "value"}.Encode()
+
+	for _, length := range []int{HEADER_SIZE - 1, len(b) - 1} {
+		reader := NewReader(bytes.NewReader(b[:length]), 0)
+		if _, err := reader.Next(); err != io.ErrUnexpectedEOF {
+			t.Fatalf("Expected io.ErrUnexpectedEOF for record cut to %d bytes, got %v", length, err)
+		}
+	}
+}
+
+func Test_Reader_ReturnsErrCorruptForDamagedLength(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(Record{Key: "a", Value: "1"}.Encode())
+	damaged := Record{Key: "b", Value: "2"}.Encode()
+	damaged[11] ^= 0x40 // the value now appears to run past the end of the data
+	buf.Write(damaged)
+
+	reader := NewReader(&buf, 0)
+	reader.Next()
+	_, err := reader.Next()
+	var corrupt *ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected *ErrCorrupt for a damaged length, got %v", err)
+	}
+	if expected := (Record{Key: "a", Value: "1"}).Size(); corrupt.Offset != expected {
+		t.Fatalf("Expected corruption at offset %d, got %d", expected, corrupt.Offset)
+	}
+}
+
+func Test_Decode_AfterEncodeTombstone_ReturnsDeletedRecord(t *testing.T) {
+	r := Record{Key: "key", Deleted: true}
+
+	b := r.Encode()
+	if int64(len(b)) != r.Size() {
+		t.Fatalf("Encoded tombstone is %d bytes, expected %d", len(b), r.Size())
+	}
+	result, err := NewReader(bytes.NewReader(b), 0).Next()
+	if err != nil {
+		t.Fatalf("Unexpected error reading tombstone: %v", err)
+	}
+	if result != r {
+		t.Fatalf("Read record %v doesn't match encoded tombstone %v", result, r)
+	}
+}
+
+func Test_PeekKey_ReturnsKeyAndSizeOfFirstRecord(t *testing.T) {
+	b := append(Record{Key: "key", Value: "value"}.Encode(), Record{Key: "next"}.Encode()...)
+
+	key, size, ok := PeekKey(b)
+	if !ok || string(key) != "key" || size != HEADER_SIZE+8 {
+		t.Fatalf("Expected 'key' and %d bytes, got '%s', %d, %v", HEADER_SIZE+8, key, size, ok)
+	}
+	if _, _, ok := PeekKey(b[:size-1]); ok {
+		t.Fatal("Expected a torn record not to be peeked")
+	}
+}
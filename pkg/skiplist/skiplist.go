@@ -0,0 +1,228 @@
+package skiplist
+
+import (
+	"math/bits"
+	"sync/atomic"
+	"unsafe"
+)
+
+// A skip list is a sorted linked list with extra links that skip over runs of nodes, giving
+// O(log(n)) searches and inserts on average. Each node is linked into the bottom level, and into
+// each level above that with probability 1/BRANCHING.
+//
+// Nodes are never removed, which lets the list be safe for concurrent use without any locks. A
+// new node is linked in with a compare-and-swap on its predecessor at each level, bottom first,
+// and an insert that loses a race to another just searches again. Searches and iteration only
+// follow links, so they never wait on writers, and always see a node once it is in the bottom
+// level. Replacing the value of a key swaps it atomically, and deleting a key clears its value,
+// leaving the node in place until the whole list is dropped.
+
+const MAX_HEIGHT = 12
+const BRANCHING = 4
+
+type node struct {
+	key   string
+	value unsafe.Pointer // *string, or nil once the key has been deleted
+	next  []unsafe.Pointer
+}
+
+func (n *node) loadNext(level int) *node {
+	return (*node)(atomic.LoadPointer(&n.next[level]))
+}
+
+func (n *node) storeNext(level int, next *node) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
+
+func (n *node) casNext(level int, old *node, next *node) bool {
+	return atomic.CompareAndSwapPointer(&n.next[level], unsafe.Pointer(old), unsafe.Pointer(next))
+}
+
+func (n *node) loadValue() (string, bool) {
+	value := (*string)(atomic.LoadPointer(&n.value))
+	if value == nil {
+		return "", false
+	}
+	return *value, true
+}
+
+// SkipList is a sorted map of keys to values, safe for concurrent use
+type SkipList struct {
+	head  *node
+	seed  uint64
+	size  int64 // the number of distinct keys
+	bytes int64 // the combined length of every key and value
+}
+
+func New() *SkipList {
+	return &SkipList{head: &node{next: make([]unsafe.Pointer, MAX_HEIGHT)}}
+}
+
+// Insert adds the key to the list, or replaces its value if it is already there
+func (l *SkipList) Insert(key string, value string) {
+	var preds, succs [MAX_HEIGHT]*node
+	var n *node
+	for {
+		if found := l.find(key, &preds, &succs); found != nil {
+			previous := (*string)(atomic.SwapPointer(&found.value, unsafe.Pointer(&value)))
+			if previous == nil {
+				// the key had been deleted, so it counts as new
+				atomic.AddInt64(&l.size, 1)
+				atomic.AddInt64(&l.bytes, int64(len(key)+len(value)))
+			} else {
+				atomic.AddInt64(&l.bytes, int64(len(value)-len(*previous)))
+			}
+			return
+		}
+
+		if n == nil {
+			n = &node{key: key, value: unsafe.Pointer(&value), next: make([]unsafe.Pointer, l.randomHeight())}
+		}
+		for level := range n.next {
+			n.storeNext(level, succs[level])
+		}
+		// once the node is in the bottom level it is in the list, and the levels above only
+		// make it quicker to find
+		if preds[0].casNext(0, succs[0], n) {
+			break
+		}
+	}
+	atomic.AddInt64(&l.size, 1)
+	atomic.AddInt64(&l.bytes, int64(len(key)+len(value)))
+
+	for level := 1; level < len(n.next); level++ {
+		for !preds[level].casNext(level, succs[level], n) {
+			// another node was linked in next to this one, so find its neighbours again
+			l.find(key, &preds, &succs)
+			n.storeNext(level, succs[level])
+		}
+	}
+}
+
+// find fills preds and succs with the last node before key, and the first node after it, at each
+// level, and returns the node holding key if there is one
+func (l *SkipList) find(key string, preds *[MAX_HEIGHT]*node, succs *[MAX_HEIGHT]*node) *node {
+	var found *node
+	pred := l.head
+	for level := MAX_HEIGHT - 1; level >= 0; level-- {
+		curr := pred.loadNext(level)
+		for curr != nil && curr.key < key {
+			pred = curr
+			curr = pred.loadNext(level)
+		}
+		if curr != nil && curr.key == key {
+			found = curr
+		}
+		preds[level], succs[level] = pred, curr
+	}
+	return found
+}
+
+// randomHeight returns the number of levels for a new node, which is at least one, and one more
+// with probability 1/BRANCHING each time
+func (l *SkipList) randomHeight() int {
+	// splitmix64, seeded by a counter so that concurrent inserts don't contend on a lock
+	x := atomic.AddUint64(&l.seed, 0x9e3779b97f4a7c15)
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+
+	height := 1 + bits.TrailingZeros64(x)/bits.TrailingZeros(BRANCHING)
+	if height > MAX_HEIGHT {
+		height = MAX_HEIGHT
+	}
+	return height
+}
+
+func (l *SkipList) Search(key string) (string, bool) {
+	n := l.search(key)
+	if n == nil {
+		return "", false
+	}
+	return n.loadValue()
+}
+
+// Delete removes the key from the list, returning false if it wasn't there
+func (l *SkipList) Delete(key string) bool {
+	n := l.search(key)
+	if n == nil {
+		return false
+	}
+	for {
+		previous := atomic.LoadPointer(&n.value)
+		if previous == nil {
+			return false
+		}
+		if atomic.CompareAndSwapPointer(&n.value, previous, nil) {
+			atomic.AddInt64(&l.size, -1)
+			atomic.AddInt64(&l.bytes, -int64(len(key)+len(*(*string)(previous))))
+			return true
+		}
+	}
+}
+
+// search returns the node holding key, which may have been deleted, or nil if there isn't one
+func (l *SkipList) search(key string) *node {
+	pred := l.head
+	for level := MAX_HEIGHT - 1; level >= 0; level-- {
+		curr := pred.loadNext(level)
+		for curr != nil && curr.key < key {
+			pred = curr
+			curr = pred.loadNext(level)
+		}
+		if curr != nil && curr.key == key {
+			return curr
+		}
+	}
+	return nil
+}
+
+// Size returns the number of distinct keys in the list
+func (l *SkipList) Size() uint {
+	return uint(atomic.LoadInt64(&l.size))
+}
+
+// Bytes returns the combined length of every key and value in the list
+func (l *SkipList) Bytes() uint {
+	return uint(atomic.LoadInt64(&l.bytes))
+}
+
+// Iterator walks the keys of a list in order, skipping deleted keys. Keys inserted while it is in
+// use are returned if they come after its current position.
+type Iterator struct {
+	list    *SkipList
+	curr    *node
+	value   string
+	started bool
+}
+
+func (l *SkipList) NewIterator() *Iterator {
+	return &Iterator{list: l}
+}
+
+func (i *Iterator) Next() bool {
+	if !i.started {
+		i.curr = i.list.head
+		i.started = true
+	}
+	for i.curr != nil {
+		i.curr = i.curr.loadNext(0)
+		if i.curr == nil {
+			break
+		}
+		// the value is read as the node is reached, so it can't be deleted from under Value
+		if value, exists := i.curr.loadValue(); exists {
+			i.value = value
+			return true
+		}
+	}
+	return false
+}
+
+func (i *Iterator) Key() string {
+	return i.curr.key
+}
+
+func (i *Iterator) Value() string {
+	return i.value
+}
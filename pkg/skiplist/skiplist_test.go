@@ -0,0 +1,139 @@
+package skiplist
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func Test_SkipList_MatchesMapForRandomInserts(t *testing.T) {
+	list := New()
+	expected := make(map[string]string)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(rng.Intn(2000))
+		list.Insert(key, strconv.Itoa(i))
+		expected[key] = strconv.Itoa(i)
+	}
+
+	bytes := 0
+	for key, value := range expected {
+		if result, exists := list.Search(key); !exists || result != value {
+			t.Fatalf("Expected '%s' to be '%s', got '%s'", key, value, result)
+		}
+		bytes += len(key) + len(value)
+	}
+	if list.Size() != uint(len(expected)) || list.Bytes() != uint(bytes) {
+		t.Fatalf("Expected %d keys and %d bytes, got %d and %d", len(expected), bytes, list.Size(), list.Bytes())
+	}
+	if _, exists := list.Search("missing"); exists {
+		t.Fatal("Expected a missing key not to be found")
+	}
+}
+
+func Test_Iterator_ReturnsKeysInOrder(t *testing.T) {
+	list := New()
+	keys := []string{"5", "3", "8", "1", "4", "7", "9", "2", "6"}
+	for _, key := range keys {
+		list.Insert(key, "value"+key)
+	}
+	sort.Strings(keys)
+
+	iter := list.NewIterator()
+	for i, key := range keys {
+		if !iter.Next() || iter.Key() != key || iter.Value() != "value"+key {
+			t.Fatalf("Expected key %d to be '%s'", i, key)
+		}
+	}
+	if iter.Next() || iter.Next() {
+		t.Fatal("Expected the iterator to stay finished after every key")
+	}
+}
+
+func Test_Iterator_IsEmptyForEmptyList(t *testing.T) {
+	if New().NewIterator().Next() {
+		t.Fatal("Expected no keys in an empty list")
+	}
+}
+
+func Test_SkipList_IsSafeForConcurrentInserts(t *testing.T) {
+	list := New()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				// every goroutine also writes to a shared set of keys
+				key := strconv.Itoa(g*1000 + i)
+				list.Insert(key, key)
+				list.Insert("shared"+strconv.Itoa(i%10), key)
+				if result, exists := list.Search(key); !exists || result != key {
+					t.Errorf("Expected to find '%s' after inserting it", key)
+				}
+			}
+		}(g)
+	}
+
+	// iterate while the writers are running
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for round := 0; round < 10; round++ {
+			iter := list.NewIterator()
+			previous := ""
+			for iter.Next() {
+				if iter.Key() <= previous {
+					t.Errorf("Expected keys in order, got '%s' after '%s'", iter.Key(), previous)
+				}
+				previous = iter.Key()
+			}
+		}
+	}()
+	wg.Wait()
+
+	if list.Size() != 8010 {
+		t.Fatalf("Expected 8010 keys, got %d", list.Size())
+	}
+	count := 0
+	for iter := list.NewIterator(); iter.Next(); {
+		count++
+	}
+	if count != 8010 {
+		t.Fatalf("Expected to iterate over 8010 keys, got %d", count)
+	}
+}
+
+func Test_SkipList_Delete_HidesKeyUntilInsertedAgain(t *testing.T) {
+	list := New()
+	for _, key := range []string{"a", "b", "c"} {
+		list.Insert(key, "value")
+	}
+
+	if !list.Delete("b") || list.Delete("b") || list.Delete("missing") {
+		t.Fatal("Expected only the first delete of 'b' to succeed")
+	}
+	if _, exists := list.Search("b"); exists {
+		t.Fatal("Expected 'b' to be deleted")
+	}
+	if list.Size() != 2 || list.Bytes() != 12 {
+		t.Fatalf("Expected 2 keys and 12 bytes, got %d and %d", list.Size(), list.Bytes())
+	}
+	iter := list.NewIterator()
+	for _, key := range []string{"a", "c"} {
+		if !iter.Next() || iter.Key() != key {
+			t.Fatalf("Expected the iterator to skip the deleted key and return '%s'", key)
+		}
+	}
+	if iter.Next() {
+		t.Fatal("Expected no more keys")
+	}
+
+	list.Insert("b", "new")
+	if result, exists := list.Search("b"); !exists || result != "new" || list.Size() != 3 || list.Bytes() != 16 {
+		t.Fatalf("Expected 'b' to be back with 3 keys and 16 bytes, got '%s', %d and %d", result, list.Size(), list.Bytes())
+	}
+}
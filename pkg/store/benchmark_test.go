@@ -0,0 +1,95 @@
+package store
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/store/btree"
+	"github.com/haydenjeune/kvstore/pkg/store/sortedfile"
+	"github.com/spf13/afero"
+)
+
+var benchmarkDurabilityPolicies = []durability.Policy{
+	durability.Never(),
+	durability.Interval(10 * time.Millisecond),
+	durability.Always(),
+}
+
+// Compares write throughput of each file backed storage engine under each durability policy
+func Benchmark_FileBackedKvStorage_Set(b *testing.B) {
+	for _, policy := range benchmarkDurabilityPolicies {
+		policy := policy
+
+		b.Run("FsAppendOnlyStorage/"+policy.String(), func(b *testing.B) {
+			filename := makeTestFilePath("kvstore_bench_FsAppendOnlyStorage")
+			defer os.Remove(filename)
+			benchmark_KvStoreImplementation_Set(b, func() (KvStore, error) {
+				return NewFsAppendOnlyStorage(filename, WithDurability(policy))
+			})
+		})
+
+		b.Run("HashIndexedFsAppendOnlyStorage/"+policy.String(), func(b *testing.B) {
+			filename := makeTestFilePath("kvstore_bench_HashIndexedFsAppendOnlyStorage")
+			defer os.Remove(filename)
+			defer os.Remove(hintFilename(filename))
+			benchmark_KvStoreImplementation_Set(b, func() (KvStore, error) {
+				return NewHashIndexedFsAppendOnlyStorage(filename, WithDurability(policy))
+			})
+		})
+
+		b.Run("SortedFileKVStorage/"+policy.String(), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "kvstore_bench_SortedFileKVStorage")
+			if err != nil {
+				b.Fatalf("failed to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			benchmark_KvStoreImplementation_Set(b, func() (KvStore, error) {
+				fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+				return sortedfile.NewSortedFileKvStorage(fs, sortedfile.WithDurability(policy))
+			})
+		})
+
+		b.Run("BTreeKVStorage/"+policy.String(), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "kvstore_bench_BTreeKVStorage")
+			if err != nil {
+				b.Fatalf("failed to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			benchmark_KvStoreImplementation_Set(b, func() (KvStore, error) {
+				fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+				return btree.NewBTreeKvStorage(fs, btree.WithDurability(policy))
+			})
+		})
+
+		b.Run("CowBTreeKVStorage/"+policy.String(), func(b *testing.B) {
+			dir, err := os.MkdirTemp("", "kvstore_bench_CowBTreeKVStorage")
+			if err != nil {
+				b.Fatalf("failed to create temporary directory: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			benchmark_KvStoreImplementation_Set(b, func() (KvStore, error) {
+				fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+				return btree.NewCowBTreeKvStorage(fs, btree.WithDurability(policy))
+			})
+		})
+	}
+}
+
+func benchmark_KvStoreImplementation_Set(b *testing.B, storeFactory func() (KvStore, error)) {
+	store, err := storeFactory()
+	if err != nil {
+		b.Fatalf("failed to instantiate KVstore: %v", err)
+	}
+	defer store.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err = store.Set(strconv.Itoa(i), "value")
+		if err != nil {
+			b.Fatalf("failed to set key: %v", err)
+		}
+	}
+}
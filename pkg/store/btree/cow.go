@@ -0,0 +1,467 @@
+package btree
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+// The copy-on-write pager never changes a page that a committed tree refers to, in the style of
+// LMDB. A write transaction copies each node it changes to a free page, and so each of the
+// node's ancestors in turn, up to a new root. Committing writes the new pages, then a meta page
+// pointing at the new root. There are two meta pages, 0 and 1, written to in turn, so the one
+// holding the previous commit is never overwritten. On startup the valid meta page with the
+// latest transaction is used, so a crash at any point leaves the tree as of a commit.
+//
+// A read transaction pins the root of the last commit when it begins, and sees that tree for as
+// long as it is open, without taking any locks that writers wait on. The pages a commit replaces
+// are only reused once every read transaction that began before the commit has finished.
+//
+// They must also wait until a later commit is durable, as in LMDB. Until a meta page has been
+// fsynced, a power failure can leave the other meta page, with the commit before, as the latest
+// on disk, and if the write of a meta page is torn, the startup falls back to the commit before
+// that one. So the pages replaced by commit n are only reused once commit n+1 is known to be on
+// disk. Whatever the durability policy, a commit fsyncs its pages before writing its meta page,
+// which also makes the commit before it durable, and with durability.Always() the meta page is
+// fsynced too. Otherwise the pages replaced by the last commit wait for the next one, unless
+// COW_SYNC_RETIRED_PAGES of them are waiting, when the pager fsyncs the file itself.
+//
+// The free list is only kept in memory. On startup, every page that the tree doesn't refer to is
+// free, which is found by reading the internal nodes of the tree.
+
+const COW_DATA_FILENAME = "cowbtree.db"
+
+// the first page after the two meta pages
+const COW_FIRST_PAGE = 2
+
+// the number of replaced pages waiting only for a later commit to be durable before the pager
+// fsyncs the file so that they can be reused
+const COW_SYNC_RETIRED_PAGES = 256
+
+type cowPager struct {
+	file     afero.File
+	reader   afero.File // a separate handle for reads, as some afero.Fs files can't read and write at once
+	syncer   *durability.Syncer
+	policy   durability.Policy
+	capacity int
+
+	mu      sync.Mutex // guards the buffer pool, the last commit and the read transactions
+	frames  map[pageID]*list.Element
+	lru     *list.List     // the most recently used node is at the front
+	meta    meta           // as of the last commit
+	readers map[uint64]int // the number of read transactions open on each commit
+
+	// only used by write transactions, which must not overlap
+	reusable []pageID            // free pages that no read transaction or crash can see
+	retired  map[uint64][]pageID // pages replaced by each commit, until every read transaction that can see them finishes and a later commit is durable
+	durable  uint64              // the last commit whose meta page is known to be on disk
+	fallback *meta               // the commit in the other meta page when the file was opened, if it is valid
+}
+
+func openCowPager(afs afero.Fs, o options) (*cowPager, error) {
+	f, err := afs.OpenFile(COW_DATA_FILENAME, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %v", COW_DATA_FILENAME, err)
+	}
+	r, err := afs.Open(COW_DATA_FILENAME)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open '%s': %v", COW_DATA_FILENAME, err)
+	}
+	p := &cowPager{
+		file:     f,
+		reader:   r,
+		syncer:   durability.NewSyncer(f, o.durability),
+		policy:   o.durability,
+		capacity: o.bufferPoolSize,
+		frames:   make(map[pageID]*list.Element),
+		lru:      list.New(),
+		readers:  make(map[uint64]int),
+		retired:  make(map[uint64][]pageID),
+	}
+	if p.capacity < MIN_BUFFER_POOL_SIZE {
+		p.capacity = MIN_BUFFER_POOL_SIZE
+	}
+
+	err = p.readMeta()
+	if err == nil {
+		err = p.findFreePages()
+	}
+	if err == nil {
+		// the meta pages read may only be in the operating system's cache, after a crash
+		err = f.Sync()
+		if err != nil {
+			err = fmt.Errorf("failed to sync '%s': %v", COW_DATA_FILENAME, err)
+		}
+		p.durable = p.meta.txn
+	}
+	if err != nil {
+		p.syncer.Close()
+		r.Close()
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// readMeta reads the latest valid meta page, or starts an empty tree if the file is empty
+func (p *cowPager) readMeta() error {
+	info, err := p.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get stats from '%s': %v", COW_DATA_FILENAME, err)
+	}
+	if info.Size() == 0 {
+		p.meta = meta{pages: COW_FIRST_PAGE}
+		w := p.beginWrite()
+		root, err := w.allocate(leafPage)
+		if err == nil {
+			w.meta.root = root.id
+			err = p.commit(w)
+		}
+		return err
+	}
+
+	var valid []meta
+	for slot := int64(0); slot < COW_FIRST_PAGE; slot++ {
+		b := make([]byte, META_SIZE)
+		_, err = p.reader.ReadAt(b, slot*PAGE_SIZE)
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read meta page: %v", err)
+		}
+		m, err := decodeMeta(b, COW_BTREE_MAGIC)
+		if err == nil {
+			valid = append(valid, m)
+		}
+	}
+	if len(valid) == 2 && valid[1].txn > valid[0].txn {
+		valid[0], valid[1] = valid[1], valid[0]
+	}
+	if len(valid) == 2 {
+		p.fallback = &valid[1]
+	}
+	if len(valid) == 0 {
+		return fmt.Errorf("failed to read meta page: %w", &record.ErrCorrupt{Offset: 0, Reason: "no meta page is valid"})
+	}
+	p.meta = valid[0]
+	if info.Size() < int64(p.meta.pages)*PAGE_SIZE {
+		return fmt.Errorf("failed to read meta page: %w", &record.ErrCorrupt{Offset: int64(p.meta.txn%COW_FIRST_PAGE) * PAGE_SIZE, Reason: "file ends before its last page"})
+	}
+	return nil
+}
+
+// findFreePages adds every page that the tree doesn't refer to to the free list. The pages that
+// only the commit in the other meta page refers to are retired by the last commit instead, as a
+// crash could still fall back to it.
+func (p *cowPager) findFreePages() error {
+	used, err := p.usedPages(p.meta)
+	if err != nil {
+		return err
+	}
+	var previous map[pageID]bool
+	if p.fallback != nil {
+		// if the previous tree is damaged it can't be fallen back to, so its pages are free
+		previous, _ = p.usedPages(*p.fallback)
+	}
+
+	for id := pageID(COW_FIRST_PAGE); uint32(id) < p.meta.pages; id++ {
+		if used[id] {
+			continue
+		} else if previous[id] {
+			p.retired[p.meta.txn] = append(p.retired[p.meta.txn], id)
+		} else {
+			p.reusable = append(p.reusable, id)
+		}
+	}
+	return nil
+}
+
+// usedPages returns every page the tree of a commit refers to. Only internal nodes are read, as
+// every leaf is at the same depth.
+func (p *cowPager) usedPages(m meta) (map[pageID]bool, error) {
+	used := make(map[pageID]bool)
+	depth := 0
+	n, err := p.get(m.root, m.pages)
+	for err == nil && n.kind == internalPage {
+		n, err = p.get(n.children[0], m.pages)
+		depth++
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var walk func(id pageID, level int) error
+	walk = func(id pageID, level int) error {
+		if used[id] {
+			return errCorruptPage(id, "page is linked from more than one node")
+		}
+		used[id] = true
+		if level == depth {
+			return nil
+		}
+		n, err := p.get(id, m.pages)
+		if err != nil {
+			return err
+		}
+		if n.kind != internalPage {
+			return errCorruptPage(id, "leaves are at different depths")
+		}
+		for _, child := range n.children {
+			err = walk(child, level+1)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = walk(m.root, 0)
+	if err != nil {
+		return nil, err
+	}
+	return used, nil
+}
+
+// get returns the node in a page of a tree with the given number of pages, from the buffer pool
+// if it's there. Nodes that have been committed are never changed, so they can be shared.
+func (p *cowPager) get(id pageID, pages uint32) (*node, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.frames[id]; ok {
+		p.lru.MoveToFront(e)
+		return e.Value.(*node), nil
+	}
+
+	if id < COW_FIRST_PAGE || uint32(id) >= pages {
+		return nil, errCorruptPage(id, "page is outside the file")
+	}
+	b := make([]byte, PAGE_SIZE)
+	_, err := p.reader.ReadAt(b, int64(id)*PAGE_SIZE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %v", id, err)
+	}
+	n, err := decodeNode(id, b)
+	if err != nil {
+		return nil, errCorruptPage(id, err.Error())
+	}
+	p.add(n)
+	return n, nil
+}
+
+// add puts a node in the buffer pool, replacing any node already there for its page, then
+// evicts the least recently used nodes if it is full. It must be called with mu held.
+func (p *cowPager) add(n *node) {
+	if e, ok := p.frames[n.id]; ok {
+		e.Value = n
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.frames[n.id] = p.lru.PushFront(n)
+	for p.lru.Len() > p.capacity {
+		e := p.lru.Back()
+		p.lru.Remove(e)
+		delete(p.frames, e.Value.(*node).id)
+	}
+}
+
+// beginRead pins the last commit until the returned transaction is finished
+func (p *cowPager) beginRead() *cowTxn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readers[p.meta.txn]++
+	return &cowTxn{pager: p, meta: p.meta}
+}
+
+// finishRead unpins a read transaction's commit
+func (p *cowPager) finishRead(txn *cowTxn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.readers[txn.meta.txn]--
+	if p.readers[txn.meta.txn] == 0 {
+		delete(p.readers, txn.meta.txn)
+	}
+}
+
+// beginWrite starts a write transaction on the last commit, first reusing any pages that no read
+// transaction or crash can see any more
+func (p *cowPager) beginWrite() *cowTxn {
+	p.mu.Lock()
+	oldest := p.meta.txn
+	for txn := range p.readers {
+		if txn < oldest {
+			oldest = txn
+		}
+	}
+	m := p.meta
+	p.mu.Unlock()
+
+	// If enough pages are only waiting for a later commit to be durable, make the last one
+	// durable. If the sync fails, they wait for a later one.
+	waiting := 0
+	for txn, ids := range p.retired {
+		if txn <= oldest && txn >= p.durable {
+			waiting += len(ids)
+		}
+	}
+	if waiting >= COW_SYNC_RETIRED_PAGES && p.file.Sync() == nil {
+		p.durable = m.txn
+	}
+
+	// a read transaction on commit n sees the pages replaced by every later commit
+	for txn, ids := range p.retired {
+		if txn <= oldest && txn < p.durable {
+			p.reusable = append(p.reusable, ids...)
+			delete(p.retired, txn)
+		}
+	}
+	return &cowTxn{pager: p, meta: m, writing: true, fresh: make(map[pageID]*node)}
+}
+
+// commit writes the pages of a write transaction, then the meta page pointing at its root. If
+// it fails before the meta page is written, the last commit is left as it was. Otherwise the meta
+// page may or may not be on disk, so an error is returned that the caller must not write after.
+func (p *cowPager) commit(w *cowTxn) (err error) {
+	if len(w.fresh) == 0 {
+		return nil
+	}
+	ids := make([]int, 0, len(w.fresh))
+	for id := range w.fresh {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		_, err = p.file.WriteAt(w.fresh[pageID(id)].encode(), int64(id)*PAGE_SIZE)
+		if err != nil {
+			return fmt.Errorf("failed to write page %d: %v", id, err)
+		}
+	}
+	// The pages must be on disk before the meta page that refers to them, whatever the durability
+	// policy, or a crash could leave the latest valid meta page pointing at pages that were never
+	// written. This also makes the meta page of the last commit durable.
+	err = p.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync '%s': %v", COW_DATA_FILENAME, err)
+	}
+	p.durable = w.meta.txn
+
+	w.meta.txn++
+	page := make([]byte, PAGE_SIZE)
+	copy(page, w.meta.encode(COW_BTREE_MAGIC))
+	_, err = p.file.WriteAt(page, int64(w.meta.txn%COW_FIRST_PAGE)*PAGE_SIZE)
+	if err == nil {
+		err = p.syncer.Written()
+	}
+	if err != nil {
+		return &errUncertainCommit{err}
+	}
+	if p.policy.SyncOnWrite() {
+		p.durable = w.meta.txn
+	}
+
+	p.reusable = append(p.reusable[:len(p.reusable)-w.reused], w.recycled...)
+	if len(w.retired) > 0 {
+		p.retired[w.meta.txn] = w.retired
+	}
+	p.mu.Lock()
+	p.meta = w.meta
+	for _, id := range ids {
+		p.add(w.fresh[pageID(id)])
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+// errUncertainCommit is returned when a commit fails after its meta page may have been written
+type errUncertainCommit struct {
+	err error
+}
+
+func (e *errUncertainCommit) Error() string {
+	return fmt.Sprintf("failed to write meta page: %v", e.err)
+}
+
+func (e *errUncertainCommit) Unwrap() error {
+	return e.err
+}
+
+func (p *cowPager) Close() error {
+	err := p.syncer.Close()
+	if err != nil {
+		err = fmt.Errorf("failed to sync '%s': %v", COW_DATA_FILENAME, err)
+	}
+	p.reader.Close()
+	if closeErr := p.file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close '%s': %v", COW_DATA_FILENAME, closeErr)
+	}
+	return err
+}
+
+// cowTxn is a read or write transaction on a copy-on-write tree. Read transactions only use get.
+type cowTxn struct {
+	pager   *cowPager
+	meta    meta // the tree as of the transaction
+	writing bool
+
+	fresh    map[pageID]*node // pages written by the transaction, which only it can see
+	reused   int              // the number of pages taken from the end of the pager's free list
+	recycled []pageID         // fresh pages freed again, which were never committed
+	retired  []pageID         // committed pages replaced by the transaction
+}
+
+func (txn *cowTxn) get(id pageID) (*node, error) {
+	if n, ok := txn.fresh[id]; ok {
+		return n, nil
+	}
+	return txn.pager.get(id, txn.meta.pages)
+}
+
+// writable returns n if the transaction wrote it, or otherwise a copy of it on a new page
+func (txn *cowTxn) writable(n *node) (*node, error) {
+	if _, ok := txn.fresh[n.id]; ok {
+		return n, nil
+	}
+	c, err := txn.allocate(n.kind)
+	if err != nil {
+		return nil, err
+	}
+	c = n.clone(c.id)
+	txn.fresh[c.id] = c
+	txn.free(n)
+	return c, nil
+}
+
+func (txn *cowTxn) allocate(kind pageKind) (*node, error) {
+	if !txn.writing {
+		return nil, errors.New("failed to allocate page: transaction is read only")
+	}
+	var id pageID
+	reusable := txn.pager.reusable
+	if last := len(txn.recycled) - 1; last >= 0 {
+		id, txn.recycled = txn.recycled[last], txn.recycled[:last]
+	} else if txn.reused < len(reusable) {
+		txn.reused++
+		id = reusable[len(reusable)-txn.reused]
+	} else {
+		id = pageID(txn.meta.pages)
+		txn.meta.pages++
+	}
+
+	n := &node{id: id, kind: kind}
+	txn.fresh[id] = n
+	return n, nil
+}
+
+func (txn *cowTxn) free(n *node) {
+	if _, ok := txn.fresh[n.id]; ok {
+		delete(txn.fresh, n.id)
+		txn.recycled = append(txn.recycled, n.id)
+		return
+	}
+	txn.retired = append(txn.retired, n.id)
+}
@@ -0,0 +1,337 @@
+package btree
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/spf13/afero"
+)
+
+func newTestCowTree(t *testing.T, fs afero.Fs) *CowBTreeKvStorage {
+	s, err := NewCowBTreeKvStorage(fs, WithBufferPoolSize(MIN_BUFFER_POOL_SIZE))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	return s
+}
+
+// checkCowTree fails the test unless the last commit is a valid tree, and every other page is
+// either free or waiting to be reused, exactly once
+func checkCowTree(t *testing.T, s *CowBTreeKvStorage) {
+	t.Helper()
+	txn := s.BeginRead()
+	defer txn.Close()
+	seen := checkTree(t, txn.tree)
+
+	p := s.pager
+	free := append([]pageID(nil), p.reusable...)
+	for _, ids := range p.retired {
+		free = append(free, ids...)
+	}
+	for _, id := range free {
+		if seen[id] {
+			t.Fatalf("Page %d is both free and in use", id)
+		}
+		seen[id] = true
+	}
+	if len(seen) != int(txn.txn.meta.pages)-COW_FIRST_PAGE {
+		t.Fatalf("Expected %d pages in use or free, got %d", int(txn.txn.meta.pages)-COW_FIRST_PAGE, len(seen))
+	}
+}
+
+// crashFs keeps the contents of the data file as of its last sync, along with every write made
+// to it since, so that a test can crash the store with only some of those writes on disk
+type crashFs struct {
+	afero.Fs
+	mu       sync.Mutex
+	synced   []byte
+	unsynced []unsyncedWrite
+}
+
+type unsyncedWrite struct {
+	offset int64
+	b      []byte
+}
+
+func (fs *crashFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &crashFile{File: f, fs: fs}, nil
+}
+
+// crash returns a filesystem holding the data file as a power failure could leave it, as of the
+// last sync along with only the writes since then whose offsets keep says reached the disk
+func (fs *crashFs) crash(keep func(offset int64) bool) afero.Fs {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	contents := append([]byte(nil), fs.synced...)
+	for _, w := range fs.unsynced {
+		if !keep(w.offset) {
+			continue
+		}
+		if end := w.offset + int64(len(w.b)); end > int64(len(contents)) {
+			contents = append(contents, make([]byte, end-int64(len(contents)))...)
+		}
+		copy(contents[w.offset:], w.b)
+	}
+	crashed := afero.NewMemMapFs()
+	afero.WriteFile(crashed, COW_DATA_FILENAME, contents, 0644)
+	return crashed
+}
+
+type crashFile struct {
+	afero.File
+	fs *crashFs
+}
+
+func (f *crashFile) WriteAt(b []byte, offset int64) (int, error) {
+	f.fs.mu.Lock()
+	f.fs.unsynced = append(f.fs.unsynced, unsyncedWrite{offset: offset, b: append([]byte(nil), b...)})
+	f.fs.mu.Unlock()
+	return f.File.WriteAt(b, offset)
+}
+
+func (f *crashFile) Sync() error {
+	err := f.File.Sync()
+	if err != nil {
+		return err
+	}
+	contents, err := afero.ReadFile(f.fs.Fs, f.Name())
+	if err != nil {
+		return err
+	}
+	f.fs.mu.Lock()
+	f.fs.synced = contents
+	f.fs.unsynced = nil
+	f.fs.mu.Unlock()
+	return nil
+}
+
+func Test_cowTree_MatchesMapThroughRandomWrites(t *testing.T) {
+	s := newTestCowTree(t, afero.NewMemMapFs())
+	defer s.Close()
+	rng := rand.New(rand.NewSource(1))
+	expected := make(map[string]string)
+
+	for i := 0; i < 5000; i++ {
+		key := "key" + strconv.Itoa(rng.Intn(1000))
+		if rng.Intn(3) == 0 {
+			s.Delete(key)
+			delete(expected, key)
+		} else {
+			value := strings.Repeat("v", rng.Intn(200))
+			s.Set(key, value)
+			expected[key] = value
+		}
+		if i%500 == 0 {
+			checkCowTree(t, s)
+		}
+	}
+	checkCowTree(t, s)
+
+	for key, value := range expected {
+		if result, exists, err := s.Get(key); err != nil || !exists || result != value {
+			t.Fatalf("Expected '%s' to be '%s', got '%s', %v, %v", key, value, result, exists, err)
+		}
+	}
+	var scanned int
+	s.Scan("", "", func(key string, value string) bool {
+		if expected[key] != value {
+			t.Fatalf("Expected '%s' to be scanned as '%s', got '%s'", key, expected[key], value)
+		}
+		scanned++
+		return true
+	})
+	if scanned != len(expected) {
+		t.Fatalf("Expected to scan %d keys, got %d", len(expected), scanned)
+	}
+}
+
+func Test_cowPager_ReusesPagesOnceNoReaderCanSeeThem(t *testing.T) {
+	// every commit is durable as it's made, so only readers hold pages back
+	s, err := NewCowBTreeKvStorage(afero.NewMemMapFs(), WithBufferPoolSize(MIN_BUFFER_POOL_SIZE), WithDurability(durability.Always()))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer s.Close()
+	for i := 0; i < 1000; i++ {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 50))
+	}
+
+	// every overwrite copies the path to a leaf, and the old path can be reused once the commit
+	// after the overwrite is durable
+	s.Set("key0", "a")
+	s.Set("key0", "b")
+	pages := s.pager.meta.pages
+	for i := 0; i < 100; i++ {
+		s.Set("key0", strconv.Itoa(i))
+	}
+	if s.pager.meta.pages != pages {
+		t.Fatalf("Expected the file to stay at %d pages, got %d", pages, s.pager.meta.pages)
+	}
+
+	// while a reader can see the old paths, they can't be reused
+	txn := s.BeginRead()
+	for i := 0; i < 100; i++ {
+		s.Set("key0", strconv.Itoa(i))
+	}
+	if s.pager.meta.pages <= pages {
+		t.Fatal("Expected the file to grow while a reader holds old pages")
+	}
+	if result, _, _ := txn.Get("key0"); result != "99" {
+		t.Fatalf("Expected the reader to see 'key0' as '99', got '%s'", result)
+	}
+	txn.Close()
+	checkCowTree(t, s)
+
+	pages = s.pager.meta.pages
+	for i := 0; i < 1000; i++ {
+		s.Set("key0", strconv.Itoa(i))
+	}
+	if s.pager.meta.pages != pages {
+		t.Fatalf("Expected the pages held by the reader to be reused, got %d pages from %d", s.pager.meta.pages, pages)
+	}
+}
+
+func Test_cowPager_ReusesPagesOnlyOnceALaterCommitIsDurable(t *testing.T) {
+	s := newTestCowTree(t, afero.NewMemMapFs())
+	defer s.Close()
+	for i := 0; i < 1000; i++ {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 50))
+	}
+
+	// the contents of every page of each commit's tree, as written
+	commits := make(map[uint64]map[pageID][]byte)
+	record := func() {
+		txn := s.BeginRead()
+		defer txn.Close()
+		pages := make(map[pageID][]byte)
+		for id := range checkTree(t, txn.tree) {
+			b := make([]byte, PAGE_SIZE)
+			s.pager.reader.ReadAt(b, int64(id)*PAGE_SIZE)
+			pages[id] = b
+		}
+		commits[txn.txn.meta.txn] = pages
+	}
+
+	pages := s.pager.meta.pages
+	record()
+	for i := 0; i < 1000; i++ {
+		s.Set("key0", strconv.Itoa(i))
+		record()
+
+		// a crash can fall back to the commit before the last durable one, so nothing it refers
+		// to may have been overwritten
+		fallback, ok := commits[s.pager.durable-1]
+		if !ok {
+			continue
+		}
+		for id, expected := range fallback {
+			b := make([]byte, PAGE_SIZE)
+			s.pager.reader.ReadAt(b, int64(id)*PAGE_SIZE)
+			if !bytes.Equal(b, expected) {
+				t.Fatalf("Page %d of commit %d was overwritten while commit %d was the last durable one", id, s.pager.durable-1, s.pager.durable)
+			}
+		}
+	}
+	checkCowTree(t, s)
+	if s.pager.durable <= 1 {
+		t.Fatal("Expected the pager to sync the file to reuse pages")
+	}
+	if s.pager.meta.pages > pages+2*COW_SYNC_RETIRED_PAGES {
+		t.Fatalf("Expected the file to grow by at most %d pages between syncs, got %d pages from %d", 2*COW_SYNC_RETIRED_PAGES, s.pager.meta.pages, pages)
+	}
+}
+
+func Test_cowPager_FindsFreePagesOnReopen(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := newTestCowTree(t, fs)
+	for i := 0; i < 2000; i++ {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 100))
+	}
+	for i := 0; i < 2000; i += 2 {
+		s.Delete("key" + strconv.Itoa(i))
+	}
+	pages := s.pager.meta.pages
+	s.Close()
+
+	s = newTestCowTree(t, fs)
+	defer s.Close()
+	checkCowTree(t, s)
+	if len(s.pager.reusable) == 0 {
+		t.Fatal("Expected the pages freed by deletes to be found")
+	}
+	for i := 0; i < 2000; i += 2 {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 100))
+	}
+	if s.pager.meta.pages > pages {
+		t.Fatalf("Expected the free pages to be reused, got %d pages from %d", s.pager.meta.pages, pages)
+	}
+}
+
+func Test_cowPager_FallsBackToPreviousCommitIfMetaPageIsTorn(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s := newTestCowTree(t, fs)
+	for i := 0; i < 500; i++ {
+		s.Set("key"+strconv.Itoa(i), "1")
+	}
+	s.Set("last", "1")
+	txn := s.pager.meta.txn
+	s.Close()
+
+	f, _ := fs.OpenFile(COW_DATA_FILENAME, os.O_RDWR, 0644)
+	f.WriteAt([]byte{0xff}, int64(txn%COW_FIRST_PAGE)*PAGE_SIZE+20)
+	f.Close()
+
+	s = newTestCowTree(t, fs)
+	defer s.Close()
+	if s.pager.meta.txn != txn-1 {
+		t.Fatalf("Expected commit %d to be used, got %d", txn-1, s.pager.meta.txn)
+	}
+	if _, exists, _ := s.Get("last"); exists {
+		t.Fatal("Expected the torn commit of 'last' to be lost")
+	}
+	if result, _, _ := s.Get("key499"); result != "1" {
+		t.Fatalf("Expected 'key499' from the previous commit, got '%s'", result)
+	}
+	checkCowTree(t, s)
+}
+
+func Test_cowPager_SurvivesCrashBetweenPagesAndMetaPage(t *testing.T) {
+	fs := &crashFs{Fs: afero.NewMemMapFs()}
+	s, err := NewCowBTreeKvStorage(fs, WithBufferPoolSize(MIN_BUFFER_POOL_SIZE), WithDurability(durability.Never()))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 50))
+	}
+	s.Set("last", "1")
+
+	// the meta pages written since the last sync reach the disk, but none of the other pages
+	crashed := fs.crash(func(offset int64) bool {
+		return offset < COW_FIRST_PAGE*PAGE_SIZE
+	})
+	s, err = NewCowBTreeKvStorage(crashed, WithBufferPoolSize(MIN_BUFFER_POOL_SIZE))
+	if err != nil {
+		t.Fatalf("Failed to reopen storage after the crash: %v", err)
+	}
+	defer s.Close()
+	checkCowTree(t, s)
+	for i := 0; i < 500; i++ {
+		if result, _, err := s.Get("key" + strconv.Itoa(i)); err != nil || result != strings.Repeat("v", 50) {
+			t.Fatalf("Expected 'key%d' to survive the crash, got '%s', %v", i, result, err)
+		}
+	}
+	if result, _, _ := s.Get("last"); result != "1" {
+		t.Fatalf("Expected 'last' to survive the crash, got '%s'", result)
+	}
+}
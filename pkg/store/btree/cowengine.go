@@ -0,0 +1,144 @@
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// CowBTreeKvStorage keeps every key in a copy-on-write B+tree, so reads run in transactions that
+// see the store as of when they began, for as long as they are open, and never wait on writers.
+// Writes are serialised, and each is committed as a new version of the tree.
+type CowBTreeKvStorage struct {
+	writeMu sync.Mutex // held while a write transaction is open
+	pager   *cowPager
+	err     error // set if a commit fails after its meta page may have been written, after which writes are refused
+}
+
+func NewCowBTreeKvStorage(fs afero.Fs, opts ...Option) (*CowBTreeKvStorage, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	p, err := openCowPager(fs, o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tree: %w", err)
+	}
+	return &CowBTreeKvStorage{pager: p}, nil
+}
+
+func (s *CowBTreeKvStorage) Get(key string) (string, bool, error) {
+	txn := s.BeginRead()
+	defer txn.Close()
+	return txn.Get(key)
+}
+
+func (s *CowBTreeKvStorage) Set(key string, value string) error {
+	if len(key)+len(value) > MAX_ENTRY_SIZE {
+		return fmt.Errorf("failed to set key '%s': key and value are longer than %d bytes", key, MAX_ENTRY_SIZE)
+	}
+	return s.write(func(t *tree) error {
+		return t.put(key, value)
+	})
+}
+
+// Delete removes key from the store, and does nothing if it isn't there
+func (s *CowBTreeKvStorage) Delete(key string) error {
+	return s.write(func(t *tree) error {
+		_, err := t.remove(key)
+		return err
+	})
+}
+
+// Scan calls fn with each key from start up to, but not including, end, in order, until fn
+// returns false. An empty end means there is no upper bound. The keys are read as of when the
+// scan began, and writes carry on while it runs.
+func (s *CowBTreeKvStorage) Scan(start string, end string, fn func(key string, value string) bool) error {
+	txn := s.BeginRead()
+	defer txn.Close()
+	return txn.Scan(start, end, fn)
+}
+
+// write applies a change to a copy of the tree in a write transaction, and commits it. If the
+// change fails, nothing is written.
+func (s *CowBTreeKvStorage) write(change func(t *tree) error) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	w := s.pager.beginWrite()
+	err := change(&tree{pages: w, meta: &w.meta})
+	if err == nil {
+		err = s.pager.commit(w)
+	}
+	if err != nil {
+		var uncertain *errUncertainCommit
+		if errors.As(err, &uncertain) {
+			s.err = fmt.Errorf("tree is unusable after a failed commit: %w", err)
+		}
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+// BeginRead starts a read transaction on the last commit. Pages that the transaction can see
+// aren't reused until it is closed, so it should be closed as soon as it is no longer needed,
+// and before the store is closed.
+func (s *CowBTreeKvStorage) BeginRead() *ReadTxn {
+	txn := s.pager.beginRead()
+	return &ReadTxn{txn: txn, tree: &tree{pages: txn, meta: &txn.meta}}
+}
+
+func (s *CowBTreeKvStorage) Close() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	err := s.pager.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close tree: %v", err)
+	}
+	return s.err
+}
+
+// ReadTxn is a consistent snapshot of a CowBTreeKvStorage, safe for concurrent use
+type ReadTxn struct {
+	txn   *cowTxn
+	tree  *tree
+	close sync.Once
+}
+
+func (r *ReadTxn) Get(key string) (string, bool, error) {
+	value, exists, err := r.tree.get(key)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get key '%s': %w", key, err)
+	}
+	return value, exists, nil
+}
+
+// Scan calls fn with each key from start up to, but not including, end, in order, until fn
+// returns false. An empty end means there is no upper bound.
+func (r *ReadTxn) Scan(start string, end string, fn func(key string, value string) bool) error {
+	err := r.tree.scan(start, end, fn)
+	if err != nil {
+		return fmt.Errorf("failed to scan from '%s': %w", start, err)
+	}
+	return nil
+}
+
+// Len returns the number of keys in the snapshot
+func (r *ReadTxn) Len() uint64 {
+	return r.txn.meta.keys
+}
+
+// Close finishes the transaction, letting the pages only it could see be reused. It must not be
+// used afterwards.
+func (r *ReadTxn) Close() {
+	r.close.Do(func() {
+		r.txn.pager.finishRead(r.txn)
+	})
+}
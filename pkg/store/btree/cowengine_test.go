@@ -0,0 +1,149 @@
+package btree
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func Test_ReadTxn_SeesSnapshotAsOfBegin(t *testing.T) {
+	s := newTestCowTree(t, afero.NewMemMapFs())
+	defer s.Close()
+	for i := 0; i < 300; i++ {
+		s.Set("key"+strconv.Itoa(i), "old")
+	}
+
+	txn := s.BeginRead()
+	defer txn.Close()
+	for i := 0; i < 300; i++ {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("new", 20))
+	}
+	for i := 0; i < 150; i++ {
+		s.Delete("key" + strconv.Itoa(i))
+	}
+	s.Set("added", "new")
+
+	if txn.Len() != 300 {
+		t.Fatalf("Expected the snapshot to hold 300 keys, got %d", txn.Len())
+	}
+	if _, exists, _ := txn.Get("added"); exists {
+		t.Fatal("Expected 'added' not to be in the snapshot")
+	}
+	scanned := 0
+	err := txn.Scan("", "", func(key string, value string) bool {
+		if value != "old" {
+			t.Fatalf("Expected '%s' to be 'old' in the snapshot, got '%s'", key, value)
+		}
+		scanned++
+		return true
+	})
+	if err != nil || scanned != 300 {
+		t.Fatalf("Expected to scan 300 keys, got %d, %v", scanned, err)
+	}
+	if result, _, _ := s.Get("key299"); result != strings.Repeat("new", 20) {
+		t.Fatalf("Expected reads outside the snapshot to see the new value, got '%s'", result)
+	}
+}
+
+func Test_CowBTreeKvStorage_ReadersSeeConsistentSnapshotsWhileWriting(t *testing.T) {
+	s := newTestCowTree(t, afero.NewMemMapFs())
+	defer s.Close()
+
+	// each write adds a key and updates the count, so every snapshot must agree with itself
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				txn := s.BeginRead()
+				scanned := uint64(0)
+				err := txn.Scan("", "", func(key string, value string) bool {
+					scanned++
+					return true
+				})
+				if err != nil || scanned != txn.Len() {
+					t.Errorf("Expected to scan the %d keys in the snapshot, got %d, %v", txn.Len(), scanned, err)
+				}
+				txn.Close()
+			}
+		}()
+	}
+	for i := 0; i < 500; i++ {
+		err := s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 50))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	close(done)
+	wg.Wait()
+	checkCowTree(t, s)
+}
+
+func Test_CowBTreeKvStorage_FailedWriteLeavesLastCommit(t *testing.T) {
+	fail := false
+	s := newTestCowTree(t, &failingFs{Fs: afero.NewMemMapFs(), fails: func(int64) bool { return fail }})
+	defer s.Close()
+	s.Set("a", "1")
+
+	fail = true
+	if err := s.Set("b", "2"); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	fail = false
+	if _, exists, _ := s.Get("b"); exists {
+		t.Fatal("Expected the failed write of 'b' not to be seen")
+	}
+	if err := s.Set("c", "3"); err != nil {
+		t.Fatalf("Expected writes to carry on after a failed page write, got %v", err)
+	}
+	checkCowTree(t, s)
+}
+
+func Test_CowBTreeKvStorage_RefusesWritesAfterFailedMetaPageWrite(t *testing.T) {
+	fail := false
+	base := afero.NewMemMapFs()
+	s := newTestCowTree(t, &failingFs{Fs: base, fails: func(offset int64) bool {
+		return fail && offset < COW_FIRST_PAGE*PAGE_SIZE
+	}})
+	s.Set("a", "1")
+
+	fail = true
+	if err := s.Set("b", "2"); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	fail = false
+	if err := s.Set("c", "3"); err == nil {
+		t.Fatal("Expected writes to be refused once a meta page write has failed")
+	}
+	if result, _, _ := s.Get("a"); result != "1" {
+		t.Fatalf("Expected reads to carry on, got '%s'", result)
+	}
+	if err := s.Close(); err == nil {
+		t.Fatal("Expected Close to report the failed commit")
+	}
+
+	s = newTestCowTree(t, base)
+	defer s.Close()
+	if result, _, _ := s.Get("a"); result != "1" {
+		t.Fatalf("Expected 'a' to be recovered, got '%s'", result)
+	}
+}
+
+func Test_CowBTreeKvStorage_Set_RejectsEntriesLargerThanAPageAllows(t *testing.T) {
+	s := newTestCowTree(t, afero.NewMemMapFs())
+	defer s.Close()
+
+	if err := s.Set("key", strings.Repeat("v", MAX_ENTRY_SIZE)); err == nil {
+		t.Fatal("Expected an error for an entry larger than MAX_ENTRY_SIZE")
+	}
+}
@@ -0,0 +1,122 @@
+package btree
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// BTreeKvStorage keeps every key in a B+tree of pages in a single file, updated in place. Reads
+// take one page per level of the tree, most of which are in the buffer pool, so their latency
+// doesn't depend on how the keys were written, and there is no compaction running alongside.
+type BTreeKvStorage struct {
+	mu    sync.RWMutex // held for writing while the tree is changed
+	pager *pager
+	tree  *tree
+	err   error // set if a write fails part way through, after which the store can't be used
+}
+
+func NewBTreeKvStorage(fs afero.Fs, opts ...Option) (*BTreeKvStorage, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	p, err := openPager(fs, o)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tree: %w", err)
+	}
+	return &BTreeKvStorage{pager: p, tree: &tree{pages: p, meta: &p.meta, linked: true}}, nil
+}
+
+func (s *BTreeKvStorage) Get(key string) (string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.err != nil {
+		return "", false, s.err
+	}
+
+	value, exists, err := s.tree.get(key)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get key '%s': %w", key, err)
+	}
+	return value, exists, nil
+}
+
+func (s *BTreeKvStorage) Set(key string, value string) error {
+	if len(key)+len(value) > MAX_ENTRY_SIZE {
+		return fmt.Errorf("failed to set key '%s': key and value are longer than %d bytes", key, MAX_ENTRY_SIZE)
+	}
+	return s.write(func() error {
+		return s.tree.put(key, value)
+	})
+}
+
+// Delete removes key from the store, and does nothing if it isn't there
+func (s *BTreeKvStorage) Delete(key string) error {
+	return s.write(func() error {
+		_, err := s.tree.remove(key)
+		return err
+	})
+}
+
+// Scan calls fn with each key from start up to, but not including, end, in order, until fn
+// returns false. An empty end means there is no upper bound. Writes wait until the scan is
+// done, so fn must not write to the store.
+func (s *BTreeKvStorage) Scan(start string, end string, fn func(key string, value string) bool) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	err := s.tree.scan(start, end, fn)
+	if err != nil {
+		return fmt.Errorf("failed to scan from '%s': %w", start, err)
+	}
+	return nil
+}
+
+// Len returns the number of keys in the store
+func (s *BTreeKvStorage) Len() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.pager.meta.keys
+}
+
+// write applies a change to the tree and commits it to the write-ahead log. If either fails, the
+// pages in memory may be half changed, so the store refuses to be used until it is reopened from
+// the last commit.
+func (s *BTreeKvStorage) write(change func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+
+	err := change()
+	if err == nil {
+		err = s.pager.commit()
+	}
+	if err != nil {
+		s.err = fmt.Errorf("tree is unusable after a failed write: %w", err)
+		return fmt.Errorf("failed to write: %w", err)
+	}
+	return nil
+}
+
+func (s *BTreeKvStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		s.pager.abandon()
+		return s.err
+	}
+	err := s.pager.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close tree: %v", err)
+	}
+	return nil
+}
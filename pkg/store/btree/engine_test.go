@@ -0,0 +1,115 @@
+package btree
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// failingFs returns files whose writes fail once fails returns true for their offset, which is
+// -1 for appends
+type failingFs struct {
+	afero.Fs
+	fails func(offset int64) bool
+}
+
+func (fs *failingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &failingFile{File: f, fails: fs.fails}, nil
+}
+
+type failingFile struct {
+	afero.File
+	fails func(offset int64) bool
+}
+
+func (f *failingFile) Write(b []byte) (int, error) {
+	if f.fails(-1) {
+		return 0, errors.New("disk full")
+	}
+	return f.File.Write(b)
+}
+
+func (f *failingFile) WriteAt(b []byte, offset int64) (int, error) {
+	if f.fails(offset) {
+		return 0, errors.New("disk full")
+	}
+	return f.File.WriteAt(b, offset)
+}
+
+func Test_BTreeKvStorage_PersistsAcrossReopen(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s, _ := NewBTreeKvStorage(fs)
+	s.Set("a", "1")
+	s.Set("b", "2")
+	s.Delete("a")
+	err := s.Close()
+	if err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+
+	s, _ = NewBTreeKvStorage(fs)
+	defer s.Close()
+	if _, exists, _ := s.Get("a"); exists {
+		t.Fatal("Expected 'a' to stay deleted")
+	}
+	if result, _, _ := s.Get("b"); result != "2" {
+		t.Fatalf("Expected 'b' to be '2', got '%s'", result)
+	}
+}
+
+func Test_BTreeKvStorage_Set_RejectsEntriesLargerThanAPageAllows(t *testing.T) {
+	s := newTestTree(t)
+	defer s.Close()
+
+	err := s.Set("key", strings.Repeat("v", MAX_ENTRY_SIZE))
+	if err == nil {
+		t.Fatal("Expected an error for an entry larger than MAX_ENTRY_SIZE")
+	}
+	if _, exists, _ := s.Get("key"); exists {
+		t.Fatal("Expected the entry not to be written")
+	}
+	if err := s.Set("key", "value"); err != nil {
+		t.Fatalf("Expected later writes to succeed, got %v", err)
+	}
+}
+
+func Test_BTreeKvStorage_RefusesUseAfterFailedWrite(t *testing.T) {
+	fail := false
+	base := afero.NewMemMapFs()
+	s, _ := NewBTreeKvStorage(&failingFs{Fs: base, fails: func(int64) bool { return fail }})
+	s.Set("a", "1")
+
+	fail = true
+	if err := s.Set("b", "2"); err == nil {
+		t.Fatal("Expected the write to fail")
+	}
+	fail = false
+	if err := s.Set("c", "3"); err == nil {
+		t.Fatal("Expected writes to be refused after a failed write")
+	}
+	if _, _, err := s.Get("a"); err == nil {
+		t.Fatal("Expected reads to be refused after a failed write")
+	}
+	if err := s.Close(); err == nil {
+		t.Fatal("Expected Close to report the failed write")
+	}
+
+	s, err := NewBTreeKvStorage(base)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer s.Close()
+	if result, _, _ := s.Get("a"); result != "1" {
+		t.Fatalf("Expected 'a' to be recovered, got '%s'", result)
+	}
+	if _, exists, _ := s.Get("b"); exists {
+		t.Fatal("Expected the failed write of 'b' not to be recovered")
+	}
+}
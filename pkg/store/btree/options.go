@@ -0,0 +1,35 @@
+package btree
+
+import "github.com/haydenjeune/kvstore/pkg/durability"
+
+// Option configures a BTreeKvStorage
+type Option func(*options)
+
+type options struct {
+	durability     durability.Policy
+	bufferPoolSize int
+}
+
+func defaultOptions() options {
+	return options{
+		durability:     durability.Never(),
+		bufferPoolSize: BUFFER_POOL_SIZE,
+	}
+}
+
+// WithDurability sets when the write-ahead log is fsynced. By default this is left to the
+// operating system. The data file is always fsynced at a checkpoint, before the log is emptied.
+func WithDurability(p durability.Policy) Option {
+	return func(o *options) {
+		o.durability = p
+	}
+}
+
+// WithBufferPoolSize sets the number of pages kept in memory, which is BUFFER_POOL_SIZE by
+// default. Pages changed since the last checkpoint are always kept, so a checkpoint is made once
+// they fill the pool.
+func WithBufferPoolSize(pages int) Option {
+	return func(o *options) {
+		o.bufferPoolSize = pages
+	}
+}
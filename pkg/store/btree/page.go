@@ -0,0 +1,250 @@
+package btree
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// The tree is stored in a single file of fixed size pages, numbered from 0. The file starts with
+// a meta page, which records the root of the tree, the number of pages in the file, the first
+// free page, the number of keys and the last transaction committed, as:
+//
+//	magic (8 bytes) | format version (4 bytes) | root (4 bytes) | pages (4 bytes) |
+//	first free page (4 bytes) | keys (8 bytes) | transaction (8 bytes) |
+//	crc32 of the meta page so far (4 bytes)
+//
+// Every other page is a node of the tree, or a free page, and starts with a header:
+//
+//	kind (1 byte) | entries (2 bytes) | next page (4 bytes) | crc32 of the rest of the page (4 bytes)
+//
+// A leaf holds keys and their values in key order, each as a key length (2 bytes), value length
+// (2 bytes), key and value, and links to the next leaf, so range scans never have to go back up
+// the tree. An internal node holds its first child (4 bytes), then for each key a key length (2
+// bytes), the key and the next child (4 bytes). Each child holds the keys at or after the key
+// before it, and before the key after it. A free page links to the next free page.
+
+const PAGE_SIZE = 4 << 10
+const PAGE_HEADER_SIZE = 11
+
+const BTREE_MAGIC = "KVSBTREE"
+const COW_BTREE_MAGIC = "KVSCOWBT"
+const BTREE_FORMAT_VERSION uint32 = 1
+const META_SIZE = 44
+
+// MAX_ENTRY_SIZE is the largest combined length of a key and value, which keeps at least four
+// entries in every page, so that splitting a full page always leaves two that fit
+const MAX_ENTRY_SIZE = (PAGE_SIZE-PAGE_HEADER_SIZE)/4 - LEAF_CELL_OVERHEAD
+
+// MIN_FILL is the size below which a node, other than the root, is merged with a sibling or
+// takes entries from it
+const MIN_FILL = PAGE_SIZE / 4
+
+const LEAF_CELL_OVERHEAD = 4
+const INTERNAL_CELL_OVERHEAD = 6
+
+var pageCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// pageID is the number of a page in the file. As page 0 is the meta page, 0 is used to mean
+// no page.
+type pageID uint32
+
+type pageKind byte
+
+const (
+	leafPage pageKind = iota + 1
+	internalPage
+	freePage
+)
+
+type node struct {
+	id       pageID
+	kind     pageKind
+	keys     []string
+	values   []string // leaves only, one for each key
+	children []pageID // internal nodes only, one more than the keys
+	next     pageID   // the next leaf, or the next free page
+}
+
+// size returns the number of bytes the node takes up once encoded
+func (n *node) size() int {
+	size := PAGE_HEADER_SIZE
+	switch n.kind {
+	case leafPage:
+		for i, key := range n.keys {
+			size += LEAF_CELL_OVERHEAD + len(key) + len(n.values[i])
+		}
+	case internalPage:
+		size += 4
+		for _, key := range n.keys {
+			size += INTERNAL_CELL_OVERHEAD + len(key)
+		}
+	}
+	return size
+}
+
+// cellSize returns the number of bytes the ith entry of the node takes up once encoded
+func (n *node) cellSize(i int) int {
+	if n.kind == leafPage {
+		return LEAF_CELL_OVERHEAD + len(n.keys[i]) + len(n.values[i])
+	}
+	return INTERNAL_CELL_OVERHEAD + len(n.keys[i])
+}
+
+// clone returns a copy of n on another page, sharing nothing that can be changed
+func (n *node) clone(id pageID) *node {
+	return &node{
+		id:       id,
+		kind:     n.kind,
+		keys:     append([]string(nil), n.keys...),
+		values:   append([]string(nil), n.values...),
+		children: append([]pageID(nil), n.children...),
+		next:     n.next,
+	}
+}
+
+// encode returns the page holding the node. Only the first size() bytes are used, and the rest
+// are zeroes.
+func (n *node) encode() []byte {
+	b := make([]byte, PAGE_SIZE)
+	b[0] = byte(n.kind)
+	binary.BigEndian.PutUint16(b[1:], uint16(len(n.keys)))
+	binary.BigEndian.PutUint32(b[3:], uint32(n.next))
+
+	offset := PAGE_HEADER_SIZE
+	switch n.kind {
+	case leafPage:
+		for i, key := range n.keys {
+			binary.BigEndian.PutUint16(b[offset:], uint16(len(key)))
+			binary.BigEndian.PutUint16(b[offset+2:], uint16(len(n.values[i])))
+			offset += LEAF_CELL_OVERHEAD
+			offset += copy(b[offset:], key)
+			offset += copy(b[offset:], n.values[i])
+		}
+	case internalPage:
+		binary.BigEndian.PutUint32(b[offset:], uint32(n.children[0]))
+		offset += 4
+		for i, key := range n.keys {
+			binary.BigEndian.PutUint16(b[offset:], uint16(len(key)))
+			offset += 2
+			offset += copy(b[offset:], key)
+			binary.BigEndian.PutUint32(b[offset:], uint32(n.children[i+1]))
+			offset += 4
+		}
+	}
+
+	crc := crc32.Update(crc32.Checksum(b[:7], pageCrcTable), pageCrcTable, b[PAGE_HEADER_SIZE:])
+	binary.BigEndian.PutUint32(b[7:], crc)
+	return b
+}
+
+// decodeNode parses a page, checking it against its checksum
+func decodeNode(id pageID, b []byte) (*node, error) {
+	if len(b) != PAGE_SIZE {
+		return nil, errors.New("page has the wrong size")
+	}
+	crc := crc32.Update(crc32.Checksum(b[:7], pageCrcTable), pageCrcTable, b[PAGE_HEADER_SIZE:])
+	if crc != binary.BigEndian.Uint32(b[7:]) {
+		return nil, errors.New("page checksum mismatch")
+	}
+
+	n := &node{id: id, kind: pageKind(b[0]), next: pageID(binary.BigEndian.Uint32(b[3:]))}
+	count := int(binary.BigEndian.Uint16(b[1:]))
+	r := pageReader{b: b[PAGE_HEADER_SIZE:]}
+	switch n.kind {
+	case leafPage:
+		n.keys, n.values = make([]string, count), make([]string, count)
+		for i := 0; i < count; i++ {
+			keyLength, valueLength := r.uint16(), r.uint16()
+			n.keys[i], n.values[i] = r.string(keyLength), r.string(valueLength)
+		}
+	case internalPage:
+		n.keys, n.children = make([]string, count), make([]pageID, count+1)
+		n.children[0] = r.pageID()
+		for i := 0; i < count; i++ {
+			n.keys[i] = r.string(r.uint16())
+			n.children[i+1] = r.pageID()
+		}
+	case freePage:
+	default:
+		return nil, errors.New("page has an unknown kind")
+	}
+	if r.bad {
+		return nil, errors.New("page entries run past the end of the page")
+	}
+	return n, nil
+}
+
+// pageReader reads the fields of a page, remembering if it ran out of bytes so that callers
+// only need to check once they're done
+type pageReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *pageReader) take(n int) []byte {
+	if r.bad || n > len(r.b) {
+		r.bad = true
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *pageReader) uint16() int {
+	return int(binary.BigEndian.Uint16(r.take(2)))
+}
+
+func (r *pageReader) pageID() pageID {
+	return pageID(binary.BigEndian.Uint32(r.take(4)))
+}
+
+func (r *pageReader) string(n int) string {
+	return string(r.take(n))
+}
+
+type meta struct {
+	root     pageID
+	pages    uint32 // the number of pages in the file, including the meta pages
+	freeHead pageID // the first free page, or 0 if there are none
+	keys     uint64
+	txn      uint64 // the number of transactions committed
+}
+
+func (m meta) encode(magic string) []byte {
+	b := make([]byte, META_SIZE)
+	copy(b, magic)
+	binary.BigEndian.PutUint32(b[8:], BTREE_FORMAT_VERSION)
+	binary.BigEndian.PutUint32(b[12:], uint32(m.root))
+	binary.BigEndian.PutUint32(b[16:], m.pages)
+	binary.BigEndian.PutUint32(b[20:], uint32(m.freeHead))
+	binary.BigEndian.PutUint64(b[24:], m.keys)
+	binary.BigEndian.PutUint64(b[32:], m.txn)
+	binary.BigEndian.PutUint32(b[40:], crc32.Checksum(b[:40], pageCrcTable))
+	return b
+}
+
+// decodeMeta parses a meta page, checking that it was written by the engine that uses magic
+func decodeMeta(b []byte, magic string) (meta, error) {
+	if len(b) < META_SIZE || string(b[:8]) != magic {
+		return meta{}, errors.New("meta page has the wrong magic number")
+	}
+	if crc32.Checksum(b[:40], pageCrcTable) != binary.BigEndian.Uint32(b[40:]) {
+		return meta{}, errors.New("meta page checksum mismatch")
+	}
+	if version := binary.BigEndian.Uint32(b[8:]); version != BTREE_FORMAT_VERSION {
+		return meta{}, errors.New("meta page has an unsupported format version")
+	}
+	m := meta{
+		root:     pageID(binary.BigEndian.Uint32(b[12:])),
+		pages:    binary.BigEndian.Uint32(b[16:]),
+		freeHead: pageID(binary.BigEndian.Uint32(b[20:])),
+		keys:     binary.BigEndian.Uint64(b[24:]),
+		txn:      binary.BigEndian.Uint64(b[32:]),
+	}
+	if m.root == 0 || uint32(m.root) >= m.pages || uint32(m.freeHead) >= m.pages {
+		return meta{}, errors.New("meta page points outside the file")
+	}
+	return m, nil
+}
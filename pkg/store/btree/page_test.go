@@ -0,0 +1,79 @@
+package btree
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_decodeNode_RoundTripsEncodedLeaf(t *testing.T) {
+	n := &node{id: 3, kind: leafPage, keys: []string{"a", "b"}, values: []string{"1", ""}, next: 7}
+
+	decoded, err := decodeNode(3, n.encode())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, n) {
+		t.Fatalf("Expected %+v, got %+v", n, decoded)
+	}
+}
+
+func Test_decodeNode_RoundTripsEncodedInternalNode(t *testing.T) {
+	n := &node{id: 4, kind: internalPage, keys: []string{"m", "t"}, children: []pageID{1, 2, 3}}
+
+	decoded, err := decodeNode(4, n.encode())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, n) {
+		t.Fatalf("Expected %+v, got %+v", n, decoded)
+	}
+}
+
+func Test_node_size_MatchesEncodedLength(t *testing.T) {
+	n := &node{kind: leafPage, keys: []string{"key", "other"}, values: []string{"value", "v"}}
+
+	b := n.encode()
+	used := len(b)
+	for used > PAGE_HEADER_SIZE && b[used-1] == 0 {
+		used--
+	}
+	if used != n.size() {
+		t.Fatalf("Expected %d bytes to be used, got %d", n.size(), used)
+	}
+}
+
+func Test_decodeNode_ErrorsForDamagedPage(t *testing.T) {
+	b := (&node{kind: leafPage, keys: []string{"a"}, values: []string{"1"}}).encode()
+	b[PAGE_SIZE-1] ^= 0xff
+
+	_, err := decodeNode(1, b)
+	if err == nil {
+		t.Fatal("Expected an error for a damaged page")
+	}
+}
+
+func Test_decodeMeta_RoundTripsEncodedMeta(t *testing.T) {
+	m := meta{root: 5, pages: 9, freeHead: 2, keys: 100, txn: 7}
+
+	decoded, err := decodeMeta(m.encode(BTREE_MAGIC), BTREE_MAGIC)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded != m {
+		t.Fatalf("Expected %+v, got %+v", m, decoded)
+	}
+}
+
+func Test_decodeMeta_ErrorsForRootOutsideFile(t *testing.T) {
+	_, err := decodeMeta(meta{root: 9, pages: 9}.encode(BTREE_MAGIC), BTREE_MAGIC)
+	if err == nil {
+		t.Fatal("Expected an error for a root outside the file")
+	}
+}
+
+func Test_decodeMeta_ErrorsForOtherEnginesMeta(t *testing.T) {
+	_, err := decodeMeta(meta{root: 2, pages: 3}.encode(COW_BTREE_MAGIC), BTREE_MAGIC)
+	if err == nil {
+		t.Fatal("Expected an error for a meta page written by the copy-on-write engine")
+	}
+}
@@ -0,0 +1,407 @@
+package btree
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+// The pager reads and writes the pages of the tree, keeping recently used nodes in a buffer pool
+// so that the top of the tree is rarely read from disk.
+//
+// Pages are updated in place, so writes are made crash safe with a write-ahead log of page
+// images. The nodes changed by a write stay in the buffer pool, and once the write is complete
+// they are appended to the log along with the meta page, followed by a commit record. Changed
+// nodes are only written back to the file at a checkpoint, once the log grows past MAX_WAL_SIZE
+// or the buffer pool fills up with changed nodes. A checkpoint syncs the log, writes the nodes,
+// syncs the file and then empties the log. On startup every committed write in the log is
+// written to the file again, so a crash during a write or a checkpoint leaves the file as of the
+// last commit.
+
+const DATA_FILENAME = "btree.db"
+const WAL_FILENAME = "btree.wal"
+const MAX_WAL_SIZE = 4 << 20
+
+// BUFFER_POOL_SIZE is the default number of pages kept in memory
+const BUFFER_POOL_SIZE = 256
+
+// MIN_BUFFER_POOL_SIZE is the fewest pages the buffer pool holds, which is enough for the nodes a
+// single write reads and changes
+const MIN_BUFFER_POOL_SIZE = 16
+
+// the key of the record that ends each write in the log. Every other record is a page image,
+// keyed by the page's number.
+const COMMIT_KEY = "commit"
+
+type pager struct {
+	fs      afero.Fs
+	file    afero.File
+	wal     afero.File
+	syncer  *durability.Syncer
+	walSize int64
+
+	meta     meta
+	capacity int
+
+	mu     sync.Mutex // guards the buffer pool, which readers add pages to
+	frames map[pageID]*list.Element
+	lru    *list.List // the most recently used node is at the front
+
+	dirty   map[pageID]*node // changed since the last checkpoint, so kept in the buffer pool
+	changed map[pageID]*node // changed by the write in progress
+}
+
+func openPager(afs afero.Fs, o options) (*pager, error) {
+	f, err := afs.OpenFile(DATA_FILENAME, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %v", DATA_FILENAME, err)
+	}
+	p := &pager{
+		fs:       afs,
+		file:     f,
+		capacity: o.bufferPoolSize,
+		frames:   make(map[pageID]*list.Element),
+		lru:      list.New(),
+		dirty:    make(map[pageID]*node),
+		changed:  make(map[pageID]*node),
+	}
+	if p.capacity < MIN_BUFFER_POOL_SIZE {
+		p.capacity = MIN_BUFFER_POOL_SIZE
+	}
+
+	err = p.recover()
+	if err == nil {
+		p.wal, err = afs.OpenFile(WAL_FILENAME, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			err = fmt.Errorf("failed to open write-ahead log: %v", err)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	p.syncer = durability.NewSyncer(p.wal, o.durability)
+
+	err = p.readMeta()
+	if err != nil {
+		p.syncer.Close()
+		p.wal.Close()
+		f.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// readMeta reads the meta page, or starts an empty tree if the file is empty
+func (p *pager) readMeta() error {
+	info, err := p.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get stats from '%s': %v", DATA_FILENAME, err)
+	}
+	if info.Size() == 0 {
+		p.meta = meta{root: 1, pages: 2}
+		root := &node{id: 1, kind: leafPage}
+		p.mu.Lock()
+		p.add(root)
+		p.mu.Unlock()
+		p.modify(root)
+		return p.commit()
+	}
+
+	b := make([]byte, META_SIZE)
+	_, err = p.file.ReadAt(b, 0)
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("failed to read meta page: %v", err)
+	}
+	p.meta, err = decodeMeta(b, BTREE_MAGIC)
+	if err == nil && info.Size() < int64(p.meta.pages)*PAGE_SIZE {
+		err = errors.New("file ends before its last page")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read meta page: %w", &record.ErrCorrupt{Offset: 0, Reason: err.Error()})
+	}
+	return nil
+}
+
+// get returns the node in a page, from the buffer pool if it's there. It must not be changed
+// without calling modify.
+func (p *pager) get(id pageID) (*node, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if e, ok := p.frames[id]; ok {
+		p.lru.MoveToFront(e)
+		return e.Value.(*node), nil
+	}
+
+	offset := int64(id) * PAGE_SIZE
+	if id == 0 || uint32(id) >= p.meta.pages {
+		return nil, fmt.Errorf("failed to read page %d: %w", id, &record.ErrCorrupt{Offset: offset, Reason: "page is outside the file"})
+	}
+	b := make([]byte, PAGE_SIZE)
+	_, err := p.file.ReadAt(b, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %v", id, err)
+	}
+	n, err := decodeNode(id, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read page %d: %w", id, &record.ErrCorrupt{Offset: offset, Reason: err.Error()})
+	}
+	p.add(n)
+	p.evict()
+	return n, nil
+}
+
+// add puts a node in the buffer pool, replacing any node already there for its page. It must be
+// called with mu held.
+func (p *pager) add(n *node) {
+	if e, ok := p.frames[n.id]; ok {
+		e.Value = n
+		p.lru.MoveToFront(e)
+		return
+	}
+	p.frames[n.id] = p.lru.PushFront(n)
+}
+
+// evict removes the least recently used nodes until the buffer pool is back within its
+// capacity, skipping those that haven't been written back to the file yet. It must be called
+// with mu held.
+func (p *pager) evict() {
+	e := p.lru.Back()
+	for p.lru.Len() > p.capacity && e != nil {
+		prev := e.Prev()
+		n := e.Value.(*node)
+		if _, dirty := p.dirty[n.id]; !dirty {
+			p.lru.Remove(e)
+			delete(p.frames, n.id)
+		}
+		e = prev
+	}
+}
+
+// modify records that a node has been changed by the write in progress
+func (p *pager) modify(n *node) {
+	p.changed[n.id] = n
+	p.dirty[n.id] = n
+	// the node may have been evicted while it was clean, since it was read
+	p.mu.Lock()
+	p.add(n)
+	p.mu.Unlock()
+}
+
+// writable records that a node is about to be changed by the write in progress. As pages are
+// updated in place, the node itself is returned.
+func (p *pager) writable(n *node) (*node, error) {
+	p.modify(n)
+	return n, nil
+}
+
+// allocate returns a new, empty node, reusing a free page if there is one
+func (p *pager) allocate(kind pageKind) (*node, error) {
+	var id pageID
+	if p.meta.freeHead != 0 {
+		free, err := p.get(p.meta.freeHead)
+		if err != nil {
+			return nil, err
+		}
+		if free.kind != freePage {
+			return nil, fmt.Errorf("failed to allocate page %d: %w", free.id, &record.ErrCorrupt{Offset: int64(free.id) * PAGE_SIZE, Reason: "free list holds a page in use"})
+		}
+		id = free.id
+		p.meta.freeHead = free.next
+	} else {
+		id = pageID(p.meta.pages)
+		p.meta.pages++
+	}
+
+	n := &node{id: id, kind: kind}
+	p.modify(n)
+	return n, nil
+}
+
+// free adds a node's page to the free list, after which the node must not be used
+func (p *pager) free(n *node) {
+	n.kind, n.keys, n.values, n.children = freePage, nil, nil, nil
+	n.next = p.meta.freeHead
+	p.meta.freeHead = n.id
+	p.modify(n)
+}
+
+// commit appends the nodes changed by the write in progress to the log, followed by the meta
+// page and a commit record, then checkpoints if the log or buffer pool is full
+func (p *pager) commit() error {
+	if len(p.changed) == 0 {
+		return nil
+	}
+	p.meta.txn++
+	ids := make([]int, 0, len(p.changed))
+	for id := range p.changed {
+		ids = append(ids, int(id))
+	}
+	sort.Ints(ids)
+
+	buf := make([]byte, 0)
+	for _, id := range ids {
+		n := p.changed[pageID(id)]
+		// the rest of the page is zeroes, so it doesn't need to be logged
+		page := n.encode()[:n.size()]
+		buf = append(buf, record.Record{Key: strconv.Itoa(id), Value: string(page)}.Encode()...)
+	}
+	buf = append(buf, record.Record{Key: "0", Value: string(p.meta.encode(BTREE_MAGIC))}.Encode()...)
+	buf = append(buf, record.Record{Key: COMMIT_KEY}.Encode()...)
+	p.changed = make(map[pageID]*node)
+
+	n, err := p.wal.Write(buf)
+	p.walSize += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to append to write-ahead log: %v", err)
+	}
+	err = p.syncer.Written()
+	if err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %v", err)
+	}
+
+	if p.walSize >= MAX_WAL_SIZE || len(p.dirty) >= p.capacity {
+		return p.checkpoint()
+	}
+	p.mu.Lock()
+	p.evict()
+	p.mu.Unlock()
+	return nil
+}
+
+// checkpoint writes every changed node back to the file, then empties the log
+func (p *pager) checkpoint() error {
+	if p.walSize == 0 {
+		return nil
+	}
+	// the log must be on disk before any page is overwritten, in case the write is torn
+	err := p.wal.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync write-ahead log: %v", err)
+	}
+	for id, n := range p.dirty {
+		_, err = p.file.WriteAt(n.encode(), int64(id)*PAGE_SIZE)
+		if err != nil {
+			return fmt.Errorf("failed to write page %d: %v", id, err)
+		}
+	}
+	err = p.writeMetaPage(p.meta.encode(BTREE_MAGIC))
+	if err != nil {
+		return err
+	}
+	err = p.file.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync '%s': %v", DATA_FILENAME, err)
+	}
+
+	err = p.wal.Truncate(0)
+	if err == nil {
+		_, err = p.wal.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to empty write-ahead log: %v", err)
+	}
+	p.walSize = 0
+	p.dirty = make(map[pageID]*node)
+
+	p.mu.Lock()
+	p.evict()
+	p.mu.Unlock()
+	return nil
+}
+
+// writeMetaPage writes the encoded meta page, padded to a whole page
+func (p *pager) writeMetaPage(encoded []byte) error {
+	b := make([]byte, PAGE_SIZE)
+	copy(b, encoded)
+	_, err := p.file.WriteAt(b, 0)
+	if err != nil {
+		return fmt.Errorf("failed to write meta page: %v", err)
+	}
+	return nil
+}
+
+// recover writes every committed write in the log to the file. A torn write at the end of the
+// log is ignored, as it was never acknowledged, but corruption elsewhere is returned as an error.
+func (p *pager) recover() error {
+	f, err := p.fs.Open(WAL_FILENAME)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to open write-ahead log: %v", err)
+	}
+	defer f.Close()
+
+	pages := make(map[pageID][]byte)
+	recovered := false
+	reader := record.NewReader(f, 0)
+	for {
+		r, err := reader.Next()
+		var corrupt *record.ErrCorrupt
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || (errors.As(err, &corrupt) && reader.AtEOF()) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("failed to replay write-ahead log: %w", err)
+		}
+
+		if r.Key != COMMIT_KEY {
+			id, err := strconv.ParseUint(r.Key, 10, 32)
+			if err != nil || len(r.Value) > PAGE_SIZE {
+				return fmt.Errorf("failed to replay write-ahead log: %w", &record.ErrCorrupt{Offset: reader.Offset(), Reason: "page image is malformed"})
+			}
+			pages[pageID(id)] = []byte(r.Value)
+			continue
+		}
+
+		for id, page := range pages {
+			if id == 0 {
+				err = p.writeMetaPage(page)
+			} else {
+				b := make([]byte, PAGE_SIZE)
+				copy(b, page)
+				_, err = p.file.WriteAt(b, int64(id)*PAGE_SIZE)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to recover page %d: %v", id, err)
+			}
+		}
+		pages = make(map[pageID][]byte)
+		recovered = true
+	}
+
+	if recovered {
+		err = p.file.Sync()
+		if err != nil {
+			return fmt.Errorf("failed to sync '%s': %v", DATA_FILENAME, err)
+		}
+	}
+	return nil
+}
+
+func (p *pager) Close() error {
+	err := p.checkpoint()
+	if syncErr := p.syncer.Close(); err == nil && syncErr != nil {
+		err = fmt.Errorf("failed to sync write-ahead log: %v", syncErr)
+	}
+	p.wal.Close()
+	p.file.Close()
+	return err
+}
+
+// abandon closes the files without a checkpoint, leaving the log to be replayed when the tree is
+// next opened, for when the nodes in memory can't be trusted
+func (p *pager) abandon() {
+	p.syncer.Close()
+	p.wal.Close()
+	p.file.Close()
+}
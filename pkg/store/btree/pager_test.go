@@ -0,0 +1,144 @@
+package btree
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+// crash closes the store's files as if the process had died, without a checkpoint
+func crash(s *BTreeKvStorage) {
+	s.pager.abandon()
+}
+
+func Test_pager_RecoversCommittedWritesFromLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s, _ := NewBTreeKvStorage(fs)
+	for i := 0; i < 500; i++ {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 20))
+	}
+	s.Delete("key7")
+	if s.pager.walSize == 0 {
+		t.Fatal("Expected the writes to be waiting in the log for a checkpoint")
+	}
+	crash(s)
+
+	s, err := NewBTreeKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer s.Close()
+	checkTree(t, s.tree)
+	if s.Len() != 499 {
+		t.Fatalf("Expected 499 keys to be recovered, got %d", s.Len())
+	}
+	if _, exists, _ := s.Get("key7"); exists {
+		t.Fatal("Expected the delete of 'key7' to be recovered")
+	}
+	if result, _, _ := s.Get("key499"); result != strings.Repeat("v", 20) {
+		t.Fatalf("Expected 'key499' to be recovered, got '%s'", result)
+	}
+}
+
+func Test_pager_IgnoresUncommittedAndTornWrites(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s, _ := NewBTreeKvStorage(fs)
+	s.Set("a", "1")
+	crash(s)
+
+	// a page image without its commit record, then half of another record
+	uncommitted := &node{id: 1, kind: leafPage, keys: []string{"b"}, values: []string{"2"}}
+	torn := record.Record{Key: COMMIT_KEY}.Encode()
+	f, _ := fs.OpenFile(WAL_FILENAME, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(record.Record{Key: "1", Value: string(uncommitted.encode()[:uncommitted.size()])}.Encode())
+	f.Write(torn[:len(torn)-2])
+	f.Close()
+
+	s, err := NewBTreeKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Unexpected error reopening with a torn log: %v", err)
+	}
+	defer s.Close()
+	if result, exists, _ := s.Get("a"); !exists || result != "1" {
+		t.Fatalf("Expected 'a' to be recovered, got '%s'", result)
+	}
+	if _, exists, _ := s.Get("b"); exists {
+		t.Fatal("Expected the uncommitted write of 'b' to be ignored")
+	}
+}
+
+func Test_pager_CheckpointEmptiesLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s, _ := NewBTreeKvStorage(fs, WithBufferPoolSize(MIN_BUFFER_POOL_SIZE))
+	defer s.Close()
+
+	for i := 0; i < 2000; i++ {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 100))
+		if len(s.pager.dirty) > MIN_BUFFER_POOL_SIZE+5 {
+			t.Fatalf("Expected a checkpoint once the buffer pool filled, got %d changed pages", len(s.pager.dirty))
+		}
+	}
+	if s.pager.lru.Len() > MIN_BUFFER_POOL_SIZE+5 {
+		t.Fatalf("Expected the buffer pool to stay near %d pages, got %d", MIN_BUFFER_POOL_SIZE, s.pager.lru.Len())
+	}
+
+	err := s.pager.checkpoint()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if info, _ := fs.Stat(WAL_FILENAME); info.Size() != 0 {
+		t.Fatalf("Expected the log to be empty after a checkpoint, got %d bytes", info.Size())
+	}
+	if info, _ := fs.Stat(DATA_FILENAME); info.Size() != int64(s.pager.meta.pages)*PAGE_SIZE {
+		t.Fatalf("Expected %d pages in the file, got %d bytes", s.pager.meta.pages, info.Size())
+	}
+}
+
+func Test_pager_ErrorsForDamagedPage(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s, _ := NewBTreeKvStorage(fs)
+	for i := 0; i < 500; i++ {
+		s.Set("key"+strconv.Itoa(i), strings.Repeat("v", 20))
+	}
+	s.Close()
+
+	f, _ := fs.OpenFile(DATA_FILENAME, os.O_RDWR, 0644)
+	f.WriteAt([]byte{0xff}, 2*PAGE_SIZE+PAGE_HEADER_SIZE)
+	f.Close()
+
+	s, err := NewBTreeKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer s.Close()
+	var corrupt *record.ErrCorrupt
+	for i := 0; i < 500 && corrupt == nil; i++ {
+		_, _, err = s.Get("key" + strconv.Itoa(i))
+		errors.As(err, &corrupt)
+	}
+	if corrupt == nil || corrupt.Offset != 2*PAGE_SIZE {
+		t.Fatalf("Expected corruption in page 2, got %v", err)
+	}
+}
+
+func Test_pager_ErrorsForDamagedMetaPage(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	s, _ := NewBTreeKvStorage(fs)
+	s.Set("a", "1")
+	s.Close()
+
+	f, _ := fs.OpenFile(DATA_FILENAME, os.O_RDWR, 0644)
+	f.WriteAt([]byte{0xff}, 13)
+	f.Close()
+
+	_, err := NewBTreeKvStorage(fs)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) || corrupt.Offset != 0 {
+		t.Fatalf("Expected corruption in the meta page, got %v", err)
+	}
+}
@@ -0,0 +1,457 @@
+package btree
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+// The tree is a B+tree, so every key and value is held in the leaves, and internal nodes only
+// hold the keys that separate their children. Nodes are sized in bytes rather than entries, as
+// keys and values vary in length. A node that grows past PAGE_SIZE is split in two halves of
+// about the same size, and a node that shrinks below MIN_FILL is merged with a sibling, or takes
+// entries from it if they don't fit in one page. Either may change the keys of the parent,
+// which is then split or merged in turn on the way back up the tree.
+//
+// The tree only changes a node once the page store has made it writable. A store that updates
+// pages in place returns the same node, while a copy-on-write store returns a copy in a new page,
+// in which case the parent is made writable in turn to point at the copy, and so on up to a new
+// root.
+
+// pageStore holds the nodes of a tree
+type pageStore interface {
+	get(id pageID) (*node, error)
+	// writable returns a node that can be changed in place of n, which may be on a new page
+	writable(n *node) (*node, error)
+	allocate(kind pageKind) (*node, error)
+	// free releases a node's page, after which the node must not be used
+	free(n *node)
+}
+
+type tree struct {
+	pages pageStore
+	meta  *meta
+	// linked is set if leaves link to the next leaf. A copy-on-write store can't keep the links,
+	// as copying a leaf would mean copying every leaf before it, so scans go back up the tree.
+	linked bool
+}
+
+// subtree is the result of changing a subtree: its root, which may be on a new page, and the new
+// node split off to its right, if it had to be split, along with the key that separates them
+type subtree struct {
+	root  *node
+	sep   string
+	right *node
+}
+
+func errCorruptPage(id pageID, reason string) error {
+	return fmt.Errorf("failed to read page %d: %w", id, &record.ErrCorrupt{Offset: int64(id) * PAGE_SIZE, Reason: reason})
+}
+
+// childIndex returns the index of the child of an internal node that holds key
+func childIndex(n *node, key string) int {
+	return sort.Search(len(n.keys), func(i int) bool { return n.keys[i] > key })
+}
+
+// child returns the ith child of an internal node
+func (t *tree) child(n *node, i int) (*node, error) {
+	c, err := t.pages.get(n.children[i])
+	if err != nil {
+		return nil, err
+	}
+	if c.kind == freePage {
+		return nil, errCorruptPage(c.id, "tree links to a free page")
+	}
+	return c, nil
+}
+
+// cursor is the path from the root to a leaf, holding the index of the child taken at each
+// internal node
+type cursor struct {
+	nodes   []*node
+	indexes []int
+}
+
+// descend follows the children that hold key from n down to a leaf, adding each internal node to
+// the cursor, and returns the leaf
+func (t *tree) descend(n *node, key string, c *cursor) (*node, error) {
+	var err error
+	for n.kind == internalPage {
+		i := childIndex(n, key)
+		c.nodes, c.indexes = append(c.nodes, n), append(c.indexes, i)
+		n, err = t.child(n, i)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if n.kind != leafPage {
+		return nil, errCorruptPage(n.id, "tree links to a free page")
+	}
+	return n, nil
+}
+
+// nextLeaf returns the leaf after n, or nil if n is the last
+func (t *tree) nextLeaf(n *node, c *cursor) (*node, error) {
+	if t.linked {
+		if n.next == 0 {
+			return nil, nil
+		}
+		next, err := t.pages.get(n.next)
+		if err == nil && next.kind != leafPage {
+			err = errCorruptPage(next.id, "leaf links to a page that isn't a leaf")
+		}
+		return next, err
+	}
+
+	// go back up to the first node with a child to the right of the path, then down its leftmost
+	// children
+	for len(c.nodes) > 0 {
+		last := len(c.nodes) - 1
+		parent, i := c.nodes[last], c.indexes[last]+1
+		if i < len(parent.children) {
+			c.indexes[last] = i
+			n, err := t.child(parent, i)
+			if err != nil {
+				return nil, err
+			}
+			return t.descend(n, "", c)
+		}
+		c.nodes, c.indexes = c.nodes[:last], c.indexes[:last]
+	}
+	return nil, nil
+}
+
+func (t *tree) get(key string) (string, bool, error) {
+	root, err := t.pages.get(t.meta.root)
+	if err != nil {
+		return "", false, err
+	}
+	n, err := t.descend(root, key, &cursor{})
+	if err != nil {
+		return "", false, err
+	}
+	i := sort.SearchStrings(n.keys, key)
+	if i < len(n.keys) && n.keys[i] == key {
+		return n.values[i], true, nil
+	}
+	return "", false, nil
+}
+
+// scan calls fn with each key from start up to, but not including, end, in order, until fn
+// returns false. An empty end means there is no upper bound.
+func (t *tree) scan(start string, end string, fn func(key string, value string) bool) error {
+	root, err := t.pages.get(t.meta.root)
+	if err != nil {
+		return err
+	}
+	c := &cursor{}
+	n, err := t.descend(root, start, c)
+	if err != nil {
+		return err
+	}
+	for i := sort.SearchStrings(n.keys, start); ; i++ {
+		for i == len(n.keys) {
+			n, err = t.nextLeaf(n, c)
+			if n == nil || err != nil {
+				return err
+			}
+			i = 0
+		}
+		if end != "" && n.keys[i] >= end {
+			return nil
+		}
+		if !fn(n.keys[i], n.values[i]) {
+			return nil
+		}
+	}
+}
+
+func (t *tree) put(key string, value string) error {
+	root, err := t.pages.get(t.meta.root)
+	if err != nil {
+		return err
+	}
+	s, err := t.insert(root, key, value)
+	if err != nil {
+		return err
+	}
+	return t.setRoot(s)
+}
+
+// insert adds the key to the subtree rooted at n, or replaces its value
+func (t *tree) insert(n *node, key string, value string) (subtree, error) {
+	var err error
+	switch n.kind {
+	case leafPage:
+		n, err = t.pages.writable(n)
+		if err != nil {
+			return subtree{}, err
+		}
+		i := sort.SearchStrings(n.keys, key)
+		if i < len(n.keys) && n.keys[i] == key {
+			n.values[i] = value
+		} else {
+			n.keys = insertString(n.keys, i, key)
+			n.values = insertString(n.values, i, value)
+			t.meta.keys++
+		}
+	case internalPage:
+		i := childIndex(n, key)
+		c, err := t.child(n, i)
+		if err != nil {
+			return subtree{}, err
+		}
+		s, err := t.insert(c, key, value)
+		if err != nil {
+			return subtree{}, err
+		}
+		if s.root.id == c.id && s.right == nil {
+			return subtree{root: n}, nil
+		}
+		n, err = t.adopt(n, i, s)
+		if err != nil {
+			return subtree{}, err
+		}
+	default:
+		return subtree{}, errCorruptPage(n.id, "tree links to a free page")
+	}
+	return t.splitIfFull(n)
+}
+
+// adopt makes n writable and points its ith child at the changed subtree, returning the
+// writable n
+func (t *tree) adopt(n *node, i int, s subtree) (*node, error) {
+	n, err := t.pages.writable(n)
+	if err != nil {
+		return nil, err
+	}
+	n.children[i] = s.root.id
+	if s.right != nil {
+		n.keys = insertString(n.keys, i, s.sep)
+		n.children = insertPageID(n.children, i+1, s.right.id)
+	}
+	return n, nil
+}
+
+// splitIfFull splits n, which must be writable, in two if it no longer fits in a page
+func (t *tree) splitIfFull(n *node) (subtree, error) {
+	if n.size() <= PAGE_SIZE {
+		return subtree{root: n}, nil
+	}
+	left, sep, right := halves(n)
+	r, err := t.pages.allocate(n.kind)
+	if err != nil {
+		return subtree{}, err
+	}
+	n.keys, n.values, n.children = left.keys, left.values, left.children
+	r.keys, r.values, r.children = right.keys, right.values, right.children
+	if n.kind == leafPage && t.linked {
+		r.next = n.next
+		n.next = r.id
+	}
+	return subtree{root: n, sep: sep, right: r}, nil
+}
+
+// setRoot makes the changed subtree the root of the tree, adding a new root above it if it
+// was split
+func (t *tree) setRoot(s subtree) error {
+	t.meta.root = s.root.id
+	if s.right == nil {
+		return nil
+	}
+	n, err := t.pages.allocate(internalPage)
+	if err != nil {
+		return err
+	}
+	n.keys = []string{s.sep}
+	n.children = []pageID{s.root.id, s.right.id}
+	t.meta.root = n.id
+	return nil
+}
+
+// remove deletes key, returning false if it wasn't there
+func (t *tree) remove(key string) (bool, error) {
+	root, err := t.pages.get(t.meta.root)
+	if err != nil {
+		return false, err
+	}
+	s, removed, err := t.delete(root, key)
+	if err != nil || !removed {
+		return removed, err
+	}
+	if s.right != nil {
+		return true, t.setRoot(s)
+	}
+
+	// the root has merged its last two children, so the merged child becomes the root
+	t.meta.root = s.root.id
+	if s.root.kind == internalPage && len(s.root.keys) == 0 {
+		t.meta.root = s.root.children[0]
+		t.pages.free(s.root)
+	}
+	return true, nil
+}
+
+// delete removes the key from the subtree rooted at n, rebalancing any child that becomes too
+// small. Rebalancing can lengthen the keys in n, so n may have to be split.
+func (t *tree) delete(n *node, key string) (subtree, bool, error) {
+	var err error
+	switch n.kind {
+	case leafPage:
+		i := sort.SearchStrings(n.keys, key)
+		if i == len(n.keys) || n.keys[i] != key {
+			return subtree{root: n}, false, nil
+		}
+		n, err = t.pages.writable(n)
+		if err != nil {
+			return subtree{}, false, err
+		}
+		n.keys = append(n.keys[:i], n.keys[i+1:]...)
+		n.values = append(n.values[:i], n.values[i+1:]...)
+		t.meta.keys--
+		return subtree{root: n}, true, nil
+	case internalPage:
+		i := childIndex(n, key)
+		c, err := t.child(n, i)
+		if err != nil {
+			return subtree{}, false, err
+		}
+		s, removed, err := t.delete(c, key)
+		if err != nil || !removed {
+			return subtree{root: n}, removed, err
+		}
+		if s.root.id == c.id && s.right == nil && s.root.size() >= MIN_FILL {
+			return subtree{root: n}, true, nil
+		}
+		n, err = t.adopt(n, i, s)
+		if err == nil && s.right == nil && s.root.size() < MIN_FILL {
+			err = t.rebalance(n, i)
+		}
+		if err != nil {
+			return subtree{}, false, err
+		}
+		s, err = t.splitIfFull(n)
+		return s, true, err
+	default:
+		return subtree{}, false, errCorruptPage(n.id, "tree links to a free page")
+	}
+}
+
+// rebalance merges the ith child of n, which must be writable, with a sibling, or moves entries
+// between them if they don't fit in one page
+func (t *tree) rebalance(n *node, i int) error {
+	l := i - 1
+	if i == 0 {
+		l = 0
+	}
+	left, err := t.child(n, l)
+	if err == nil {
+		left, err = t.pages.writable(left)
+	}
+	if err != nil {
+		return err
+	}
+	n.children[l] = left.id
+	right, err := t.child(n, l+1)
+	if err != nil {
+		return err
+	}
+
+	combined := combine(left, n.keys[l], right)
+	if combined.size() <= PAGE_SIZE {
+		left.keys, left.values, left.children = combined.keys, combined.values, combined.children
+		if left.kind == leafPage && t.linked {
+			left.next = right.next
+		}
+		n.keys = append(n.keys[:l], n.keys[l+1:]...)
+		n.children = append(n.children[:l+1], n.children[l+2:]...)
+		t.pages.free(right)
+		return nil
+	}
+
+	right, err = t.pages.writable(right)
+	if err != nil {
+		return err
+	}
+	n.children[l+1] = right.id
+	var halfLeft, halfRight *node
+	halfLeft, n.keys[l], halfRight = halves(combined)
+	left.keys, left.values, left.children = halfLeft.keys, halfLeft.values, halfLeft.children
+	right.keys, right.values, right.children = halfRight.keys, halfRight.values, halfRight.children
+	return nil
+}
+
+// combine returns a node holding the entries of left and then right, which are siblings
+// separated by sep in their parent
+func combine(left *node, sep string, right *node) *node {
+	c := &node{kind: left.kind}
+	c.keys = make([]string, 0, len(left.keys)+len(right.keys)+1)
+	c.keys = append(c.keys, left.keys...)
+	if left.kind == internalPage {
+		// the separator moves down between the children of left and right
+		c.keys = append(c.keys, sep)
+		c.children = make([]pageID, 0, len(left.children)+len(right.children))
+		c.children = append(append(c.children, left.children...), right.children...)
+	} else {
+		c.values = make([]string, 0, len(left.values)+len(right.values))
+		c.values = append(append(c.values, left.values...), right.values...)
+	}
+	c.keys = append(c.keys, right.keys...)
+	return c
+}
+
+// halves divides the entries of n between two new nodes of about the same size, returning them
+// and the key that separates them. For internal nodes, that key moves up to the parent, so it is
+// in neither half.
+func halves(n *node) (*node, string, *node) {
+	total := 0
+	for i := range n.keys {
+		total += n.cellSize(i)
+	}
+	m, size := 0, 0
+	for m < len(n.keys) && size < total/2 {
+		size += n.cellSize(m)
+		m++
+	}
+
+	left, right := &node{kind: n.kind}, &node{kind: n.kind}
+	if n.kind == leafPage {
+		m = clamp(m, 1, len(n.keys)-1)
+		left.keys = append([]string(nil), n.keys[:m]...)
+		left.values = append([]string(nil), n.values[:m]...)
+		right.keys = append([]string(nil), n.keys[m:]...)
+		right.values = append([]string(nil), n.values[m:]...)
+		return left, n.keys[m], right
+	}
+	m = clamp(m, 1, len(n.keys)-2)
+	left.keys = append([]string(nil), n.keys[:m]...)
+	left.children = append([]pageID(nil), n.children[:m+1]...)
+	right.keys = append([]string(nil), n.keys[m+1:]...)
+	right.children = append([]pageID(nil), n.children[m+1:]...)
+	return left, n.keys[m], right
+}
+
+func clamp(x int, lower int, upper int) int {
+	if x < lower {
+		return lower
+	}
+	if x > upper {
+		return upper
+	}
+	return x
+}
+
+func insertString(s []string, i int, x string) []string {
+	s = append(s, "")
+	copy(s[i+1:], s[i:])
+	s[i] = x
+	return s
+}
+
+func insertPageID(s []pageID, i int, x pageID) []pageID {
+	s = append(s, 0)
+	copy(s[i+1:], s[i:])
+	s[i] = x
+	return s
+}
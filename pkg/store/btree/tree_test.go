@@ -0,0 +1,219 @@
+package btree
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func newTestTree(t *testing.T) *BTreeKvStorage {
+	s, err := NewBTreeKvStorage(afero.NewMemMapFs(), WithBufferPoolSize(MIN_BUFFER_POOL_SIZE))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	return s
+}
+
+// checkTree fails the test unless every node is ordered, fits in a page and is at the same depth,
+// the leaves link to each other in order if they are linked, and every page is either in the tree
+// or the in-place pager's free list
+func checkTree(t *testing.T, tr *tree) map[pageID]bool {
+	t.Helper()
+	p := tr.pages
+	seen := make(map[pageID]bool)
+	var leaves []pageID
+	depth := -1
+
+	var walk func(id pageID, lower string, upper string, level int)
+	walk = func(id pageID, lower string, upper string, level int) {
+		n, err := p.get(id)
+		if err != nil {
+			t.Fatalf("Failed to read page %d: %v", id, err)
+		}
+		if seen[id] {
+			t.Fatalf("Page %d is linked from more than one node", id)
+		}
+		seen[id] = true
+		if n.size() > PAGE_SIZE {
+			t.Fatalf("Page %d is %d bytes", id, n.size())
+		}
+		for i, key := range n.keys {
+			if (i > 0 && key <= n.keys[i-1]) || key < lower || (upper != "" && key >= upper) {
+				t.Fatalf("Key '%s' of page %d is out of order", key, id)
+			}
+		}
+		if n.kind == leafPage {
+			if depth == -1 {
+				depth = level
+			} else if depth != level {
+				t.Fatalf("Leaf %d is at depth %d, others at %d", id, level, depth)
+			}
+			leaves = append(leaves, id)
+			return
+		}
+		if len(n.keys) == 0 {
+			t.Fatalf("Internal node %d has no keys", id)
+		}
+		for i, child := range n.children {
+			childLower, childUpper := lower, upper
+			if i > 0 {
+				childLower = n.keys[i-1]
+			}
+			if i < len(n.keys) {
+				childUpper = n.keys[i]
+			}
+			walk(child, childLower, childUpper, level+1)
+		}
+	}
+	walk(tr.meta.root, "", "", 0)
+
+	for i, id := range leaves {
+		n, _ := p.get(id)
+		if !tr.linked && n.next != 0 {
+			t.Fatalf("Leaf %d links to %d, expected no links", id, n.next)
+		} else if tr.linked && (i < len(leaves)-1 && n.next != leaves[i+1] || i == len(leaves)-1 && n.next != 0) {
+			t.Fatalf("Leaf %d links to %d, expected the next leaf", id, n.next)
+		}
+	}
+	in, ok := p.(*pager)
+	if !ok {
+		return seen
+	}
+	for id := in.meta.freeHead; id != 0; {
+		if seen[id] {
+			t.Fatalf("Page %d is both free and in use", id)
+		}
+		seen[id] = true
+		n, err := in.get(id)
+		if err != nil {
+			t.Fatalf("Failed to read free page %d: %v", id, err)
+		}
+		id = n.next
+	}
+	if len(seen) != int(in.meta.pages)-1 {
+		t.Fatalf("Expected %d pages in use or free, got %d", in.meta.pages-1, len(seen))
+	}
+	return seen
+}
+
+func Test_tree_MatchesMapThroughRandomWrites(t *testing.T) {
+	s := newTestTree(t)
+	defer s.Close()
+	rng := rand.New(rand.NewSource(1))
+	expected := make(map[string]string)
+
+	for i := 0; i < 5000; i++ {
+		key := "key" + strconv.Itoa(rng.Intn(1000))
+		if rng.Intn(3) == 0 {
+			s.Delete(key)
+			delete(expected, key)
+		} else {
+			value := strings.Repeat("v", rng.Intn(200))
+			s.Set(key, value)
+			expected[key] = value
+		}
+		if i%500 == 0 {
+			checkTree(t, s.tree)
+		}
+	}
+	checkTree(t, s.tree)
+
+	if s.Len() != uint64(len(expected)) {
+		t.Fatalf("Expected %d keys, got %d", len(expected), s.Len())
+	}
+	for key, value := range expected {
+		if result, exists, err := s.Get(key); err != nil || !exists || result != value {
+			t.Fatalf("Expected '%s' to be '%s', got '%s', %v, %v", key, value, result, exists, err)
+		}
+	}
+}
+
+func Test_tree_SplitsAndMergesNodes(t *testing.T) {
+	s := newTestTree(t)
+	defer s.Close()
+	value := strings.Repeat("v", 100)
+
+	for i := 0; i < 2000; i++ {
+		s.Set("key"+strconv.Itoa(i), value)
+	}
+	checkTree(t, s.tree)
+	root, _ := s.pager.get(s.pager.meta.root)
+	if root.kind != internalPage {
+		t.Fatal("Expected the root to have split")
+	}
+	grown := s.pager.meta.pages
+
+	for i := 0; i < 2000; i++ {
+		s.Delete("key" + strconv.Itoa(i))
+	}
+	checkTree(t, s.tree)
+	root, _ = s.pager.get(s.pager.meta.root)
+	if root.kind != leafPage || len(root.keys) != 0 {
+		t.Fatalf("Expected the tree to shrink back to an empty leaf, got %d keys", len(root.keys))
+	}
+
+	// pages freed by the merges are reused before the file grows
+	for i := 0; i < 2000; i++ {
+		s.Set("key"+strconv.Itoa(i), value)
+	}
+	checkTree(t, s.tree)
+	if s.pager.meta.pages != grown {
+		t.Fatalf("Expected the file to stay at %d pages, got %d", grown, s.pager.meta.pages)
+	}
+}
+
+func Test_tree_HandlesLargeEntries(t *testing.T) {
+	s := newTestTree(t)
+	defer s.Close()
+
+	for i := 0; i < 200; i++ {
+		key := strings.Repeat(strconv.Itoa(i%10), 300) + strconv.Itoa(i)
+		err := s.Set(key, strings.Repeat("v", MAX_ENTRY_SIZE-len(key)))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	checkTree(t, s.tree)
+	for i := 0; i < 200; i += 2 {
+		s.Delete(strings.Repeat(strconv.Itoa(i%10), 300) + strconv.Itoa(i))
+	}
+	checkTree(t, s.tree)
+}
+
+func Test_BTreeKvStorage_Scan_FollowsLeavesInOrder(t *testing.T) {
+	s := newTestTree(t)
+	defer s.Close()
+	var keys []string
+	for i := 0; i < 1000; i++ {
+		key := "key" + strconv.Itoa(i)
+		keys = append(keys, key)
+		s.Set(key, strings.Repeat("v", 50))
+	}
+	sort.Strings(keys)
+
+	var scanned []string
+	err := s.Scan("key2", "key5", func(key string, value string) bool {
+		scanned = append(scanned, key)
+		return true
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	start, end := sort.SearchStrings(keys, "key2"), sort.SearchStrings(keys, "key5")
+	if strings.Join(scanned, ",") != strings.Join(keys[start:end], ",") {
+		t.Fatalf("Expected %d keys from 'key2' to 'key5', got %d", end-start, len(scanned))
+	}
+
+	scanned = nil
+	s.Scan("", "", func(key string, value string) bool {
+		scanned = append(scanned, key)
+		return len(scanned) < 10
+	})
+	if len(scanned) != 10 || scanned[0] != keys[0] {
+		t.Fatalf("Expected the scan to stop after the first 10 keys, got %v", scanned)
+	}
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+// recoverDataFile reads every record in the data file from startOffset onwards, calling
+// onRecord for each. A record torn by a crash part of the way through a write can only be the
+// last one in the file, so it is truncated away if it provably is: either its header is intact
+// and the file ends before the record does, or nothing follows it. A damaged length can't pass
+// for a torn record, as the header has its own checksum. Corruption anywhere else is returned
+// as a *record.ErrCorrupt, and the file is left as it is. The offset of the end of the last
+// valid record is returned.
+func recoverDataFile(filename string, startOffset int64, onRecord func(r record.Record, offset int64)) (int64, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR, 0644)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, fmt.Errorf("couldn't open data file: %v", err)
+	}
+	defer f.Close()
+
+	_, err = f.Seek(startOffset, io.SeekStart)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't seek to offset %d in data file: %v", startOffset, err)
+	}
+
+	reader := record.NewReader(f, startOffset)
+	for {
+		offset := reader.Offset()
+		r, err := reader.Next()
+		var corrupt *record.ErrCorrupt
+		if err == io.EOF {
+			return offset, nil
+		} else if errors.Is(err, io.ErrUnexpectedEOF) || (errors.As(err, &corrupt) && reader.AtEOF()) {
+			err = f.Truncate(offset)
+			if err != nil {
+				return 0, fmt.Errorf("couldn't truncate torn record at offset %d: %v", offset, err)
+			}
+			return offset, nil
+		} else if err != nil {
+			return 0, fmt.Errorf("couldn't read data file: %w", err)
+		}
+
+		if onRecord != nil {
+			onRecord(r, offset)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+func Test_recoverDataFile_TruncatesTornTail(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_TornTail")
+	defer os.Remove(filename)
+
+	whole := record.Record{Key: "a", Value: "1"}.Encode()
+	torn := record.Record{Key: "b", Value: "2"}.Encode()
+	os.WriteFile(filename, append(whole, torn[:len(torn)-1]...), 0644)
+
+	var keys []string
+	endOffset, err := recoverDataFile(filename, 0, func(r record.Record, offset int64) {
+		keys = append(keys, r.Key)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error recovering file with torn tail: %v", err)
+	}
+	if len(keys) != 1 || keys[0] != "a" {
+		t.Fatalf("Expected only the whole record to be read, got %v", keys)
+	}
+	if info, _ := os.Stat(filename); endOffset != int64(len(whole)) || info.Size() != endOffset {
+		t.Fatalf("Expected file to be truncated to %d bytes, got end offset %d", len(whole), endOffset)
+	}
+}
+
+func Test_recoverDataFile_ReturnsErrCorruptMidFile(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_MidFileCorruption")
+	defer os.Remove(filename)
+
+	first := record.Record{Key: "a", Value: "1"}.Encode()
+	damaged := record.Record{Key: "b", Value: "2"}.Encode()
+	damaged[len(damaged)-1] ^= 0xff
+	last := record.Record{Key: "c", Value: "3"}.Encode()
+	os.WriteFile(filename, append(append(first, damaged...), last...), 0644)
+
+	_, err := NewHashIndexedFsAppendOnlyStorage(filename)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected *record.ErrCorrupt, got %v", err)
+	}
+	if corrupt.Offset != int64(len(first)) {
+		t.Fatalf("Expected corruption at offset %d, got %d", len(first), corrupt.Offset)
+	}
+}
+
+func Test_recoverDataFile_ReturnsErrCorruptForDamagedLength(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_DamagedLength")
+	defer os.Remove(filename)
+
+	var contents []byte
+	for _, key := range []string{"a", "b", "c", "d"} {
+		contents = append(contents, record.Record{Key: key, Value: "value"}.Encode()...)
+	}
+	contents[11] ^= 0x40 // the first record's value now appears to run past the end of the file
+	os.WriteFile(filename, contents, 0644)
+
+	_, err := NewHashIndexedFsAppendOnlyStorage(filename)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) || corrupt.Offset != 0 {
+		t.Fatalf("Expected *record.ErrCorrupt at offset 0, got %v", err)
+	}
+	if info, _ := os.Stat(filename); info.Size() != int64(len(contents)) {
+		t.Fatalf("Expected the corrupt file to be left alone, but it is now %d bytes", info.Size())
+	}
+}
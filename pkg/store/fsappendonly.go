@@ -1,26 +1,50 @@
 package store
 
 import (
-	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"os"
-	"strings"
+	"sync"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/record"
 )
 
 type FsAppendOnlyStorage struct {
 	filename string
+	syncer   *durability.Syncer
+
+	mu        sync.RWMutex // held for writing while appending to file
+	file      *os.File     // held open for appending
+	endOffset int64        // the end of the last complete record
 }
 
-func NewFsAppendOnlyStorage(filename string) (*FsAppendOnlyStorage, error) {
-	// Ensure data file exists and is openable
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+func NewFsAppendOnlyStorage(filename string, opts ...Option) (*FsAppendOnlyStorage, error) {
+	o := buildOptions(opts)
+
+	err := upgradeLegacyDataFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure the file only contains whole, valid records before appending to it
+	endOffset, err := recoverDataFile(filename, 0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't recover data file: %w", err)
+	}
+
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't open data file: %v", err)
 	}
-	f.Close()
-	return &FsAppendOnlyStorage{filename: filename}, nil
+	return &FsAppendOnlyStorage{
+		filename:  filename,
+		syncer:    durability.NewSyncer(f, o.durability),
+		file:      f,
+		endOffset: endOffset,
+	}, nil
 }
 
 func (s *FsAppendOnlyStorage) Get(key string) (string, bool, error) {
@@ -32,35 +56,57 @@ func (s *FsAppendOnlyStorage) Get(key string) (string, bool, error) {
 		return "", false, fmt.Errorf("couldn't open data file: %v", err)
 	}
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
+
+	// Only read up to the end of the last complete record, as a write may be in progress
+	s.mu.RLock()
+	endOffset := s.endOffset
+	s.mu.RUnlock()
+	reader := record.NewReader(io.LimitReader(f, endOffset), 0)
 
 	value := ""
 	exists := false
-	var line string
-	for scanner.Scan() {
-		line = string(scanner.Bytes()) // go strings are utf8
-		if strings.HasPrefix(line, key+", ") {
-			value = strings.SplitN(line, ", ", 2)[1]
+	for {
+		r, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", false, fmt.Errorf("couldn't scan data file: %w", err)
+		}
+		if r.Key == key {
+			value = r.Value
 			exists = true
 		}
 	}
-	if scanner.Err() != nil {
-		return "", false, fmt.Errorf("couldn't scan data file: %v", scanner.Err())
-	}
 	return value, exists, nil
 }
 
 func (s *FsAppendOnlyStorage) Set(key string, value string) error {
-	f, err := os.OpenFile(s.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	nBytes, err := s.file.Write(record.Record{Key: key, Value: value}.Encode())
 	if err != nil {
-		return fmt.Errorf("couldn't open data file: %v", err)
+		// don't leave a partial record behind for the next write to be appended after
+		s.file.Truncate(s.endOffset)
+		return fmt.Errorf("couldn't append to data file: %v", err)
 	}
-	defer f.Close()
+	s.endOffset += int64(nBytes)
 
-	_, err = f.WriteString(key + ", " + value + "\n") // go strings are utf8
+	err = s.syncer.Written()
 	if err != nil {
-		return fmt.Errorf("couldn't append to data file: %v", err)
+		return fmt.Errorf("couldn't sync data file: %v", err)
 	}
 
 	return nil
 }
+
+func (s *FsAppendOnlyStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.syncer.Close()
+	if err != nil {
+		s.file.Close()
+		return fmt.Errorf("couldn't sync data file: %v", err)
+	}
+	return s.file.Close()
+}
@@ -1,118 +1,180 @@
 package store
 
 import (
-	"bufio"
-	"errors"
 	"fmt"
-	"io"
-	"io/fs"
 	"os"
-	"strings"
+	"sync"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/record"
 )
 
 type HashIndexedFsAppendOnlyStorage struct {
-	filename  string
-	index     map[string]int64
-	endOffset int64
+	filename string
+	syncer   *durability.Syncer
+	reader   *os.File // held open for reads, which use ReadAt so they don't share an offset
+
+	mu           sync.RWMutex // held for writing while appending to file or updating index
+	file         *os.File     // held open for appending
+	index        map[string]recordLocation
+	endOffset    int64
+	hintedOffset int64 // the length of the data file covered by the hint file
+	hintInterval int64
 }
 
-func newHashIndexFromFile(filename string) (map[string]int64, error) {
-	index := make(map[string]int64)
+// recordLocation describes where a record lives in the data file
+type recordLocation struct {
+	offset int64
+	size   int64
+}
 
-	f, err := os.Open(filename)
-	if errors.Is(err, fs.ErrNotExist) {
-		return index, nil
-	} else if err != nil {
-		return nil, fmt.Errorf("couldn't open data file: %v", err)
-	}
-	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	var offset int64 = 0
-	for scanner.Scan() {
-		key := strings.SplitN(scanner.Text(), ", ", 2)[0]
-		index[key] = offset
-		offset += int64(len(scanner.Bytes())) + 1 // add an extra byte for the newline
-	}
-	if scanner.Err() != nil {
-		return nil, fmt.Errorf("couldn't scan data file: %v", err)
+func NewHashIndexedFsAppendOnlyStorage(filename string, opts ...Option) (*HashIndexedFsAppendOnlyStorage, error) {
+	o := buildOptions(opts)
+
+	err := upgradeLegacyDataFile(filename)
+	if err != nil {
+		return nil, err
 	}
-	return index, nil
-}
 
-func NewHashIndexedFsAppendOnlyStorage(filename string) (*HashIndexedFsAppendOnlyStorage, error) {
 	// Ensure data file exists and is openable
-	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0644)
+	f, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, fmt.Errorf("couldn't open data file: %v", err)
 	}
 
-	// Get size of file to set the offset
 	info, err := f.Stat()
 	if err != nil {
+		f.Close()
 		return nil, fmt.Errorf("couldn't get stats for data file: %v", err)
 	}
-	f.Close()
 
-	index, err := newHashIndexFromFile(filename)
+	// Start from the hint file if there is a usable one, so that only the records appended
+	// after it was written need to be scanned
+	index, hintedOffset, ok := readHintFile(hintFilename(filename), info.Size())
+	if !ok {
+		index, hintedOffset = make(map[string]recordLocation), 0
+	}
+
+	endOffset, err := recoverDataFile(filename, hintedOffset, func(r record.Record, offset int64) {
+		index[r.Key] = recordLocation{offset: offset, size: r.Size()}
+	})
 	if err != nil {
-		return nil, fmt.Errorf("couldn't build index: %v", err)
+		f.Close()
+		return nil, fmt.Errorf("couldn't build index: %w", err)
 	}
 
-	return &HashIndexedFsAppendOnlyStorage{filename: filename, index: index, endOffset: info.Size()}, nil
+	reader, err := os.Open(filename)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("couldn't open data file for reading: %v", err)
+	}
+
+	return &HashIndexedFsAppendOnlyStorage{
+		filename:     filename,
+		file:         f,
+		reader:       reader,
+		syncer:       durability.NewSyncer(f, o.durability),
+		index:        index,
+		endOffset:    endOffset,
+		hintedOffset: hintedOffset,
+		hintInterval: o.hintInterval,
+	}, nil
 }
 
 func (s *HashIndexedFsAppendOnlyStorage) Get(key string) (string, bool, error) {
-	// Check index for key
-	offset, exists := s.index[key]
+	// Check index for key. Records are never modified once written, so there's no need to hold
+	// the lock while reading it from the file.
+	s.mu.RLock()
+	location, exists := s.index[key]
+	s.mu.RUnlock()
 	if !exists {
 		return "", false, nil
 	}
 
-	// Open the data file and seek to the relevant line offset
-	f, err := os.Open(s.filename)
-	if err != nil {
-		return "", false, fmt.Errorf("couldn't open data file: %v", err)
-	}
-	defer f.Close()
-	_, err = f.Seek(offset, io.SeekStart)
+	// Read the record at the relevant offset. ReadAt doesn't move the file's offset, so any
+	// number of reads can share the one handle.
+	b := make([]byte, location.size)
+	_, err := s.reader.ReadAt(b, location.offset)
 	if err != nil {
-		return "", false, fmt.Errorf("couldn't seek to offset %d in file: %v", offset, err)
+		return "", false, fmt.Errorf("couldn't read record at offset %d in file: %v", location.offset, err)
 	}
 
-	// Read the line from the file
-	r := bufio.NewReader(f)
-	line, _, err := r.ReadLine()
+	// Parse key and value from the record and quickly sanity check
+	r, err := record.Decode(b, location.offset)
 	if err != nil {
-		return "", false, fmt.Errorf("couldn't read line at offset %d in file: %v", offset, err)
+		return "", false, fmt.Errorf("couldn't decode record: %w", err)
 	}
-
-	// Parse key and value from the line and quickly sanity check
-	keyValuePair := strings.SplitN(string(line), ", ", 2)
-	readKey, value := keyValuePair[0], keyValuePair[1]
-	if readKey != key {
-		return "", false, fmt.Errorf("key at offset %d is '%s', expected '%s'", offset, readKey, key)
+	if r.Key != key {
+		return "", false, fmt.Errorf("key at offset %d is '%s', expected '%s'", location.offset, r.Key, key)
 	}
 
-	return value, exists, nil
+	return r.Value, exists, nil
 }
 
 func (s *HashIndexedFsAppendOnlyStorage) Set(key string, value string) error {
-	// TODO: keep a file pointer open and don't open and close each time?
-	f, err := os.OpenFile(s.filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
-	if err != nil {
-		return fmt.Errorf("couldn't open data file: %v", err)
-	}
-	defer f.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	recordStartOffset := s.endOffset
-	nBytes, err := f.WriteString(key + ", " + value + "\n") // go strings are utf8
-	s.endOffset += int64(nBytes)
+	nBytes, err := s.file.Write(record.Record{Key: key, Value: value}.Encode())
 	if err != nil {
+		// don't leave a partial record behind for the next write to be appended after
+		s.file.Truncate(recordStartOffset)
 		return fmt.Errorf("couldn't append to data file: %v", err)
 	}
+	s.endOffset += int64(nBytes)
+
+	err = s.syncer.Written()
+	if err != nil {
+		return fmt.Errorf("couldn't sync data file: %v", err)
+	}
 
 	// only save offset once record has already been written to avoid race conditions
-	s.index[key] = recordStartOffset
+	s.index[key] = recordLocation{offset: recordStartOffset, size: int64(nBytes)}
+
+	if s.endOffset-s.hintedOffset >= s.hintInterval {
+		err = s.writeHint()
+		if err != nil {
+			return fmt.Errorf("couldn't refresh hint file: %v", err)
+		}
+	}
 
 	return nil
 }
+
+// writeHint writes a hint file covering everything appended so far. The data file is synced
+// first, as a hint covering records that were then lost could be trusted once later writes
+// had taken their place. It must be called with mu held for writing.
+func (s *HashIndexedFsAppendOnlyStorage) writeHint() error {
+	// only try again after another interval if this fails
+	s.hintedOffset = s.endOffset
+	err := s.file.Sync()
+	if err != nil {
+		return fmt.Errorf("couldn't sync data file: %v", err)
+	}
+	return writeHintFile(hintFilename(s.filename), s.index, s.endOffset)
+}
+
+// Close writes a hint file describing the current contents of the data file, so that the
+// next call to NewHashIndexedFsAppendOnlyStorage doesn't need to scan the whole file.
+func (s *HashIndexedFsAppendOnlyStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reader.Close()
+	err := s.syncer.Close()
+	if err != nil {
+		s.file.Close()
+		return fmt.Errorf("couldn't sync data file: %v", err)
+	}
+	err = s.writeHint()
+	if err != nil {
+		s.file.Close()
+		return fmt.Errorf("couldn't write hint file: %v", err)
+	}
+	err = s.file.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't close data file: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+)
+
+func Test_HashIndexedFsAppendOnlyStorage_ReopensFromHintFile(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_HashIndexedHint")
+	defer os.Remove(filename)
+	defer os.Remove(hintFilename(filename))
+
+	store, err := NewHashIndexedFsAppendOnlyStorage(filename)
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Set("a", "3")
+	if err = store.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+
+	if _, err := os.Stat(hintFilename(filename)); err != nil {
+		t.Fatalf("Expected a hint file to be written on close: %v", err)
+	}
+
+	store, err = NewHashIndexedFsAppendOnlyStorage(filename)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	if value, exists, err := store.Get("a"); err != nil || !exists || value != "3" {
+		t.Fatalf("Expected 'a' to be '3' after reopening, got '%s', %v, %v", value, exists, err)
+	}
+	if value, exists, err := store.Get("b"); err != nil || !exists || value != "2" {
+		t.Fatalf("Expected 'b' to be '2' after reopening, got '%s', %v, %v", value, exists, err)
+	}
+}
+
+func Test_HashIndexedFsAppendOnlyStorage_ScansTailAfterHintFile(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_HashIndexedHintTail")
+	defer os.Remove(filename)
+	defer os.Remove(hintFilename(filename))
+
+	store, _ := NewHashIndexedFsAppendOnlyStorage(filename)
+	store.Set("a", "1")
+	store.Close()
+
+	// records written after the hint, e.g. by a process that crashed before closing
+	store, _ = NewHashIndexedFsAppendOnlyStorage(filename)
+	store.Set("a", "2")
+	store.Set("c", "3")
+
+	store, err := NewHashIndexedFsAppendOnlyStorage(filename)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	if value, _, err := store.Get("a"); err != nil || value != "2" {
+		t.Fatalf("Expected 'a' to be '2', got '%s', %v", value, err)
+	}
+	if value, _, err := store.Get("c"); err != nil || value != "3" {
+		t.Fatalf("Expected 'c' to be '3', got '%s', %v", value, err)
+	}
+}
+
+func Test_HashIndexedFsAppendOnlyStorage_RefreshesHintFileWhileWriting(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_HashIndexedHintCheckpoint")
+	defer os.Remove(filename)
+	defer os.Remove(hintFilename(filename))
+
+	store, err := NewHashIndexedFsAppendOnlyStorage(filename, WithHintInterval(1024))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%03d", i))
+	}
+	// no Close, as if the process had crashed
+
+	info, _ := os.Stat(filename)
+	_, coveredLength, ok := readHintFile(hintFilename(filename), info.Size())
+	if !ok || coveredLength == 0 {
+		t.Fatalf("Expected a hint file to have been written while writing, got %v covering %d bytes", ok, coveredLength)
+	}
+	if info.Size()-coveredLength >= 1024 {
+		t.Fatalf("Expected the hint to cover all but the last 1024 bytes of %d, but it covers %d", info.Size(), coveredLength)
+	}
+
+	store, err = NewHashIndexedFsAppendOnlyStorage(filename)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		key, expected := fmt.Sprintf("key%03d", i), fmt.Sprintf("value%03d", i)
+		if value, exists, err := store.Get(key); err != nil || !exists || value != expected {
+			t.Fatalf("Expected '%s' to be '%s' after reopening, got '%s', %v, %v", key, expected, value, exists, err)
+		}
+	}
+}
+
+func Test_HashIndexedFsAppendOnlyStorage_Get_ReadsConcurrentlyWithWrites(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_HashIndexedConcurrent")
+	defer os.Remove(filename)
+	defer os.Remove(hintFilename(filename))
+
+	store, err := NewHashIndexedFsAppendOnlyStorage(filename)
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%03d", i))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 9)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 100; i < 300; i++ {
+			if err := store.Set(fmt.Sprintf("key%03d", i), fmt.Sprintf("value%03d", i)); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				key := fmt.Sprintf("key%03d", (g*13+i)%100)
+				value, exists, err := store.Get(key)
+				if err != nil || !exists || value != "value"+key[3:] {
+					errs <- fmt.Errorf("got '%s' for '%s', %v, %v", value, key, exists, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Unexpected result: %v", err)
+	}
+}
+
+func Test_readHintFile_RejectsCorruptHint(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_CorruptHint")
+	defer os.Remove(filename)
+
+	index := map[string]recordLocation{"a": {offset: 0, size: 5}}
+	if err := writeHintFile(filename, index, 5); err != nil {
+		t.Fatalf("Failed to write hint file: %v", err)
+	}
+
+	if _, _, ok := readHintFile(filename, 5); !ok {
+		t.Fatal("Expected valid hint file to be accepted")
+	}
+	if _, _, ok := readHintFile(filename, 4); ok {
+		t.Fatal("Expected hint file covering more than the data file to be rejected")
+	}
+
+	contents, _ := os.ReadFile(filename)
+	contents[len(HINT_MAGIC)+9] ^= 0xff
+	os.WriteFile(filename, contents, 0644)
+	if _, _, ok := readHintFile(filename, 5); ok {
+		t.Fatal("Expected hint file with bad checksum to be rejected")
+	}
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// A hint file is a compact summary of a data file's index, written when the data file is
+// closed, and refreshed every HINT_INTERVAL_BYTES appended to it so that a crash doesn't lose
+// it. It lets the index be rebuilt on startup without reading every record. The layout is:
+//
+//	magic (8 bytes) | covered length (8 bytes) | entries... | crc32 of everything before (4 bytes)
+//
+// where each entry is a uvarint key length, the key, then uvarint offset and size of the record.
+// The covered length is the size of the data file when the hint was written; any records after
+// it must be scanned from the data file itself.
+
+const HINT_MAGIC = "KVHINT01"
+const HINT_INTERVAL_BYTES int64 = 64 << 20
+
+func hintFilename(dataFilename string) string {
+	return dataFilename + ".hint"
+}
+
+func writeHintFile(filename string, index map[string]recordLocation, coveredLength int64) error {
+	var buf bytes.Buffer
+	buf.WriteString(HINT_MAGIC)
+
+	scratch := make([]byte, binary.MaxVarintLen64)
+	binary.BigEndian.PutUint64(scratch, uint64(coveredLength))
+	buf.Write(scratch[:8])
+
+	for key, location := range index {
+		buf.Write(scratch[:binary.PutUvarint(scratch, uint64(len(key)))])
+		buf.WriteString(key)
+		buf.Write(scratch[:binary.PutUvarint(scratch, uint64(location.offset))])
+		buf.Write(scratch[:binary.PutUvarint(scratch, uint64(location.size))])
+	}
+
+	binary.BigEndian.PutUint32(scratch, crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(scratch[:4])
+
+	// Write to a temporary file first so a crash can never leave a half written hint in place
+	tmpFilename := filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open temporary hint file: %v", err)
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("couldn't write temporary hint file: %v", err)
+	}
+
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return fmt.Errorf("couldn't move hint file into place: %v", err)
+	}
+	return nil
+}
+
+// readHintFile loads the index stored in a hint file, returning false if there is no hint file
+// or it can't be trusted for a data file of the given size.
+func readHintFile(filename string, dataLength int64) (map[string]recordLocation, int64, bool) {
+	contents, err := os.ReadFile(filename)
+	if err != nil || len(contents) < len(HINT_MAGIC)+8+4 {
+		return nil, 0, false
+	}
+
+	body, checksum := contents[:len(contents)-4], contents[len(contents)-4:]
+	if string(body[:len(HINT_MAGIC)]) != HINT_MAGIC || crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(checksum) {
+		return nil, 0, false
+	}
+
+	coveredLength := int64(binary.BigEndian.Uint64(body[len(HINT_MAGIC):]))
+	if coveredLength > dataLength {
+		// the data file has been truncated or replaced since the hint was written
+		return nil, 0, false
+	}
+
+	index := make(map[string]recordLocation)
+	r := bytes.NewReader(body[len(HINT_MAGIC)+8:])
+	for {
+		keyLength, err := binary.ReadUvarint(r)
+		if err != nil {
+			break // reached the end of the entries
+		}
+		key := make([]byte, keyLength)
+		if _, err := io.ReadFull(r, key); err != nil {
+			return nil, 0, false
+		}
+		offset, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, 0, false
+		}
+		size, err := binary.ReadUvarint(r)
+		if err != nil || int64(offset+size) > coveredLength {
+			return nil, 0, false
+		}
+		index[string(key)] = recordLocation{offset: int64(offset), size: int64(size)}
+	}
+
+	return index, coveredLength, true
+}
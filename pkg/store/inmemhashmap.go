@@ -1,6 +1,9 @@
 package store
 
+import "sync"
+
 type InMemHashMapKVStorage struct {
+	mu      sync.RWMutex
 	hashmap map[string]string
 }
 
@@ -11,11 +14,19 @@ func NewInMemHashMapKVStorage() (*InMemHashMapKVStorage, error) {
 }
 
 func (s *InMemHashMapKVStorage) Get(key string) (string, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	value, exists := s.hashmap[key]
 	return value, exists, nil
 }
 
 func (s *InMemHashMapKVStorage) Set(key string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.hashmap[key] = value
 	return nil
 }
+
+func (s *InMemHashMapKVStorage) Close() error {
+	return nil
+}
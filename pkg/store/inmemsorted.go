@@ -1,14 +1,16 @@
 package store
 
-import "github.com/haydenjeune/kvstore/pkg/bst"
+import "github.com/haydenjeune/kvstore/pkg/memtable"
 
+// InMemSortedKVStorage relies on the memtable to synchronise concurrent access
 type InMemSortedKVStorage struct {
-	memtable *bst.BinarySearchTree
+	memtable memtable.Memtable
 }
 
-func NewInMemSortedKVStorage() (*InMemSortedKVStorage, error) {
+func NewInMemSortedKVStorage(opts ...Option) (*InMemSortedKVStorage, error) {
+	o := buildOptions(opts)
 	return &InMemSortedKVStorage{
-		memtable: &bst.BinarySearchTree{},
+		memtable: memtable.New(o.memtableKind),
 	}, nil
 }
 
@@ -21,3 +23,13 @@ func (s *InMemSortedKVStorage) Set(key string, value string) error {
 	s.memtable.Insert(key, value)
 	return nil
 }
+
+// Delete removes key from the store, and does nothing if it isn't there
+func (s *InMemSortedKVStorage) Delete(key string) error {
+	s.memtable.Delete(key)
+	return nil
+}
+
+func (s *InMemSortedKVStorage) Close() error {
+	return nil
+}
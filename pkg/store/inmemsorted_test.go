@@ -0,0 +1,28 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+)
+
+func Test_InMemSortedKVStorage_Delete_RemovesKey(t *testing.T) {
+	for _, kind := range []memtable.Kind{memtable.AVLTree, memtable.UnbalancedTree, memtable.SkipList} {
+		store, _ := NewInMemSortedKVStorage(WithMemtable(kind))
+		store.Set("key", "value")
+		store.Set("other", "value")
+
+		if err := store.Delete("key"); err != nil {
+			t.Fatalf("Unexpected error deleting: %v", err)
+		}
+		if err := store.Delete("missing"); err != nil {
+			t.Fatalf("Unexpected error deleting a missing key: %v", err)
+		}
+		if _, exists, _ := store.Get("key"); exists {
+			t.Fatalf("Expected 'key' to be deleted from memtable kind %d", kind)
+		}
+		if result, _, _ := store.Get("other"); result != "value" {
+			t.Fatalf("Expected 'other' to be kept, got '%s'", result)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+// Data files used to be plain text, with a "key, value" line for each write. A data file in the
+// old format is rewritten as records when it is opened, before anything else reads it.
+
+const LEGACY_SEPARATOR = ", "
+
+// upgradeLegacyDataFile rewrites the data file as records if it is in the old text format,
+// replacing the original only once every record has been written and synced
+func upgradeLegacyDataFile(filename string) error {
+	legacy, err := isLegacyDataFile(filename)
+	if err != nil || !legacy {
+		return err
+	}
+
+	in, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("couldn't open data file: %v", err)
+	}
+	defer in.Close()
+
+	tmpFilename := filename + ".tmp"
+	out, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("couldn't open temporary data file: %v", err)
+	}
+	w := bufio.NewWriter(out)
+	err = scanLegacyLines(in, func(key string, value string) error {
+		_, err := w.Write(record.Record{Key: key, Value: value}.Encode())
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	out.Close()
+	if err != nil {
+		os.Remove(tmpFilename)
+		return fmt.Errorf("couldn't rewrite legacy data file: %v", err)
+	}
+
+	err = os.Rename(tmpFilename, filename)
+	if err != nil {
+		return fmt.Errorf("couldn't move upgraded data file into place: %v", err)
+	}
+	// any hint describes offsets in the old file
+	err = os.Remove(hintFilename(filename))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("couldn't remove stale hint file: %v", err)
+	}
+	return nil
+}
+
+// isLegacyDataFile reports whether a data file is in the old text format: it doesn't start
+// with a valid record, and every line of it is valid text holding a key and value
+func isLegacyDataFile(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("couldn't open data file: %v", err)
+	}
+	defer f.Close()
+
+	_, err = record.NewReader(f, 0).Next()
+	if err == nil || err == io.EOF {
+		return false, nil
+	}
+
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return false, fmt.Errorf("couldn't seek to start of data file: %v", err)
+	}
+	err = scanLegacyLines(f, func(key string, value string) error { return nil })
+	return err == nil, nil
+}
+
+// scanLegacyLines calls fn with the key and value of each line of a legacy data file, returning
+// an error if any line isn't one. The last line may be missing its newline, if the process
+// exited part of the way through writing it.
+func scanLegacyLines(r io.Reader, fn func(key string, value string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		line := scanner.Text()
+		keyValuePair := strings.SplitN(line, LEGACY_SEPARATOR, 2)
+		if len(keyValuePair) != 2 || !utf8.ValidString(line) {
+			return fmt.Errorf("line '%.20s' isn't a key and value", line)
+		}
+		err := fn(keyValuePair[0], keyValuePair[1])
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,55 @@
+package store
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_FileBackedStorage_UpgradesLegacyTextDataFile(t *testing.T) {
+	constructors := map[string]func(filename string) (KvStore, error){
+		"FsAppendOnlyStorage": func(filename string) (KvStore, error) {
+			return NewFsAppendOnlyStorage(filename)
+		},
+		"HashIndexedFsAppendOnlyStorage": func(filename string) (KvStore, error) {
+			return NewHashIndexedFsAppendOnlyStorage(filename)
+		},
+	}
+	for name, open := range constructors {
+		filename := makeTestFilePath("kvstore_test_Legacy" + name)
+		defer os.Remove(filename)
+		os.WriteFile(filename, []byte("foo, bar\nbaz, a value, with a comma\nfoo, updated\n"), 0644)
+
+		store, err := open(filename)
+		if err != nil {
+			t.Fatalf("%s: failed to open legacy data file: %v", name, err)
+		}
+		for key, expected := range map[string]string{"foo": "updated", "baz": "a value, with a comma"} {
+			if value, exists, err := store.Get(key); err != nil || !exists || value != expected {
+				t.Fatalf("%s: expected '%s' to be '%s', got '%s', %v, %v", name, key, expected, value, exists, err)
+			}
+		}
+		store.Set("new", "value")
+		store.Close()
+
+		// the upgraded file should reopen as records
+		store, err = open(filename)
+		if err != nil {
+			t.Fatalf("%s: failed to reopen upgraded data file: %v", name, err)
+		}
+		if value, _, _ := store.Get("new"); value != "value" {
+			t.Fatalf("%s: expected 'new' to be 'value' after reopening, got '%s'", name, value)
+		}
+		store.Close()
+		os.Remove(hintFilename(filename))
+	}
+}
+
+func Test_isLegacyDataFile_RejectsDamagedRecords(t *testing.T) {
+	filename := makeTestFilePath("kvstore_test_NotLegacy")
+	defer os.Remove(filename)
+	os.WriteFile(filename, []byte{0x01, 0x02, '\n', 0xff}, 0644)
+
+	if legacy, err := isLegacyDataFile(filename); legacy || err != nil {
+		t.Fatalf("Expected a damaged data file not to be taken for text, got %v, %v", legacy, err)
+	}
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+)
+
+// Option configures one of the storage engines. Options that don't apply to an engine are ignored.
+type Option func(*options)
+
+type options struct {
+	durability   durability.Policy
+	memtableKind memtable.Kind
+	hintInterval int64
+}
+
+func defaultOptions() options {
+	return options{durability: durability.Never(), memtableKind: memtable.AVLTree, hintInterval: HINT_INTERVAL_BYTES}
+}
+
+func buildOptions(opts []Option) options {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithDurability sets how often the file backed engines fsync writes to disk. By default this is
+// left to the operating system.
+func WithDurability(p durability.Policy) Option {
+	return func(o *options) {
+		o.durability = p
+	}
+}
+
+// WithHintInterval sets how many bytes HashIndexedFsAppendOnlyStorage appends to its data file
+// between refreshing its hint file. By default this is HINT_INTERVAL_BYTES (64MiB).
+func WithHintInterval(bytes int64) Option {
+	return func(o *options) {
+		o.hintInterval = bytes
+	}
+}
+
+// WithMemtable sets which kind of memtable InMemSortedKVStorage keeps its keys in. By default this
+// is memtable.AVLTree, which stays balanced however keys are inserted. memtable.SkipList lets
+// Sets run in parallel, and never makes a Get wait for one.
+func WithMemtable(kind memtable.Kind) Option {
+	return func(o *options) {
+		o.memtableKind = kind
+	}
+}
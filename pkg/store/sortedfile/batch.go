@@ -0,0 +1,255 @@
+package sortedfile
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+// Writers queue up to take their turn at the write-ahead log. The writer at the front of the
+// queue commits its own batch along with those of any writers behind it, logging them with one
+// append and one sync, and then wakes them all. Only the writer at the front rotates memtables
+// and logs, so it can apply the batches to the memtables without the store's mu, which is only
+// held while the batches are checked and while a full memtable is swapped for a new one. Reads
+// don't wait for the log to be synced, or for the memtables to be written.
+
+// MAX_WRITE_GROUP_SIZE is the number of bytes of batches beyond which a writer stops taking on
+// the batches of the writers behind it, so that a small write isn't held up by a large group
+const MAX_WRITE_GROUP_SIZE = 1 << 20
+
+// writer is a Write waiting in the store's queue
+type writer struct {
+	batch *WriteBatch // nil for a caller that only needs writes held off, such as Flush
+	err   error
+	done  bool // set once the batch has been committed by the writer in front of it
+}
+
+// WriteBatch collects writes to any of a store's column families, to be applied together by
+// Write. Either every write in the batch survives a crash, or none of them do.
+type WriteBatch struct {
+	writes []batchWrite
+}
+
+type batchWrite struct {
+	family *ColumnFamily
+	record record.Record
+}
+
+// Set adds a write of value to key in family to the batch
+func (b *WriteBatch) Set(family *ColumnFamily, key string, value string) {
+	b.add(family, record.Record{Key: key, Value: value})
+}
+
+// Delete adds the removal of key from family to the batch
+func (b *WriteBatch) Delete(family *ColumnFamily, key string) {
+	b.add(family, record.Record{Key: key, Deleted: true})
+}
+
+func (b *WriteBatch) add(family *ColumnFamily, r record.Record) {
+	b.writes = append(b.writes, batchWrite{family: family, record: r})
+}
+
+// Len returns the number of writes in the batch
+func (b *WriteBatch) Len() int {
+	return len(b.writes)
+}
+
+// encode returns the record holding the batch in the write-ahead log
+func (b *WriteBatch) encode() record.Record {
+	var encoded []byte
+	for _, w := range b.writes {
+		encoded = appendUvarint(encoded, w.family.id)
+		encoded = appendField(encoded, []byte(w.record.Key))
+		encoded = appendField(encoded, []byte(encodeEntry(w.record)))
+	}
+	return record.Record{Key: WAL_BATCH_KEY, Value: string(encoded)}
+}
+
+// decodeBatch calls fn for each write in a batch read from the write-ahead log
+func decodeBatch(r record.Record, fn func(family int64, r record.Record)) error {
+	if r.Key != WAL_BATCH_KEY {
+		return errors.New("log record isn't a batch")
+	}
+	reader := fieldReader{b: []byte(r.Value)}
+	for !reader.done() {
+		family := reader.uvarint()
+		key := reader.field()
+		entry := reader.field()
+		if reader.bad || len(entry) == 0 {
+			return errors.New("batch is malformed")
+		}
+		fn(family, decodeEntry(string(key), string(entry)))
+	}
+	return nil
+}
+
+// Write applies every write in the batch, which is logged as a single record so that a crash
+// can't leave only some of them in the store
+func (s *SortedFileKvStorage) Write(b *WriteBatch) error {
+	if len(b.writes) == 0 {
+		return nil
+	}
+	for _, w := range b.writes {
+		if w.family.store != s {
+			return fmt.Errorf("failed to write batch: column family '%s' belongs to another store", w.family.name)
+		}
+	}
+
+	w := &writer{batch: b}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	if !s.awaitTurn(w) {
+		return w.err
+	}
+	group := s.writeGroup()
+	s.writeMu.Unlock()
+	s.commitGroup(group)
+	s.writeMu.Lock()
+	s.finishTurn(group)
+	return w.err
+}
+
+// commitGroup logs the batches of a group of writers with a single append to the write-ahead
+// log, and so a single sync, then applies them to the memtables, setting the error of each
+// writer. The store's mu is only held to check the batches, and to swap in new memtables once
+// they are full, so that reads aren't held up while the log is being synced.
+func (s *SortedFileKvStorage) commitGroup(group []*writer) {
+	s.mu.Lock()
+	var err error
+	if s.closed {
+		err = fmt.Errorf("failed to write batch: %w", ErrClosed)
+	} else if s.backgroundErr != nil {
+		err = s.backgroundErr
+	}
+	if err != nil {
+		s.mu.Unlock()
+		failWriters(group, err)
+		return
+	}
+
+	records := make([]record.Record, 0, len(group))
+	logged := make([]*writer, 0, len(group))
+	for _, w := range group {
+		if w.err = w.batch.check(); w.err == nil {
+			records = append(records, w.batch.encode())
+			logged = append(logged, w)
+			for _, bw := range w.batch.writes {
+				if bw.family.memtable.Size() == 0 {
+					bw.family.memtableLog = s.wal.number
+				}
+			}
+		}
+	}
+	// only the writer at the front of the queue rotates the log, so it stays the same until the
+	// batches have been applied
+	wal := s.wal
+	s.mu.Unlock()
+	if len(logged) == 0 {
+		return
+	}
+
+	err = wal.Append(records...)
+	if err != nil {
+		failWriters(logged, fmt.Errorf("failed to log write: %v", err))
+		return
+	}
+
+	// The memtables are safe for concurrent use, so the batches are applied without mu, letting
+	// reads carry on. Only swapping in a new memtable once one is full needs it.
+	full := false
+	for _, w := range logged {
+		for _, bw := range w.batch.writes {
+			bw.family.insert(bw.record)
+			full = full || int64(bw.family.memtable.Bytes()) >= bw.family.opts.memtableSize
+		}
+	}
+	if !full {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, w := range logged {
+		for _, bw := range w.batch.writes {
+			err = s.makeRoomForWrite(bw.family, false)
+			if err != nil {
+				failWriters(logged, fmt.Errorf("failed to start new memtable: %v", err))
+				return
+			}
+		}
+	}
+}
+
+// check returns an error if any of the batch's families has been dropped. It must be called with
+// the store's mu held.
+func (b *WriteBatch) check() error {
+	for _, w := range b.writes {
+		if w.family.dropped {
+			return fmt.Errorf("failed to write batch: %w", w.family.errDropped())
+		}
+	}
+	return nil
+}
+
+// awaitTurn adds w to the queue and waits until it is at the front, returning false if it was
+// committed by a writer in front of it in the meantime. It must be called with writeMu held.
+func (s *SortedFileKvStorage) awaitTurn(w *writer) bool {
+	s.writers = append(s.writers, w)
+	for !w.done && s.writers[0] != w {
+		s.writerTurn.Wait()
+	}
+	return !w.done
+}
+
+// writeGroup returns the writers from the front of the queue whose batches can be committed
+// together. It must be called with writeMu held.
+func (s *SortedFileKvStorage) writeGroup() []*writer {
+	size := 0
+	n := 0
+	for _, w := range s.writers {
+		if w.batch == nil || (n > 0 && size+w.batch.size() > MAX_WRITE_GROUP_SIZE) {
+			break
+		}
+		size += w.batch.size()
+		n++
+	}
+	return s.writers[:n:n]
+}
+
+// finishTurn takes a group from the front of the queue, marking each of them done, and wakes
+// the writers left waiting. It must be called with writeMu held.
+func (s *SortedFileKvStorage) finishTurn(group []*writer) {
+	for _, w := range group {
+		w.done = true
+	}
+	s.writers = s.writers[len(group):]
+	s.writerTurn.Broadcast()
+}
+
+// whileWritesHeld calls fn once every write queued ahead of it has been committed, and keeps any
+// more from starting until it returns, so that fn can rotate memtables and logs or close them
+func (s *SortedFileKvStorage) whileWritesHeld(fn func()) {
+	w := &writer{}
+	s.writeMu.Lock()
+	s.awaitTurn(w)
+	s.writeMu.Unlock()
+	fn()
+	s.writeMu.Lock()
+	s.finishTurn([]*writer{w})
+	s.writeMu.Unlock()
+}
+
+// size returns the number of bytes of keys and values in the batch
+func (b *WriteBatch) size() int {
+	n := 0
+	for _, w := range b.writes {
+		n += len(w.record.Key) + len(w.record.Value)
+	}
+	return n
+}
+
+func failWriters(writers []*writer, err error) {
+	for _, w := range writers {
+		w.err = err
+	}
+}
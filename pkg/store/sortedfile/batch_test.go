@@ -0,0 +1,268 @@
+package sortedfile
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+	"github.com/spf13/afero"
+)
+
+// logSyncHookFs calls hook whenever a write-ahead log is synced, so tests can hold up syncs
+type logSyncHookFs struct {
+	afero.Fs
+	hook func()
+}
+
+func (fs *logSyncHookFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil || !strings.HasSuffix(name, WAL_SUFFIX) {
+		return f, err
+	}
+	return &logSyncHookFile{File: f, hook: fs.hook}, nil
+}
+
+type logSyncHookFile struct {
+	afero.File
+	hook func()
+}
+
+func (f *logSyncHookFile) Sync() error {
+	f.hook()
+	return f.File.Sync()
+}
+
+func Test_SortedFileKvStorage_Write_AppliesBatchAcrossFamilies(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	users, _ := storage.CreateColumnFamily("users")
+	storage.Set("stale", "1")
+
+	b := &WriteBatch{}
+	b.Set(storage.defaultFamily, "a", "1")
+	b.Set(users, "a", "2")
+	b.Delete(storage.defaultFamily, "stale")
+	err := storage.Write(b)
+	if err != nil {
+		t.Fatalf("Failed to write batch: %v", err)
+	}
+	// no Close, as if the process had crashed
+
+	storage, err = NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	users, _ = storage.ColumnFamily("users")
+	if result, _, _ := storage.Get("a"); result != "1" {
+		t.Fatalf("Expected 'a' to be '1' in the default family, got '%s'", result)
+	}
+	if result, _, _ := users.Get("a"); result != "2" {
+		t.Fatalf("Expected 'a' to be '2' in the users family, got '%s'", result)
+	}
+	if _, exists, _ := storage.Get("stale"); exists {
+		t.Fatal("Expected 'stale' to be deleted")
+	}
+}
+
+func Test_SortedFileKvStorage_Write_IgnoresTornBatch(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	users, _ := storage.CreateColumnFamily("users")
+	filename := storage.wal.filename
+
+	b := &WriteBatch{}
+	b.Set(storage.defaultFamily, "a", "1")
+	b.Set(users, "b", "2")
+	storage.Write(b)
+	// no Close, as if the process had crashed part way through appending the batch
+	contents, _ := afero.ReadFile(fs, filename)
+	afero.WriteFile(fs, filename, contents[:len(contents)-3], 0644)
+
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	users, _ = storage.ColumnFamily("users")
+	_, aExists, _ := storage.Get("a")
+	_, bExists, _ := users.Get("b")
+	if aExists || bExists {
+		t.Fatalf("Expected none of the torn batch to be applied, got %v and %v", aExists, bExists)
+	}
+}
+
+func Test_SortedFileKvStorage_Write_RefusesBatchWithDroppedFamily(t *testing.T) {
+	storage, _ := NewSortedFileKvStorage(afero.NewMemMapFs())
+	defer storage.Close()
+	users, _ := storage.CreateColumnFamily("users")
+	storage.DropColumnFamily("users")
+
+	b := &WriteBatch{}
+	b.Set(storage.defaultFamily, "a", "1")
+	b.Set(users, "a", "2")
+	if err := storage.Write(b); err == nil {
+		t.Fatal("Expected a batch with a dropped family to be refused")
+	}
+	if _, exists, _ := storage.Get("a"); exists {
+		t.Fatal("Expected none of the refused batch to be applied")
+	}
+}
+
+func Test_SortedFileKvStorage_Get_DoesntWaitForWriteToBeSynced(t *testing.T) {
+	var holding int32
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	fs := &logSyncHookFs{Fs: afero.NewMemMapFs(), hook: func() {
+		if atomic.CompareAndSwapInt32(&holding, 1, 0) {
+			close(syncing)
+			<-release
+		}
+	}}
+	storage, err := NewSortedFileKvStorage(fs, WithDurability(durability.Always()))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+	storage.Set("a", "1")
+
+	atomic.StoreInt32(&holding, 1)
+	written := make(chan error)
+	go func() {
+		written <- storage.Set("b", "2")
+	}()
+	<-syncing
+
+	read := make(chan string)
+	go func() {
+		result, _, _ := storage.Get("a")
+		read <- result
+	}()
+	select {
+	case result := <-read:
+		if result != "1" {
+			t.Fatalf("Expected 'a' to be '1', got '%s'", result)
+		}
+	case <-time.After(5 * time.Second):
+		close(release) // so that Close isn't held up too
+		t.Fatal("Expected the read not to wait for the write's log to be synced")
+	}
+
+	close(release)
+	if err := <-written; err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if result, _, _ := storage.Get("b"); result != "2" {
+		t.Fatalf("Expected 'b' to be '2', got '%s'", result)
+	}
+}
+
+func Test_SortedFileKvStorage_Write_CommitsWaitingBatchesTogether(t *testing.T) {
+	var syncs int32
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	fs := &logSyncHookFs{Fs: afero.NewMemMapFs(), hook: func() {
+		if atomic.AddInt32(&syncs, 1) == 1 {
+			close(syncing)
+			<-release
+		}
+	}}
+	storage, err := NewSortedFileKvStorage(fs, WithDurability(durability.Always()))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+
+	// the first write holds up the log while the rest queue behind it
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	write := func(key string) {
+		defer wg.Done()
+		errs <- storage.Set(key, "v")
+	}
+	wg.Add(1)
+	go write("key0")
+	<-syncing
+	for i := 1; i < 10; i++ {
+		wg.Add(1)
+		go write("key" + strconv.Itoa(i))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		storage.writeMu.Lock()
+		queued := len(storage.writers)
+		storage.writeMu.Unlock()
+		if queued == 10 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Expected 10 writers to be queued, got %d", queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&syncs); n != 2 {
+		t.Fatalf("Expected the waiting writes to be synced together, got %d syncs", n)
+	}
+	for i := 0; i < 10; i++ {
+		if _, exists, _ := storage.Get("key" + strconv.Itoa(i)); !exists {
+			t.Fatalf("Expected 'key%d' to be written", i)
+		}
+	}
+}
+
+func Test_SortedFileKvStorage_Write_AppliesBatchWhileReadsHoldTheLock(t *testing.T) {
+	var holding int32
+	syncing := make(chan struct{})
+	release := make(chan struct{})
+	fs := &logSyncHookFs{Fs: afero.NewMemMapFs(), hook: func() {
+		if atomic.CompareAndSwapInt32(&holding, 1, 0) {
+			close(syncing)
+			<-release
+		}
+	}}
+	storage, err := NewSortedFileKvStorage(fs, WithDurability(durability.Always()), WithMemtable(memtable.SkipList))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+
+	atomic.StoreInt32(&holding, 1)
+	written := make(chan error)
+	go func() {
+		written <- storage.Set("a", "1")
+	}()
+	<-syncing
+
+	// hold the lock as a read does while it finds the memtables, for as long as the write
+	// takes to be applied once it has been logged
+	storage.mu.RLock()
+	close(release)
+	select {
+	case err := <-written:
+		storage.mu.RUnlock()
+		if err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		storage.mu.RUnlock()
+		<-written
+		t.Fatal("Expected the write to be applied to the memtable without waiting for reads")
+	}
+	if result, _, _ := storage.Get("a"); result != "1" {
+		t.Fatalf("Expected 'a' to be '1', got '%s'", result)
+	}
+}
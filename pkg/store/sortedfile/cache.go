@@ -0,0 +1,97 @@
+package sortedfile
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// BLOCK_CACHE_SIZE is the default number of bytes of data blocks kept in memory, so that
+// frequently read keys don't need to be read from disk every time
+const BLOCK_CACHE_SIZE int64 = 8 << 20
+
+// blockCache holds recently read data blocks, decompressed, for every sorted file in a store.
+// Once it holds more than its capacity, the least recently used blocks are evicted.
+type blockCache struct {
+	capacity int64
+	nextID   uint64
+
+	mu     sync.Mutex
+	size   int64
+	blocks map[blockCacheKey]*list.Element
+	lru    *list.List // the most recently used block is at the front
+
+	hits   int64
+	misses int64
+}
+
+// blockCacheKey identifies a block by the id the cache gave its file, and its offset in the file
+type blockCacheKey struct {
+	file   uint64
+	offset int64
+}
+
+type cachedBlock struct {
+	key      blockCacheKey
+	contents []byte
+}
+
+func newBlockCache(capacity int64) *blockCache {
+	return &blockCache{
+		capacity: capacity,
+		blocks:   make(map[blockCacheKey]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// newFileID returns an id for a file's blocks that hasn't been used before, so that blocks
+// cached for a removed file can never be mistaken for another's
+func (c *blockCache) newFileID() uint64 {
+	return atomic.AddUint64(&c.nextID, 1)
+}
+
+// get returns the contents of a cached block, which must not be modified
+func (c *blockCache) get(key blockCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.blocks[key]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachedBlock).contents, true
+}
+
+// add caches a block's contents, which must not be modified afterwards
+func (c *blockCache) add(key blockCacheKey, contents []byte) {
+	size := int64(len(contents))
+	if size > c.capacity {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.blocks[key]; ok {
+		// another reader got there first
+		return
+	}
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, contents: contents})
+	c.size += size
+
+	for c.size > c.capacity {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedBlock)
+		delete(c.blocks, oldest.key)
+		c.size -= int64(len(oldest.contents))
+	}
+}
+
+// usage returns the number of bytes of blocks in the cache
+func (c *blockCache) usage() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.size
+}
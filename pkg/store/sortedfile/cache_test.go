@@ -0,0 +1,99 @@
+package sortedfile
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func Test_blockCache_add_EvictsLeastRecentlyUsedBlocks(t *testing.T) {
+	c := newBlockCache(30)
+	for i := 0; i < 3; i++ {
+		c.add(blockCacheKey{file: 1, offset: int64(i)}, make([]byte, 10))
+	}
+	c.get(blockCacheKey{file: 1, offset: 0}) // makes block 1 the least recently used
+	c.add(blockCacheKey{file: 2, offset: 0}, make([]byte, 10))
+
+	if _, ok := c.get(blockCacheKey{file: 1, offset: 1}); ok {
+		t.Fatal("Expected the least recently used block to be evicted")
+	}
+	for _, key := range []blockCacheKey{{file: 1, offset: 0}, {file: 1, offset: 2}, {file: 2, offset: 0}} {
+		if _, ok := c.get(key); !ok {
+			t.Fatalf("Expected block %v to still be cached", key)
+		}
+	}
+	if c.usage() != 30 {
+		t.Fatalf("Expected 30 bytes to be cached, got %d", c.usage())
+	}
+}
+
+func Test_blockCache_add_SkipsBlocksLargerThanCapacity(t *testing.T) {
+	c := newBlockCache(10)
+	c.add(blockCacheKey{file: 1}, make([]byte, 5))
+	c.add(blockCacheKey{file: 2}, make([]byte, 20))
+
+	if _, ok := c.get(blockCacheKey{file: 2}); ok {
+		t.Fatal("Expected a block larger than the cache not to be cached")
+	}
+	if _, ok := c.get(blockCacheKey{file: 1}); !ok {
+		t.Fatal("Expected the cache to be left alone")
+	}
+}
+
+func Test_blockCache_get_CountsHitsAndMisses(t *testing.T) {
+	c := newBlockCache(100)
+	c.add(blockCacheKey{file: 1}, []byte("block"))
+	c.get(blockCacheKey{file: 1})
+	c.get(blockCacheKey{file: 1})
+	c.get(blockCacheKey{file: 2})
+
+	if c.hits != 2 || c.misses != 1 {
+		t.Fatalf("Expected 2 hits and 1 miss, got %d and %d", c.hits, c.misses)
+	}
+}
+
+func Test_SortedFileKvStorage_ServesHotBlocksFromCache(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+	for i := 0; i < 100; i++ {
+		storage.Set("key"+strconv.Itoa(i), "value")
+	}
+	storage.Flush()
+
+	for i := 0; i < 10; i++ {
+		if _, exists, err := storage.Get("key5"); err != nil || !exists {
+			t.Fatalf("Expected 'key5' to be found, got %v, %v", exists, err)
+		}
+	}
+	stats := storage.Stats()
+	if stats.BlockCacheMisses != 1 || stats.BlockCacheHits != 9 {
+		t.Fatalf("Expected 1 miss then 9 hits, got %d and %d", stats.BlockCacheMisses, stats.BlockCacheHits)
+	}
+	if stats.BlockCacheBytes == 0 || stats.BlockCacheHitRate() != 0.9 {
+		t.Fatalf("Expected the block to be cached, got %d bytes and a hit rate of %v", stats.BlockCacheBytes, stats.BlockCacheHitRate())
+	}
+}
+
+func Test_SortedFileKvStorage_WithoutBlockCacheReadsFromDisk(t *testing.T) {
+	storage, err := NewSortedFileKvStorage(afero.NewMemMapFs(), WithBlockCacheSize(0))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+	for i := 0; i < 100; i++ {
+		storage.Set("key"+strconv.Itoa(i), "value")
+	}
+	storage.Flush()
+
+	if result, exists, _ := storage.Get("key5"); !exists || result != "value" {
+		t.Fatalf("Expected 'key5' to be 'value', got '%s'", result)
+	}
+	if stats := storage.Stats(); stats.BlockCacheHits+stats.BlockCacheMisses != 0 {
+		t.Fatal("Expected no cache lookups")
+	}
+}
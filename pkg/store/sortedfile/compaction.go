@@ -0,0 +1,281 @@
+package sortedfile
+
+import (
+	"fmt"
+)
+
+// Sorted files are merged in the background by compaction. Which files are merged, and when,
+// is decided by the store's compaction strategy. Merging keeps only the newest record for each
+// key, and drops tombstones once there are no older files left for them to shadow, so the
+// space taken by overwritten and deleted keys is reclaimed. Each column family is compacted on
+// its own, with its own strategy.
+
+// CompactionStrategy chooses how sorted files are merged
+type CompactionStrategy int
+
+const (
+	// Leveled compaction keeps reads and space usage low at the cost of rewriting data more often
+	Leveled CompactionStrategy = iota
+	// SizeTiered compaction rewrites data less often at the cost of more files to read
+	SizeTiered
+)
+
+// compactionPicker chooses the next compaction to run for a strategy
+type compactionPicker interface {
+	// pick returns the next compaction to run, or nil if none is needed
+	pick(v *version) *compaction
+}
+
+func newCompactionPicker(o options) compactionPicker {
+	if o.compactionStrategy == SizeTiered {
+		return newSizeTieredPicker()
+	}
+	picker := newLeveledPicker()
+	picker.targetFileSize = o.targetFileSize
+	return picker
+}
+
+// compaction merges files from level into outputLevel
+type compaction struct {
+	family      *ColumnFamily
+	level       int
+	outputLevel int
+	inputs      [2][]*SortedFile // the files from level, and the overlapping files from outputLevel
+	base        *version         // the version the inputs were chosen from
+
+	maxOutputFileSize int64
+}
+
+// keyRange returns the smallest and largest keys across all files
+func keyRange(files []*SortedFile) (string, string) {
+	smallest, largest := files[0].smallest, files[0].largest
+	for _, f := range files[1:] {
+		if f.smallest < smallest {
+			smallest = f.smallest
+		}
+		if f.largest > largest {
+			largest = f.largest
+		}
+	}
+	return smallest, largest
+}
+
+// isTrivialMove reports whether the compaction can just move a file down a level, as there's
+// nothing to merge it with
+func (c *compaction) isTrivialMove() bool {
+	return c.outputLevel != c.level && len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0
+}
+
+// isBottomLevelFor reports whether no file older than the compaction's inputs could contain
+// key, in which case a tombstone for it no longer has anything to shadow
+func (c *compaction) isBottomLevelFor(key string) bool {
+	if c.outputLevel == 0 {
+		// level 0 files are ordered oldest first, so anything before the inputs is older
+		for _, f := range c.base.levels[0] {
+			if f == c.inputs[0][0] {
+				break
+			} else if f.overlaps(key, key) {
+				return false
+			}
+		}
+	}
+	for level := c.outputLevel + 1; level < NUM_LEVELS; level++ {
+		if len(c.base.overlapping(level, key, key)) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// compactUntilBalanced runs compactions until no level of any family needs one
+func (s *SortedFileKvStorage) compactUntilBalanced() error {
+	s.compactionMu.Lock()
+	defer s.compactionMu.Unlock()
+
+	for {
+		s.mu.RLock()
+		families := make([]*ColumnFamily, 0, len(s.families))
+		for _, f := range s.families {
+			families = append(families, f)
+		}
+		s.mu.RUnlock()
+
+		compacted := false
+		for _, f := range families {
+			select {
+			case <-s.closing:
+				return nil
+			default:
+			}
+
+			ran, err := s.compactFamily(f)
+			if err != nil {
+				return err
+			}
+			compacted = compacted || ran
+		}
+		if !compacted {
+			return nil
+		}
+	}
+}
+
+// compactFamily runs the next compaction the family needs, returning false if it needs none
+func (s *SortedFileKvStorage) compactFamily(f *ColumnFamily) (bool, error) {
+	s.mu.RLock()
+	v := f.current
+	v.ref()
+	s.mu.RUnlock()
+	defer v.unref()
+
+	c := f.compactionPicker.pick(v)
+	if c == nil {
+		return false, nil
+	}
+	c.family = f
+	return true, s.runCompaction(c)
+}
+
+func (s *SortedFileKvStorage) runCompaction(c *compaction) error {
+	edit := &versionEdit{removed: make(map[*SortedFile]bool)}
+	for _, inputs := range c.inputs {
+		for _, f := range inputs {
+			edit.removed[f] = true
+		}
+	}
+
+	if c.isTrivialMove() {
+		edit.added[c.outputLevel] = c.inputs[0]
+		return s.applyEdit(c.family, edit)
+	}
+
+	outputs, err := s.mergeFiles(c)
+	if err != nil {
+		for _, f := range outputs {
+			s.fs.Remove(f.filename)
+		}
+		return fmt.Errorf("failed to merge files from level %d: %v", c.level, err)
+	}
+	edit.added[c.outputLevel] = outputs
+	err = s.applyEdit(c.family, edit)
+	if err != nil {
+		return err
+	}
+
+	c.family.stats.recordCompaction(c, outputs)
+	return nil
+}
+
+// mergeFiles writes the merged contents of the compaction's inputs to new files
+func (s *SortedFileKvStorage) mergeFiles(c *compaction) ([]*SortedFile, error) {
+	// iterators are ordered newest first, so the newest record for each key wins
+	iters := make([]iterator, 0)
+	for i := len(c.inputs[0]) - 1; i >= 0; i-- {
+		iter, err := newSortedFileIterator(c.inputs[0][i])
+		if err != nil {
+			newMergingIterator(iters).Close()
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	for _, f := range c.inputs[1] {
+		iter, err := newSortedFileIterator(f)
+		if err != nil {
+			newMergingIterator(iters).Close()
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	merged := newMergingIterator(iters)
+	defer merged.Close()
+
+	outputs := make([]*SortedFile, 0)
+	var w *sortedFileWriter
+	finishOutput := func() error {
+		// synced whatever the durability policy, as the inputs are removed once the outputs
+		// have been recorded in the manifest
+		err := w.Close(true)
+		if err != nil {
+			return err
+		}
+		file, err := newSortedFile(w.filename, s.fs, s.readOptions())
+		if err != nil {
+			return fmt.Errorf("failed to read new sorted file: %w", err)
+		}
+		outputs = append(outputs, file)
+		w = nil
+		return nil
+	}
+
+	for merged.Next() {
+		r := merged.Record()
+		if r.Deleted && c.isBottomLevelFor(r.Key) {
+			continue
+		}
+
+		if w == nil {
+			var err error
+			w, err = newSortedFileWriter(s.allocateFileName(), s.fs, c.family.opts.table())
+			if err != nil {
+				return outputs, err
+			}
+		}
+		err := w.Append(r)
+		if err != nil {
+			w.abort()
+			s.fs.Remove(w.filename)
+			return outputs, err
+		}
+		if w.Size() >= c.maxOutputFileSize {
+			err = finishOutput()
+			if err != nil {
+				s.fs.Remove(w.filename)
+				return outputs, err
+			}
+		}
+	}
+	if merged.Err() != nil {
+		if w != nil {
+			w.abort()
+			s.fs.Remove(w.filename)
+		}
+		return outputs, merged.Err()
+	}
+	if w != nil {
+		err := finishOutput()
+		if err != nil {
+			s.fs.Remove(w.filename)
+			return outputs, err
+		}
+	}
+
+	return outputs, nil
+}
+
+// compactInBackground runs compactions whenever they're requested, until the store is closed
+func (s *SortedFileKvStorage) compactInBackground() {
+	defer close(s.compactorDone)
+	for {
+		select {
+		case <-s.compactionRequested:
+		case <-s.closing:
+			return
+		}
+
+		err := s.compactUntilBalanced()
+		if err != nil {
+			s.mu.Lock()
+			s.backgroundErr = fmt.Errorf("background compaction failed: %v", err)
+			s.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (s *SortedFileKvStorage) maybeScheduleCompaction() {
+	select {
+	case s.compactionRequested <- struct{}{}:
+	default:
+		// a compaction is already due to run
+	}
+}
@@ -0,0 +1,287 @@
+package sortedfile
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haydenjeune/kvstore/pkg/keyoffset"
+	"github.com/spf13/afero"
+)
+
+func newTestFile(name string, smallest string, largest string, size int64) *SortedFile {
+	index := keyoffset.NewBuilder()
+	index.Add(largest, 0, size)
+	return &SortedFile{
+		filename: name,
+		index:    index.Build(),
+		smallest: smallest,
+		largest:  largest,
+		size:     size,
+	}
+}
+
+func Test_leveledPicker_pick_ReturnsNilWhenBalanced(t *testing.T) {
+	var levels [NUM_LEVELS][]*SortedFile
+	levels[0] = []*SortedFile{newTestFile("0", "a", "c", 10)}
+	levels[1] = []*SortedFile{newTestFile("1", "a", "z", 10)}
+
+	if c := newLeveledPicker().pick(newVersion(levels)); c != nil {
+		t.Fatalf("Expected no compaction, got one for level %d", c.level)
+	}
+}
+
+func Test_newCompactionPicker_UsesTargetFileSize(t *testing.T) {
+	o := defaultOptions()
+	WithTargetFileSize(64 << 10)(&o)
+
+	var levels [NUM_LEVELS][]*SortedFile
+	for i := 0; i < L0_COMPACTION_TRIGGER; i++ {
+		levels[0] = append(levels[0], newTestFile(strconv.Itoa(i), "a", "z", 10))
+	}
+	c := newCompactionPicker(o).pick(newVersion(levels))
+	if c == nil || c.maxOutputFileSize != 64<<10 {
+		t.Fatalf("Expected a compaction with 64KiB output files, got %+v", c)
+	}
+}
+
+func Test_leveledPicker_pick_CompactsAllLevel0FilesWithOverlappingLevel1Files(t *testing.T) {
+	var levels [NUM_LEVELS][]*SortedFile
+	levels[0] = []*SortedFile{
+		newTestFile("3", "b", "c", 10),
+		newTestFile("4", "a", "b", 10),
+		newTestFile("5", "f", "g", 10),
+		newTestFile("6", "c", "d", 10),
+	}
+	levels[1] = []*SortedFile{
+		newTestFile("0", "a", "c", 10),
+		newTestFile("1", "d", "e", 10),
+		newTestFile("2", "x", "z", 10),
+	}
+
+	c := newLeveledPicker().pick(newVersion(levels))
+	if c == nil || c.level != 0 {
+		t.Fatal("Expected a level 0 compaction")
+	}
+	if len(c.inputs[0]) != 4 {
+		t.Fatalf("Expected all 4 level 0 files as inputs, got %d", len(c.inputs[0]))
+	}
+	if len(c.inputs[1]) != 2 || c.inputs[1][0].filename != "0" || c.inputs[1][1].filename != "1" {
+		t.Fatalf("Expected level 1 files '0' and '1' as inputs, got %v", c.inputs[1])
+	}
+}
+
+func Test_leveledPicker_pick_RotatesThroughFilesInOversizedLevel(t *testing.T) {
+	var levels [NUM_LEVELS][]*SortedFile
+	levels[1] = []*SortedFile{
+		newTestFile("0", "a", "c", 100),
+		newTestFile("1", "d", "f", 100),
+	}
+	l := newLeveledPicker()
+	l.level1MaxBytes = 100
+	v := newVersion(levels)
+
+	first := l.pick(v)
+	second := l.pick(v)
+	if first == nil || second == nil || first.level != 1 || second.level != 1 {
+		t.Fatal("Expected level 1 compactions")
+	}
+	if first.inputs[0][0] == second.inputs[0][0] {
+		t.Fatal("Expected consecutive compactions to pick different files")
+	}
+}
+
+// newCompactingTestStorage returns storage with small levels, so compaction happens quickly
+func newCompactingTestStorage(t *testing.T, fs afero.Fs) *SortedFileKvStorage {
+	storage, err := NewSortedFileKvStorage(fs, WithMemtableSize(1<<10))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	picker := newLeveledPicker()
+	picker.l0Trigger = 2
+	picker.level1MaxBytes = 4 << 10
+	picker.levelMultiplier = 2
+	picker.targetFileSize = 1 << 10
+	storage.compactionMu.Lock()
+	storage.defaultFamily.compactionPicker = picker
+	storage.compactionMu.Unlock()
+	return storage
+}
+
+func Test_SortedFileKvStorage_CompactionKeepsNewestValuesAndDropsDeletedKeys(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := newCompactingTestStorage(t, fs)
+
+	expected := make(map[string]string)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%03d", i%300)
+		storage.Set(key, strconv.Itoa(i))
+		expected[key] = strconv.Itoa(i)
+	}
+	for i := 0; i < 300; i += 7 {
+		key := fmt.Sprintf("key%03d", i)
+		storage.Delete(key)
+		delete(expected, key)
+	}
+	// push the deletes down through the levels
+	for i := 0; i < 1000; i++ {
+		storage.Set(fmt.Sprintf("other%03d", i%300), strconv.Itoa(i))
+	}
+
+	storage.waitForFlushes()
+	err := storage.compactUntilBalanced()
+	if err != nil {
+		t.Fatalf("Unexpected error compacting: %v", err)
+	}
+
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		result, exists, err := storage.Get(key)
+		if err != nil {
+			t.Fatalf("Unexpected error getting '%s': %v", key, err)
+		}
+		if expectedValue, ok := expected[key]; exists != ok || result != expectedValue {
+			t.Fatalf("Expected '%s' to be '%s' (exists: %v), got '%s' (exists: %v)", key, expectedValue, ok, result, exists)
+		}
+	}
+
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	v := storage.defaultFamily.current
+	if len(v.levels[0]) >= 2 {
+		t.Fatalf("Expected level 0 to be compacted, got %d files", len(v.levels[0]))
+	}
+	liveFiles := len(v.levels[0])
+	for level := 1; level < NUM_LEVELS; level++ {
+		liveFiles += len(v.levels[level])
+		for i := 1; i < len(v.levels[level]); i++ {
+			if v.levels[level][i-1].largest >= v.levels[level][i].smallest {
+				t.Fatalf("Files in level %d overlap", level)
+			}
+		}
+	}
+
+	// nothing is older than the bottom level, so it has no use for tombstones
+	bottom := NUM_LEVELS - 1
+	for len(v.levels[bottom]) == 0 {
+		bottom--
+	}
+	for _, f := range v.levels[bottom] {
+		iter, _ := newSortedFileIterator(f)
+		for iter.Next() {
+			if iter.Record().Deleted {
+				t.Fatalf("Found tombstone for '%s' in bottom level %d", iter.Record().Key, bottom)
+			}
+		}
+		iter.Close()
+	}
+
+	// replaced files should have been removed from disk
+	numbers, _ := listNumberedFiles(fs, "")
+	if len(numbers) != liveFiles {
+		t.Fatalf("Expected %d files on disk, got %d", liveFiles, len(numbers))
+	}
+}
+
+func Test_SortedFileKvStorage_RemovesCompactedFilesOnlyOnceTheirEditIsSynced(t *testing.T) {
+	fs := &syncRecordingFs{Fs: afero.NewMemMapFs()}
+	storage := newCompactingTestStorage(t, fs) // durability.Never()
+	defer storage.Close()
+	for i := 0; i < 1000; i++ {
+		storage.Set(fmt.Sprintf("key%03d", i%300), strconv.Itoa(i))
+	}
+	storage.waitForFlushes()
+	err := storage.compactUntilBalanced()
+	if err != nil {
+		t.Fatalf("Unexpected error compacting: %v", err)
+	}
+
+	manifestSynced := true
+	unsynced := make(map[string]bool)
+	removed := 0
+	for _, event := range fs.recorded() {
+		parts := strings.SplitN(event, " ", 2)
+		switch {
+		case event == "write "+MANIFEST_FILENAME:
+			manifestSynced = false
+		case event == "sync "+MANIFEST_FILENAME:
+			manifestSynced = true
+		case parts[0] == "write" && isNumbered(parts[1]):
+			unsynced[parts[1]] = true
+		case parts[0] == "sync":
+			delete(unsynced, parts[1])
+		case parts[0] == "remove" && isNumbered(parts[1]):
+			if !manifestSynced {
+				t.Fatalf("Expected '%s' to be removed only once the manifest was synced, got %v", parts[1], fs.recorded())
+			}
+			removed++
+		}
+	}
+	if removed == 0 {
+		t.Fatal("Expected compaction to remove its inputs")
+	}
+	if len(unsynced) > 0 {
+		t.Fatalf("Expected every sorted file to be synced, but %v weren't", unsynced)
+	}
+}
+
+func Test_SortedFileKvStorage_RestoresLevelsOnStartup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := newCompactingTestStorage(t, fs)
+	for i := 0; i < 1000; i++ {
+		storage.Set(fmt.Sprintf("key%03d", i%500), strconv.Itoa(i))
+	}
+	storage.waitForFlushes()
+	storage.compactUntilBalanced()
+	storage.Close()
+
+	before := storage.defaultFamily.current
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	for level := range before.levels {
+		if len(storage.defaultFamily.current.levels[level]) != len(before.levels[level]) {
+			t.Fatalf("Expected %d files in level %d after reopening, got %d", len(before.levels[level]), level, len(storage.defaultFamily.current.levels[level]))
+		}
+	}
+	if result, _, _ := storage.Get("key250"); result != "750" {
+		t.Fatalf("Expected 'key250' to be '750' after reopening, got '%s'", result)
+	}
+}
+
+func Test_SortedFileKvStorage_CompactsInBackground(t *testing.T) {
+	storage, err := NewSortedFileKvStorage(afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+
+	for i := 0; i < L0_COMPACTION_TRIGGER*100; i++ {
+		storage.Set(strconv.Itoa(i), strconv.Itoa(i))
+		if i%100 == 99 {
+			storage.Flush()
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		storage.mu.RLock()
+		level0Files := len(storage.defaultFamily.current.levels[0])
+		storage.mu.RUnlock()
+		if level0Files == 0 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("Expected level 0 to be compacted in the background, still has %d files", level0Files)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if result, _, _ := storage.Get("42"); result != "42" {
+		t.Fatalf("Expected '42' to be '42' after compaction, got '%s'", result)
+	}
+}
@@ -0,0 +1,80 @@
+package sortedfile
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// Data blocks can be compressed before they're written. The codec used for each block is
+// recorded in its trailer, so files written with different settings, or a file where only some
+// blocks were worth compressing, can always be read back.
+
+// Compression chooses how the data blocks of new sorted files are compressed
+type Compression int
+
+const (
+	// NoCompression writes blocks as they are
+	NoCompression Compression = iota
+	// FlateCompression compresses blocks with DEFLATE, which suits verbose values such as JSON
+	FlateCompression
+)
+
+const CODEC_FLATE byte = 1
+
+// a compressed block is only kept if it saves at least 1/MIN_COMPRESSION_SAVING of the space,
+// as otherwise it isn't worth decompressing on every read
+const MIN_COMPRESSION_SAVING = 8
+
+// blockCompressor compresses blocks for a single writer, reusing its buffers between blocks
+type blockCompressor struct {
+	compression Compression
+	flate       *flate.Writer
+	buf         bytes.Buffer
+}
+
+// compress returns the block to write and the codec it was written with, which is CODEC_NONE
+// if compression didn't save enough space
+func (c *blockCompressor) compress(contents []byte) ([]byte, byte, error) {
+	if c.compression != FlateCompression {
+		return contents, CODEC_NONE, nil
+	}
+
+	c.buf.Reset()
+	if c.flate == nil {
+		var err error
+		c.flate, err = flate.NewWriter(&c.buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to start compressor: %v", err)
+		}
+	} else {
+		c.flate.Reset(&c.buf)
+	}
+	_, err := c.flate.Write(contents)
+	if err == nil {
+		err = c.flate.Close()
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to compress block: %v", err)
+	}
+
+	if c.buf.Len() > len(contents)-len(contents)/MIN_COMPRESSION_SAVING {
+		return contents, CODEC_NONE, nil
+	}
+	return c.buf.Bytes(), CODEC_FLATE, nil
+}
+
+// decompressBlock returns the original contents of a block written with codec
+func decompressBlock(stored []byte, codec byte) ([]byte, error) {
+	switch codec {
+	case CODEC_NONE:
+		return stored, nil
+	case CODEC_FLATE:
+		r := flate.NewReader(bytes.NewReader(stored))
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown block codec %d", codec)
+	}
+}
@@ -0,0 +1,116 @@
+package sortedfile
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+func Test_blockCompressor_compress_RoundTripsCompressibleBlock(t *testing.T) {
+	contents := []byte(strings.Repeat(`{"name": "value", "count": 1}`, 100))
+	c := blockCompressor{compression: FlateCompression}
+
+	for i := 0; i < 2; i++ { // the compressor is reused between blocks
+		stored, codec, err := c.compress(contents)
+		if err != nil {
+			t.Fatalf("Unexpected error compressing: %v", err)
+		}
+		if codec != CODEC_FLATE || len(stored) >= len(contents) {
+			t.Fatalf("Expected block to be compressed, got codec %d and %d bytes", codec, len(stored))
+		}
+		decompressed, err := decompressBlock(stored, codec)
+		if err != nil || !bytes.Equal(decompressed, contents) {
+			t.Fatalf("Expected block to round trip, got %v", err)
+		}
+	}
+}
+
+func Test_blockCompressor_compress_StoresIncompressibleBlockAsIs(t *testing.T) {
+	contents := make([]byte, 1024)
+	rand.New(rand.NewSource(1)).Read(contents)
+	c := blockCompressor{compression: FlateCompression}
+
+	stored, codec, err := c.compress(contents)
+	if err != nil {
+		t.Fatalf("Unexpected error compressing: %v", err)
+	}
+	if codec != CODEC_NONE || !bytes.Equal(stored, contents) {
+		t.Fatal("Expected an incompressible block to be stored as is")
+	}
+}
+
+func Test_decompressBlock_ErrorsForUnknownCodec(t *testing.T) {
+	if _, err := decompressBlock([]byte("contents"), 99); err == nil {
+		t.Fatal("Expected error for unknown codec")
+	}
+}
+
+func Test_SortedFile_Get_ReadsCompressedBlocks(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	plain := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
+	compressed := writeTestSortedFile(t, fs, "1", 100, tableOptions{blockSize: 256, compression: FlateCompression})
+
+	if compressed.storedDataSize >= plain.storedDataSize {
+		t.Fatalf("Expected compressed data to be smaller, got %d and %d bytes", compressed.storedDataSize, plain.storedDataSize)
+	}
+	if compressed.dataSize != plain.dataSize {
+		t.Fatalf("Expected the same data size before compression, got %d and %d", compressed.dataSize, plain.dataSize)
+	}
+	for i := 0; i < 100; i++ {
+		r, exists, err := compressed.Get(fmt.Sprintf("key%03d", i))
+		if err != nil || !exists || r.Value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected 'key%03d' to be 'value%d', got '%s', %v, %v", i, i, r.Value, exists, err)
+		}
+	}
+}
+
+func Test_SortedFileKvStorage_ReadsFilesWrittenWithOtherCompression(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	value := strings.Repeat(`{"field": "value"}`, 10)
+
+	storage, _ := NewSortedFileKvStorage(fs)
+	for i := 0; i < 100; i++ {
+		storage.Set("a"+strconv.Itoa(i), value)
+	}
+	storage.Flush()
+	storage.Close()
+
+	storage, err := NewSortedFileKvStorage(fs, WithCompression(FlateCompression))
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	for i := 0; i < 100; i++ {
+		storage.Set("b"+strconv.Itoa(i), value)
+	}
+	storage.Flush()
+
+	for _, key := range []string{"a5", "b5"} {
+		if result, exists, err := storage.Get(key); err != nil || !exists || result != value {
+			t.Fatalf("Expected '%s' to be found, got %v, %v", key, exists, err)
+		}
+	}
+	if ratio := storage.Stats().CompressionRatio(); ratio <= 1 {
+		t.Fatalf("Expected a compression ratio above 1, got %v", ratio)
+	}
+}
+
+func Test_readBlock_ErrorsForDamagedCompressedBlock(t *testing.T) {
+	c := blockCompressor{compression: FlateCompression}
+	stored, codec, _ := c.compress([]byte(strings.Repeat("value", 100)))
+	// a stream that passes its checksum but can't be decompressed
+	b := encodeBlock(stored[:len(stored)/2], codec)
+
+	_, err := readBlock(bytes.NewReader(b), blockHandle{offset: 0, size: int64(len(stored) / 2)})
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected corruption error, got %v", err)
+	}
+}
@@ -1,85 +1,502 @@
 package sortedfile
 
 import (
+	"errors"
 	"fmt"
 	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 
-	"github.com/haydenjeune/kvstore/pkg/bst"
+	"github.com/haydenjeune/kvstore/pkg/record"
 	"github.com/spf13/afero"
 )
 
+// ErrClosed is returned by reads and writes made once the store has been closed
+var ErrClosed = errors.New("store is closed")
+
 type SortedFileKvStorage struct {
-	fs       afero.Fs
-	memtable bst.BinarySearchTree
-	files    []*SortedFile // ordered oldest to newest
+	fs   afero.Fs
+	opts options
+
+	mu             sync.RWMutex // held for writing while memtables, versions, logs or families change
+	defaultFamily  *ColumnFamily
+	families       map[string]*ColumnFamily // every family in the store, including the default
+	wal            *writeAheadLog
+	logs           []int64              // the logs that may hold writes that haven't been flushed, oldest first
+	immutables     []*immutableMemtable // full memtables of every family waiting to be flushed, oldest first
+	manifest       *manifest
+	nextFileNumber int64
+	backgroundErr  error // set if a background flush or compaction fails, after which writes are refused
+
+	writeMu    sync.Mutex // guards writers, but isn't held while a group is being committed
+	writers    []*writer  // writes waiting to be committed, the first of which commits its group and alone rotates wal
+	writerTurn *sync.Cond // signalled on writeMu whenever a group has been committed
+
+	flushed        *sync.Cond // signalled on mu whenever an immutable memtable has been flushed
+	flushRequested chan struct{}
+	flusherDone    chan struct{}
+
+	compactionMu        sync.Mutex // held while compactions are running
+	compactionRequested chan struct{}
+	closing             chan struct{}
+	compactorDone       chan struct{}
+	closeOnce           sync.Once
+	closeErr            error          // the result of the first Close, returned by any later ones
+	closed              bool           // set on mu once Close has started, after which reads and writes are refused
+	reads               sync.WaitGroup // reads holding a version, which Close waits for before closing files
+
+	blockCache  *blockCache  // nil if blocks aren't cached
+	handleCache *handleCache // nil if files are opened for each read
 }
 
-func NewSortedFileKvStorage(fs afero.Fs) (*SortedFileKvStorage, error) {
-	return &SortedFileKvStorage{fs: fs}, nil
+func NewSortedFileKvStorage(fs afero.Fs, opts ...Option) (*SortedFileKvStorage, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	s := &SortedFileKvStorage{
+		fs:                  fs,
+		opts:                o,
+		families:            make(map[string]*ColumnFamily),
+		flushRequested:      make(chan struct{}, 1),
+		flusherDone:         make(chan struct{}),
+		compactionRequested: make(chan struct{}, 1),
+		closing:             make(chan struct{}),
+		compactorDone:       make(chan struct{}),
+	}
+	s.flushed = sync.NewCond(&s.mu)
+	s.writerTurn = sync.NewCond(&s.writeMu)
+	if o.blockCacheSize > 0 {
+		s.blockCache = newBlockCache(o.blockCacheSize)
+	}
+	if o.maxOpenFiles > 0 {
+		s.handleCache = newHandleCache(fs, o.maxOpenFiles)
+	}
+	err := s.openSortedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open existing sorted files: %w", err)
+	}
+	err = s.recoverMemtables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to recover memtables: %w", err)
+	}
+
+	go s.flushInBackground()
+	go s.compactInBackground()
+	s.maybeScheduleCompaction()
+	return s, nil
 }
 
+// Get reads key from the default column family
 func (s *SortedFileKvStorage) Get(key string) (string, bool, error) {
-	value, exists := s.memtable.Search(key)
-	if exists {
-		return value, true, nil
+	return s.defaultFamily.Get(key)
+}
+
+// Set writes key to the default column family
+func (s *SortedFileKvStorage) Set(key string, value string) error {
+	return s.defaultFamily.Set(key, value)
+}
+
+// Delete removes key from the default column family. Until compaction catches up, this is
+// recorded as a tombstone that shadows any older values for the key.
+func (s *SortedFileKvStorage) Delete(key string) error {
+	return s.defaultFamily.Delete(key)
+}
+
+// Close can be called more than once, but only the first call does anything. Everything the
+// store holds open is released even if closing part of it fails, and the first error is returned.
+func (s *SortedFileKvStorage) Close() error {
+	s.closeOnce.Do(func() {
+		s.closeErr = s.close()
+	})
+	return s.closeErr
+}
+
+func (s *SortedFileKvStorage) close() error {
+	// Reads can return blocks that point straight into a file's memory mapping, so every read
+	// must be finished before the files are closed
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.reads.Wait()
+	// any write already past the check is still appending to the log, and must be let finish
+	s.whileWritesHeld(func() {})
+
+	// flush any full memtables, and let any running compaction finish, before closing
+	firstErr := s.waitForFlushes()
+	close(s.closing)
+	<-s.flusherDone
+	<-s.compactorDone
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.wal.Close()
+	if err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to close write-ahead log: %v", err)
+	}
+	err = s.manifest.Close()
+	if err != nil && firstErr == nil {
+		firstErr = fmt.Errorf("failed to close manifest: %v", err)
+	}
+	for _, f := range s.families {
+		for _, level := range f.current.levels {
+			for _, file := range level {
+				err = file.Close()
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+	}
+	if s.handleCache != nil {
+		s.handleCache.close()
+	}
+	return firstErr
+}
+
+// acquireVersion returns the family's current version for a read, which must be given back with
+// releaseVersion so that Close can wait for it. It must be called with mu held.
+func (s *SortedFileKvStorage) acquireVersion(f *ColumnFamily) (*version, error) {
+	if s.closed {
+		return nil, ErrClosed
+	}
+	v := f.current
+	v.ref()
+	s.reads.Add(1)
+	return v, nil
+}
+
+func (s *SortedFileKvStorage) releaseVersion(v *version) {
+	v.unref()
+	s.reads.Done()
+}
+
+func (s *SortedFileKvStorage) applyEdit(f *ColumnFamily, edit *versionEdit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.applyEditLocked(f, edit)
+}
+
+// applyEditLocked records the edited layout of a family's files and makes it the family's
+// current version. It must be called with mu held for writing.
+func (s *SortedFileKvStorage) applyEditLocked(f *ColumnFamily, edit *versionEdit) error {
+	previous, previousLogNumber := f.current, f.logNumber
+	f.current = previous.apply(edit)
+	f.current.ref()
+	if edit.logNumber > f.logNumber {
+		f.logNumber = edit.logNumber
 	}
 
-	for i := len(s.files) - 1; i >= 0; i-- {
-		value, exists, err := s.files[i].Get(key)
+	e := newManifestEdit(edit, atomic.LoadInt64(&s.nextFileNumber))
+	e.Family = f.id
+	err := s.logEdit(e)
+	if err != nil {
+		f.current.discard()
+		f.current, f.logNumber = previous, previousLogNumber
+		return fmt.Errorf("failed to record new version: %v", err)
+	}
+
+	previous.unref()
+	return nil
+}
+
+// logEdit appends an edit to the manifest, or rewrites the manifest from the families as they
+// are now, which must already include the edit, once it has grown too large. It must be called
+// with mu held for writing.
+func (s *SortedFileKvStorage) logEdit(e manifestEdit) error {
+	if s.manifest.err == nil && s.manifest.size < MAX_MANIFEST_SIZE {
+		return s.manifest.append(e)
+	}
+
+	m, err := writeManifest(s.fs, s.snapshotEdits())
+	if err != nil {
+		return err
+	}
+	s.manifest.Close()
+	s.manifest = m
+	return nil
+}
+
+// snapshotEdits describes every family as it is now, as edits that create each family with all
+// of its files. It must be called with mu held.
+func (s *SortedFileKvStorage) snapshotEdits() []manifestEdit {
+	families := make([]*ColumnFamily, 0, len(s.families))
+	for _, f := range s.families {
+		families = append(families, f)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		return families[i].id < families[j].id
+	})
+
+	nextFileNumber := atomic.LoadInt64(&s.nextFileNumber)
+	edits := make([]manifestEdit, len(families))
+	for i, f := range families {
+		edits[i] = f.snapshotEdit(nextFileNumber)
+	}
+	return edits
+}
+
+// allocateFileNumber returns a number for a new file or column family
+func (s *SortedFileKvStorage) allocateFileNumber() int64 {
+	return atomic.AddInt64(&s.nextFileNumber, 1) - 1
+}
+
+// allocateFileName returns the name for a new sorted file
+func (s *SortedFileKvStorage) allocateFileName() string {
+	return strconv.FormatInt(s.allocateFileNumber(), 10)
+}
+
+// startLog opens a new write-ahead log, which every write goes to from then on. It must be
+// called with mu held for writing.
+func (s *SortedFileKvStorage) startLog(number int64) error {
+	wal, err := openWriteAheadLog(s.fs, walFileName(strconv.FormatInt(number, 10)), s.opts.durability)
+	if err != nil {
+		return err
+	}
+	wal.number = number
+	previous := s.wal
+	s.wal = wal
+	s.logs = append(s.logs, number)
+	if previous != nil {
+		err = previous.Close()
 		if err != nil {
-			return "", false, fmt.Errorf("failed to get key '%s': %v", key, err)
-		} else if exists {
-			return value, true, nil
+			return fmt.Errorf("failed to close write-ahead log: %v", err)
 		}
 	}
+	return nil
+}
 
-	return "", false, nil
+// obsoleteLogsLocked forgets the logs that only hold writes every family has flushed, returning
+// their names to be removed. It must be called with mu held for writing.
+func (s *SortedFileKvStorage) obsoleteLogsLocked() []string {
+	oldest := s.wal.number
+	for _, f := range s.families {
+		if f.memtable.Size() > 0 && f.memtableLog < oldest {
+			oldest = f.memtableLog
+		}
+	}
+	for _, m := range s.immutables {
+		if m.firstLog < oldest {
+			oldest = m.firstLog
+		}
+	}
+
+	var obsolete []string
+	for len(s.logs) > 0 && s.logs[0] < oldest {
+		obsolete = append(obsolete, walFileName(strconv.FormatInt(s.logs[0], 10)))
+		s.logs = s.logs[1:]
+	}
+	return obsolete
 }
 
-func (s *SortedFileKvStorage) Set(key string, value string) error {
-	s.memtable.Insert(key, value)
+func (s *SortedFileKvStorage) removeLogs(filenames []string) error {
+	for _, filename := range filenames {
+		err := s.fs.Remove(filename)
+		if err != nil {
+			return fmt.Errorf("failed to remove write-ahead log '%s': %v", filename, err)
+		}
+	}
+	return nil
+}
 
-	if s.memtable.Size() >= MAX_RECORDS_PER_FILE {
-		filename, err := s.nextFileName()
+// recoverMemtables rebuilds the memtables of every family from any write-ahead logs left behind
+// by a previous process, skipping writes a family has already flushed, and moves their contents
+// into a new log.
+func (s *SortedFileKvStorage) recoverMemtables() error {
+	logs, err := findWriteAheadLogs(s.fs)
+	if err != nil {
+		return err
+	}
+	byID := make(map[int64]*ColumnFamily, len(s.families))
+	families := make([]*ColumnFamily, 0, len(s.families))
+	for _, f := range s.families {
+		byID[f.id] = f
+		families = append(families, f)
+	}
+	for _, log := range logs {
+		err = replayWrites(s.fs, log, func(id int64, r record.Record) {
+			// writes to dropped families are skipped along with those already flushed
+			if f, ok := byID[id]; ok && log.number >= f.logNumber {
+				f.memtable.Insert(r.Key, encodeEntry(r))
+			}
+		})
 		if err != nil {
-			return fmt.Errorf("failed to infer next filename in series: %v", err)
+			return err
 		}
-		err = writeBstToSortedFile(&s.memtable, filename, s.fs)
+	}
+
+	number := s.allocateFileNumber()
+	filename := walFileName(strconv.FormatInt(number, 10))
+
+	// Durably write the recovered records to the new log before any of the old ones are removed
+	recovered := false
+	for _, f := range families {
+		f.memtableLog = number
+		recovered = recovered || f.memtable.Size() > 0
+	}
+	if recovered {
+		tmpFilename := filename + TMP_SUFFIX
+		err = writeMemtablesToLog(families, tmpFilename, s.fs)
 		if err != nil {
-			return fmt.Errorf("failed to write memtable to file: %v", err)
+			return fmt.Errorf("failed to write recovered records: %v", err)
 		}
-		file, err := NewSortedFile(filename, s.fs)
+		err = s.fs.Rename(tmpFilename, filename)
 		if err != nil {
-			return fmt.Errorf("failed to read new sorted file: %v", err)
+			return fmt.Errorf("failed to move recovered write-ahead log into place: %v", err)
+		}
+	}
+	for _, log := range logs {
+		err = s.fs.Remove(log.filename)
+		if err != nil {
+			return fmt.Errorf("failed to remove old write-ahead log '%s': %v", log.filename, err)
 		}
-		s.files = append(s.files, file)
-		s.memtable = bst.BinarySearchTree{}
 	}
 
-	return nil
+	return s.startLog(number)
 }
 
-func (s *SortedFileKvStorage) nextFileName() (string, error) {
-	files, err := afero.ReadDir(s.fs, ".")
+// openSortedFiles opens every sorted file recorded in the manifest in its family and level, and
+// removes any files that aren't part of the store
+func (s *SortedFileKvStorage) openSortedFiles() error {
+	families, nextFileNumber, recorded, err := readManifest(s.fs)
 	if err != nil {
-		return "", fmt.Errorf("failed to list files: %v", err)
+		return err
+	}
+	if !recorded {
+		l, err := s.upgradeLegacyStore()
+		if err != nil {
+			return err
+		}
+		families[DEFAULT_FAMILY_ID].levels = l
 	}
 
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].ModTime().UnixMicro() < files[j].ModTime().UnixMicro()
-	})
+	live := make(map[string]bool)
+	highest := int64(-1)
+	for id, fl := range families {
+		var levels [NUM_LEVELS][]*SortedFile
+		for i, filenames := range fl.levels {
+			for _, filename := range filenames {
+				file, err := s.openSortedFile(filename)
+				if err != nil {
+					return fmt.Errorf("failed to open sorted file: %w", err)
+				}
+				levels[i] = append(levels[i], file)
+				live[filename] = true
+			}
+			if i > 0 {
+				sort.Slice(levels[i], func(a, b int) bool {
+					return levels[i][a].smallest < levels[i][b].smallest
+				})
+			}
+		}
+
+		o := s.opts
+		if fl.options != nil {
+			o = fl.options.apply(o)
+		}
+		f := newColumnFamily(s, id, fl.name, o, newVersion(levels))
+		f.logNumber = fl.logNumber
+		s.families[f.name] = f
+		if id == DEFAULT_FAMILY_ID {
+			s.defaultFamily = f
+		}
+		if n := fl.levels.highestFileNumber(); n > highest {
+			highest = n
+		}
+		if id != DEFAULT_FAMILY_ID && id > highest {
+			highest = id
+		}
+	}
+
+	// Numbers are never reused, so numbering carries on after every file and family in the
+	// store, and every log that is about to be replayed
+	if highest >= nextFileNumber {
+		nextFileNumber = highest + 1
+	}
+	logs, err := findWriteAheadLogs(s.fs)
+	if err != nil {
+		return err
+	}
+	if len(logs) > 0 && logs[len(logs)-1].number >= nextFileNumber {
+		nextFileNumber = logs[len(logs)-1].number + 1
+	}
+	s.nextFileNumber = nextFileNumber
+
+	s.manifest, err = writeManifest(s.fs, s.snapshotEdits())
+	if err != nil {
+		return err
+	}
+	return removeObsoleteFiles(s.fs, live)
+}
+
+// removeObsoleteFiles removes every file that isn't needed now the manifest records which files
+// are live: sorted files left behind by a flush or compaction that didn't finish, and temporary
+// files from an interrupted rewrite. It must only be called before
+// any flushes or compactions have started.
+func removeObsoleteFiles(fs afero.Fs, live map[string]bool) error {
+	files, err := afero.ReadDir(fs, ".")
+	if err != nil {
+		return fmt.Errorf("failed to list files: %v", err)
+	}
+	for _, f := range files {
+		if f.IsDir() || !isObsoleteFile(f.Name(), live) {
+			continue
+		}
+		err = fs.Remove(f.Name())
+		if err != nil {
+			return fmt.Errorf("failed to remove obsolete file '%s': %v", f.Name(), err)
+		}
+	}
+	return nil
+}
+
+func isObsoleteFile(filename string, live map[string]bool) bool {
+	switch {
+	case strings.HasSuffix(filename, TMP_SUFFIX):
+		base := strings.TrimSuffix(filename, TMP_SUFFIX)
+		return base == MANIFEST_FILENAME || isNumbered(strings.TrimSuffix(base, WAL_SUFFIX))
+	default:
+		return isNumbered(filename) && !live[filename]
+	}
+}
+
+func isNumbered(filename string) bool {
+	_, err := strconv.Atoi(filename)
+	return err == nil
+}
+
+// openSortedFile opens a sorted file left behind by a previous process
+func (s *SortedFileKvStorage) openSortedFile(filename string) (*SortedFile, error) {
+	return newSortedFile(filename, s.fs, s.readOptions())
+}
+
+// readOptions returns the settings for reading sorted files, which share the store's caches
+func (s *SortedFileKvStorage) readOptions() readOptions {
+	return readOptions{blocks: s.blockCache, handles: s.handleCache, mmap: s.opts.mmapReads}
+}
+
+// listNumberedFiles returns the numbers of all files named as an integer followed by suffix,
+// in ascending order
+func listNumberedFiles(fs afero.Fs, suffix string) ([]int, error) {
+	files, err := afero.ReadDir(fs, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
 
-	// all filenames are just integers, starting at 0
-	var last int = -1
+	numbers := make([]int, 0)
 	for _, f := range files {
-		if !f.IsDir() {
-			fileNumber, err := strconv.Atoi(f.Name())
+		if !f.IsDir() && strings.HasSuffix(f.Name(), suffix) {
+			fileNumber, err := strconv.Atoi(strings.TrimSuffix(f.Name(), suffix))
 			if err == nil {
-				last = fileNumber
+				numbers = append(numbers, fileNumber)
 			}
 		}
 	}
+	sort.Ints(numbers)
 
-	return strconv.Itoa(last + 1), nil
+	return numbers, nil
 }
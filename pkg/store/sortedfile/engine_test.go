@@ -1,32 +1,30 @@
 package sortedfile
 
 import (
-	"path"
+	"fmt"
 	"strconv"
 	"testing"
 
+	"github.com/haydenjeune/kvstore/pkg/memtable"
 	"github.com/spf13/afero"
 )
 
-func Test_nextFileNameForDir_Returns0ForEmptyDir(t *testing.T) {
+func Test_SortedFileKvStorage_allocateFileName_FollowsMemtableInEmptyDir(t *testing.T) {
 	fs := afero.NewMemMapFs()
 	s, err := NewSortedFileKvStorage(fs)
 	if err != nil {
 		t.Fatalf("Unexpected error initialising storage: %v", err)
 	}
+	defer s.Close()
 
-	result, err := s.nextFileName()
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-
-	expected := "0"
-	if path.Base(result) != expected {
+	// the log takes "0"
+	expected := "1"
+	if result := s.allocateFileName(); result != expected {
 		t.Fatalf("Expected filename '%s', got '%s'", expected, result)
 	}
 }
 
-func Test_nextFileNameForDir_ReturnsCorrectNextFile(t *testing.T) {
+func Test_SortedFileKvStorage_allocateFileName_SkipsExistingFiles(t *testing.T) {
 	fs := afero.NewMemMapFs()
 	fs.Create("0")
 	fs.Create("1")
@@ -35,14 +33,11 @@ func Test_nextFileNameForDir_ReturnsCorrectNextFile(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error initialising storage: %v", err)
 	}
+	defer s.Close()
 
-	result, err := s.nextFileName()
-	if err != nil {
-		t.Fatalf("Unexpected error: %v", err)
-	}
-
-	expected := "4"
-	if path.Base(result) != expected {
+	// the log takes "4"
+	expected := "5"
+	if result := s.allocateFileName(); result != expected {
 		t.Fatalf("Expected filename '%s', got '%s'", expected, result)
 	}
 }
@@ -61,13 +56,215 @@ func Test_SortedFileKvStorage_CorrectlyWritesSortedFile(t *testing.T) {
 		}
 	}
 
+	storage.Flush()
+
 	result, exists, err := storage.Get("33")
 	if err != nil || !exists || result != "66" {
 		t.Fatalf("Failed to get record '33': %v", err)
 	}
 
-	exists, _ = afero.Exists(fs, "0")
+	filename := storage.defaultFamily.current.levels[0][0].Name()
+	exists, _ = afero.Exists(fs, filename)
 	if !exists {
-		t.Fatalf("Expected a file with name '0' to be written")
+		t.Fatalf("Expected a file with name '%s' to be written", filename)
+	}
+}
+
+func Test_SortedFileKvStorage_FlushesEveryKindOfMemtable(t *testing.T) {
+	for _, kind := range []memtable.Kind{memtable.AVLTree, memtable.UnbalancedTree, memtable.SkipList} {
+		fs := afero.NewMemMapFs()
+		storage, err := NewSortedFileKvStorage(fs, WithMemtable(kind), WithMemtableSize(1<<10))
+		if err != nil {
+			t.Fatalf("Failed to init storage: %v", err)
+		}
+
+		// out of order, so the memtable has to sort the keys before they are flushed
+		for i := 0; i < 150; i++ {
+			storage.Set(strconv.Itoa((i*37)%150), strconv.Itoa(i))
+		}
+		storage.Flush()
+		storage.Close()
+
+		storage, _ = NewSortedFileKvStorage(fs)
+		for i := 0; i < 150; i++ {
+			key, expected := strconv.Itoa((i*37)%150), strconv.Itoa(i)
+			if result, _, err := storage.Get(key); err != nil || result != expected {
+				t.Fatalf("Expected '%s' to be '%s' after flushing memtable kind %d, got '%s', %v", key, expected, kind, result, err)
+			}
+		}
+		storage.Close()
+	}
+}
+
+func Test_SortedFileKvStorage_RecoversMemtableFromWriteAheadLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+
+	// write past a flush, so that some records are in a sorted file and some only in the log
+	for i := 0; i < 150; i++ {
+		storage.Set(strconv.Itoa(i), strconv.Itoa(i*2))
+		if i == 99 {
+			storage.Flush()
+		}
+	}
+	storage.Set("1", "updated")
+	// no Close, as if the process had crashed
+
+	storage, err = NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	for key, expected := range map[string]string{"120": "240", "149": "298", "1": "updated"} {
+		result, exists, err := storage.Get(key)
+		if err != nil || !exists || result != expected {
+			t.Fatalf("Expected '%s' to be '%s' after reopening, got '%s', %v, %v", key, expected, result, exists, err)
+		}
+	}
+
+	// the recovered records should survive another restart too
+	storage.Close()
+	storage, _ = NewSortedFileKvStorage(fs)
+	if result, _, _ := storage.Get("149"); result != "298" {
+		t.Fatalf("Expected '149' to be '298' after reopening twice, got '%s'", result)
+	}
+}
+
+func Test_SortedFileKvStorage_RemovesWriteAheadLogAfterFlush(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		storage.Set(strconv.Itoa(i), strconv.Itoa(i))
+	}
+	storage.Flush()
+
+	if exists, _ := afero.Exists(fs, walFileName("0")); exists {
+		t.Fatal("Expected the log for flushed file '0' to be removed")
+	}
+	if exists, _ := afero.Exists(fs, walFileName("1")); !exists {
+		t.Fatal("Expected a log to be started for the next file")
+	}
+}
+
+func Test_SortedFileKvStorage_ReopensExistingSortedFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+
+	// write past several flushes, updating some keys in later files
+	for i := 0; i < 350; i++ {
+		storage.Set(strconv.Itoa(i%250), strconv.Itoa(i))
+		if i%100 == 99 {
+			storage.Flush()
+		}
+	}
+	filenames := make([]string, 0)
+	for _, f := range storage.defaultFamily.current.levels[0] {
+		filenames = append(filenames, f.Name())
+	}
+	storage.Close()
+
+	storage, err = NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	if len(storage.defaultFamily.current.levels[0]) != 3 {
+		t.Fatalf("Expected 3 sorted files to be reopened, got %d", len(storage.defaultFamily.current.levels[0]))
+	}
+	for key, expected := range map[string]string{"5": "255", "99": "349", "120": "120", "249": "249"} {
+		result, exists, err := storage.Get(key)
+		if err != nil || !exists || result != expected {
+			t.Fatalf("Expected '%s' to be '%s' after reopening, got '%s', %v, %v", key, expected, result, exists, err)
+		}
+	}
+
+	// numbering should carry on from the reopened files rather than overwriting them
+	storage.compactionMu.Lock()
+	storage.defaultFamily.compactionPicker.(*leveledPicker).l0Trigger = 100 // keep the files in level 0 to check them
+	storage.compactionMu.Unlock()
+	for i := 0; i < 100; i++ {
+		storage.Set("new"+strconv.Itoa(i), "value")
+	}
+	storage.Flush()
+	storage.mu.RLock()
+	defer storage.mu.RUnlock()
+	if len(storage.defaultFamily.current.levels[0]) != 4 {
+		t.Fatalf("Expected the next flush to add a fourth file, got %d files", len(storage.defaultFamily.current.levels[0]))
+	}
+	for i, f := range storage.defaultFamily.current.levels[0][:3] {
+		if f.Name() != filenames[i] {
+			t.Fatalf("Expected reopened file '%s' to be kept, got '%s'", filenames[i], f.Name())
+		}
+	}
+}
+
+func Test_SortedFileKvStorage_RemovesIncompleteSortedFileOnStartup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	storage.Set("a", "1")
+	storage.Close()
+
+	// a partially written sorted file, as if the process crashed while flushing the memtable
+	afero.WriteFile(fs, "0", []byte("garbage"), 0644)
+
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	if result, exists, err := storage.Get("a"); err != nil || !exists || result != "1" {
+		t.Fatalf("Expected 'a' to be recovered from the log, got '%s', %v, %v", result, exists, err)
+	}
+}
+
+func Test_SortedFileKvStorage_Close_CanBeCalledTwice(t *testing.T) {
+	storage, _ := NewSortedFileKvStorage(afero.NewMemMapFs())
+	storage.Set("a", "1")
+
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close storage: %v", err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Expected closing again to do nothing, got %v", err)
+	}
+}
+
+func Test_SortedFileKvStorage_Close_ReleasesEverythingAfterAnError(t *testing.T) {
+	fs := newMappableTestFs(t)
+	storage, err := NewSortedFileKvStorage(fs, WithMemtableSize(4<<10))
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		storage.Set(fmt.Sprintf("key%04d", i), "value"+strconv.Itoa(i))
+	}
+	storage.waitForFlushes()
+	files := storage.defaultFamily.current.levels[0]
+	if len(files) == 0 {
+		t.Fatalf("Expected the writes to have been flushed to sorted files")
+	}
+	storage.wal.file.Close() // so closing the write-ahead log fails
+
+	err = storage.Close()
+	if err == nil {
+		t.Fatalf("Expected an error from closing the write-ahead log")
+	}
+	if storage.manifest.file.Close() == nil {
+		t.Fatalf("Expected the manifest to have been closed")
+	}
+	for _, file := range files {
+		if file.mapped != nil {
+			t.Fatalf("Expected sorted file '%s' to have been unmapped", file.filename)
+		}
+	}
+	if second := storage.Close(); second != err {
+		t.Fatalf("Expected closing again to return the first error, got %v", second)
 	}
 }
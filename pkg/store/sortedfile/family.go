@@ -0,0 +1,224 @@
+package sortedfile
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+// A store holds one or more column families, each a separate keyspace with its own memtable,
+// sorted files and tuning. Every store has the default family, which the store's own Get, Set
+// and Delete use, and others can be created and dropped while it is open. The families share the
+// write-ahead log, so that a WriteBatch can change keys in several of them atomically, along
+// with the manifest, the caches, and the background flusher and compactor.
+//
+// Each family records in the manifest the first log that may hold writes it hasn't flushed to
+// sorted files, so that on startup the writes it has already flushed aren't replayed again.
+
+const DEFAULT_COLUMN_FAMILY = "default"
+
+// DEFAULT_FAMILY_ID is the id of the default family. Other families take their ids from the
+// same sequence as file numbers, so no family reuses the id of one that was dropped.
+const DEFAULT_FAMILY_ID int64 = 0
+
+type ColumnFamily struct {
+	store *SortedFileKvStorage
+	id    int64
+	name  string
+	opts  options
+
+	// guarded by the store's mu, except that memtable is only replaced by the writer at the front
+	// of the store's queue, which writes to it without holding mu
+	memtable    memtable.Memtable
+	memtableLog int64    // the first log holding writes in the memtable, if it isn't empty
+	current     *version // the family's sorted files
+	logNumber   int64    // every write to the family in earlier logs is in its sorted files
+	dropped     bool
+
+	compactionPicker compactionPicker // only used with the store's compactionMu held
+	stats            stats
+}
+
+func newColumnFamily(s *SortedFileKvStorage, id int64, name string, o options, v *version) *ColumnFamily {
+	v.ref()
+	return &ColumnFamily{
+		store:            s,
+		id:               id,
+		name:             name,
+		opts:             o,
+		memtable:         memtable.New(o.memtableKind),
+		current:          v,
+		compactionPicker: newCompactionPicker(o),
+	}
+}
+
+// Name returns the name the family was created with
+func (f *ColumnFamily) Name() string {
+	return f.name
+}
+
+func (f *ColumnFamily) Get(key string) (string, bool, error) {
+	s := f.store
+	s.mu.RLock()
+	if f.dropped {
+		s.mu.RUnlock()
+		return "", false, fmt.Errorf("failed to get key '%s': %w", key, f.errDropped())
+	}
+	v, err := s.acquireVersion(f)
+	if err != nil {
+		s.mu.RUnlock()
+		return "", false, fmt.Errorf("failed to get key '%s': %w", key, err)
+	}
+	// the memtables are searched once mu is released, so that reads don't wait for writes
+	mem, immutables := f.memtable, s.immutables
+	s.mu.RUnlock()
+	defer s.releaseVersion(v)
+
+	entry, exists := mem.Search(key)
+	for i := len(immutables) - 1; i >= 0 && !exists; i-- {
+		if immutables[i].family == f {
+			entry, exists = immutables[i].memtable.Search(key)
+		}
+	}
+	if exists {
+		r := decodeEntry(key, entry)
+		return r.Value, !r.Deleted, nil
+	}
+
+	r, exists, err := v.get(key, &f.stats)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to get key '%s': %w", key, err)
+	}
+	return r.Value, exists && !r.Deleted, nil
+}
+
+func (f *ColumnFamily) Set(key string, value string) error {
+	b := &WriteBatch{}
+	b.Set(f, key, value)
+	return f.store.Write(b)
+}
+
+// Delete removes key from the family. Until compaction catches up, this is recorded as a
+// tombstone that shadows any older values for the key.
+func (f *ColumnFamily) Delete(key string) error {
+	b := &WriteBatch{}
+	b.Delete(f, key)
+	return f.store.Write(b)
+}
+
+// insert adds a write, already appended to the log, to the memtable. It must only be called by
+// the writer at the front of the store's queue, having set memtableLog if the memtable was empty.
+func (f *ColumnFamily) insert(r record.Record) {
+	f.memtable.Insert(r.Key, encodeEntry(r))
+	atomic.AddInt64(&f.stats.userBytes, r.Size())
+}
+
+func (f *ColumnFamily) errDropped() error {
+	return fmt.Errorf("column family '%s' has been dropped", f.name)
+}
+
+// ColumnFamily returns the family called name, if there is one
+func (s *SortedFileKvStorage) ColumnFamily(name string) (*ColumnFamily, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	f, ok := s.families[name]
+	return f, ok
+}
+
+// ColumnFamilies returns the names of every family in the store, in order
+func (s *SortedFileKvStorage) ColumnFamilies() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.families))
+	for name := range s.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CreateColumnFamily adds an empty family called name to the store. It starts from the options
+// the store was opened with, changed by opts, which are recorded so that the family keeps them
+// when the store is reopened. Only WithMemtableSize, WithMemtable, WithCompression,
+// WithCompactionStrategy, WithTargetFileSize and WithBloomFilterBitsPerKey apply to a single
+// family, and any other options are ignored.
+func (s *SortedFileKvStorage) CreateColumnFamily(name string, opts ...Option) (*ColumnFamily, error) {
+	if name == "" {
+		return nil, errors.New("failed to create column family: name is empty")
+	}
+	o := s.opts
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.backgroundErr != nil {
+		return nil, s.backgroundErr
+	}
+	if _, ok := s.families[name]; ok {
+		return nil, fmt.Errorf("failed to create column family: '%s' already exists", name)
+	}
+
+	f := newColumnFamily(s, s.allocateFileNumber(), name, o.familyOptions(s.opts), newVersion([NUM_LEVELS][]*SortedFile{}))
+	s.families[name] = f
+	err := s.logEdit(f.snapshotEdit(atomic.LoadInt64(&s.nextFileNumber)))
+	if err != nil {
+		delete(s.families, name)
+		return nil, fmt.Errorf("failed to create column family '%s': %v", name, err)
+	}
+	return f, nil
+}
+
+// DropColumnFamily removes the family called name and all of its keys from the store. Its
+// sorted files are removed once no reads are using them. The default family can't be dropped.
+func (s *SortedFileKvStorage) DropColumnFamily(name string) error {
+	if name == DEFAULT_COLUMN_FAMILY {
+		return errors.New("failed to drop column family: the default family can't be dropped")
+	}
+
+	// wait for any running compaction, so that none finishes for a family that's gone
+	s.compactionMu.Lock()
+	defer s.compactionMu.Unlock()
+
+	s.mu.Lock()
+	if s.backgroundErr != nil {
+		s.mu.Unlock()
+		return s.backgroundErr
+	}
+	f, ok := s.families[name]
+	if !ok {
+		s.mu.Unlock()
+		return fmt.Errorf("failed to drop column family: '%s' doesn't exist", name)
+	}
+
+	delete(s.families, name)
+	f.dropped = true
+	err := s.logEdit(manifestEdit{Family: f.id, DropFamily: true, NextFileNumber: atomic.LoadInt64(&s.nextFileNumber)})
+	if err != nil {
+		s.families[name] = f
+		f.dropped = false
+		s.mu.Unlock()
+		return fmt.Errorf("failed to drop column family '%s': %v", name, err)
+	}
+
+	// memtables waiting to be flushed are discarded, including any being flushed right now
+	immutables := make([]*immutableMemtable, 0, len(s.immutables))
+	for _, m := range s.immutables {
+		if m.family != f {
+			immutables = append(immutables, m)
+		}
+	}
+	s.immutables = immutables
+	s.flushed.Broadcast()
+	f.current.unref()
+	obsolete := s.obsoleteLogsLocked()
+	s.mu.Unlock()
+
+	return s.removeLogs(obsolete)
+}
@@ -0,0 +1,196 @@
+package sortedfile
+
+import (
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func Test_ColumnFamily_KeepsKeysSeparateFromOtherFamilies(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	defer storage.Close()
+
+	users, err := storage.CreateColumnFamily("users")
+	if err != nil {
+		t.Fatalf("Failed to create column family: %v", err)
+	}
+	storage.Set("a", "default")
+	users.Set("a", "users")
+	users.Set("b", "users")
+
+	for _, flush := range []bool{false, true} {
+		if flush {
+			storage.Flush()
+		}
+		if result, _, _ := storage.Get("a"); result != "default" {
+			t.Fatalf("Expected 'a' to be 'default' in the default family, got '%s'", result)
+		}
+		if result, _, _ := users.Get("a"); result != "users" {
+			t.Fatalf("Expected 'a' to be 'users' in the users family, got '%s'", result)
+		}
+		if _, exists, _ := storage.Get("b"); exists {
+			t.Fatal("Expected 'b' not to exist in the default family")
+		}
+	}
+	if names := storage.ColumnFamilies(); !reflect.DeepEqual(names, []string{DEFAULT_COLUMN_FAMILY, "users"}) {
+		t.Fatalf("Expected families 'default' and 'users', got %v", names)
+	}
+}
+
+func Test_SortedFileKvStorage_CreateColumnFamily_RefusesExistingName(t *testing.T) {
+	storage, _ := NewSortedFileKvStorage(afero.NewMemMapFs())
+	defer storage.Close()
+
+	storage.CreateColumnFamily("users")
+	for _, name := range []string{"users", DEFAULT_COLUMN_FAMILY, ""} {
+		if _, err := storage.CreateColumnFamily(name); err == nil {
+			t.Fatalf("Expected creating family '%s' to fail", name)
+		}
+	}
+}
+
+func Test_SortedFileKvStorage_CreateColumnFamily_KeepsOptionsAcrossReopen(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	logs, _ := storage.CreateColumnFamily("logs", WithMemtableSize(1<<10), WithCompression(FlateCompression), WithCompactionStrategy(SizeTiered), WithMaxOpenFiles(1))
+	for i := 0; i < 100; i++ {
+		logs.Set("key"+strconv.Itoa(i), "value")
+	}
+	storage.Close()
+
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	logs, ok := storage.ColumnFamily("logs")
+	if !ok {
+		t.Fatal("Expected the 'logs' family to be reopened")
+	}
+	if logs.opts.memtableSize != 1<<10 || logs.opts.compression != FlateCompression || logs.opts.compactionStrategy != SizeTiered {
+		t.Fatalf("Expected the family's options to be kept, got %+v", logs.opts)
+	}
+	if logs.opts.maxOpenFiles != storage.opts.maxOpenFiles {
+		t.Fatal("Expected options for the whole store to be ignored")
+	}
+	if _, ok := logs.compactionPicker.(*sizeTieredPicker); !ok {
+		t.Fatalf("Expected the family to compact with its own strategy")
+	}
+	if storage.defaultFamily.opts.compression != NoCompression {
+		t.Fatal("Expected the default family to keep the store's options")
+	}
+	if result, _, _ := logs.Get("key99"); result != "value" {
+		t.Fatalf("Expected 'key99' to be 'value', got '%s'", result)
+	}
+}
+
+func Test_SortedFileKvStorage_DropColumnFamily_RemovesFamilyAndFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	users, _ := storage.CreateColumnFamily("users")
+	for i := 0; i < 100; i++ {
+		users.Set("key"+strconv.Itoa(i), "value")
+	}
+	storage.Set("a", "1")
+	storage.Flush()
+	filename := users.current.levels[0][0].Name()
+
+	err := storage.DropColumnFamily("users")
+	if err != nil {
+		t.Fatalf("Failed to drop column family: %v", err)
+	}
+	if exists, _ := afero.Exists(fs, filename); exists {
+		t.Fatalf("Expected the family's file '%s' to be removed", filename)
+	}
+	if err := users.Set("a", "1"); err == nil {
+		t.Fatal("Expected writes to a dropped family to fail")
+	}
+	if _, _, err := users.Get("a"); err == nil {
+		t.Fatal("Expected reads from a dropped family to fail")
+	}
+	if err := storage.DropColumnFamily(DEFAULT_COLUMN_FAMILY); err == nil {
+		t.Fatal("Expected dropping the default family to fail")
+	}
+	storage.Close()
+
+	storage, _ = NewSortedFileKvStorage(fs)
+	defer storage.Close()
+	if _, ok := storage.ColumnFamily("users"); ok {
+		t.Fatal("Expected the dropped family to stay dropped after reopening")
+	}
+	if result, _, _ := storage.Get("a"); result != "1" {
+		t.Fatalf("Expected 'a' to be '1' in the default family, got '%s'", result)
+	}
+
+	// the name can be used again, for a new empty family
+	users, err = storage.CreateColumnFamily("users")
+	if err != nil {
+		t.Fatalf("Failed to recreate column family: %v", err)
+	}
+	if _, exists, _ := users.Get("key1"); exists {
+		t.Fatal("Expected the recreated family to be empty")
+	}
+}
+
+func Test_SortedFileKvStorage_RecoversOnlyUnflushedWritesOfEachFamily(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	users, _ := storage.CreateColumnFamily("users", WithMemtableSize(1<<10))
+
+	// the default family's write stays in the first log while users flushes past it
+	storage.Set("a", "1")
+	for i := 0; i < 100; i++ {
+		users.Set("key"+strconv.Itoa(i), "value")
+	}
+	storage.waitForFlushes()
+	// no Close, as if the process had crashed
+
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	users, _ = storage.ColumnFamily("users")
+	if result, _, _ := storage.Get("a"); result != "1" {
+		t.Fatalf("Expected 'a' to be recovered, got '%s'", result)
+	}
+	for i := 0; i < 100; i++ {
+		if result, _, _ := users.Get("key" + strconv.Itoa(i)); result != "value" {
+			t.Fatalf("Expected 'key%d' to be 'value', got '%s'", i, result)
+		}
+	}
+
+	// writes already in the family's sorted files shouldn't be replayed into its memtable
+	flushed := 0
+	for _, level := range users.current.levels {
+		flushed += len(level)
+	}
+	if flushed == 0 || users.memtable.Size() >= 100 {
+		t.Fatalf("Expected only unflushed writes to be recovered, got %d files and %d keys in the memtable", flushed, users.memtable.Size())
+	}
+}
+
+func Test_SortedFileKvStorage_KeepsLogUntilEveryFamilyHasFlushed(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	defer storage.Close()
+	users, _ := storage.CreateColumnFamily("users", WithMemtableSize(1<<10))
+
+	first := storage.wal.filename
+	storage.Set("a", "1")
+	for i := 0; i < 100; i++ {
+		users.Set("key"+strconv.Itoa(i), "value")
+	}
+	storage.waitForFlushes()
+	if exists, _ := afero.Exists(fs, first); !exists {
+		t.Fatal("Expected the first log to be kept while the default family hasn't flushed")
+	}
+
+	storage.Flush()
+	if exists, _ := afero.Exists(fs, first); exists {
+		t.Fatal("Expected the first log to be removed once every family has flushed")
+	}
+}
@@ -1,166 +1,549 @@
 package sortedfile
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"strings"
+	"sync/atomic"
 
-	"github.com/haydenjeune/kvstore/pkg/bst"
+	"github.com/haydenjeune/kvstore/pkg/bloom"
+	"github.com/haydenjeune/kvstore/pkg/keyoffset"
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+	"github.com/haydenjeune/kvstore/pkg/record"
 	"github.com/spf13/afero"
 )
 
 type SortedFile struct {
-	index    []KeyOffset
+	index    *keyoffset.Index // the last key in each data block
+	filter   *bloom.Filter    // nil if the file has no filter
 	filename string
 	fs       afero.Fs
+	cache    *blockCache // nil if blocks aren't cached
+	cacheID  uint64
+	handles  *handleCache // nil if the file is opened for each read
+	mapped   []byte       // the whole file mapped into memory, or nil if it is read through fs
+
+	smallest string // the first key in the file
+	largest  string // the last key in the file
+	size     int64
+
+	// the size of the data blocks as stored, and before they were compressed
+	storedDataSize int64
+	dataSize       int64
+
+	// refs counts the versions of the store that include this file. Once none do, the file
+	// has been replaced by compaction and can be removed.
+	refs int32
 }
 
-type KeyOffset struct {
-	Key    string
-	Offset int64
+// NewSortedFile opens a sorted file, reading only its footer, index and meta blocks, and maps it
+// into memory if it can. It should be closed once it is no longer needed.
+func NewSortedFile(filename string, fs afero.Fs) (*SortedFile, error) {
+	return newSortedFile(filename, fs, readOptions{mmap: true})
 }
 
-const RECORDS_PER_INDEX_ENTRY uint = 10
-const MAX_RECORDS_PER_FILE uint = 100
+// readOptions configures how a sorted file is read, sharing caches with the rest of its store
+type readOptions struct {
+	blocks  *blockCache  // nil if blocks aren't cached
+	handles *handleCache // nil if the file is opened for each read
+	mmap    bool         // map the file into memory if it can be
+}
 
-func NewSortedFile(filename string, fs afero.Fs) (*SortedFile, error) {
-	index, err := newSparseIndexFromFile(filename, fs)
+// newSortedFile opens a sorted file to be read as opts describes
+func newSortedFile(filename string, fs afero.Fs, opts readOptions) (*SortedFile, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open file '%s': %v", filename, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stats from file '%s': %v", filename, err)
+	}
+	if info.Size() < FOOTER_SIZE {
+		return nil, fmt.Errorf("failed to read file '%s': %w", filename, &record.ErrCorrupt{Offset: 0, Reason: "file is too short to be a table"})
+	}
+
+	footer := make([]byte, FOOTER_SIZE)
+	_, err = f.ReadAt(footer, info.Size()-FOOTER_SIZE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read footer of file '%s': %v", filename, err)
+	}
+	metaHandle, indexHandle, err := decodeFooter(footer, info.Size())
 	if err != nil {
-		return nil, fmt.Errorf("failed to build index from file '%s': %v", filename, err)
+		return nil, fmt.Errorf("failed to read footer of file '%s': %w", filename, err)
 	}
-	return &SortedFile{
-		index:    index,
-		filename: filename,
-		fs:       fs,
-	}, nil
+
+	indexBlock, err := readBlock(f, indexHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of file '%s': %w", filename, err)
+	}
+	index, err := decodeIndex(indexBlock, indexHandle.offset, metaHandle.offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index of file '%s': %w", filename, err)
+	}
+	metaBlock, err := readBlock(f, metaHandle)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meta block of file '%s': %w", filename, err)
+	}
+	properties, err := decodeMeta(metaBlock, metaHandle.offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read meta block of file '%s': %w", filename, err)
+	}
+
+	// the data blocks fill the file up to the meta block, less their trailers
+	storedDataSize := metaHandle.offset - int64(index.Len())*BLOCK_TRAILER_SIZE
+	file := &SortedFile{
+		index:          index,
+		filename:       filename,
+		fs:             fs,
+		size:           info.Size(),
+		storedDataSize: storedDataSize,
+		dataSize:       storedDataSize,
+		cache:          opts.blocks,
+		handles:        opts.handles,
+	}
+	if opts.blocks != nil {
+		file.cacheID = opts.blocks.newFileID()
+	}
+	if index.Len() > 0 {
+		file.smallest = string(properties[META_SMALLEST])
+		file.largest = index.At(index.Len() - 1).Key
+	}
+	if encoded, ok := properties[META_DATA_SIZE]; ok {
+		r := fieldReader{b: encoded}
+		file.dataSize = r.uvarint()
+		if r.bad || !r.done() {
+			return nil, fmt.Errorf("failed to read meta block of file '%s': %w", filename, &record.ErrCorrupt{Offset: metaHandle.offset, Reason: "data size is malformed"})
+		}
+	}
+	if encoded, ok := properties[META_FILTER]; ok {
+		file.filter, err = bloom.Decode(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read filter of file '%s': %w", filename, &record.ErrCorrupt{Offset: metaHandle.offset, Reason: err.Error()})
+		}
+	}
+	if opts.mmap {
+		file.mapped = mapFile(fs, filename, info.Size())
+	}
+	return file, nil
 }
 
-func (s *SortedFile) Get(key string) (string, bool, error) {
-	f, err := s.fs.Open(s.filename)
+// filterResult records whether a lookup was ruled out by a file's filter
+type filterResult int
+
+const (
+	filterNotChecked filterResult = iota // the key was out of range, or the file has no filter
+	filterExcluded                       // the filter said the file doesn't have the key
+	filterPassed                         // the filter said the file may have the key
+)
+
+// Get returns the record for key if the file has one, which may be a tombstone
+func (s *SortedFile) Get(key string) (record.Record, bool, error) {
+	r, exists, _, err := s.get(key)
+	return r, exists, err
+}
+
+func (s *SortedFile) get(key string) (record.Record, bool, filterResult, error) {
+	if s.index.Len() == 0 || key < s.smallest || key > s.largest {
+		return record.Record{}, false, filterNotChecked, nil
+	}
+	filtered := filterNotChecked
+	if s.filter != nil {
+		if !s.filter.MayContain(key) {
+			return record.Record{}, false, filterExcluded, nil
+		}
+		filtered = filterPassed
+	}
+
+	// the key can only be in the first block that ends at or after it, which there always is
+	// as the key is no larger than the last key in the file
+	entry, _ := s.index.Ceiling(key)
+	handle := blockOf(entry)
+	block, err := s.readDataBlock(handle)
 	if err != nil {
-		return "", false, fmt.Errorf("failed to open sorted file '%s': %v", s.filename, err)
+		return record.Record{}, false, filtered, err
 	}
 
-	info, err := f.Stat()
+	r, exists, err := searchBlock(block, handle.offset, key)
 	if err != nil {
-		return "", false, fmt.Errorf("failed to get stats from file '%s': %v", s.filename, err)
+		return record.Record{}, false, filtered, fmt.Errorf("failed to read file '%s': %w", s.filename, err)
+	}
+	return r, exists, filtered, nil
+}
+
+// searchBlock returns the record for key in a data block that starts at offset. Keys are
+// compared where they lie in the block, and only the record found is decoded.
+func searchBlock(block []byte, offset int64, key string) (record.Record, bool, error) {
+	for pos := int64(0); pos < int64(len(block)); {
+		recordKey, size, ok := record.PeekKey(block[pos:])
+		if !ok {
+			return record.Record{}, false, &record.ErrCorrupt{Offset: offset + pos, Reason: "data ends part of the way through a record"}
+		}
+		if string(recordKey) == key {
+			r, err := record.Decode(block[pos:pos+size], offset+pos)
+			if err != nil {
+				return record.Record{}, false, err
+			}
+			return r, true, nil
+		} else if string(recordKey) > key {
+			return record.Record{}, false, nil
+		}
+		pos += size
 	}
+	return record.Record{}, false, nil
+}
 
-	l, r := getInterval(s.index, key)
+// readDataBlock returns the contents of a data block, from the mapping or the cache if it's there
+func (s *SortedFile) readDataBlock(handle blockHandle) ([]byte, error) {
+	var stored []byte
+	if s.mapped != nil {
+		end := handle.offset + handle.size + BLOCK_TRAILER_SIZE
+		if end > int64(len(s.mapped)) {
+			return nil, fmt.Errorf("failed to read block in file '%s': %w", s.filename, &record.ErrCorrupt{Offset: handle.offset, Reason: "file ends part of the way through a block"})
+		}
+		stored = s.mapped[handle.offset:end]
+		// an uncompressed block is used where it lies in the mapping, so caching it would only
+		// take up memory
+		if stored[handle.size] == CODEC_NONE {
+			block, err := decodeBlock(stored, handle)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read block in file '%s': %w", s.filename, err)
+			}
+			return block, nil
+		}
+	}
 
-	var offset int64
-	if l == nil {
-		offset = 0
-	} else {
-		offset = l.Offset
+	key := blockCacheKey{file: s.cacheID, offset: handle.offset}
+	if s.cache != nil {
+		if block, ok := s.cache.get(key); ok {
+			return block, nil
+		}
 	}
 
-	var endOffset int64
-	if r != nil {
-		endOffset = r.Offset
+	var block []byte
+	var err error
+	if stored != nil {
+		block, err = decodeBlock(stored, handle)
 	} else {
-		endOffset = info.Size()
+		block, err = s.readBlockFromFs(handle)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read block in file '%s': %w", s.filename, err)
 	}
 
-	f.Seek(offset, io.SeekStart)
-	scanner := bufio.NewScanner(f)
+	if s.cache != nil {
+		s.cache.add(key, block)
+	}
+	return block, nil
+}
 
-	for scanner.Scan() && offset < endOffset {
-		line := scanner.Text()
-		if strings.HasPrefix(line, key+", ") {
-			value := strings.SplitN(line, ", ", 2)[1]
-			return value, true, nil
+func (s *SortedFile) readBlockFromFs(handle blockHandle) ([]byte, error) {
+	if s.handles != nil {
+		h, err := s.handles.acquire(s.filename)
+		if err != nil {
+			return nil, err
 		}
-		offset += int64(len(scanner.Bytes()) + 1) // add one for the newline
+		defer s.handles.release(h)
+		return readBlock(h, handle)
 	}
-	if scanner.Err() != nil {
-		return "", false, fmt.Errorf("failed to scan line at offset %d in file '%s': %v", offset, s.filename, scanner.Err())
+
+	f, err := s.fs.Open(s.filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open: %v", err)
 	}
-	return "", false, nil
+	defer f.Close()
+	return readBlock(f, handle)
 }
 
-func newSparseIndexFromFile(filename string, fs afero.Fs) ([]KeyOffset, error) {
-	index := make([]KeyOffset, 0)
+// Name returns the name of the file on disk
+func (s *SortedFile) Name() string {
+	return s.filename
+}
 
-	if exists, _ := afero.Exists(fs, filename); !exists {
-		return nil, fmt.Errorf("file '%s' does not exist", filename)
+// Size returns the size of the file on disk in bytes
+func (s *SortedFile) Size() int64 {
+	return s.size
+}
+
+// overlaps reports whether any keys in the file fall within [smallest, largest]
+func (s *SortedFile) overlaps(smallest string, largest string) bool {
+	return s.index.Len() > 0 && s.smallest <= largest && s.largest >= smallest
+}
+
+func (s *SortedFile) ref() {
+	atomic.AddInt32(&s.refs, 1)
+}
+
+// Close releases the file's memory mapping and open handle, if it has them, after which it must
+// not be read
+func (s *SortedFile) Close() error {
+	if s.handles != nil {
+		s.handles.evict(s.filename)
 	}
-	f, err := fs.Open(filename)
+	if s.mapped == nil {
+		return nil
+	}
+	err := munmap(s.mapped)
+	s.mapped = nil
 	if err != nil {
-		return nil, fmt.Errorf("couldn't open file '%s': %v", filename, err)
+		return fmt.Errorf("failed to unmap sorted file '%s': %v", s.filename, err)
 	}
-	defer f.Close()
+	return nil
+}
 
-	scanner := bufio.NewScanner(f)
-	var offset int64 = 0
-	var lastKey string
-	for i := uint(0); scanner.Scan(); i++ {
-		key := strings.SplitN(scanner.Text(), ", ", 2)[0]
-		if key <= lastKey && key != "" {
-			return nil, fmt.Errorf("encountered out of order keys '%s' and '%s'", lastKey, key)
-		}
-		if i%RECORDS_PER_INDEX_ENTRY == 0 {
-			index = append(index, KeyOffset{Key: key, Offset: offset})
-		}
-		offset += int64(len(scanner.Bytes())) + 1 // add an extra byte for the newline
-		lastKey = key
+// unref removes the file from disk once no version of the store refers to it. A version only
+// stops being current once the edit replacing it has been synced to the manifest, so by then
+// the file can never be needed again.
+func (s *SortedFile) unref() error {
+	last, err := s.release()
+	if !last || err != nil {
+		return err
+	}
+	err = s.fs.Remove(s.filename)
+	if err != nil {
+		return fmt.Errorf("failed to remove obsolete sorted file '%s': %v", s.filename, err)
+	}
+	return nil
+}
+
+// release closes the file once no version of the store refers to it, reporting whether it has,
+// but leaves it on disk
+func (s *SortedFile) release() (bool, error) {
+	if atomic.AddInt32(&s.refs, -1) != 0 {
+		return false, nil
 	}
-	if scanner.Err() != nil {
-		return nil, fmt.Errorf("couldn't scan data file: %v", err)
+	return true, s.Close()
+}
+
+// corruptionAt converts a truncated read into corruption, as sorted files are always written
+// in full before being read
+func corruptionAt(offset int64, err error) error {
+	if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+		return &record.ErrCorrupt{Offset: offset, Reason: "data ends part of the way through a record"}
 	}
+	return err
+}
+
+// tableOptions configures how new sorted files are written
+type tableOptions struct {
+	blockSize   int
+	bitsPerKey  int // the size of the file's Bloom filter, or 0 for no filter
+	compression Compression
+}
+
+// sortedFileWriter writes records, which must be added in key order, to a new sorted file
+type sortedFileWriter struct {
+	filename string
+	file     afero.File
+	opts     tableOptions
+	size     int64 // the number of bytes written to the file so far
 
-	return index, nil
+	block      []byte // the data block being built
+	lastKey    string
+	smallest   string
+	index      *keyoffset.Builder
+	filter     *bloom.Builder // nil if the file won't have a filter
+	compressor blockCompressor
+	dataSize   int64 // the size of the data blocks written so far, before compression
 }
 
-func writeBstToSortedFile(t *bst.BinarySearchTree, filename string, fs afero.Fs) error {
-	f, err := fs.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+func newSortedFileWriter(filename string, fs afero.Fs, opts tableOptions) (*sortedFileWriter, error) {
+	f, err := fs.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %v", err)
+		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
-	defer f.Close()
+	w := &sortedFileWriter{
+		filename:   filename,
+		file:       f,
+		opts:       opts,
+		index:      keyoffset.NewBuilder(),
+		compressor: blockCompressor{compression: opts.compression},
+	}
+	if opts.bitsPerKey > 0 {
+		w.filter = bloom.NewBuilder(opts.bitsPerKey)
+	}
+	return w, nil
+}
 
-	iter := bst.NewInOrderTraversalIterator(t)
+func (w *sortedFileWriter) Append(r record.Record) error {
+	if w.index.Len() == 0 && len(w.block) == 0 {
+		w.smallest = r.Key
+	}
+	w.block = append(w.block, r.Encode()...)
+	w.lastKey = r.Key
+	if w.filter != nil {
+		w.filter.Add(r.Key)
+	}
 
-	for iter.Next() {
-		node := iter.Value()
-		_, err := f.WriteString(fmt.Sprintf("%s, %s\n", node.Key(), node.Value()))
+	if len(w.block) >= w.opts.blockSize {
+		return w.finishBlock()
+	}
+	return nil
+}
+
+// finishBlock writes out the data block being built and adds it to the index
+func (w *sortedFileWriter) finishBlock() error {
+	stored, codec, err := w.compressor.compress(w.block)
+	if err != nil {
+		return err
+	}
+	handle, err := w.writeBlock(stored, codec)
+	if err != nil {
+		return fmt.Errorf("failed to write block to file: %v", err)
+	}
+	err = w.index.Add(w.lastKey, handle.offset, handle.size)
+	if err != nil {
+		return fmt.Errorf("failed to index block: %v", err)
+	}
+	w.dataSize += int64(len(w.block))
+	w.block = w.block[:0]
+	return nil
+}
+
+func (w *sortedFileWriter) writeBlock(stored []byte, codec byte) (blockHandle, error) {
+	handle := blockHandle{offset: w.size, size: int64(len(stored))}
+	n, err := w.file.Write(encodeBlock(stored, codec))
+	w.size += int64(n)
+	return handle, err
+}
+
+// Size returns the number of bytes written so far, including the block being built
+func (w *sortedFileWriter) Size() int64 {
+	return w.size + int64(len(w.block))
+}
+
+// Close finishes the file by writing out its last data block, then its meta block, index block
+// and footer
+func (w *sortedFileWriter) Close(sync bool) error {
+	if len(w.block) > 0 {
+		err := w.finishBlock()
 		if err != nil {
-			return fmt.Errorf("failed to write line to file: %v", err)
+			w.file.Close()
+			return err
 		}
 	}
 
-	return nil
+	properties := make(map[string][]byte)
+	if w.index.Len() > 0 {
+		properties[META_SMALLEST] = []byte(w.smallest)
+	}
+	properties[META_DATA_SIZE] = appendUvarint(nil, w.dataSize)
+	if w.filter != nil {
+		properties[META_FILTER] = w.filter.Build().Encode()
+	}
+	meta, err := w.writeBlock(encodeMeta(properties), CODEC_NONE)
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to write meta block to file: %v", err)
+	}
+	index, err := w.writeBlock(w.index.Build().Encode(), CODEC_NONE)
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to write index block to file: %v", err)
+	}
+	n, err := w.file.Write(encodeFooter(meta, index))
+	w.size += int64(n)
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to write footer to file: %v", err)
+	}
+
+	if sync {
+		err := w.file.Sync()
+		if err != nil {
+			w.file.Close()
+			return fmt.Errorf("failed to sync file: %v", err)
+		}
+	}
+	return w.file.Close()
+}
+
+// abort closes the file without finishing it, for when it won't be used
+func (w *sortedFileWriter) abort() {
+	w.file.Close()
 }
 
-func getInterval(index []KeyOffset, key string) (*KeyOffset, *KeyOffset) {
-	if len(index) == 0 {
-		return nil, nil
+func writeMemtableToSortedFile(m memtable.Memtable, filename string, fs afero.Fs, opts tableOptions, sync bool) error {
+	w, err := newSortedFileWriter(filename, fs, opts)
+	if err != nil {
+		return err
 	}
 
-	if len(index) == 1 {
-		if key < index[0].Key {
-			return nil, &index[0]
-		} else {
-			return &index[0], nil
+	iter := m.Iterator()
+
+	for iter.Next() {
+		err := w.Append(decodeEntry(iter.Key(), iter.Value()))
+		if err != nil {
+			w.abort()
+			return err
 		}
 	}
 
-	mid := len(index) / 2
+	return w.Close(sync)
+}
+
+// sortedFileIterator reads every record in a sorted file in order, a block at a time
+type sortedFileIterator struct {
+	file    afero.File
+	index   *keyoffset.Index
+	next    int            // the position in the index of the next block to read
+	reader  *record.Reader // reads records from the current block, or nil between blocks
+	current record.Record
+	err     error
+}
 
-	var l, r *KeyOffset
-	if key < index[mid].Key {
-		l, r = getInterval(index[:mid], key)
-		if r == nil {
-			r = &index[mid]
+func newSortedFileIterator(s *SortedFile) (*sortedFileIterator, error) {
+	f, err := s.fs.Open(s.filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sorted file '%s': %v", s.filename, err)
+	}
+	return &sortedFileIterator{file: f, index: s.index}, nil
+}
+
+func (i *sortedFileIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+	for {
+		if i.reader == nil {
+			if i.next >= i.index.Len() {
+				return false
+			}
+			handle := blockOf(i.index.At(i.next))
+			block, err := readBlock(i.file, handle)
+			if err != nil {
+				i.err = fmt.Errorf("failed to read sorted file '%s': %w", i.file.Name(), err)
+				return false
+			}
+			i.reader = record.NewReader(bytes.NewReader(block), handle.offset)
+			i.next++
 		}
-	} else {
-		l, r = getInterval(index[mid:], key)
-		if l == nil && mid > 0 {
-			l = &index[mid-1]
+
+		offset := i.reader.Offset()
+		r, err := i.reader.Next()
+		if err == io.EOF {
+			i.reader = nil
+			continue
+		} else if err != nil {
+			i.err = fmt.Errorf("failed to read sorted file '%s': %w", i.file.Name(), corruptionAt(offset, err))
+			return false
 		}
+		i.current = r
+		return true
 	}
+}
+
+func (i *sortedFileIterator) Record() record.Record {
+	return i.current
+}
+
+func (i *sortedFileIterator) Err() error {
+	return i.err
+}
 
-	return l, r
+func (i *sortedFileIterator) Close() error {
+	return i.file.Close()
 }
@@ -1,169 +1,243 @@
 package sortedfile
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
 	"testing"
 
+	"github.com/haydenjeune/kvstore/pkg/record"
 	"github.com/spf13/afero"
 )
 
-func Test_newSparseIndexFromFile_ReadsCorrectFile(t *testing.T) {
-	fs := afero.NewMemMapFs()
-	f, err := fs.Create("testfile")
+// writeTestSortedFile writes a sorted file holding keys "key000" up to numKeys
+func writeTestSortedFile(t *testing.T, fs afero.Fs, filename string, numKeys int, opts tableOptions) *SortedFile {
+	w, err := newSortedFileWriter(filename, fs, opts)
 	if err != nil {
-		t.Fatal("Failed to create temporary file")
+		t.Fatalf("Failed to start sorted file: %v", err)
 	}
-	f.WriteString(`a, value1
-b, value2
-c, value3
-`)
-	f.Close()
-
-	index, err := newSparseIndexFromFile(f.Name(), fs)
+	for i := 0; i < numKeys; i++ {
+		w.Append(record.Record{Key: fmt.Sprintf("key%03d", i), Value: "value" + strconv.Itoa(i)})
+	}
+	err = w.Close(false)
 	if err != nil {
-		t.Fatal("Failed to read storage file")
+		t.Fatalf("Failed to write sorted file: %v", err)
 	}
-	expected := []KeyOffset{
-		{Key: "a", Offset: 0},
+	file, err := NewSortedFile(filename, fs)
+	if err != nil {
+		t.Fatalf("Failed to open sorted file: %v", err)
 	}
+	return file
+}
+
+func Test_NewSortedFile_ReadsIndexAndKeyRange(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
 
-	if index[0] != expected[0] {
-		t.Fatal("Unexpected value")
+	if file.index.Len() < 2 {
+		t.Fatalf("Expected several blocks, got %d", file.index.Len())
+	}
+	if file.smallest != "key000" || file.largest != "key099" {
+		t.Fatalf("Expected keys 'key000' to 'key099', got '%s' to '%s'", file.smallest, file.largest)
+	}
+	if info, _ := fs.Stat("0"); file.Size() != info.Size() {
+		t.Fatalf("Expected size %d, got %d", info.Size(), file.Size())
 	}
 }
 
-func Test_newSparseIndexFromFile_ErrorsForUnorderedFile(t *testing.T) {
+func Test_SortedFile_Get_FindsEveryKeyAcrossBlocks(t *testing.T) {
 	fs := afero.NewMemMapFs()
-	f, err := fs.Create("testfile")
-	if err != nil {
-		t.Fatal("Failed to create temporary file")
-	}
-	f.WriteString(`b, value1
-a, value2
-c, value3
-`)
-	f.Close()
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
 
-	_, err = newSparseIndexFromFile(f.Name(), fs)
-	if err == nil {
-		t.Fatal("Expected error on reading badly ordered file")
+	for i := 0; i < 100; i++ {
+		r, exists, err := file.Get(fmt.Sprintf("key%03d", i))
+		if err != nil || !exists || r.Value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected 'key%03d' to be 'value%d', got '%s', %v, %v", i, i, r.Value, exists, err)
+		}
+	}
+	for _, key := range []string{"a", "key0005", "key050x", "z"} {
+		if _, exists, err := file.Get(key); err != nil || exists {
+			t.Fatalf("Expected '%s' not to be found, got %v, %v", key, exists, err)
+		}
 	}
 }
 
-func Test_newSparseIndexFromFile_ErrorsForDuplicateKeys(t *testing.T) {
+func Test_SortedFile_Get_ReadsEmptyKey(t *testing.T) {
 	fs := afero.NewMemMapFs()
-	f, err := fs.Create("testfile")
+	w, _ := newSortedFileWriter("0", fs, tableOptions{blockSize: BLOCK_SIZE})
+	w.Append(record.Record{Key: "", Value: "value1"})
+	w.Close(false)
+
+	file, err := NewSortedFile("0", fs)
 	if err != nil {
-		t.Fatal("Failed to create temporary file")
+		t.Fatalf("Failed to open file: %v", err)
 	}
-	f.WriteString(`a, value1
-a, value2
-c, value3
-`)
-	f.Close()
-
-	_, err = newSparseIndexFromFile(f.Name(), fs)
-	if err == nil {
-		t.Fatal("Expected error on reading file with duplicate keys")
+	if r, exists, _ := file.Get(""); !exists || r.Value != "value1" {
+		t.Fatal("Failed to read empty key")
 	}
 }
 
-func Test_newSparseIndexFromFile_ReadsEmptyKey(t *testing.T) {
+func Test_NewSortedFile_ReadsEmptyFile(t *testing.T) {
 	fs := afero.NewMemMapFs()
-	f, err := fs.Create("testfile")
-	if err != nil {
-		t.Fatal("Failed to create temporary file")
+	file := writeTestSortedFile(t, fs, "0", 0, tableOptions{blockSize: BLOCK_SIZE})
+
+	if file.index.Len() != 0 || file.overlaps("", "z") {
+		t.Fatal("Expected an empty file to hold no keys")
+	}
+	if _, exists, err := file.Get("key000"); err != nil || exists {
+		t.Fatalf("Expected nothing to be found, got %v, %v", exists, err)
 	}
-	f.WriteString(", value1\n")
-	f.Close()
+}
 
-	index, err := newSparseIndexFromFile(f.Name(), fs)
-	if err != nil {
-		t.Fatal("Failed to read file")
+func Test_SortedFile_Get_ErrorsForCorruptBlock(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
+
+	second := blockOf(file.index.At(1))
+	contents, _ := afero.ReadFile(fs, "0")
+	contents[second.offset+3] ^= 0xff
+	afero.WriteFile(fs, "0", contents, 0644)
+
+	_, _, err := file.Get(file.index.At(1).Key)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected corruption error, got %v", err)
+	}
+	if corrupt.Offset != second.offset {
+		t.Fatalf("Expected corruption at offset %d, got %d", second.offset, corrupt.Offset)
 	}
 
-	expected := KeyOffset{Key: "", Offset: 0}
-	if index[0] != expected {
-		t.Fatal("Failed to parse empty key")
+	// other blocks can still be read
+	if _, exists, err := file.Get("key000"); err != nil || !exists {
+		t.Fatalf("Expected 'key000' to be found, got %v, %v", exists, err)
 	}
 }
 
-func Test_getInterval_EmptySlice(t *testing.T) {
-	data := []KeyOffset{}
+func Test_NewSortedFile_ErrorsForDamagedFooter(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
 
-	var l, r *KeyOffset
+	contents, _ := afero.ReadFile(fs, "0")
+	contents[len(contents)-FOOTER_SIZE] ^= 0xff
+	afero.WriteFile(fs, "0", contents, 0644)
 
-	l, r = getInterval(data, "b")
-	if l != nil || r != nil {
-		t.Fail()
+	_, err := NewSortedFile("0", fs)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected corruption error, got %v", err)
 	}
 }
 
-func Test_getInterval_LengthOne(t *testing.T) {
-	data := []KeyOffset{
-		{Key: "f"},
-	}
+func Test_NewSortedFile_ErrorsForTruncatedFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
 
-	var l, r *KeyOffset
+	contents, _ := afero.ReadFile(fs, "0")
+	afero.WriteFile(fs, "0", contents[:len(contents)-10], 0644)
 
-	l, r = getInterval(data, "b")
-	if l != nil || r != &data[0] {
-		t.Fail()
+	if _, err := NewSortedFile("0", fs); err == nil {
+		t.Fatal("Expected error opening truncated file")
 	}
+}
 
-	l, r = getInterval(data, "g")
-	if l != &data[0] || r != nil {
-		t.Fail()
-	}
+func Test_sortedFileIterator_ReadsEveryRecordInOrder(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
 
-	l, r = getInterval(data, "f")
-	if l != &data[0] || r != nil {
-		t.Fail()
+	iter, err := newSortedFileIterator(file)
+	if err != nil {
+		t.Fatalf("Failed to open iterator: %v", err)
+	}
+	defer iter.Close()
+	i := 0
+	for ; iter.Next(); i++ {
+		if expected := fmt.Sprintf("key%03d", i); iter.Record().Key != expected {
+			t.Fatalf("Expected '%s', got '%s'", expected, iter.Record().Key)
+		}
+	}
+	if iter.Err() != nil || i != 100 {
+		t.Fatalf("Expected 100 records, got %d and %v", i, iter.Err())
 	}
 }
 
-func Test_getInterval(t *testing.T) {
-	data := []KeyOffset{
-		{Key: "b"},
-		{Key: "e"},
-		{Key: "f"},
-		{Key: "k"},
-		{Key: "s"},
+func Test_NewSortedFile_LoadsFilter(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: BLOCK_SIZE, bitsPerKey: 10})
+
+	if file.filter == nil {
+		t.Fatal("Expected the file's filter to be loaded")
+	}
+	for i := 0; i < 100; i++ {
+		if _, exists, _ := file.Get(fmt.Sprintf("key%03d", i)); !exists {
+			t.Fatalf("Expected 'key%03d' to be found", i)
+		}
 	}
+}
 
-	var l, r *KeyOffset
+func Test_SortedFile_get_SkipsFileRuledOutByFilter(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: BLOCK_SIZE, bitsPerKey: 10})
 
-	l, r = getInterval(data, "a")
-	if l != nil || r != &data[0] {
-		t.Fail()
+	excluded := 0
+	for i := 0; i < 100; i++ {
+		_, exists, filtered, err := file.get(fmt.Sprintf("key%03d", i) + "x")
+		if err != nil || exists {
+			t.Fatalf("Expected missing key not to be found, got %v, %v", exists, err)
+		}
+		if filtered == filterExcluded {
+			excluded++
+		}
 	}
-
-	l, r = getInterval(data, "b")
-	if l != &data[0] || r != &data[1] {
-		t.Fail()
+	if excluded < 90 {
+		t.Fatalf("Expected the filter to rule out most missing keys, got %d of 100", excluded)
 	}
+}
 
-	l, r = getInterval(data, "c")
-	if l != &data[0] || r != &data[1] {
-		t.Fail()
+func Test_SortedFileKvStorage_CountsFilterFalsePositives(t *testing.T) {
+	storage, err := NewSortedFileKvStorage(afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
 	}
+	defer storage.Close()
 
-	l, r = getInterval(data, "e")
-	if l != &data[1] || r != &data[2] {
-		t.Fail()
+	for i := 0; i < 4*100; i++ {
+		storage.Set("key"+strconv.Itoa(i), "value")
+		if i%100 == 99 {
+			storage.Flush()
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		storage.Get("key" + strconv.Itoa(i) + "x")
 	}
 
-	l, r = getInterval(data, "f")
-	if l != &data[2] || r != &data[3] {
-		t.Fail()
+	stats := storage.Stats()
+	if stats.FilterNegatives == 0 {
+		t.Fatal("Expected filters to rule out missing keys")
+	}
+	if rate := stats.FilterFalsePositiveRate(); rate > 0.05 {
+		t.Fatalf("Expected a false positive rate of around 1%%, got %v", rate)
 	}
+}
 
-	l, r = getInterval(data, "m")
-	if l != &data[3] || r != &data[4] {
-		t.Fail()
+func Test_SortedFileKvStorage_WithoutFiltersReadsEveryFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, err := NewSortedFileKvStorage(fs, WithBloomFilterBitsPerKey(0))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
 	}
+	defer storage.Close()
 
-	l, r = getInterval(data, "z")
-	if l != &data[4] || r != nil {
-		t.Fail()
+	for i := 0; i < 100; i++ {
+		storage.Set("key"+strconv.Itoa(i), "value")
+	}
+	storage.Flush()
+	storage.mu.RLock()
+	filter := storage.defaultFamily.current.levels[0][0].filter
+	storage.mu.RUnlock()
+	if filter != nil {
+		t.Fatal("Expected no filter to be written")
+	}
+	if result, exists, _ := storage.Get("key5"); !exists || result != "value" {
+		t.Fatalf("Expected 'key5' to be 'value', got '%s'", result)
 	}
 }
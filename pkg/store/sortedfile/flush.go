@@ -0,0 +1,209 @@
+package sortedfile
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+)
+
+// Once a column family's memtable is full it becomes immutable, and a new memtable takes its
+// place. Immutable memtables are still read by Get, and are written to sorted files one at a
+// time, oldest first, by a background goroutine shared by every family. Writers only have to wait
+// for a flush if the flusher has fallen so far behind that the maximum number of the family's
+// immutable memtables are already waiting.
+
+const MAX_IMMUTABLE_MEMTABLES = 2
+
+type immutableMemtable struct {
+	family   *ColumnFamily
+	memtable memtable.Memtable
+	firstLog int64 // the first log holding writes in the memtable
+	nextLog  int64 // the log started when the memtable was made immutable, which holds none of them
+}
+
+// Flush makes the memtable of every column family immutable, if it holds anything, and waits for
+// them and every other immutable memtable to be written to sorted files
+func (s *SortedFileKvStorage) Flush() error {
+	var err error
+	s.whileWritesHeld(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, f := range s.families {
+			err = s.makeRoomForWrite(f, true)
+			if err != nil {
+				break
+			}
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start new memtable: %v", err)
+	}
+	return s.waitForFlushes()
+}
+
+// makeRoomForWrite replaces a family's memtable with a new one once it is full, or if force is
+// set and it isn't empty, first waiting for a flush to finish if too many of the family's
+// memtables are waiting already. It must be called with mu held for writing, by the writer at
+// the front of the queue.
+func (s *SortedFileKvStorage) makeRoomForWrite(f *ColumnFamily, force bool) error {
+	stalled := false
+	for !f.dropped && (int64(f.memtable.Bytes()) >= f.opts.memtableSize || (force && f.memtable.Size() > 0)) {
+		if s.backgroundErr != nil {
+			return s.backgroundErr
+		}
+		if s.immutablesOf(f) >= s.opts.maxImmutableMemtables {
+			if !stalled && !force {
+				atomic.AddInt64(&f.stats.writeStalls, 1)
+			}
+			stalled = true
+			// another writer may rotate the memtable while this one waits
+			s.flushed.Wait()
+			continue
+		}
+		return s.rotateMemtable(f)
+	}
+	return nil
+}
+
+// immutablesOf returns the number of a family's memtables waiting to be flushed. It must be
+// called with mu held.
+func (s *SortedFileKvStorage) immutablesOf(f *ColumnFamily) int {
+	n := 0
+	for _, m := range s.immutables {
+		if m.family == f {
+			n++
+		}
+	}
+	return n
+}
+
+// rotateMemtable makes a family's memtable immutable and starts a new one, along with a new log
+// so that the old memtable's writes are all in logs before it. It must be called with mu held
+// for writing.
+func (s *SortedFileKvStorage) rotateMemtable(f *ColumnFamily) error {
+	err := s.startLog(s.allocateFileNumber())
+	if err != nil {
+		return err
+	}
+	s.immutables = append(s.immutables, &immutableMemtable{
+		family:   f,
+		memtable: f.memtable,
+		firstLog: f.memtableLog,
+		nextLog:  s.wal.number,
+	})
+	f.memtable = memtable.New(f.opts.memtableKind)
+	s.maybeScheduleFlush()
+	return nil
+}
+
+// flushInBackground flushes immutable memtables whenever there are any, until the store is closed
+func (s *SortedFileKvStorage) flushInBackground() {
+	defer close(s.flusherDone)
+	for {
+		select {
+		case <-s.flushRequested:
+		case <-s.closing:
+			return
+		}
+
+		for {
+			s.mu.RLock()
+			if len(s.immutables) == 0 {
+				s.mu.RUnlock()
+				break
+			}
+			m := s.immutables[0]
+			s.mu.RUnlock()
+
+			err := s.flushImmutable(m)
+			if err != nil {
+				s.mu.Lock()
+				s.backgroundErr = fmt.Errorf("background flush failed: %v", err)
+				s.flushed.Broadcast()
+				s.mu.Unlock()
+				return
+			}
+		}
+	}
+}
+
+// flushImmutable writes the oldest immutable memtable to a new sorted file in level 0 of its
+// family, and removes any logs that are no longer needed once it has
+func (s *SortedFileKvStorage) flushImmutable(m *immutableMemtable) error {
+	f := m.family
+	filename := s.allocateFileName()
+	// the file is synced whatever the durability policy, as the logs holding its writes are
+	// removed once it has been recorded in the manifest
+	err := writeMemtableToSortedFile(m.memtable, filename, s.fs, f.opts.table(), true)
+	if err != nil {
+		return fmt.Errorf("failed to write memtable to file: %v", err)
+	}
+	file, err := newSortedFile(filename, s.fs, s.readOptions())
+	if err != nil {
+		return fmt.Errorf("failed to read new sorted file: %w", err)
+	}
+	edit := &versionEdit{logNumber: m.nextLog}
+	edit.added[0] = []*SortedFile{file}
+
+	s.mu.Lock()
+	if f.dropped {
+		// the family was dropped while it was being flushed
+		s.removeImmutableLocked(m)
+		s.mu.Unlock()
+		file.Close()
+		return s.fs.Remove(filename)
+	}
+	err = s.applyEditLocked(f, edit)
+	var obsolete []string
+	if err == nil {
+		s.removeImmutableLocked(m)
+		obsolete = s.obsoleteLogsLocked()
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&f.stats.flushBytes, file.size)
+
+	// The memtable's contents are now safely in the sorted file, so any logs that only hold
+	// flushed writes can go
+	err = s.removeLogs(obsolete)
+	if err != nil {
+		return err
+	}
+
+	s.maybeScheduleCompaction()
+	return nil
+}
+
+// removeImmutableLocked forgets a memtable that has been flushed, or whose family was dropped.
+// It must be called with mu held for writing.
+func (s *SortedFileKvStorage) removeImmutableLocked(m *immutableMemtable) {
+	for i, other := range s.immutables {
+		if other == m {
+			s.immutables = append(s.immutables[:i:i], s.immutables[i+1:]...)
+			break
+		}
+	}
+	s.flushed.Broadcast()
+}
+
+// waitForFlushes waits until every immutable memtable has been flushed, returning an error if
+// the flusher has failed
+func (s *SortedFileKvStorage) waitForFlushes() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.immutables) > 0 && s.backgroundErr == nil {
+		s.flushed.Wait()
+	}
+	return s.backgroundErr
+}
+
+func (s *SortedFileKvStorage) maybeScheduleFlush() {
+	select {
+	case s.flushRequested <- struct{}{}:
+	default:
+		// a flush is already due to run
+	}
+}
@@ -0,0 +1,156 @@
+package sortedfile
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// flushHookFs calls hook before a sorted file is created, so tests can hold up or fail flushes
+type flushHookFs struct {
+	afero.Fs
+	hook func() error
+}
+
+func (fs *flushHookFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	if _, err := strconv.Atoi(name); err == nil {
+		if err := fs.hook(); err != nil {
+			return nil, err
+		}
+	}
+	return fs.Fs.OpenFile(name, flag, perm)
+}
+
+func Test_SortedFileKvStorage_Get_ReadsImmutableMemtables(t *testing.T) {
+	release := make(chan struct{})
+	fs := &flushHookFs{Fs: afero.NewMemMapFs(), hook: func() error { <-release; return nil }}
+	storage, err := NewSortedFileKvStorage(fs, WithMemtableSize(1)) // every write fills the memtable
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+
+	storage.Set("key5", "5")
+	if stats := storage.Stats(); stats.ImmutableMemtables != 1 || stats.TotalBytes() != 0 {
+		t.Fatalf("Expected one memtable waiting to be flushed, got %d and %d bytes in files", stats.ImmutableMemtables, stats.TotalBytes())
+	}
+	if result, exists, err := storage.Get("key5"); err != nil || !exists || result != "5" {
+		t.Fatalf("Expected 'key5' to be read from the immutable memtable, got '%s', %v, %v", result, exists, err)
+	}
+
+	close(release)
+	err = storage.waitForFlushes()
+	if err != nil {
+		t.Fatalf("Unexpected error flushing: %v", err)
+	}
+	if stats := storage.Stats(); stats.ImmutableMemtables != 0 || stats.Levels[0].Files != 1 {
+		t.Fatalf("Expected the memtable to be flushed to level 0, got %d waiting and %d files", stats.ImmutableMemtables, stats.Levels[0].Files)
+	}
+	if result, _, _ := storage.Get("key5"); result != "5" {
+		t.Fatalf("Expected 'key5' to be '5' after flushing, got '%s'", result)
+	}
+	storage.Close()
+}
+
+func Test_SortedFileKvStorage_StallsWritesWhenTooManyImmutableMemtables(t *testing.T) {
+	release := make(chan struct{})
+	fs := &flushHookFs{Fs: afero.NewMemMapFs(), hook: func() error { <-release; return nil }}
+	storage, err := NewSortedFileKvStorage(fs, WithMaxImmutableMemtables(1), WithMemtableSize(1))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+
+	// the first write fills the memtable, so the second fills the next one while the first is
+	// still waiting to be flushed
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		storage.Set("key0", "0")
+		storage.Set("key1", "1")
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for storage.Stats().WriteStalls == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the writer to stall while the first memtable is being flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-written:
+		t.Fatal("Expected the writer to wait for the flush")
+	default:
+	}
+
+	close(release)
+	<-written
+	err = storage.Close()
+	if err != nil {
+		t.Fatalf("Unexpected error closing: %v", err)
+	}
+	if stalls := storage.Stats().WriteStalls; stalls != 1 {
+		t.Fatalf("Expected 1 stalled write, got %d", stalls)
+	}
+
+	storage, _ = NewSortedFileKvStorage(fs)
+	defer storage.Close()
+	for _, key := range []string{"key0", "key1"} {
+		if _, exists, _ := storage.Get(key); !exists {
+			t.Fatalf("Expected '%s' to be written", key)
+		}
+	}
+}
+
+func Test_SortedFileKvStorage_RefusesWritesAfterFailedFlush(t *testing.T) {
+	fs := &flushHookFs{Fs: afero.NewMemMapFs(), hook: func() error { return errors.New("disk full") }}
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+
+	for i := 0; i < 100; i++ {
+		storage.Set("key"+strconv.Itoa(i), "value")
+	}
+	if err := storage.Flush(); err == nil {
+		t.Fatal("Expected the flush to fail")
+	}
+	if err := storage.Set("another", "value"); err == nil {
+		t.Fatal("Expected writes to be refused after a failed flush")
+	}
+	if result, _, _ := storage.Get("key5"); result != "value" {
+		t.Fatalf("Expected 'key5' to still be readable from the memtable, got '%s'", result)
+	}
+	if err := storage.Close(); err == nil {
+		t.Fatal("Expected Close to report the failed flush")
+	}
+}
+
+func Test_SortedFileKvStorage_FlushesOnceMemtableReachesSize(t *testing.T) {
+	storage, err := NewSortedFileKvStorage(afero.NewMemMapFs(), WithMemtableSize(1<<10))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+
+	// overwriting a key only grows the memtable by the change in its value's size
+	for i := 0; i < 1000; i++ {
+		storage.Set("hot", "value")
+	}
+	stats := storage.Stats()
+	if stats.TotalBytes() != 0 || stats.ImmutableMemtables != 0 || stats.MemtableKeys != 1 {
+		t.Fatalf("Expected a single key in the memtable, got %d keys and %d bytes flushed", stats.MemtableKeys, stats.TotalBytes())
+	}
+
+	for i := 0; i < 100; i++ {
+		storage.Set("key"+strconv.Itoa(i), strings.Repeat("v", 20))
+	}
+	storage.waitForFlushes()
+	stats = storage.Stats()
+	if stats.Levels[0].Files != 2 || stats.MemtableBytes >= 1<<10 {
+		t.Fatalf("Expected two flushes of 1KiB memtables, got %d files and %d bytes left in the memtable", stats.Levels[0].Files, stats.MemtableBytes)
+	}
+}
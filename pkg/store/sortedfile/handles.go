@@ -0,0 +1,126 @@
+package sortedfile
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// MAX_OPEN_FILES is the default number of sorted files kept open for reading, so that reads
+// don't have to open and close a file every time
+const MAX_OPEN_FILES = 500
+
+// handleCache keeps files open for reading, shared between every sorted file in a store. Once it
+// holds more than its capacity, the least recently used handle is evicted, and closed once no
+// read is using it.
+type handleCache struct {
+	fs       afero.Fs
+	capacity int
+
+	mu      sync.Mutex
+	handles map[string]*list.Element
+	lru     *list.List // the most recently used handle is at the front
+}
+
+// fileHandle is an open file that many reads can use at once
+type fileHandle struct {
+	filename string
+	file     afero.File
+	refs     int  // the reads using the handle, plus one while it is cached, guarded by the cache
+	serial   bool // ReadAt moves the file's offset, so reads have to take turns
+	readMu   sync.Mutex
+}
+
+func newHandleCache(fs afero.Fs, capacity int) *handleCache {
+	return &handleCache{
+		fs:       fs,
+		capacity: capacity,
+		handles:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// acquire returns an open handle for filename, which must be released once the read is done
+func (c *handleCache) acquire(filename string) (*fileHandle, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.handles[filename]; ok {
+		c.lru.MoveToFront(e)
+		h := e.Value.(*fileHandle)
+		h.refs++
+		return h, nil
+	}
+
+	f, err := c.fs.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open: %v", err)
+	}
+	// positional reads of the operating system's files don't touch the offset, but other afero
+	// files, such as MemMapFs's, implement ReadAt with a seek
+	_, concurrent := unwrapOsFile(f)
+	h := &fileHandle{filename: filename, file: f, refs: 2, serial: !concurrent}
+	c.handles[filename] = c.lru.PushFront(h)
+
+	for len(c.handles) > c.capacity {
+		c.removeLocked(c.lru.Back().Value.(*fileHandle))
+	}
+	return h, nil
+}
+
+// release finishes a read with a handle, closing it if it has since been evicted
+func (c *handleCache) release(h *fileHandle) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.unrefLocked(h)
+}
+
+// evict closes the handle for filename, if there is one, once no read is using it
+func (c *handleCache) evict(filename string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.handles[filename]; ok {
+		c.removeLocked(e.Value.(*fileHandle))
+	}
+}
+
+// close evicts every handle
+func (c *handleCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.lru.Len() > 0 {
+		c.removeLocked(c.lru.Back().Value.(*fileHandle))
+	}
+}
+
+func (c *handleCache) removeLocked(h *fileHandle) {
+	c.lru.Remove(c.handles[h.filename])
+	delete(c.handles, h.filename)
+	c.unrefLocked(h)
+}
+
+func (c *handleCache) unrefLocked(h *fileHandle) {
+	h.refs--
+	if h.refs == 0 {
+		h.file.Close()
+	}
+}
+
+// len returns the number of handles in the cache
+func (c *handleCache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.handles)
+}
+
+func (h *fileHandle) ReadAt(b []byte, offset int64) (int, error) {
+	if h.serial {
+		h.readMu.Lock()
+		defer h.readMu.Unlock()
+	}
+	return h.file.ReadAt(b, offset)
+}
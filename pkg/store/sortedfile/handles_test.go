@@ -0,0 +1,142 @@
+package sortedfile
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func Test_handleCache_Acquire_ReusesOpenHandle(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "0", []byte("contents"), 0644)
+	c := newHandleCache(fs, 2)
+
+	first, err := c.acquire("0")
+	if err != nil {
+		t.Fatalf("Failed to acquire handle: %v", err)
+	}
+	c.release(first)
+	second, _ := c.acquire("0")
+	c.release(second)
+
+	if first != second {
+		t.Fatalf("Expected the same handle to be reused")
+	}
+	if c.len() != 1 {
+		t.Fatalf("Expected 1 handle to be cached, got %d", c.len())
+	}
+}
+
+func Test_handleCache_Acquire_EvictsLeastRecentlyUsed(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for _, filename := range []string{"0", "1", "2"} {
+		afero.WriteFile(fs, filename, []byte("contents"), 0644)
+	}
+	c := newHandleCache(fs, 2)
+
+	handles := make(map[string]*fileHandle)
+	for _, filename := range []string{"0", "1", "0", "2"} {
+		h, err := c.acquire(filename)
+		if err != nil {
+			t.Fatalf("Failed to acquire handle for '%s': %v", filename, err)
+		}
+		c.release(h)
+		handles[filename] = h
+	}
+
+	if c.len() != 2 {
+		t.Fatalf("Expected 2 handles to be cached, got %d", c.len())
+	}
+	if _, err := handles["1"].ReadAt(make([]byte, 1), 0); err == nil {
+		t.Fatalf("Expected the handle for '1' to be closed")
+	}
+	if _, err := handles["0"].ReadAt(make([]byte, 1), 0); err != nil {
+		t.Fatalf("Expected the handle for '0' to be open, got %v", err)
+	}
+}
+
+func Test_handleCache_Evict_WaitsForReadsToFinish(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "0", []byte("contents"), 0644)
+	c := newHandleCache(fs, 2)
+
+	h, _ := c.acquire("0")
+	c.evict("0")
+	if c.len() != 0 {
+		t.Fatalf("Expected the handle to be evicted")
+	}
+	b := make([]byte, 8)
+	if _, err := h.ReadAt(b, 0); err != nil || string(b) != "contents" {
+		t.Fatalf("Expected the handle in use to still be readable, got '%s', %v", b, err)
+	}
+
+	c.release(h)
+	if _, err := h.ReadAt(b, 0); err == nil {
+		t.Fatalf("Expected the handle to be closed once released")
+	}
+}
+
+func Test_handleCache_ReadAt_ReadsConcurrentlyFromOneHandle(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	contents := make([]byte, 10000)
+	for i := range contents {
+		contents[i] = byte(i)
+	}
+	afero.WriteFile(fs, "0", contents, 0644)
+	c := newHandleCache(fs, 1)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				offset := int64((g*997 + i*31) % (len(contents) - 10))
+				h, err := c.acquire("0")
+				if err != nil {
+					errs <- err
+					return
+				}
+				b := make([]byte, 10)
+				_, err = h.ReadAt(b, offset)
+				c.release(h)
+				if err != nil || b[0] != byte(offset) {
+					errs <- fmt.Errorf("read %d at offset %d: %v", b[0], offset, err)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("Unexpected read: %v", err)
+	}
+}
+
+func Test_SortedFileKvStorage_Get_ReadsMoreFilesThanHandles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	store, err := NewSortedFileKvStorage(fs, WithMemtableSize(1<<10), WithMaxOpenFiles(2), WithBlockCacheSize(0))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 500; i++ {
+		store.Set(fmt.Sprintf("key%04d", i), "value"+strconv.Itoa(i))
+	}
+	store.waitForFlushes()
+
+	for i := 0; i < 500; i++ {
+		value, exists, err := store.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || !exists || value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected 'key%04d' to be 'value%d', got '%s', %v, %v", i, i, value, exists, err)
+		}
+	}
+	if store.handleCache.len() > 2 {
+		t.Fatalf("Expected at most 2 open handles, got %d", store.handleCache.len())
+	}
+}
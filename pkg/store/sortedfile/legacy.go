@@ -0,0 +1,126 @@
+package sortedfile
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+// Sorted files used to be plain text, with a "key, value" line for each key in key order, and
+// no record of which files made up the store: every file was in level 0, numbered from 0 in the
+// order they were written. A store without a manifest has its files rewritten as tables when it
+// is opened, and its layout recorded in a new manifest.
+
+const LEGACY_SEPARATOR = ", "
+
+// upgradeLegacyStore rewrites the sorted files of a store written before the manifest as tables,
+// returning its layout. A file may already be a table if an earlier upgrade was interrupted
+// before the manifest was written.
+func (s *SortedFileKvStorage) upgradeLegacyStore() (layout, error) {
+	var l layout
+	numbers, err := listNumberedFiles(s.fs, "")
+	if err != nil {
+		return l, err
+	}
+	for _, n := range numbers {
+		filename := strconv.Itoa(n)
+		legacy, err := isLegacySortedFile(s.fs, filename)
+		if err != nil {
+			return l, err
+		}
+		if legacy {
+			// synced whatever the durability policy, as it replaces the original
+			err = upgradeLegacySortedFile(s.fs, filename, s.opts.table(), true)
+			if err != nil {
+				return l, fmt.Errorf("failed to upgrade legacy sorted file '%s': %w", filename, err)
+			}
+		}
+		l[0] = append(l[0], filename)
+	}
+	return l, nil
+}
+
+// isLegacySortedFile reports whether a file was written before sorted files were tables
+func isLegacySortedFile(fs afero.Fs, filename string) (bool, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return false, fmt.Errorf("couldn't open file '%s': %v", filename, err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false, fmt.Errorf("failed to get stats from file '%s': %v", filename, err)
+	}
+	if info.Size() < FOOTER_SIZE {
+		return true, nil
+	}
+
+	magic := make([]byte, len(TABLE_MAGIC))
+	_, err = f.ReadAt(magic, info.Size()-int64(len(magic)))
+	if err != nil {
+		return false, fmt.Errorf("failed to read file '%s': %v", filename, err)
+	}
+	return string(magic) != TABLE_MAGIC, nil
+}
+
+// upgradeLegacySortedFile rewrites a legacy sorted file as a table, checking every line holds a
+// key and value and the keys are in order, and replaces the original once the table has been
+// completely written
+func upgradeLegacySortedFile(fs afero.Fs, filename string, opts tableOptions, sync bool) error {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return fmt.Errorf("couldn't open file '%s': %v", filename, err)
+	}
+	defer f.Close()
+
+	tmpFilename := filename + TMP_SUFFIX
+	w, err := newSortedFileWriter(tmpFilename, fs, opts)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		w.abort()
+		fs.Remove(tmpFilename)
+		return err
+	}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<30)
+	var offset int64
+	var lastKey string
+	for i := 0; scanner.Scan(); i++ {
+		keyValuePair := strings.SplitN(scanner.Text(), LEGACY_SEPARATOR, 2)
+		if len(keyValuePair) != 2 {
+			return fail(&record.ErrCorrupt{Offset: offset, Reason: "line isn't a key and value"})
+		}
+		key := keyValuePair[0]
+		if i > 0 && key <= lastKey {
+			return fail(fmt.Errorf("encountered out of order keys '%s' and '%s'", lastKey, key))
+		}
+		lastKey = key
+
+		err = w.Append(record.Record{Key: key, Value: keyValuePair[1]})
+		if err != nil {
+			return fail(err)
+		}
+		offset += int64(len(scanner.Bytes())) + 1 // add one for the newline
+	}
+	if scanner.Err() != nil {
+		return fail(fmt.Errorf("couldn't scan file '%s': %v", filename, scanner.Err()))
+	}
+
+	err = w.Close(sync)
+	if err != nil {
+		fs.Remove(tmpFilename)
+		return err
+	}
+	err = fs.Rename(tmpFilename, filename)
+	if err != nil {
+		return fmt.Errorf("failed to move upgraded file into place: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package sortedfile
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+func Test_upgradeLegacySortedFile_RewritesFileAsTable(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "0", []byte(", value0\na, value1\nb, value, with a comma\nc, value3\n"), 0644)
+
+	if legacy, err := isLegacySortedFile(fs, "0"); err != nil || !legacy {
+		t.Fatalf("Expected file to be detected as legacy, got %v, %v", legacy, err)
+	}
+	err := upgradeLegacySortedFile(fs, "0", tableOptions{blockSize: BLOCK_SIZE}, false)
+	if err != nil {
+		t.Fatalf("Failed to upgrade file: %v", err)
+	}
+	if legacy, err := isLegacySortedFile(fs, "0"); err != nil || legacy {
+		t.Fatalf("Expected upgraded file not to be legacy, got %v, %v", legacy, err)
+	}
+
+	file, err := NewSortedFile("0", fs)
+	if err != nil {
+		t.Fatalf("Failed to open upgraded file: %v", err)
+	}
+	for key, expected := range map[string]string{"": "value0", "a": "value1", "b": "value, with a comma", "c": "value3"} {
+		if r, exists, _ := file.Get(key); !exists || r.Value != expected {
+			t.Fatalf("Expected '%s' to be '%s', got '%s'", key, expected, r.Value)
+		}
+	}
+}
+
+func Test_upgradeLegacySortedFile_ErrorsForUnorderedFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "0", []byte("b, value1\na, value2\nc, value3\n"), 0644)
+
+	err := upgradeLegacySortedFile(fs, "0", tableOptions{blockSize: BLOCK_SIZE}, false)
+	if err == nil {
+		t.Fatal("Expected error on reading badly ordered file")
+	}
+	if legacy, _ := isLegacySortedFile(fs, "0"); !legacy {
+		t.Fatal("Expected the original file to be left alone")
+	}
+}
+
+func Test_upgradeLegacySortedFile_ErrorsForDuplicateKeys(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "0", []byte("a, value1\na, value2\nc, value3\n"), 0644)
+
+	err := upgradeLegacySortedFile(fs, "0", tableOptions{blockSize: BLOCK_SIZE}, false)
+	if err == nil {
+		t.Fatal("Expected error on reading file with duplicate keys")
+	}
+}
+
+func Test_upgradeLegacySortedFile_ErrorsForLineWithoutValue(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "0", []byte("a, value1\nb\nc, value3\n"), 0644)
+
+	err := upgradeLegacySortedFile(fs, "0", tableOptions{blockSize: BLOCK_SIZE}, false)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected corruption error, got %v", err)
+	}
+	if offset := int64(len("a, value1\n")); corrupt.Offset != offset {
+		t.Fatalf("Expected corruption at offset %d, got %d", offset, corrupt.Offset)
+	}
+}
+
+func Test_SortedFileKvStorage_UpgradesLegacyFilesOnStartup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	afero.WriteFile(fs, "0", []byte("a, 1\nb, 2\n"), 0644)
+	afero.WriteFile(fs, "1", []byte("b, 3\nc, 4\n"), 0644)
+
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	for key, expected := range map[string]string{"a": "1", "b": "3", "c": "4"} {
+		if result, exists, err := storage.Get(key); err != nil || !exists || result != expected {
+			t.Fatalf("Expected '%s' to be '%s', got '%s', %v, %v", key, expected, result, exists, err)
+		}
+	}
+	for _, filename := range []string{"0", "1"} {
+		if legacy, _ := isLegacySortedFile(fs, filename); legacy {
+			t.Fatalf("Expected legacy file '%s' to have been upgraded", filename)
+		}
+	}
+	storage.Set("d", "5")
+	storage.Close()
+
+	// the layout is now in the manifest
+	if _, _, recorded, _ := readManifest(fs); !recorded {
+		t.Fatal("Expected the upgraded layout to be recorded in a manifest")
+	}
+	storage, err = NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+	if result, _, _ := storage.Get("b"); result != "3" {
+		t.Fatalf("Expected 'b' to be '3' after reopening, got '%s'", result)
+	}
+}
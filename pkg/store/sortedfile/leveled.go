@@ -0,0 +1,79 @@
+package sortedfile
+
+// With leveled compaction, files flushed from the memtable go into level 0, where their key
+// ranges can overlap. When there are too many of them, they are merged with the overlapping
+// files in level 1. Every level after that holds files with non-overlapping key ranges, and is
+// allowed to hold LEVEL_SIZE_MULTIPLIER times as many bytes as the level before it. When a level
+// grows past its limit, one of its files is merged into the next level.
+
+const L0_COMPACTION_TRIGGER = 4
+const LEVEL1_MAX_BYTES int64 = 10 << 20
+const LEVEL_SIZE_MULTIPLIER = 10
+const TARGET_FILE_SIZE int64 = 2 << 20
+
+// leveledPicker implements leveled compaction, in the style of LevelDB
+type leveledPicker struct {
+	l0Trigger       int
+	level1MaxBytes  int64
+	levelMultiplier int64
+	targetFileSize  int64
+
+	// the largest key of the last file compacted out of each level, so that compactions
+	// rotate through the key space rather than always picking the same file
+	pointers [NUM_LEVELS]string
+}
+
+func newLeveledPicker() *leveledPicker {
+	return &leveledPicker{
+		l0Trigger:       L0_COMPACTION_TRIGGER,
+		level1MaxBytes:  LEVEL1_MAX_BYTES,
+		levelMultiplier: LEVEL_SIZE_MULTIPLIER,
+		targetFileSize:  TARGET_FILE_SIZE,
+	}
+}
+
+func (l *leveledPicker) maxBytesForLevel(level int) int64 {
+	max := l.level1MaxBytes
+	for i := 1; i < level; i++ {
+		max *= l.levelMultiplier
+	}
+	return max
+}
+
+// pick chooses the level most in need of compaction, returning nil if none need it
+func (l *leveledPicker) pick(v *version) *compaction {
+	bestLevel, bestScore := -1, 1.0
+	for level := 0; level < NUM_LEVELS-1; level++ {
+		var score float64
+		if level == 0 {
+			score = float64(len(v.levels[0])) / float64(l.l0Trigger)
+		} else {
+			score = float64(v.levelSize(level)) / float64(l.maxBytesForLevel(level))
+		}
+		if score >= bestScore {
+			bestLevel, bestScore = level, score
+		}
+	}
+	if bestLevel < 0 {
+		return nil
+	}
+
+	c := &compaction{level: bestLevel, outputLevel: bestLevel + 1, base: v, maxOutputFileSize: l.targetFileSize}
+	if bestLevel == 0 {
+		// level 0 files can overlap each other, so they're all compacted together
+		c.inputs[0] = append(c.inputs[0], v.levels[0]...)
+	} else {
+		c.inputs[0] = []*SortedFile{v.levels[bestLevel][0]}
+		for _, f := range v.levels[bestLevel] {
+			if f.largest > l.pointers[bestLevel] {
+				c.inputs[0] = []*SortedFile{f}
+				break
+			}
+		}
+		l.pointers[bestLevel] = c.inputs[0][0].largest
+	}
+
+	smallest, largest := keyRange(c.inputs[0])
+	c.inputs[1] = v.overlapping(bestLevel+1, smallest, largest)
+	return c
+}
@@ -0,0 +1,344 @@
+package sortedfile
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+// The MANIFEST is a log of every change made to the set of sorted files, so that the exact
+// layout of the levels can be rebuilt on startup. Each flush or compaction appends one edit,
+// listing the files it removed and added, along with the next unused file number. A sorted
+// file is only part of the store once the edit adding it has been appended, so anything not in
+// the manifest was left behind by a flush or compaction that didn't finish, and can be removed.
+//
+// Each edit applies to one column family, the default family unless it says otherwise. Creating
+// a family appends an edit holding its name and options, and dropping one appends an edit that
+// removes it along with all of its files. A flush also records the family's log number, the first
+// write-ahead log that may hold writes to it that aren't in its sorted files.
+//
+// Edits are framed as records, as in the write-ahead log, so an edit torn by a crash is
+// ignored on replay. On startup the manifest is replaced with an edit for each family holding
+// its whole layout, and it is rewritten the same way whenever it grows past MAX_MANIFEST_SIZE.
+//
+// Whatever the store's durability policy, every edit is fsynced before it takes effect, as is
+// the directory whenever the manifest is replaced. Edits are rare, and a manifest that lost an
+// edit could refer to files that have since been removed.
+
+const MANIFEST_FILENAME = "MANIFEST"
+const TMP_SUFFIX = ".tmp"
+const MAX_MANIFEST_SIZE = 4 << 20
+
+// the key of every record in the manifest, whose value is the encoded edit
+const MANIFEST_EDIT_KEY = "edit"
+
+type manifestEdit struct {
+	Family         int64           `json:"family,omitempty"`
+	CreateFamily   *manifestFamily `json:"create_family,omitempty"`
+	DropFamily     bool            `json:"drop_family,omitempty"`
+	LogNumber      int64           `json:"log_number,omitempty"`
+	Removed        []string        `json:"removed,omitempty"`
+	Added          []manifestFile  `json:"added,omitempty"`
+	NextFileNumber int64           `json:"next_file_number"`
+}
+
+type manifestFile struct {
+	Level int    `json:"level"`
+	Name  string `json:"name"`
+}
+
+// manifestFamily records the name of a column family and the options that apply to it alone
+type manifestFamily struct {
+	Name               string             `json:"name"`
+	MemtableSize       int64              `json:"memtable_size"`
+	MemtableKind       memtable.Kind      `json:"memtable_kind"`
+	Compression        Compression        `json:"compression"`
+	CompactionStrategy CompactionStrategy `json:"compaction_strategy"`
+	TargetFileSize     int64              `json:"target_file_size"`
+	BloomBitsPerKey    int                `json:"bloom_bits_per_key"`
+}
+
+func newManifestFamily(name string, o options) *manifestFamily {
+	return &manifestFamily{
+		Name:               name,
+		MemtableSize:       o.memtableSize,
+		MemtableKind:       o.memtableKind,
+		Compression:        o.compression,
+		CompactionStrategy: o.compactionStrategy,
+		TargetFileSize:     o.targetFileSize,
+		BloomBitsPerKey:    o.bloomBitsPerKey,
+	}
+}
+
+// apply returns the store's options with the family's own options in place
+func (m *manifestFamily) apply(o options) options {
+	o.memtableSize = m.MemtableSize
+	o.memtableKind = m.MemtableKind
+	o.compression = m.Compression
+	o.compactionStrategy = m.CompactionStrategy
+	o.targetFileSize = m.TargetFileSize
+	o.bloomBitsPerKey = m.BloomBitsPerKey
+	return o
+}
+
+// layout holds the names of the files in each level, in the same order as a version
+type layout [NUM_LEVELS][]string
+
+// familyLayout is a column family as recorded in the manifest
+type familyLayout struct {
+	name      string
+	options   *manifestFamily // nil for the default family, which uses the store's options
+	levels    layout
+	logNumber int64
+}
+
+// newManifestEdit describes a version edit by the names of the files it changes
+func newManifestEdit(edit *versionEdit, nextFileNumber int64) manifestEdit {
+	e := manifestEdit{LogNumber: edit.logNumber, NextFileNumber: nextFileNumber}
+	for f := range edit.removed {
+		e.Removed = append(e.Removed, f.filename)
+	}
+	sort.Strings(e.Removed)
+	for level, files := range edit.added {
+		for _, f := range files {
+			e.Added = append(e.Added, manifestFile{Level: level, Name: f.filename})
+		}
+	}
+	return e
+}
+
+// snapshotEdit describes a whole version, as an edit that adds every file in it
+func snapshotEdit(v *version, nextFileNumber int64) manifestEdit {
+	e := manifestEdit{NextFileNumber: nextFileNumber}
+	for level, files := range v.levels {
+		for _, f := range files {
+			e.Added = append(e.Added, manifestFile{Level: level, Name: f.filename})
+		}
+	}
+	return e
+}
+
+// snapshotEdit describes the whole of a family, as an edit that creates it with every file it has
+func (f *ColumnFamily) snapshotEdit(nextFileNumber int64) manifestEdit {
+	e := snapshotEdit(f.current, nextFileNumber)
+	e.Family = f.id
+	e.LogNumber = f.logNumber
+	if f.id != DEFAULT_FAMILY_ID {
+		e.CreateFamily = newManifestFamily(f.name, f.opts)
+	}
+	return e
+}
+
+// apply makes the same changes to the layout as version.apply would. Files in levels above 0
+// are left in the order they were added, as they are sorted once they have been opened.
+func (l *layout) apply(e manifestEdit) error {
+	removed := make(map[string]bool, len(e.Removed))
+	for _, name := range e.Removed {
+		removed[name] = true
+	}
+	var added [NUM_LEVELS][]string
+	for _, f := range e.Added {
+		if f.Level < 0 || f.Level >= NUM_LEVELS {
+			return fmt.Errorf("file '%s' added to level %d, expected below %d", f.Name, f.Level, NUM_LEVELS)
+		}
+		added[f.Level] = append(added[f.Level], f.Name)
+	}
+
+	found := 0
+	for i, level := range l {
+		var names []string
+		placed := false
+		for _, name := range level {
+			if !removed[name] {
+				names = append(names, name)
+				continue
+			}
+			found++
+			if i == 0 && !placed {
+				names = append(names, added[i]...)
+				placed = true
+			}
+		}
+		if !placed {
+			names = append(names, added[i]...)
+		}
+		l[i] = names
+	}
+	if found != len(removed) {
+		return fmt.Errorf("edit removes %d files that aren't in the store", len(removed)-found)
+	}
+	return nil
+}
+
+// manifest appends edits to the MANIFEST file
+type manifest struct {
+	file afero.File
+	size int64
+	err  error // set once an append fails, as the edit may have been partly written
+}
+
+// readManifest replays the manifest, returning the layout of each family by id and the next
+// file number it records, or false if there is no manifest, in which case there is just an
+// empty default family. A manifest is only ever put in place holding a complete edit for every
+// family, so one without any is returned as a *record.ErrCorrupt rather than taken for an
+// empty store, whose files would then all be removed.
+func readManifest(afs afero.Fs) (map[int64]*familyLayout, int64, bool, error) {
+	families := map[int64]*familyLayout{DEFAULT_FAMILY_ID: {name: DEFAULT_COLUMN_FAMILY}}
+	_, err := afs.Stat(MANIFEST_FILENAME)
+	if errors.Is(err, fs.ErrNotExist) {
+		return families, 0, false, nil
+	} else if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to read manifest: %v", err)
+	}
+
+	var encoded []string
+	err = replayWriteAheadLog(afs, MANIFEST_FILENAME, func(r record.Record) {
+		encoded = append(encoded, r.Value)
+	})
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if len(encoded) == 0 {
+		return nil, 0, false, fmt.Errorf("failed to read manifest: %w", &record.ErrCorrupt{Offset: 0, Reason: "manifest holds no complete edit"})
+	}
+
+	var nextFileNumber int64
+	for i, contents := range encoded {
+		var e manifestEdit
+		err = json.Unmarshal([]byte(contents), &e)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("failed to decode manifest edit %d: %v", i, err)
+		}
+		if e.CreateFamily != nil {
+			families[e.Family] = &familyLayout{name: e.CreateFamily.Name, options: e.CreateFamily}
+		}
+		family, ok := families[e.Family]
+		if !ok {
+			return nil, 0, false, fmt.Errorf("failed to apply manifest edit %d: column family %d doesn't exist", i, e.Family)
+		}
+		if e.DropFamily {
+			delete(families, e.Family)
+		} else {
+			err = family.levels.apply(e)
+			if err != nil {
+				return nil, 0, false, fmt.Errorf("failed to apply manifest edit %d: %v", i, err)
+			}
+			if e.LogNumber > family.logNumber {
+				family.logNumber = e.LogNumber
+			}
+		}
+		nextFileNumber = e.NextFileNumber
+	}
+	return families, nextFileNumber, true, nil
+}
+
+// writeManifest replaces the manifest with one holding the edits, atomically so that a crash
+// leaves either the old or the new manifest, and opens it for appending further edits
+func writeManifest(fs afero.Fs, edits []manifestEdit) (*manifest, error) {
+	var contents []byte
+	for _, e := range edits {
+		encoded, err := encodeManifestEdit(e)
+		if err != nil {
+			return nil, err
+		}
+		contents = append(contents, encoded...)
+	}
+
+	tmpFilename := MANIFEST_FILENAME + TMP_SUFFIX
+	f, err := fs.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open temporary manifest: %v", err)
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to write temporary manifest: %v", err)
+	}
+	err = fs.Rename(tmpFilename, MANIFEST_FILENAME)
+	if err != nil {
+		return nil, fmt.Errorf("failed to move manifest into place: %v", err)
+	}
+	err = syncDir(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err = fs.OpenFile(MANIFEST_FILENAME, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	return &manifest{file: f, size: int64(len(contents))}, nil
+}
+
+// syncDir fsyncs the store's directory, so that files renamed into it stay there
+func syncDir(fs afero.Fs) error {
+	d, err := fs.Open(".")
+	if err != nil {
+		return fmt.Errorf("failed to open directory: %v", err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("failed to sync directory: %v", err)
+	}
+	return nil
+}
+
+func (m *manifest) append(e manifestEdit) error {
+	if m.err != nil {
+		return m.err
+	}
+	contents, err := encodeManifestEdit(e)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.file.Write(contents)
+	if err == nil {
+		err = m.file.Sync()
+	}
+	if err != nil {
+		// any later edits would follow a torn one, and be lost along with it on replay
+		m.err = fmt.Errorf("failed to append to manifest: %v", err)
+		return m.err
+	}
+	m.size += int64(len(contents))
+	return nil
+}
+
+func (m *manifest) Close() error {
+	return m.file.Close()
+}
+
+func encodeManifestEdit(e manifestEdit) ([]byte, error) {
+	contents, err := json.Marshal(e)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode manifest edit: %v", err)
+	}
+	return record.Record{Key: MANIFEST_EDIT_KEY, Value: string(contents)}.Encode(), nil
+}
+
+// highestFileNumber returns the highest number among the files in the layout, or -1 if it is empty
+func (l *layout) highestFileNumber() int64 {
+	highest := int64(-1)
+	for _, level := range l {
+		for _, name := range level {
+			n, err := strconv.ParseInt(name, 10, 64)
+			if err == nil && n > highest {
+				highest = n
+			}
+		}
+	}
+	return highest
+}
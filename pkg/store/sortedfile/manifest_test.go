@@ -0,0 +1,311 @@
+package sortedfile
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+func Test_layout_apply_MatchesVersionApply(t *testing.T) {
+	var levels [NUM_LEVELS][]*SortedFile
+	levels[0] = []*SortedFile{newTestFile("0", "a", "c", 10), newTestFile("1", "b", "d", 10), newTestFile("2", "a", "z", 10)}
+	levels[1] = []*SortedFile{newTestFile("3", "m", "n", 10)}
+	v := newVersion(levels)
+
+	// merge the first two level 0 files in place, and move a file down a level
+	edit := &versionEdit{removed: map[*SortedFile]bool{levels[0][0]: true, levels[0][1]: true, levels[1][0]: true}}
+	edit.added[0] = []*SortedFile{newTestFile("4", "a", "d", 20)}
+	edit.added[2] = []*SortedFile{levels[1][0]}
+	edited := v.apply(edit)
+
+	var l layout
+	err := l.apply(snapshotEdit(v, 4))
+	if err == nil {
+		err = l.apply(newManifestEdit(edit, 5))
+	}
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i, level := range edited.levels {
+		names := make([]string, 0)
+		for _, f := range level {
+			names = append(names, f.filename)
+		}
+		if len(names) != len(l[i]) || (len(names) > 0 && !reflect.DeepEqual(names, l[i])) {
+			t.Fatalf("Expected level %d to hold %v, got %v", i, names, l[i])
+		}
+	}
+}
+
+func Test_layout_apply_ErrorsForUnknownFile(t *testing.T) {
+	var l layout
+	l[0] = []string{"0"}
+	err := l.apply(manifestEdit{Removed: []string{"1"}})
+	if err == nil {
+		t.Fatal("Expected an error removing a file that isn't in the layout")
+	}
+}
+
+func Test_readManifest_IgnoresTornEdit(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	m, err := writeManifest(fs, []manifestEdit{{Added: []manifestFile{{Level: 0, Name: "0"}}, NextFileNumber: 1}})
+	if err != nil {
+		t.Fatalf("Failed to write manifest: %v", err)
+	}
+	m.append(manifestEdit{Added: []manifestFile{{Level: 1, Name: "1"}}, NextFileNumber: 2})
+	torn, _ := encodeManifestEdit(manifestEdit{Added: []manifestFile{{Level: 0, Name: "2"}}, NextFileNumber: 3})
+	m.file.Write(torn[:len(torn)/2])
+	m.Close()
+
+	families, nextFileNumber, recorded, err := readManifest(fs)
+	l := families[DEFAULT_FAMILY_ID].levels
+	if err != nil || !recorded {
+		t.Fatalf("Expected the manifest to be read, got %v, %v", recorded, err)
+	}
+	if !reflect.DeepEqual(l[0], []string{"0"}) || !reflect.DeepEqual(l[1], []string{"1"}) {
+		t.Fatalf("Expected files '0' and '1' in levels 0 and 1, got %v", l)
+	}
+	if nextFileNumber != 2 {
+		t.Fatalf("Expected next file number 2, got %d", nextFileNumber)
+	}
+}
+
+func Test_readManifest_ErrorsForCorruptEdit(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	m, _ := writeManifest(fs, []manifestEdit{{Added: []manifestFile{{Level: 0, Name: "0"}}, NextFileNumber: 1}})
+	m.append(manifestEdit{NextFileNumber: 2})
+	m.Close()
+
+	contents, _ := afero.ReadFile(fs, MANIFEST_FILENAME)
+	contents[len(contents)/4] ^= 0xff // damage the first edit, which isn't at the end of the file
+	afero.WriteFile(fs, MANIFEST_FILENAME, contents, 0644)
+
+	_, _, _, err := readManifest(fs)
+	if err == nil {
+		t.Fatal("Expected an error reading a corrupt manifest")
+	}
+}
+
+// syncRecordingFs records every fsync, rename and removal made through it, in order
+type syncRecordingFs struct {
+	afero.Fs
+	mu     sync.Mutex
+	events []string
+}
+
+func (fs *syncRecordingFs) record(event string) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.events = append(fs.events, event)
+}
+
+func (fs *syncRecordingFs) recorded() []string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return append([]string(nil), fs.events...)
+}
+
+func (fs *syncRecordingFs) Open(name string) (afero.File, error) {
+	f, err := fs.Fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &syncRecordingFile{File: f, fs: fs}, nil
+}
+
+func (fs *syncRecordingFs) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	f, err := fs.Fs.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &syncRecordingFile{File: f, fs: fs}, nil
+}
+
+func (fs *syncRecordingFs) Rename(oldname string, newname string) error {
+	fs.record("rename " + oldname + " " + newname)
+	return fs.Fs.Rename(oldname, newname)
+}
+
+func (fs *syncRecordingFs) Remove(name string) error {
+	fs.record("remove " + name)
+	return fs.Fs.Remove(name)
+}
+
+type syncRecordingFile struct {
+	afero.File
+	fs *syncRecordingFs
+}
+
+func (f *syncRecordingFile) Write(b []byte) (int, error) {
+	f.fs.record("write " + f.Name())
+	return f.File.Write(b)
+}
+
+func (f *syncRecordingFile) Sync() error {
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		f.fs.record("sync directory")
+	} else {
+		f.fs.record("sync " + f.Name())
+	}
+	return f.File.Sync()
+}
+
+func Test_SortedFileKvStorage_SyncsManifestWhateverThePolicy(t *testing.T) {
+	fs := &syncRecordingFs{Fs: afero.NewMemMapFs()}
+	storage, err := NewSortedFileKvStorage(fs) // durability.Never()
+	if err != nil {
+		t.Fatalf("Failed to open storage: %v", err)
+	}
+	defer storage.Close()
+	storage.Set("a", "1")
+	storage.Flush()
+
+	// the new manifest is synced before being renamed into place, and the directory after,
+	// and the edit recording the flush is synced once it is appended
+	expected := []string{
+		"sync " + MANIFEST_FILENAME + TMP_SUFFIX,
+		"rename " + MANIFEST_FILENAME + TMP_SUFFIX + " " + MANIFEST_FILENAME,
+		"sync directory",
+		"write " + MANIFEST_FILENAME,
+		"sync " + MANIFEST_FILENAME,
+	}
+	next := 0
+	for _, event := range fs.recorded() {
+		if next < len(expected) && event == expected[next] {
+			next++
+		}
+	}
+	if next != len(expected) {
+		t.Fatalf("Expected %v in order, got %v", expected, fs.recorded())
+	}
+}
+
+func Test_readManifest_ErrorsForManifestWithoutEdit(t *testing.T) {
+	whole, _ := encodeManifestEdit(manifestEdit{Added: []manifestFile{{Level: 0, Name: "0"}}, NextFileNumber: 1})
+	for name, contents := range map[string][]byte{"empty": {}, "torn": whole[:len(whole)/2]} {
+		fs := afero.NewMemMapFs()
+		afero.WriteFile(fs, MANIFEST_FILENAME, contents, 0644)
+
+		_, _, _, err := readManifest(fs)
+		var corrupt *record.ErrCorrupt
+		if !errors.As(err, &corrupt) {
+			t.Fatalf("%s: expected *record.ErrCorrupt, got %v", name, err)
+		}
+	}
+}
+
+func Test_SortedFileKvStorage_KeepsFilesWhenManifestHoldsNoEdit(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	storage.Set("a", "1")
+	storage.Flush()
+	flushed := storage.defaultFamily.current.levels[0][0].Name()
+	storage.Close()
+	afero.WriteFile(fs, MANIFEST_FILENAME, nil, 0644)
+
+	_, err := NewSortedFileKvStorage(fs)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected *record.ErrCorrupt opening a store with an empty manifest, got %v", err)
+	}
+	if exists, _ := afero.Exists(fs, flushed); !exists {
+		t.Fatalf("Expected sorted file '%s' to be kept", flushed)
+	}
+}
+
+func Test_SortedFileKvStorage_RemovesOrphanedFilesOnStartup(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	for i := 0; i < 100; i++ {
+		storage.Set("key"+strconv.Itoa(i), "value")
+	}
+	storage.Flush()
+	flushed := storage.defaultFamily.current.levels[0][0].Name()
+	storage.Close()
+
+	// a complete file that never made it into the manifest, as if the process crashed just
+	// before a compaction finished, and the remains of interrupted rewrites
+	writeTestSortedFile(t, fs, "7", 10, defaultOptions().table())
+	afero.WriteFile(fs, "3"+TMP_SUFFIX, []byte("partial"), 0644)
+	afero.WriteFile(fs, MANIFEST_FILENAME+TMP_SUFFIX, []byte("partial"), 0644)
+	afero.WriteFile(fs, "unrelated", []byte("keep"), 0644)
+
+	storage, err := NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen storage: %v", err)
+	}
+	defer storage.Close()
+
+	for _, filename := range []string{"7", "3" + TMP_SUFFIX, MANIFEST_FILENAME + TMP_SUFFIX} {
+		if exists, _ := afero.Exists(fs, filename); exists {
+			t.Fatalf("Expected orphaned file '%s' to be removed", filename)
+		}
+	}
+	for _, filename := range []string{flushed, MANIFEST_FILENAME, "unrelated"} {
+		if exists, _ := afero.Exists(fs, filename); !exists {
+			t.Fatalf("Expected file '%s' to be kept", filename)
+		}
+	}
+	if result, _, _ := storage.Get("key5"); result != "value" {
+		t.Fatalf("Expected 'key5' to be 'value', got '%s'", result)
+	}
+}
+
+func Test_SortedFileKvStorage_RestoresLevelsFromManifest(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage := newCompactingTestStorage(t, fs)
+	for i := 0; i < 1000; i++ {
+		storage.Set(fmt.Sprintf("key%03d", i%500), strconv.Itoa(i))
+	}
+	storage.waitForFlushes()
+	storage.compactUntilBalanced()
+	storage.Close()
+
+	// replaying every edit since the store was opened should give the same layout
+	families, _, _, err := readManifest(fs)
+	if err != nil {
+		t.Fatalf("Failed to read manifest: %v", err)
+	}
+	l := families[DEFAULT_FAMILY_ID].levels
+	for i, level := range storage.defaultFamily.current.levels {
+		if len(l[i]) != len(level) {
+			t.Fatalf("Expected %d files in level %d of the manifest, got %d", len(level), i, len(l[i]))
+		}
+	}
+}
+
+func Test_SortedFileKvStorage_RewritesManifestOnceTooLarge(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	defer storage.Close()
+	for i := 0; i < 100; i++ {
+		storage.Set("a"+strconv.Itoa(i), "value")
+	}
+	storage.Flush()
+
+	storage.mu.Lock()
+	storage.manifest.size = MAX_MANIFEST_SIZE
+	storage.mu.Unlock()
+	for i := 0; i < 100; i++ {
+		storage.Set("b"+strconv.Itoa(i), "value")
+	}
+	storage.Flush()
+
+	edits := 0
+	replayWriteAheadLog(fs, MANIFEST_FILENAME, func(r record.Record) { edits++ })
+	if edits != 1 {
+		t.Fatalf("Expected the manifest to be rewritten as a single edit, got %d edits", edits)
+	}
+	families, _, _, _ := readManifest(fs)
+	l := families[DEFAULT_FAMILY_ID].levels
+	if len(l[0]) != 2 {
+		t.Fatalf("Expected both flushed files in the rewritten manifest, got %v", l[0])
+	}
+}
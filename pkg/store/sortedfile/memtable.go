@@ -0,0 +1,30 @@
+package sortedfile
+
+import "github.com/haydenjeune/kvstore/pkg/record"
+
+// The memtable stores an entry for each key rather than its raw value, so that a deleted key
+// can be remembered as a tombstone until it is flushed. An entry is the value prefixed by a
+// single byte saying which kind of entry it is.
+
+// MEMTABLE_SIZE is the default number of bytes of keys and entries the memtable holds before
+// it is flushed to a sorted file
+const MEMTABLE_SIZE int64 = 4 << 20
+
+const (
+	ENTRY_VALUE     byte = 'v'
+	ENTRY_TOMBSTONE byte = 'd'
+)
+
+func encodeEntry(r record.Record) string {
+	if r.Deleted {
+		return string(ENTRY_TOMBSTONE)
+	}
+	return string(ENTRY_VALUE) + r.Value
+}
+
+func decodeEntry(key string, entry string) record.Record {
+	if entry[0] == ENTRY_TOMBSTONE {
+		return record.Record{Key: key, Deleted: true}
+	}
+	return record.Record{Key: key, Value: entry[1:]}
+}
@@ -0,0 +1,122 @@
+package sortedfile
+
+import (
+	"container/heap"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+// iterator steps through records in key order
+type iterator interface {
+	Next() bool
+	Record() record.Record
+	Err() error
+	Close() error
+}
+
+// mergingIterator combines several iterators into a single stream of records in key order.
+// The iterators are given newest first, and where more than one has a record for the same key
+// only the newest one is returned, as the others have been shadowed by it.
+type mergingIterator struct {
+	iters   []iterator
+	heap    iteratorHeap
+	current record.Record
+	err     error
+	started bool
+}
+
+func newMergingIterator(iters []iterator) *mergingIterator {
+	return &mergingIterator{iters: iters}
+}
+
+func (m *mergingIterator) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if !m.started {
+		m.started = true
+		for i, iter := range m.iters {
+			if !m.advance(i, iter) {
+				return false
+			}
+		}
+		heap.Init(&m.heap)
+	}
+
+	if len(m.heap) == 0 {
+		return false
+	}
+
+	m.current = m.heap[0].record
+	// skip past every older record for the same key
+	for len(m.heap) > 0 && m.heap[0].record.Key == m.current.Key {
+		top := heap.Pop(&m.heap).(heapItem)
+		if !m.advance(top.priority, m.iters[top.priority]) {
+			return false
+		}
+	}
+	return true
+}
+
+// advance moves the iterator with the given priority on, putting its next record on the heap
+func (m *mergingIterator) advance(priority int, iter iterator) bool {
+	if iter.Next() {
+		heap.Push(&m.heap, heapItem{record: iter.Record(), priority: priority})
+	} else if iter.Err() != nil {
+		m.err = iter.Err()
+		return false
+	}
+	return true
+}
+
+func (m *mergingIterator) Record() record.Record {
+	return m.current
+}
+
+func (m *mergingIterator) Err() error {
+	return m.err
+}
+
+func (m *mergingIterator) Close() error {
+	var firstErr error
+	for _, iter := range m.iters {
+		err := iter.Close()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type heapItem struct {
+	record   record.Record
+	priority int // the index of the iterator the record came from, lower is newer
+}
+
+type iteratorHeap []heapItem
+
+func (h iteratorHeap) Len() int {
+	return len(h)
+}
+
+func (h iteratorHeap) Less(i, j int) bool {
+	if h[i].record.Key != h[j].record.Key {
+		return h[i].record.Key < h[j].record.Key
+	}
+	return h[i].priority < h[j].priority
+}
+
+func (h iteratorHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *iteratorHeap) Push(x interface{}) {
+	*h = append(*h, x.(heapItem))
+}
+
+func (h *iteratorHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
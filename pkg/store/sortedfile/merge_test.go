@@ -0,0 +1,54 @@
+package sortedfile
+
+import (
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+// sliceIterator iterates over records held in memory
+type sliceIterator struct {
+	records []record.Record
+	i       int
+}
+
+func (s *sliceIterator) Next() bool {
+	s.i++
+	return s.i <= len(s.records)
+}
+
+func (s *sliceIterator) Record() record.Record {
+	return s.records[s.i-1]
+}
+
+func (s *sliceIterator) Err() error {
+	return nil
+}
+
+func (s *sliceIterator) Close() error {
+	return nil
+}
+
+func Test_mergingIterator_ReturnsNewestRecordForEachKeyInOrder(t *testing.T) {
+	newest := &sliceIterator{records: []record.Record{{Key: "b", Value: "new"}, {Key: "d", Deleted: true}}}
+	middle := &sliceIterator{records: []record.Record{}}
+	oldest := &sliceIterator{records: []record.Record{{Key: "a", Value: "1"}, {Key: "b", Value: "old"}, {Key: "d", Value: "4"}}}
+
+	merged := newMergingIterator([]iterator{newest, middle, oldest})
+	expected := []record.Record{{Key: "a", Value: "1"}, {Key: "b", Value: "new"}, {Key: "d", Deleted: true}}
+
+	for i, r := range expected {
+		if !merged.Next() {
+			t.Fatalf("Iterator finished after %d records, expected %d", i, len(expected))
+		}
+		if merged.Record() != r {
+			t.Fatalf("Expected record %v at position %d, got %v", r, i, merged.Record())
+		}
+	}
+	if merged.Next() {
+		t.Fatalf("Expected iterator to finish, got %v", merged.Record())
+	}
+	if merged.Err() != nil {
+		t.Fatalf("Unexpected error: %v", merged.Err())
+	}
+}
@@ -0,0 +1,49 @@
+package sortedfile
+
+import (
+	"errors"
+	"os"
+
+	"github.com/spf13/afero"
+)
+
+// Sorted files are never changed once written, so where the operating system allows, each one
+// is mapped into memory when it is opened, and data blocks are read straight from the mapping
+// rather than with a system call and a copy per lookup. Files in any other afero.Fs, or on
+// platforms without mmap, are read through the Fs as before.
+
+var errMmapUnsupported = errors.New("memory mapping isn't supported on this platform")
+
+// mapFile maps the whole of a file into memory for reading. It returns nil if the file isn't one
+// of the operating system's, mmap isn't supported, or mapping fails, in which case the file
+// should be read through fs.
+func mapFile(fs afero.Fs, filename string, size int64) []byte {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil
+	}
+	// the mapping stays valid once the file is closed
+	defer f.Close()
+
+	osFile, ok := unwrapOsFile(f)
+	if !ok || size == 0 {
+		return nil
+	}
+	b, err := mmap(osFile, size)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// unwrapOsFile returns the operating system file behind f, if there is one
+func unwrapOsFile(f afero.File) (*os.File, bool) {
+	switch f := f.(type) {
+	case *os.File:
+		return f, true
+	case *afero.BasePathFile:
+		return unwrapOsFile(f.File)
+	default:
+		return nil, false
+	}
+}
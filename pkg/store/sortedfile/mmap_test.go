@@ -0,0 +1,247 @@
+package sortedfile
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+// newMappableTestFs returns a filesystem in a temporary directory whose files can be mapped into
+// memory, skipping the test on platforms without mmap
+func newMappableTestFs(t testing.TB) afero.Fs {
+	if _, err := mmap(nil, 0); errors.Is(err, errMmapUnsupported) {
+		t.Skip(err)
+	}
+	return afero.NewBasePathFs(afero.NewOsFs(), t.TempDir())
+}
+
+func Test_NewSortedFile_MapsFilesOnTheOsFs(t *testing.T) {
+	fs := newMappableTestFs(t)
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
+	defer file.Close()
+
+	if int64(len(file.mapped)) != file.Size() {
+		t.Fatalf("Expected the %d byte file to be mapped, got %d bytes", file.Size(), len(file.mapped))
+	}
+}
+
+func Test_NewSortedFile_ReadsThroughOtherFsWithoutMapping(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
+
+	if file.mapped != nil {
+		t.Fatalf("Expected a file in memory not to be mapped")
+	}
+	if r, exists, err := file.Get("key050"); err != nil || !exists || r.Value != "value50" {
+		t.Fatalf("Expected 'key050' to be 'value50', got '%s', %v, %v", r.Value, exists, err)
+	}
+}
+
+func Test_SortedFile_Get_FindsEveryKeyThroughMapping(t *testing.T) {
+	for _, compression := range []Compression{NoCompression, FlateCompression} {
+		t.Run(strconv.Itoa(int(compression)), func(t *testing.T) {
+			fs := newMappableTestFs(t)
+			w, err := newSortedFileWriter("0", fs, tableOptions{blockSize: 256, compression: compression})
+			if err != nil {
+				t.Fatalf("Failed to start sorted file: %v", err)
+			}
+			for i := 0; i < 100; i++ {
+				// repetitive values so that blocks are worth compressing
+				w.Append(record.Record{Key: fmt.Sprintf("key%03d", i), Value: fmt.Sprintf("value%040d", i)})
+			}
+			if err := w.Close(false); err != nil {
+				t.Fatalf("Failed to write sorted file: %v", err)
+			}
+			file, err := newSortedFile("0", fs, readOptions{blocks: newBlockCache(1 << 20), mmap: true})
+			if err != nil {
+				t.Fatalf("Failed to open sorted file: %v", err)
+			}
+			defer file.Close()
+			if file.mapped == nil {
+				t.Fatalf("Expected the file to be mapped")
+			}
+
+			for i := 0; i < 100; i++ {
+				r, exists, err := file.Get(fmt.Sprintf("key%03d", i))
+				if err != nil || !exists || r.Value != fmt.Sprintf("value%040d", i) {
+					t.Fatalf("Expected 'key%03d' to be found, got '%s', %v, %v", i, r.Value, exists, err)
+				}
+			}
+			for _, key := range []string{"a", "key0005", "key050x", "z"} {
+				if _, exists, err := file.Get(key); err != nil || exists {
+					t.Fatalf("Expected '%s' not to be found, got %v, %v", key, exists, err)
+				}
+			}
+		})
+	}
+}
+
+func Test_SortedFile_Get_ErrorsForCorruptBlockThroughMapping(t *testing.T) {
+	fs := newMappableTestFs(t)
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
+	defer file.Close()
+
+	// the mapping is shared, so writing to the file changes what is read through it
+	second := blockOf(file.index.At(1))
+	f, _ := fs.OpenFile("0", os.O_WRONLY, 0644)
+	f.WriteAt([]byte{file.mapped[second.offset+3] ^ 0xff}, second.offset+3)
+	f.Close()
+
+	_, _, err := file.Get(file.index.At(1).Key)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected corruption error, got %v", err)
+	}
+	if corrupt.Offset != second.offset {
+		t.Fatalf("Expected corruption at offset %d, got %d", second.offset, corrupt.Offset)
+	}
+	if _, exists, err := file.Get("key000"); err != nil || !exists {
+		t.Fatalf("Expected 'key000' to be found, got %v, %v", exists, err)
+	}
+}
+
+func Test_SortedFile_Close_UnmapsOnce(t *testing.T) {
+	fs := newMappableTestFs(t)
+	file := writeTestSortedFile(t, fs, "0", 100, tableOptions{blockSize: 256})
+
+	if err := file.Close(); err != nil {
+		t.Fatalf("Failed to close sorted file: %v", err)
+	}
+	if file.mapped != nil {
+		t.Fatalf("Expected the mapping to be released")
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("Expected closing again to do nothing, got %v", err)
+	}
+}
+
+func Test_SortedFileKvStorage_Close_WaitsForReadsOfMappedFiles(t *testing.T) {
+	fs := newMappableTestFs(t)
+	storage, err := NewSortedFileKvStorage(fs, WithMemtableSize(4<<10))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		storage.Set(fmt.Sprintf("key%04d", i), "value"+strconv.Itoa(i))
+	}
+	storage.Flush()
+
+	var wg, started sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		started.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i, n := g, 0; ; i, n = (i+7)%1000, n+1 {
+				if n == 1 {
+					started.Done()
+				}
+				value, _, err := storage.Get(fmt.Sprintf("key%04d", i))
+				if errors.Is(err, ErrClosed) {
+					return
+				} else if err != nil || value != "value"+strconv.Itoa(i) {
+					errs <- fmt.Errorf("expected 'key%04d' to be 'value%d', got '%s', %v", i, i, value, err)
+					return
+				}
+			}
+		}(g)
+	}
+	started.Wait() // every goroutine is part of the way through reading
+	if err := storage.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if _, _, err := storage.Get("key0000"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected reads to be refused once the store is closed, got %v", err)
+	}
+	if err := storage.Set("key0000", "value"); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Expected writes to be refused once the store is closed, got %v", err)
+	}
+}
+
+func Test_SortedFileKvStorage_ReadsMappedFilesAfterReopening(t *testing.T) {
+	fs := newMappableTestFs(t)
+	store, err := NewSortedFileKvStorage(fs, WithMemtableSize(4<<10))
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		store.Set(fmt.Sprintf("key%04d", i), "value"+strconv.Itoa(i))
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Failed to close store: %v", err)
+	}
+
+	store, err = NewSortedFileKvStorage(fs)
+	if err != nil {
+		t.Fatalf("Failed to reopen store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 1000; i++ {
+		value, exists, err := store.Get(fmt.Sprintf("key%04d", i))
+		if err != nil || !exists || value != "value"+strconv.Itoa(i) {
+			t.Fatalf("Expected 'key%04d' to be 'value%d', got '%s', %v, %v", i, i, value, exists, err)
+		}
+	}
+}
+
+// Benchmark_SortedFile_Get compares point lookups read from a mapping with those read through
+// the Fs from a cached handle, and from a file opened for each lookup, with the block cache off so
+// that every lookup reads its block
+func Benchmark_SortedFile_Get(b *testing.B) {
+	const numKeys = 100000
+	benchmarks := []struct {
+		name string
+		opts func(fs afero.Fs) readOptions
+	}{
+		{"mapped", func(fs afero.Fs) readOptions { return readOptions{mmap: true} }},
+		{"cached handle", func(fs afero.Fs) readOptions { return readOptions{handles: newHandleCache(fs, 1)} }},
+		{"open per read", func(fs afero.Fs) readOptions { return readOptions{} }},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			fs := newMappableTestFs(b)
+			w, err := newSortedFileWriter("0", fs, tableOptions{blockSize: BLOCK_SIZE})
+			if err != nil {
+				b.Fatalf("Failed to start sorted file: %v", err)
+			}
+			for i := 0; i < numKeys; i++ {
+				w.Append(record.Record{Key: fmt.Sprintf("key%06d", i), Value: "value" + strconv.Itoa(i)})
+			}
+			if err := w.Close(false); err != nil {
+				b.Fatalf("Failed to write sorted file: %v", err)
+			}
+			file, err := newSortedFile("0", fs, bm.opts(fs))
+			if err != nil {
+				b.Fatalf("Failed to open sorted file: %v", err)
+			}
+			defer file.Close()
+
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = fmt.Sprintf("key%06d", rand.Intn(numKeys))
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for i := 0; pb.Next(); i++ {
+					if _, exists, err := file.Get(keys[i%len(keys)]); err != nil || !exists {
+						b.Errorf("Expected '%s' to be found, got %v, %v", keys[i%len(keys)], exists, err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package sortedfile
+
+import (
+	"github.com/haydenjeune/kvstore/pkg/bloom"
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+)
+
+// Option configures a SortedFileKvStorage
+type Option func(*options)
+
+type options struct {
+	durability            durability.Policy
+	compactionStrategy    CompactionStrategy
+	bloomBitsPerKey       int
+	compression           Compression
+	blockCacheSize        int64
+	maxImmutableMemtables int
+	memtableSize          int64
+	targetFileSize        int64
+	memtableKind          memtable.Kind
+	mmapReads             bool
+	maxOpenFiles          int
+}
+
+func defaultOptions() options {
+	return options{
+		durability:            durability.Never(),
+		compactionStrategy:    Leveled,
+		bloomBitsPerKey:       bloom.DEFAULT_BITS_PER_KEY,
+		compression:           NoCompression,
+		blockCacheSize:        BLOCK_CACHE_SIZE,
+		maxImmutableMemtables: MAX_IMMUTABLE_MEMTABLES,
+		memtableSize:          MEMTABLE_SIZE,
+		targetFileSize:        TARGET_FILE_SIZE,
+		memtableKind:          memtable.AVLTree,
+		mmapReads:             true,
+		maxOpenFiles:          MAX_OPEN_FILES,
+	}
+}
+
+// table returns the settings for writing new sorted files
+func (o options) table() tableOptions {
+	return tableOptions{blockSize: BLOCK_SIZE, bitsPerKey: o.bloomBitsPerKey, compression: o.compression}
+}
+
+// familyOptions returns the store's options with the ones that apply to a single column family
+// taken from o
+func (o options) familyOptions(store options) options {
+	return newManifestFamily("", o).apply(store)
+}
+
+// WithDurability sets whether sorted files are fsynced once they have been written. By
+// default this is left to the operating system.
+func WithDurability(p durability.Policy) Option {
+	return func(o *options) {
+		o.durability = p
+	}
+}
+
+// WithCompactionStrategy sets how sorted files are merged in the background. By default this is
+// Leveled.
+func WithCompactionStrategy(strategy CompactionStrategy) Option {
+	return func(o *options) {
+		o.compactionStrategy = strategy
+	}
+}
+
+// WithBloomFilterBitsPerKey sets the size of the Bloom filter written with each new sorted file.
+// More bits per key means fewer wasted reads for missing keys, at the cost of memory. By default
+// this is bloom.DEFAULT_BITS_PER_KEY, for a false positive rate of around 1%, and 0 disables the
+// filters.
+func WithBloomFilterBitsPerKey(bitsPerKey int) Option {
+	return func(o *options) {
+		o.bloomBitsPerKey = bitsPerKey
+	}
+}
+
+// WithCompression sets how the data blocks of new sorted files are compressed. By default they
+// aren't. Files already written keep the compression they were written with.
+func WithCompression(c Compression) Option {
+	return func(o *options) {
+		o.compression = c
+	}
+}
+
+// WithBlockCacheSize sets how many bytes of recently read data blocks are kept in memory, shared
+// between every sorted file in the store. By default this is BLOCK_CACHE_SIZE, and 0 turns the
+// cache off.
+func WithBlockCacheSize(bytes int64) Option {
+	return func(o *options) {
+		o.blockCacheSize = bytes
+	}
+}
+
+// WithMaxImmutableMemtables sets how many full memtables can be waiting to be flushed before
+// writers have to wait for the flusher to catch up. By default this is MAX_IMMUTABLE_MEMTABLES,
+// and it is at least 1.
+func WithMaxImmutableMemtables(n int) Option {
+	return func(o *options) {
+		if n < 1 {
+			n = 1
+		}
+		o.maxImmutableMemtables = n
+	}
+}
+
+// WithMemtableSize sets how many bytes of keys and values the memtable holds before it is flushed
+// to a sorted file. Overwriting a key only counts the change in the size of its value. By
+// default this is MEMTABLE_SIZE.
+func WithMemtableSize(bytes int64) Option {
+	return func(o *options) {
+		o.memtableSize = bytes
+	}
+}
+
+// WithTargetFileSize sets the size at which leveled compaction starts a new output file. By
+// default this is TARGET_FILE_SIZE.
+func WithTargetFileSize(bytes int64) Option {
+	return func(o *options) {
+		o.targetFileSize = bytes
+	}
+}
+
+// WithMemtable sets which kind of memtable recent writes are kept in. By default this is
+// memtable.AVLTree, which stays balanced however keys are inserted.
+func WithMemtable(kind memtable.Kind) Option {
+	return func(o *options) {
+		o.memtableKind = kind
+	}
+}
+
+// WithMmapReads sets whether sorted files are mapped into memory and read from the mapping, rather
+// than through the afero.Fs. By default they are, where the Fs is backed by the operating system
+// and the platform supports mmap, and files are read through the Fs otherwise.
+func WithMmapReads(enabled bool) Option {
+	return func(o *options) {
+		o.mmapReads = enabled
+	}
+}
+
+// WithMaxOpenFiles sets how many sorted files are kept open for reading blocks that aren't read
+// from a memory mapping, shared between every file in the store. By default this is
+// MAX_OPEN_FILES, and 0 opens a file for every read instead.
+func WithMaxOpenFiles(n int) Option {
+	return func(o *options) {
+		o.maxOpenFiles = n
+	}
+}
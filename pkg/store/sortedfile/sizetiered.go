@@ -0,0 +1,91 @@
+package sortedfile
+
+import "math"
+
+// With size-tiered compaction, every file stays in level 0. Once there are enough files of a
+// similar size, they are merged into a single larger file, which takes their place. Each byte is
+// rewritten roughly once per tier rather than once per level, but more files may need to be read
+// to find a key, and overwritten values linger for longer before they're merged away.
+
+const SIZE_TIERED_MIN_THRESHOLD = 4
+const SIZE_TIERED_MAX_THRESHOLD = 32
+
+// files smaller than this are treated as the same size, so that small flushes are grouped
+// together even if their sizes differ a lot
+const SIZE_TIERED_MIN_FILE_SIZE int64 = 50 << 10
+
+// sizeTieredPicker implements size-tiered compaction, in the style of Cassandra
+type sizeTieredPicker struct {
+	minThreshold int
+	maxThreshold int
+	minFileSize  int64
+
+	// files are in the same tier if their size is within these multiples of the tier's average
+	bucketLow  float64
+	bucketHigh float64
+}
+
+func newSizeTieredPicker() *sizeTieredPicker {
+	return &sizeTieredPicker{
+		minThreshold: SIZE_TIERED_MIN_THRESHOLD,
+		maxThreshold: SIZE_TIERED_MAX_THRESHOLD,
+		minFileSize:  SIZE_TIERED_MIN_FILE_SIZE,
+		bucketLow:    0.5,
+		bucketHigh:   1.5,
+	}
+}
+
+// pick chooses the run of files with the smallest average size out of those with enough files
+// of a similar size. Only files next to each other in level 0 are merged, so that the merged
+// file can take their place without changing which of the remaining files is newer.
+func (p *sizeTieredPicker) pick(v *version) *compaction {
+	files := v.levels[0]
+
+	var best []*SortedFile
+	var bestAverage float64
+	for start := range files {
+		run := p.similarRun(files[start:])
+		if len(run) < p.minThreshold {
+			continue
+		}
+		average := averageSize(run)
+		if best == nil || average < bestAverage {
+			best, bestAverage = run, average
+		}
+	}
+	if best == nil {
+		return nil
+	}
+
+	c := &compaction{level: 0, outputLevel: 0, base: v, maxOutputFileSize: math.MaxInt64}
+	c.inputs[0] = best
+	return c
+}
+
+// similarRun returns the longest prefix of files whose sizes are similar to their average
+func (p *sizeTieredPicker) similarRun(files []*SortedFile) []*SortedFile {
+	var total int64
+	end := 0
+	for end < len(files) && end < p.maxThreshold {
+		size := files[end].size
+		if end > 0 {
+			average := float64(total) / float64(end)
+			small := size < p.minFileSize && average < float64(p.minFileSize)
+			similar := float64(size) >= average*p.bucketLow && float64(size) <= average*p.bucketHigh
+			if !small && !similar {
+				break
+			}
+		}
+		total += size
+		end++
+	}
+	return files[:end]
+}
+
+func averageSize(files []*SortedFile) float64 {
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	return float64(total) / float64(len(files))
+}
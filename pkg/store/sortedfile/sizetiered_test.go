@@ -0,0 +1,143 @@
+package sortedfile
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func Test_sizeTieredPicker_pick_ReturnsNilWithoutEnoughSimilarFiles(t *testing.T) {
+	var levels [NUM_LEVELS][]*SortedFile
+	levels[0] = []*SortedFile{
+		newTestFile("0", "a", "z", 1000),
+		newTestFile("1", "a", "z", 100),
+		newTestFile("2", "a", "z", 100),
+		newTestFile("3", "a", "z", 100),
+		newTestFile("4", "a", "z", 1000),
+	}
+	p := newSizeTieredPicker()
+	p.minFileSize = 0
+
+	if c := p.pick(newVersion(levels)); c != nil {
+		t.Fatalf("Expected no compaction, got one with %d files", len(c.inputs[0]))
+	}
+}
+
+func Test_sizeTieredPicker_pick_MergesSmallestTierInPlace(t *testing.T) {
+	var levels [NUM_LEVELS][]*SortedFile
+	levels[0] = []*SortedFile{
+		newTestFile("0", "a", "z", 1000),
+		newTestFile("1", "a", "z", 1100),
+		newTestFile("2", "a", "z", 900),
+		newTestFile("3", "a", "z", 1000),
+		newTestFile("4", "a", "z", 100),
+		newTestFile("5", "a", "z", 110),
+		newTestFile("6", "a", "z", 90),
+		newTestFile("7", "a", "z", 100),
+	}
+	p := newSizeTieredPicker()
+	p.minFileSize = 0
+	v := newVersion(levels)
+
+	c := p.pick(v)
+	if c == nil {
+		t.Fatal("Expected a compaction")
+	}
+	if c.level != 0 || c.outputLevel != 0 {
+		t.Fatalf("Expected a compaction within level 0, got %d to %d", c.level, c.outputLevel)
+	}
+	if len(c.inputs[0]) != 4 || c.inputs[0][0].filename != "4" {
+		t.Fatalf("Expected the four smallest files to be merged, got %d starting at '%s'", len(c.inputs[0]), c.inputs[0][0].filename)
+	}
+
+	// the merged file replaces its inputs without changing the order of the other files
+	edit := &versionEdit{removed: make(map[*SortedFile]bool)}
+	for _, f := range levels[0][:4] {
+		edit.removed[f] = true
+	}
+	edit.added[0] = []*SortedFile{newTestFile("8", "a", "z", 4000)}
+	merged := v.apply(edit)
+	names := ""
+	for _, f := range merged.levels[0] {
+		names += f.filename + " "
+	}
+	if names != "8 4 5 6 7 " {
+		t.Fatalf("Expected level 0 to be '8 4 5 6 7 ', got '%s'", names)
+	}
+}
+
+func Test_sizeTieredPicker_pick_GroupsSmallFilesTogether(t *testing.T) {
+	var levels [NUM_LEVELS][]*SortedFile
+	levels[0] = []*SortedFile{
+		newTestFile("0", "a", "z", 10),
+		newTestFile("1", "a", "z", 1000),
+		newTestFile("2", "a", "z", 200),
+		newTestFile("3", "a", "z", 30),
+	}
+	p := newSizeTieredPicker()
+	p.minFileSize = 2000
+
+	c := p.pick(newVersion(levels))
+	if c == nil || len(c.inputs[0]) != 4 {
+		t.Fatal("Expected all files below the minimum size to be merged")
+	}
+}
+
+func Test_SortedFileKvStorage_SizeTieredCompactionKeepsNewestValues(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, err := NewSortedFileKvStorage(fs, WithCompactionStrategy(SizeTiered), WithMemtableSize(1<<10))
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+
+	picker := newSizeTieredPicker()
+	picker.minFileSize = 0
+	storage.compactionMu.Lock()
+	storage.defaultFamily.compactionPicker = picker
+	storage.compactionMu.Unlock()
+
+	expected := make(map[string]string)
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%03d", i%300)
+		storage.Set(key, strconv.Itoa(i))
+		expected[key] = strconv.Itoa(i)
+		if i%11 == 0 {
+			key = fmt.Sprintf("key%03d", (i*7)%300)
+			storage.Delete(key)
+			delete(expected, key)
+		}
+	}
+
+	storage.waitForFlushes()
+	err = storage.compactUntilBalanced()
+	if err != nil {
+		t.Fatalf("Unexpected error compacting: %v", err)
+	}
+
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		result, exists, err := storage.Get(key)
+		if err != nil {
+			t.Fatalf("Unexpected error getting '%s': %v", key, err)
+		}
+		if expectedValue, ok := expected[key]; exists != ok || result != expectedValue {
+			t.Fatalf("Expected '%s' to be '%s' (exists: %v), got '%s' (exists: %v)", key, expectedValue, ok, result, exists)
+		}
+	}
+
+	stats := storage.Stats()
+	if stats.Compactions == 0 {
+		t.Fatal("Expected files to have been compacted")
+	}
+	for level := 1; level < NUM_LEVELS; level++ {
+		if stats.Levels[level].Files != 0 {
+			t.Fatalf("Expected every file to stay in level 0, found %d in level %d", stats.Levels[level].Files, level)
+		}
+	}
+	if stats.Levels[0].Files >= 20 {
+		t.Fatalf("Expected level 0 to be compacted, got %d files", stats.Levels[0].Files)
+	}
+}
@@ -0,0 +1,231 @@
+package sortedfile
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// stats counts the work done for a column family, so that compaction strategies and filter settings can
+// be compared. The counters are updated atomically, as flushes, compactions and reads run
+// concurrently.
+type stats struct {
+	userBytes              int64 // the encoded size of every record written by Set or Delete
+	flushBytes             int64 // bytes written to sorted files by memtable flushes
+	compactionBytesRead    int64
+	compactionBytesWritten int64
+	compactions            int64 // compactions that merged files, excluding trivial moves
+
+	// lookups in files that the filters ruled out, and that they let through but the file
+	// didn't have the key
+	filterNegatives      int64
+	filterFalsePositives int64
+
+	writeStalls int64 // writes that had to wait for a memtable to be flushed
+}
+
+func (s *stats) recordFilterResult(filtered filterResult, exists bool) {
+	if filtered == filterExcluded {
+		atomic.AddInt64(&s.filterNegatives, 1)
+	} else if filtered == filterPassed && !exists {
+		atomic.AddInt64(&s.filterFalsePositives, 1)
+	}
+}
+
+func (s *stats) recordCompaction(c *compaction, outputs []*SortedFile) {
+	for _, inputs := range c.inputs {
+		for _, f := range inputs {
+			atomic.AddInt64(&s.compactionBytesRead, f.size)
+		}
+	}
+	for _, f := range outputs {
+		atomic.AddInt64(&s.compactionBytesWritten, f.size)
+	}
+	atomic.AddInt64(&s.compactions, 1)
+}
+
+// LevelStats describes the sorted files in one level
+type LevelStats struct {
+	Files int
+	Bytes int64
+
+	// the size of the files' data blocks as stored, and before they were compressed
+	StoredDataBytes int64
+	DataBytes       int64
+}
+
+// Stats is a snapshot of a column family's file layout and of the bytes it has written since the
+// store was opened. The block cache is shared by every family, so its counters cover them all.
+type Stats struct {
+	Levels                 [NUM_LEVELS]LevelStats
+	UserBytes              int64
+	FlushBytes             int64
+	CompactionBytesRead    int64
+	CompactionBytesWritten int64
+	Compactions            int64
+	FilterNegatives        int64
+	FilterFalsePositives   int64
+	BlockCacheHits         int64
+	BlockCacheMisses       int64
+	BlockCacheBytes        int64
+	MemtableBytes          int64 // the size of the keys and entries in the memtable
+	MemtableKeys           int64 // the number of distinct keys in the memtable
+	ImmutableMemtables     int   // full memtables waiting to be flushed
+	WriteStalls            int64
+}
+
+// FilterFalsePositiveRate returns the fraction of lookups for keys a file doesn't have that its
+// Bloom filter failed to rule out, or 0 if there haven't been any
+func (s Stats) FilterFalsePositiveRate() float64 {
+	if s.FilterNegatives+s.FilterFalsePositives == 0 {
+		return 0
+	}
+	return float64(s.FilterFalsePositives) / float64(s.FilterNegatives+s.FilterFalsePositives)
+}
+
+// BlockCacheHitRate returns the fraction of data block reads served from the block cache, or 0
+// if there haven't been any
+func (s Stats) BlockCacheHitRate() float64 {
+	if s.BlockCacheHits+s.BlockCacheMisses == 0 {
+		return 0
+	}
+	return float64(s.BlockCacheHits) / float64(s.BlockCacheHits+s.BlockCacheMisses)
+}
+
+// WriteAmplification returns the bytes written to sorted files by flushes and compactions for
+// every byte flushed from the memtable, or 0 if nothing has been flushed yet
+func (s Stats) WriteAmplification() float64 {
+	if s.FlushBytes == 0 {
+		return 0
+	}
+	return float64(s.FlushBytes+s.CompactionBytesWritten) / float64(s.FlushBytes)
+}
+
+// CompressionRatio returns the size of the data in every sorted file before compression divided
+// by its size on disk, or 0 if there are no sorted files
+func (s Stats) CompressionRatio() float64 {
+	var data, stored int64
+	for _, level := range s.Levels {
+		data += level.DataBytes
+		stored += level.StoredDataBytes
+	}
+	if stored == 0 {
+		return 0
+	}
+	return float64(data) / float64(stored)
+}
+
+// TotalBytes returns the size of all sorted files on disk
+func (s Stats) TotalBytes() int64 {
+	var total int64
+	for _, level := range s.Levels {
+		total += level.Bytes
+	}
+	return total
+}
+
+// Stats returns the current file layout and write counters of the default family
+func (s *SortedFileKvStorage) Stats() Stats {
+	return s.defaultFamily.Stats()
+}
+
+// Stats returns the family's current file layout and write counters
+func (f *ColumnFamily) Stats() Stats {
+	s := f.store
+	s.mu.RLock()
+	v := f.current
+	v.ref()
+	immutables := s.immutablesOf(f)
+	memtableBytes, memtableKeys := f.memtable.Bytes(), f.memtable.Size()
+	s.mu.RUnlock()
+	defer v.unref()
+
+	var stats Stats
+	stats.MemtableBytes = int64(memtableBytes)
+	stats.MemtableKeys = int64(memtableKeys)
+	stats.ImmutableMemtables = immutables
+	stats.WriteStalls = atomic.LoadInt64(&f.stats.writeStalls)
+	for i, level := range v.levels {
+		stats.Levels[i] = LevelStats{Files: len(level), Bytes: v.levelSize(i)}
+		for _, f := range level {
+			stats.Levels[i].StoredDataBytes += f.storedDataSize
+			stats.Levels[i].DataBytes += f.dataSize
+		}
+	}
+	stats.UserBytes = atomic.LoadInt64(&f.stats.userBytes)
+	stats.FlushBytes = atomic.LoadInt64(&f.stats.flushBytes)
+	stats.CompactionBytesRead = atomic.LoadInt64(&f.stats.compactionBytesRead)
+	stats.CompactionBytesWritten = atomic.LoadInt64(&f.stats.compactionBytesWritten)
+	stats.Compactions = atomic.LoadInt64(&f.stats.compactions)
+	stats.FilterNegatives = atomic.LoadInt64(&f.stats.filterNegatives)
+	stats.FilterFalsePositives = atomic.LoadInt64(&f.stats.filterFalsePositives)
+	if s.blockCache != nil {
+		stats.BlockCacheHits = atomic.LoadInt64(&s.blockCache.hits)
+		stats.BlockCacheMisses = atomic.LoadInt64(&s.blockCache.misses)
+		stats.BlockCacheBytes = s.blockCache.usage()
+	}
+	return stats
+}
+
+// SpaceAmplification returns the SpaceAmplification of the default family
+func (s *SortedFileKvStorage) SpaceAmplification() (float64, error) {
+	return s.defaultFamily.SpaceAmplification()
+}
+
+// SpaceAmplification returns the size of all of the family's sorted files divided by the size
+// of the live data in them, which is the newest record for each key that hasn't been deleted. It
+// reads every file, so it is expensive on a large family. It returns 0 if there is no live data.
+func (f *ColumnFamily) SpaceAmplification() (float64, error) {
+	s := f.store
+	s.mu.RLock()
+	v, err := s.acquireVersion(f)
+	s.mu.RUnlock()
+	if err != nil {
+		return 0, fmt.Errorf("failed to read sorted files: %w", err)
+	}
+	defer s.releaseVersion(v)
+
+	// iterators are ordered newest first, so the newest record for each key wins
+	iters := make([]iterator, 0)
+	var total int64
+	add := func(f *SortedFile) error {
+		iter, err := newSortedFileIterator(f)
+		if err != nil {
+			return err
+		}
+		iters = append(iters, iter)
+		total += f.size
+		return nil
+	}
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		err := add(v.levels[0][i])
+		if err != nil {
+			newMergingIterator(iters).Close()
+			return 0, err
+		}
+	}
+	for _, level := range v.levels[1:] {
+		for _, f := range level {
+			err := add(f)
+			if err != nil {
+				newMergingIterator(iters).Close()
+				return 0, err
+			}
+		}
+	}
+	merged := newMergingIterator(iters)
+	defer merged.Close()
+
+	var live int64
+	for merged.Next() {
+		if r := merged.Record(); !r.Deleted {
+			live += r.Size()
+		}
+	}
+	if merged.Err() != nil {
+		return 0, fmt.Errorf("failed to read sorted files: %v", merged.Err())
+	}
+	if live == 0 {
+		return 0, nil
+	}
+	return float64(total) / float64(live), nil
+}
@@ -0,0 +1,71 @@
+package sortedfile
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func Test_Stats_WriteAmplification_CountsCompactionWrites(t *testing.T) {
+	stats := Stats{FlushBytes: 100, CompactionBytesWritten: 250}
+	if amp := stats.WriteAmplification(); amp != 3.5 {
+		t.Fatalf("Expected write amplification of 3.5, got %v", amp)
+	}
+	if amp := (Stats{}).WriteAmplification(); amp != 0 {
+		t.Fatalf("Expected write amplification of 0 before any flush, got %v", amp)
+	}
+}
+
+func Test_SortedFileKvStorage_Stats_CountsFlushesAndCompactions(t *testing.T) {
+	storage := newCompactingTestStorage(t, afero.NewMemMapFs())
+	defer storage.Close()
+
+	for i := 0; i < 1000; i++ {
+		storage.Set(fmt.Sprintf("key%03d", i%300), "value")
+	}
+	storage.waitForFlushes()
+	storage.compactUntilBalanced()
+
+	stats := storage.Stats()
+	if stats.UserBytes == 0 || stats.FlushBytes == 0 {
+		t.Fatalf("Expected writes and flushes to be counted, got %d and %d bytes", stats.UserBytes, stats.FlushBytes)
+	}
+	if stats.Compactions == 0 || stats.CompactionBytesRead == 0 || stats.CompactionBytesWritten == 0 {
+		t.Fatal("Expected compactions to be counted")
+	}
+	if stats.WriteAmplification() <= 1 {
+		t.Fatalf("Expected write amplification above 1, got %v", stats.WriteAmplification())
+	}
+	if stats.TotalBytes() == 0 {
+		t.Fatal("Expected files to be counted in the levels")
+	}
+}
+
+func Test_SortedFileKvStorage_SpaceAmplification_CountsShadowedRecords(t *testing.T) {
+	storage, err := NewSortedFileKvStorage(afero.NewMemMapFs())
+	if err != nil {
+		t.Fatalf("Failed to init storage: %v", err)
+	}
+	defer storage.Close()
+	storage.compactionMu.Lock()
+	storage.defaultFamily.compactionPicker.(*leveledPicker).l0Trigger = 100 // keep both copies of each key
+	storage.compactionMu.Unlock()
+
+	// write the same keys twice, into two files of the same size
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 100; i++ {
+			storage.Set(fmt.Sprintf("key%03d", i), "value")
+		}
+		storage.Flush()
+	}
+
+	amp, err := storage.SpaceAmplification()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// each file also has an index, meta block and footer on top of its records
+	if amp < 2 || amp > 2.5 {
+		t.Fatalf("Expected space amplification of just over 2, got %v", amp)
+	}
+}
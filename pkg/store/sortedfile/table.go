@@ -0,0 +1,233 @@
+package sortedfile
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/haydenjeune/kvstore/pkg/keyoffset"
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+// Sorted files are written as tables laid out as:
+//
+//	data blocks... | meta block | index block | footer
+//
+// Data blocks hold records, encoded as in pkg/record, in key order. A block is finished once it
+// holds at least the configured block size, so a lookup only ever reads one small block. Every
+// block is followed by a trailer of a codec byte, saying how the block is encoded, and a crc32
+// of the block as stored and the codec.
+//
+// The index block is a sparse index, encoded as in pkg/keyoffset, with an entry for each data
+// block: the last key in the block, then the offset and size of the block. The meta block holds
+// named properties of the file, such as its Bloom filter, each a sequence of fields, each a
+// uvarint length followed by that many bytes.
+//
+// The footer takes up the last FOOTER_SIZE bytes of the file:
+//
+//	meta offset (8 bytes) | meta size (8 bytes) | index offset (8 bytes) | index size (8 bytes) |
+//	format version (4 bytes) | crc32 of the footer so far (4 bytes) | magic (8 bytes)
+//
+// so opening a file only reads the footer, then the index and meta blocks it points to.
+
+const TABLE_MAGIC = "KVSTABLE"
+const TABLE_FORMAT_VERSION uint32 = 1
+
+const FOOTER_SIZE = 48
+const BLOCK_TRAILER_SIZE = 5
+const BLOCK_SIZE = 4 << 10
+
+const CODEC_NONE byte = 0
+
+// names of the properties in the meta block
+const (
+	META_FILTER    = "filter"
+	META_SMALLEST  = "smallest"
+	META_DATA_SIZE = "data_size" // the size of the data blocks before compression
+)
+
+var tableCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// blockHandle locates a block within a table, not including its trailer
+type blockHandle struct {
+	offset int64
+	size   int64
+}
+
+// blockOf returns the handle of the data block an index entry leads to
+func blockOf(e keyoffset.KeyOffset) blockHandle {
+	return blockHandle{offset: e.Offset, size: e.Size}
+}
+
+// encodeBlock adds the trailer to a block as stored with codec
+func encodeBlock(stored []byte, codec byte) []byte {
+	b := make([]byte, len(stored)+BLOCK_TRAILER_SIZE)
+	copy(b, stored)
+	b[len(stored)] = codec
+	binary.BigEndian.PutUint32(b[len(stored)+1:], crc32.Checksum(b[:len(stored)+1], tableCrcTable))
+	return b
+}
+
+// readBlock reads a block and checks it against its trailer, returning its decompressed contents
+func readBlock(f io.ReaderAt, h blockHandle) ([]byte, error) {
+	b := make([]byte, h.size+BLOCK_TRAILER_SIZE)
+	_, err := f.ReadAt(b, h.offset)
+	if err == io.EOF {
+		return nil, &record.ErrCorrupt{Offset: h.offset, Reason: "file ends part of the way through a block"}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read block at offset %d: %v", h.offset, err)
+	}
+	return decodeBlock(b, h)
+}
+
+// decodeBlock checks a block, followed by its trailer, returning its decompressed contents. The
+// contents of an uncompressed block are a slice of b.
+func decodeBlock(b []byte, h blockHandle) ([]byte, error) {
+	stored, trailer := b[:h.size], b[h.size:]
+	if crc32.Checksum(b[:h.size+1], tableCrcTable) != binary.BigEndian.Uint32(trailer[1:]) {
+		return nil, &record.ErrCorrupt{Offset: h.offset, Reason: "block checksum mismatch"}
+	}
+	contents, err := decompressBlock(stored, trailer[0])
+	if err != nil {
+		return nil, &record.ErrCorrupt{Offset: h.offset, Reason: err.Error()}
+	}
+	return contents, nil
+}
+
+func encodeFooter(meta blockHandle, index blockHandle) []byte {
+	b := make([]byte, FOOTER_SIZE)
+	binary.BigEndian.PutUint64(b[0:], uint64(meta.offset))
+	binary.BigEndian.PutUint64(b[8:], uint64(meta.size))
+	binary.BigEndian.PutUint64(b[16:], uint64(index.offset))
+	binary.BigEndian.PutUint64(b[24:], uint64(index.size))
+	binary.BigEndian.PutUint32(b[32:], TABLE_FORMAT_VERSION)
+	binary.BigEndian.PutUint32(b[36:], crc32.Checksum(b[:36], tableCrcTable))
+	copy(b[40:], TABLE_MAGIC)
+	return b
+}
+
+// decodeFooter returns the meta and index block handles from the footer of a file of the given
+// size, checking that they lie within the file
+func decodeFooter(b []byte, fileSize int64) (blockHandle, blockHandle, error) {
+	footerOffset := fileSize - FOOTER_SIZE
+	if string(b[40:]) != TABLE_MAGIC {
+		return blockHandle{}, blockHandle{}, &record.ErrCorrupt{Offset: footerOffset, Reason: "footer has the wrong magic number"}
+	}
+	if crc32.Checksum(b[:36], tableCrcTable) != binary.BigEndian.Uint32(b[36:]) {
+		return blockHandle{}, blockHandle{}, &record.ErrCorrupt{Offset: footerOffset, Reason: "footer checksum mismatch"}
+	}
+	if version := binary.BigEndian.Uint32(b[32:]); version != TABLE_FORMAT_VERSION {
+		return blockHandle{}, blockHandle{}, fmt.Errorf("unsupported table format version %d", version)
+	}
+
+	meta := blockHandle{offset: int64(binary.BigEndian.Uint64(b[0:])), size: int64(binary.BigEndian.Uint64(b[8:]))}
+	index := blockHandle{offset: int64(binary.BigEndian.Uint64(b[16:])), size: int64(binary.BigEndian.Uint64(b[24:]))}
+	for _, h := range []blockHandle{meta, index} {
+		if !h.within(footerOffset) {
+			return blockHandle{}, blockHandle{}, &record.ErrCorrupt{Offset: footerOffset, Reason: "footer points outside the file"}
+		}
+	}
+	return meta, index, nil
+}
+
+// within reports whether the block and its trailer end before limit
+func (h blockHandle) within(limit int64) bool {
+	return h.offset >= 0 && h.size >= 0 && h.offset+h.size+BLOCK_TRAILER_SIZE <= limit
+}
+
+// appendField appends a uvarint length followed by b
+func appendField(buf []byte, b []byte) []byte {
+	scratch := make([]byte, binary.MaxVarintLen64)
+	buf = append(buf, scratch[:binary.PutUvarint(scratch, uint64(len(b)))]...)
+	return append(buf, b...)
+}
+
+func appendUvarint(buf []byte, v int64) []byte {
+	scratch := make([]byte, binary.MaxVarintLen64)
+	return append(buf, scratch[:binary.PutUvarint(scratch, uint64(v))]...)
+}
+
+// fieldReader reads the fields written by appendField and appendUvarint, remembering the first
+// problem so that callers only need to check once they're done
+type fieldReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *fieldReader) uvarint() int64 {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 || v > 1<<62 {
+		r.bad = true
+		r.b = nil
+		return 0
+	}
+	r.b = r.b[n:]
+	return int64(v)
+}
+
+func (r *fieldReader) field() []byte {
+	length := r.uvarint()
+	if r.bad || length > int64(len(r.b)) {
+		r.bad = true
+		r.b = nil
+		return nil
+	}
+	field := r.b[:length]
+	r.b = r.b[length:]
+	return field
+}
+
+func (r *fieldReader) done() bool {
+	return len(r.b) == 0
+}
+
+// decodeIndex parses an index block, checking that the data blocks are in order and lie before
+// the meta and index blocks at limit
+func decodeIndex(b []byte, offset int64, limit int64) (*keyoffset.Index, error) {
+	index, err := keyoffset.Decode(b)
+	if err != nil {
+		return nil, &record.ErrCorrupt{Offset: offset, Reason: err.Error()}
+	}
+	var nextOffset int64
+	for n := 0; n < index.Len(); n++ {
+		block := blockOf(index.At(n))
+		if block.offset != nextOffset || !block.within(limit) {
+			return nil, &record.ErrCorrupt{Offset: offset, Reason: "index block points to a block in the wrong place"}
+		}
+		nextOffset = block.offset + block.size + BLOCK_TRAILER_SIZE
+	}
+	return index, nil
+}
+
+func encodeMeta(properties map[string][]byte) []byte {
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := make([]byte, 0)
+	for _, name := range names {
+		buf = appendField(buf, []byte(name))
+		buf = appendField(buf, properties[name])
+	}
+	return buf
+}
+
+// decodeMeta parses a meta block. Unknown properties are kept, so files written by newer
+// versions that only add properties can still be read.
+func decodeMeta(b []byte, offset int64) (map[string][]byte, error) {
+	properties := make(map[string][]byte)
+	r := fieldReader{b: b}
+	for !r.done() {
+		name := r.field()
+		value := r.field()
+		if r.bad {
+			return nil, &record.ErrCorrupt{Offset: offset, Reason: "meta block is malformed"}
+		}
+		properties[string(name)] = value
+	}
+	return properties, nil
+}
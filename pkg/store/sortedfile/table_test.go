@@ -0,0 +1,102 @@
+package sortedfile
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/keyoffset"
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+func Test_decodeFooter_RoundTripsEncodedFooter(t *testing.T) {
+	meta := blockHandle{offset: 100, size: 20}
+	index := blockHandle{offset: 125, size: 30}
+	footer := encodeFooter(meta, index)
+	if len(footer) != FOOTER_SIZE {
+		t.Fatalf("Expected footer of %d bytes, got %d", FOOTER_SIZE, len(footer))
+	}
+
+	decodedMeta, decodedIndex, err := decodeFooter(footer, 160+FOOTER_SIZE)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decodedMeta != meta || decodedIndex != index {
+		t.Fatalf("Expected %v and %v, got %v and %v", meta, index, decodedMeta, decodedIndex)
+	}
+}
+
+func Test_decodeFooter_ErrorsForHandlesOutsideFile(t *testing.T) {
+	footer := encodeFooter(blockHandle{offset: 100, size: 20}, blockHandle{offset: 125, size: 30})
+
+	_, _, err := decodeFooter(footer, 100+FOOTER_SIZE)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected corruption error, got %v", err)
+	}
+}
+
+// encodeTestIndex encodes an index of the given keys and blocks, without checking their order
+func encodeTestIndex(keys []string, blocks []blockHandle) []byte {
+	encoded := make([]byte, 0)
+	for i, key := range keys {
+		b := keyoffset.NewBuilder()
+		b.Add(key, blocks[i].offset, blocks[i].size)
+		encoded = append(encoded, b.Build().Encode()...)
+	}
+	return encoded
+}
+
+func Test_decodeIndex_RoundTripsEncodedIndex(t *testing.T) {
+	keys := []string{"b", "d"}
+	blocks := []blockHandle{{offset: 0, size: 10}, {offset: 15, size: 20}}
+
+	decoded, err := decodeIndex(encodeTestIndex(keys, blocks), 40, 40)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if decoded.Len() != 2 {
+		t.Fatalf("Expected 2 entries, got %d", decoded.Len())
+	}
+	for i, key := range keys {
+		if e := decoded.At(i); e.Key != key || blockOf(e) != blocks[i] {
+			t.Fatalf("Expected entry %d to be '%s' at %v, got %v", i, key, blocks[i], e)
+		}
+	}
+}
+
+func Test_decodeIndex_ErrorsForMalformedIndex(t *testing.T) {
+	outOfOrder := encodeTestIndex([]string{"d", "b"}, []blockHandle{{offset: 0, size: 10}, {offset: 15, size: 20}})
+	gap := encodeTestIndex([]string{"b", "d"}, []blockHandle{{offset: 0, size: 10}, {offset: 20, size: 20}})
+	truncated := outOfOrder[:len(outOfOrder)-1]
+
+	for _, b := range [][]byte{outOfOrder, gap, truncated} {
+		var corrupt *record.ErrCorrupt
+		if _, err := decodeIndex(b, 40, 40); !errors.As(err, &corrupt) {
+			t.Fatalf("Expected corruption error, got %v", err)
+		}
+	}
+}
+
+func Test_decodeMeta_RoundTripsProperties(t *testing.T) {
+	properties := map[string][]byte{META_SMALLEST: []byte("a"), "other": {1, 2, 3}}
+
+	decoded, err := decodeMeta(encodeMeta(properties), 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if string(decoded[META_SMALLEST]) != "a" || len(decoded["other"]) != 3 {
+		t.Fatalf("Expected properties to round trip, got %v", decoded)
+	}
+}
+
+func Test_readBlock_ErrorsForChecksumMismatch(t *testing.T) {
+	b := encodeBlock([]byte("contents"), CODEC_NONE)
+	b[0] ^= 0xff
+
+	_, err := readBlock(bytes.NewReader(b), blockHandle{offset: 0, size: int64(len("contents"))})
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected corruption error, got %v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package sortedfile
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/haydenjeune/kvstore/pkg/record"
+)
+
+const NUM_LEVELS = 7
+
+// A version is an immutable snapshot of the sorted files making up a column family. Reads take
+// a reference to the current version, so that compaction can replace files without disturbing
+// reads that are in progress.
+type version struct {
+	// levels[0] holds files flushed from the memtable, oldest first, whose key ranges may
+	// overlap. Every other level holds files sorted by key whose ranges don't overlap.
+	levels [NUM_LEVELS][]*SortedFile
+	refs   int32
+}
+
+// versionEdit describes the changes made to the set of files by a flush or compaction
+type versionEdit struct {
+	removed   map[*SortedFile]bool
+	added     [NUM_LEVELS][]*SortedFile
+	logNumber int64 // set by a flush to the first log that may still hold writes it didn't include
+}
+
+func newVersion(levels [NUM_LEVELS][]*SortedFile) *version {
+	v := &version{levels: levels}
+	for _, level := range v.levels {
+		for _, f := range level {
+			f.ref()
+		}
+	}
+	return v
+}
+
+func (v *version) ref() {
+	atomic.AddInt32(&v.refs, 1)
+}
+
+// unref releases the version's files once it is no longer in use
+func (v *version) unref() {
+	if atomic.AddInt32(&v.refs, -1) == 0 {
+		for _, level := range v.levels {
+			for _, f := range level {
+				f.unref()
+			}
+		}
+	}
+}
+
+// discard releases a version that never became current because the edit making it couldn't be
+// recorded. Its new files are closed but left on disk: the edit may still have reached the
+// manifest if only syncing it failed, and if it didn't, they are removed as orphans the next
+// time the store is opened.
+func (v *version) discard() {
+	if atomic.AddInt32(&v.refs, -1) == 0 {
+		for _, level := range v.levels {
+			for _, f := range level {
+				f.release()
+			}
+		}
+	}
+}
+
+// apply returns a new version with the edit applied
+func (v *version) apply(edit *versionEdit) *version {
+	var levels [NUM_LEVELS][]*SortedFile
+	for i, level := range v.levels {
+		added := false
+		for _, f := range level {
+			if !edit.removed[f] {
+				levels[i] = append(levels[i], f)
+			} else if i == 0 && !added {
+				// files merged within level 0 take the place of their inputs, to keep it
+				// ordered oldest first
+				levels[i] = append(levels[i], edit.added[i]...)
+				added = true
+			}
+		}
+		if !added {
+			levels[i] = append(levels[i], edit.added[i]...)
+		}
+		if i > 0 {
+			sort.Slice(levels[i], func(a, b int) bool {
+				return levels[i][a].smallest < levels[i][b].smallest
+			})
+		}
+	}
+	return newVersion(levels)
+}
+
+// get returns the newest record for key in any file, which may be a tombstone
+func (v *version) get(key string, stats *stats) (record.Record, bool, error) {
+	for i := len(v.levels[0]) - 1; i >= 0; i-- {
+		r, exists, filtered, err := v.levels[0][i].get(key)
+		stats.recordFilterResult(filtered, exists)
+		if err != nil || exists {
+			return r, exists, err
+		}
+	}
+
+	for _, level := range v.levels[1:] {
+		// only one file in each level can contain the key
+		i := sort.Search(len(level), func(i int) bool {
+			return level[i].largest >= key
+		})
+		if i < len(level) && level[i].smallest <= key {
+			r, exists, filtered, err := level[i].get(key)
+			stats.recordFilterResult(filtered, exists)
+			if err != nil || exists {
+				return r, exists, err
+			}
+		}
+	}
+
+	return record.Record{}, false, nil
+}
+
+// overlapping returns the files in level containing any keys within [smallest, largest]
+func (v *version) overlapping(level int, smallest string, largest string) []*SortedFile {
+	files := make([]*SortedFile, 0)
+	for _, f := range v.levels[level] {
+		if f.overlaps(smallest, largest) {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+func (v *version) levelSize(level int) int64 {
+	var size int64
+	for _, f := range v.levels[level] {
+		size += f.size
+	}
+	return size
+}
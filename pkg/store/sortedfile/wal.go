@@ -0,0 +1,191 @@
+package sortedfile
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+// Every write to a memtable is first appended to a write-ahead log, so that the memtables can
+// be rebuilt if the process exits before they are flushed. Every column family shares the one
+// log, which is numbered from the same sequence as sorted files, e.g. "3.wal", and a new log is
+// started whenever a memtable is made immutable. A log is deleted once every family has flushed
+// the writes in it.
+//
+// Each record in the log holds a batch of writes, which are replayed all together or not at
+// all, as:
+//
+//	for each write: family id (uvarint) | key length (uvarint) | key | entry length (uvarint) | entry
+
+const WAL_SUFFIX = ".wal"
+
+// the key of every record in the log, whose value is the encoded batch
+const WAL_BATCH_KEY = "batch"
+
+type writeAheadLog struct {
+	number   int64
+	filename string
+	file     afero.File
+	size     int64 // the end of the last complete record
+	syncer   *durability.Syncer
+}
+
+func walFileName(name string) string {
+	return name + WAL_SUFFIX
+}
+
+func openWriteAheadLog(fs afero.Fs, filename string, policy durability.Policy) (*writeAheadLog, error) {
+	f, err := fs.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log '%s': %v", filename, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to get stats for write-ahead log '%s': %v", filename, err)
+	}
+	return &writeAheadLog{filename: filename, file: f, size: info.Size(), syncer: durability.NewSyncer(f, policy)}, nil
+}
+
+// Append writes the records to the log with a single write, followed by a sync if the
+// durability policy calls for one
+func (w *writeAheadLog) Append(records ...record.Record) error {
+	var encoded []byte
+	for _, r := range records {
+		encoded = append(encoded, r.Encode()...)
+	}
+	n, err := w.file.Write(encoded)
+	if err != nil {
+		// don't leave a partial record behind for the next append to follow, as it would then be
+		// corruption in the middle of the log rather than a torn tail
+		w.file.Truncate(w.size)
+		return fmt.Errorf("failed to append to write-ahead log '%s': %v", w.filename, err)
+	}
+	w.size += int64(n)
+	err = w.syncer.Written()
+	if err != nil {
+		return fmt.Errorf("failed to sync write-ahead log '%s': %v", w.filename, err)
+	}
+	return nil
+}
+
+func (w *writeAheadLog) Close() error {
+	err := w.syncer.Close()
+	if err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to sync write-ahead log '%s': %v", w.filename, err)
+	}
+	return w.file.Close()
+}
+
+// logFile is a write-ahead log found on disk
+type logFile struct {
+	number   int64
+	filename string
+}
+
+// findWriteAheadLogs returns any existing logs, oldest first
+func findWriteAheadLogs(fs afero.Fs) ([]logFile, error) {
+	files, err := afero.ReadDir(fs, ".")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files: %v", err)
+	}
+
+	logs := make([]logFile, 0)
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), WAL_SUFFIX) {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), WAL_SUFFIX), 10, 64)
+		if err == nil {
+			logs = append(logs, logFile{number: n, filename: f.Name()})
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		return logs[i].number < logs[j].number
+	})
+	return logs, nil
+}
+
+// replayWriteAheadLog calls fn for every record in the log. A torn record at the end of the
+// log is ignored, as it was never acknowledged, but only if it provably is the end: its lengths
+// pass the header checksum and the log ends before the record does, or nothing follows it.
+// Corruption anywhere else is returned as a *record.ErrCorrupt, so that the log is kept rather
+// than replaced by a copy missing every write after the damage.
+func replayWriteAheadLog(fs afero.Fs, filename string, fn func(r record.Record)) error {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log '%s': %v", filename, err)
+	}
+	defer f.Close()
+
+	reader := record.NewReader(f, 0)
+	for {
+		r, err := reader.Next()
+		var corrupt *record.ErrCorrupt
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || (errors.As(err, &corrupt) && reader.AtEOF()) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to replay write-ahead log '%s': %w", filename, err)
+		}
+		fn(r)
+	}
+}
+
+// replayWrites calls fn for every write in the log, along with the id of the family it was made
+// to, stopping at the first batch that can't be decoded
+func replayWrites(fs afero.Fs, log logFile, fn func(family int64, r record.Record)) error {
+	var decodeErr error
+	err := replayWriteAheadLog(fs, log.filename, func(r record.Record) {
+		if decodeErr != nil {
+			return
+		}
+		decodeErr = decodeBatch(r, fn)
+	})
+	if err != nil {
+		return err
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("failed to replay write-ahead log '%s': %w", log.filename, decodeErr)
+	}
+	return nil
+}
+
+// writeMemtablesToLog writes every entry in the memtables of the families to a new log, syncing
+// it before returning
+func writeMemtablesToLog(families []*ColumnFamily, filename string, fs afero.Fs) error {
+	f, err := fs.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open write-ahead log '%s': %v", filename, err)
+	}
+	w := bufio.NewWriter(f)
+
+	for _, family := range families {
+		iter := family.memtable.Iterator()
+		for err == nil && iter.Next() {
+			batch := &WriteBatch{}
+			batch.add(family, decodeEntry(iter.Key(), iter.Value()))
+			_, err = w.Write(batch.encode().Encode())
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write write-ahead log '%s': %v", filename, err)
+	}
+	return nil
+}
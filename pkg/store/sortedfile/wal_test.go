@@ -0,0 +1,102 @@
+package sortedfile
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/haydenjeune/kvstore/pkg/durability"
+	"github.com/haydenjeune/kvstore/pkg/record"
+	"github.com/spf13/afero"
+)
+
+func Test_replayWriteAheadLog_IgnoresTornTail(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	wal, err := openWriteAheadLog(fs, walFileName("0"), durability.Never())
+	if err != nil {
+		t.Fatalf("Failed to open log: %v", err)
+	}
+	wal.Append(record.Record{Key: "a", Value: "1"})
+	wal.Append(record.Record{Key: "b", Value: "2"})
+	wal.Close()
+	torn := record.Record{Key: "c", Value: "3"}.Encode()
+	f, _ := fs.OpenFile(walFileName("0"), os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(torn[:len(torn)-2])
+	f.Close()
+
+	var keys []string
+	err = replayWriteAheadLog(fs, walFileName("0"), func(r record.Record) {
+		keys = append(keys, r.Key)
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error replaying log with torn tail: %v", err)
+	}
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "b" {
+		t.Fatalf("Expected keys 'a' and 'b' to be replayed, got %v", keys)
+	}
+}
+
+func Test_replayWriteAheadLog_ErrorsForCorruptRecord(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	damaged := record.Record{Key: "a", Value: "1"}.Encode()
+	damaged[len(damaged)-1] ^= 0xff
+	afero.WriteFile(fs, walFileName("0"), append(damaged, record.Record{Key: "b", Value: "2"}.Encode()...), 0644)
+
+	err := replayWriteAheadLog(fs, walFileName("0"), func(r record.Record) {})
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) || corrupt.Offset != 0 {
+		t.Fatalf("Expected corruption at offset 0, got %v", err)
+	}
+}
+
+func Test_replayWriteAheadLog_ErrorsForDamagedLength(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	damaged := record.Record{Key: "a", Value: "1"}.Encode()
+	damaged[11] ^= 0x40 // the record now appears to run past the end of the log
+	afero.WriteFile(fs, "0.wal", append(damaged, record.Record{Key: "b", Value: "2"}.Encode()...), 0644)
+
+	err := replayWriteAheadLog(fs, "0.wal", func(r record.Record) {})
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) || corrupt.Offset != 0 {
+		t.Fatalf("Expected corruption at offset 0, got %v", err)
+	}
+}
+
+func Test_SortedFileKvStorage_KeepsCorruptWriteAheadLog(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	storage, _ := NewSortedFileKvStorage(fs)
+	filename := storage.wal.filename
+	for _, key := range []string{"a", "b", "c"} {
+		storage.Set(key, "value")
+	}
+	// no Close, as if the process had crashed
+	contents, _ := afero.ReadFile(fs, filename)
+	contents[11] ^= 0x40
+	afero.WriteFile(fs, filename, contents, 0644)
+
+	_, err := NewSortedFileKvStorage(fs)
+	var corrupt *record.ErrCorrupt
+	if !errors.As(err, &corrupt) {
+		t.Fatalf("Expected the store to refuse to open with *record.ErrCorrupt, got %v", err)
+	}
+	if kept, _ := afero.ReadFile(fs, filename); !reflect.DeepEqual(kept, contents) {
+		t.Fatal("Expected the corrupt log to be left as it was")
+	}
+}
+
+func Test_findWriteAheadLogs_ReturnsLogsInOrder(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	for _, name := range []string{"10.wal", "2.wal", "3", "notalog.wal", "4.log"} {
+		fs.Create(name)
+	}
+
+	logs, err := findWriteAheadLogs(fs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []logFile{{2, "2.wal"}, {10, "10.wal"}}
+	if !reflect.DeepEqual(logs, expected) {
+		t.Fatalf("Expected %v, got %v", expected, logs)
+	}
+}
@@ -3,4 +3,6 @@ package store
 type KvStore interface {
 	Get(key string) (string, bool, error)
 	Set(key string, value string) error
+	// Close releases any resources held by the store. It must not be used afterwards.
+	Close() error
 }
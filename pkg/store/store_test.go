@@ -1,12 +1,16 @@
 package store
 
 import (
+	"fmt"
 	"os"
 	"path"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/spf13/afero"
+	"github.com/haydenjeune/kvstore/pkg/memtable"
+	"github.com/haydenjeune/kvstore/pkg/store/btree"
 	"github.com/haydenjeune/kvstore/pkg/store/sortedfile"
 )
 
@@ -45,12 +49,42 @@ func Test_AllKvStoreImplementations_CaptureExpectedInvariantBehaviour(t *testing
 			return NewInMemSortedKVStorage()
 		})
 	})
+
+	t.Run("InMemSortedKVStorage/Unbalanced", func(t *testing.T) {
+		test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t, func() (KvStore, error) {
+			return NewInMemSortedKVStorage(WithMemtable(memtable.UnbalancedTree))
+		})
+	})
+
+	t.Run("InMemSortedKVStorage/SkipList", func(t *testing.T) {
+		test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t, func() (KvStore, error) {
+			return NewInMemSortedKVStorage(WithMemtable(memtable.SkipList))
+		})
+	})
 	
 	t.Run("SortedFileKVStorage", func(t *testing.T) {
 		test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t, func() (KvStore, error) {
 			return sortedfile.NewSortedFileKvStorage(afero.NewMemMapFs())
 		})
 	})
+
+	t.Run("SortedFileKVStorage/SkipList", func(t *testing.T) {
+		test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t, func() (KvStore, error) {
+			return sortedfile.NewSortedFileKvStorage(afero.NewMemMapFs(), sortedfile.WithMemtable(memtable.SkipList))
+		})
+	})
+
+	t.Run("BTreeKVStorage", func(t *testing.T) {
+		test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t, func() (KvStore, error) {
+			return btree.NewBTreeKvStorage(afero.NewMemMapFs())
+		})
+	})
+
+	t.Run("CowBTreeKVStorage", func(t *testing.T) {
+		test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t, func() (KvStore, error) {
+			return btree.NewCowBTreeKvStorage(afero.NewMemMapFs())
+		})
+	})
 }
 
 func test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t *testing.T, storeFactory func() (KvStore, error)) {
@@ -59,6 +93,7 @@ func test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t *testing.T,
 	if err != nil {
 		t.Fatalf("failed to instantiate KVstore: %v", err)
 	}
+	defer store.Close()
 
 	test_key := "key"
 	test_value := "value"
@@ -99,3 +134,113 @@ func test_KvStoreImplementation_CapturesExpectedInvariantBehaviour(t *testing.T,
 		}
 	})
 }
+
+// Run with -race to check that each engine is safe for use by concurrent HTTP handlers
+func Test_AllKvStoreImplementations_AreSafeForConcurrentUse(t *testing.T) {
+	t.Run("InMemHashMapKVStorage", func(t *testing.T) {
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return NewInMemHashMapKVStorage()
+		})
+	})
+
+	t.Run("FsAppendOnlyStorage", func(t *testing.T) {
+		filename := makeTestFilePath("kvstore_test_ConcurrentFsAppendOnlyStorage")
+		defer os.Remove(filename)
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return NewFsAppendOnlyStorage(filename)
+		})
+	})
+
+	t.Run("HashIndexedFsAppendOnlyStorage", func(t *testing.T) {
+		filename := makeTestFilePath("kvstore_test_ConcurrentHashIndexedFsAppendOnlyStorage")
+		defer os.Remove(filename)
+		defer os.Remove(hintFilename(filename))
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return NewHashIndexedFsAppendOnlyStorage(filename)
+		})
+	})
+
+	t.Run("InMemSortedKVStorage", func(t *testing.T) {
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return NewInMemSortedKVStorage()
+		})
+	})
+
+	t.Run("InMemSortedKVStorage/Unbalanced", func(t *testing.T) {
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return NewInMemSortedKVStorage(WithMemtable(memtable.UnbalancedTree))
+		})
+	})
+
+	t.Run("InMemSortedKVStorage/SkipList", func(t *testing.T) {
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return NewInMemSortedKVStorage(WithMemtable(memtable.SkipList))
+		})
+	})
+
+	t.Run("SortedFileKVStorage", func(t *testing.T) {
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return sortedfile.NewSortedFileKvStorage(afero.NewMemMapFs())
+		})
+	})
+
+	t.Run("SortedFileKVStorage/SkipList", func(t *testing.T) {
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return sortedfile.NewSortedFileKvStorage(afero.NewMemMapFs(), sortedfile.WithMemtable(memtable.SkipList))
+		})
+	})
+
+	t.Run("BTreeKVStorage", func(t *testing.T) {
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return btree.NewBTreeKvStorage(afero.NewMemMapFs())
+		})
+	})
+
+	t.Run("CowBTreeKVStorage", func(t *testing.T) {
+		test_KvStoreImplementation_IsSafeForConcurrentUse(t, func() (KvStore, error) {
+			return btree.NewCowBTreeKvStorage(afero.NewMemMapFs())
+		})
+	})
+}
+
+func test_KvStoreImplementation_IsSafeForConcurrentUse(t *testing.T, storeFactory func() (KvStore, error)) {
+	store, err := storeFactory()
+	if err != nil {
+		t.Fatalf("failed to instantiate KVstore: %v", err)
+	}
+	defer store.Close()
+
+	goroutines := 8
+	operations := 100
+
+	var wg sync.WaitGroup
+	errs := make(chan error, goroutines*operations)
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < operations; i++ {
+				// each goroutine owns some keys, and reads keys shared with other goroutines
+				key := fmt.Sprintf("%d-%d", g, i%20)
+				value := fmt.Sprintf("%d", i)
+				if err := store.Set(key, value); err != nil {
+					errs <- fmt.Errorf("failed to set '%s': %v", key, err)
+					continue
+				}
+				result, exists, err := store.Get(key)
+				if err != nil || !exists || result != value {
+					errs <- fmt.Errorf("expected '%s' to be '%s' after setting it, got '%s', %v, %v", key, value, result, exists, err)
+				}
+				if _, _, err := store.Get(fmt.Sprintf("%d-%d", (g+1)%goroutines, i%20)); err != nil {
+					errs <- fmt.Errorf("failed to get key written by another goroutine: %v", err)
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -1,11 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
+	"github.com/haydenjeune/kvstore/pkg/durability"
 	"github.com/haydenjeune/kvstore/pkg/store"
+	"github.com/haydenjeune/kvstore/pkg/store/btree"
+	"github.com/haydenjeune/kvstore/pkg/store/sortedfile"
+	"github.com/spf13/afero"
 )
 
 type GetRequest struct {
@@ -22,7 +34,30 @@ type SetRequest struct {
 	Value string `json:"value"`
 }
 
-func makeGetEndpointFunc(store store.KvStore) func(w http.ResponseWriter, r *http.Request) {
+// CreateColumnFamilyRequest tunes a new column family. Anything left out takes the value the
+// store was opened with.
+type CreateColumnFamilyRequest struct {
+	MemtableSize       int64  `json:"memtable_size"`
+	Compression        string `json:"compression"`         // "none" or "flate"
+	CompactionStrategy string `json:"compaction_strategy"` // "leveled" or "size_tiered"
+}
+
+type getter interface {
+	Get(key string) (string, bool, error)
+}
+
+type setter interface {
+	Set(key string, value string) error
+}
+
+// columnFamilyStore is a store whose keys can be split into named column families
+type columnFamilyStore interface {
+	ColumnFamily(name string) (*sortedfile.ColumnFamily, bool)
+	CreateColumnFamily(name string, opts ...sortedfile.Option) (*sortedfile.ColumnFamily, error)
+	DropColumnFamily(name string) error
+}
+
+func makeGetEndpointFunc(store getter) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var body GetRequest
 
@@ -50,7 +85,7 @@ func makeGetEndpointFunc(store store.KvStore) func(w http.ResponseWriter, r *htt
 	}
 }
 
-func makeSetEndpointFunc(store store.KvStore) func(w http.ResponseWriter, r *http.Request) {
+func makeSetEndpointFunc(store setter) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		var body SetRequest
 
@@ -73,20 +108,184 @@ func makeSetEndpointFunc(store store.KvStore) func(w http.ResponseWriter, r *htt
 	}
 }
 
+func parseColumnFamilyOptions(body CreateColumnFamilyRequest) ([]sortedfile.Option, error) {
+	var opts []sortedfile.Option
+	if body.MemtableSize < 0 {
+		return nil, fmt.Errorf("memtable size %d is negative", body.MemtableSize)
+	} else if body.MemtableSize > 0 {
+		opts = append(opts, sortedfile.WithMemtableSize(body.MemtableSize))
+	}
+	switch body.Compression {
+	case "":
+	case "none":
+		opts = append(opts, sortedfile.WithCompression(sortedfile.NoCompression))
+	case "flate":
+		opts = append(opts, sortedfile.WithCompression(sortedfile.FlateCompression))
+	default:
+		return nil, fmt.Errorf("unknown compression '%s'", body.Compression)
+	}
+	switch body.CompactionStrategy {
+	case "":
+	case "leveled":
+		opts = append(opts, sortedfile.WithCompactionStrategy(sortedfile.Leveled))
+	case "size_tiered":
+		opts = append(opts, sortedfile.WithCompactionStrategy(sortedfile.SizeTiered))
+	default:
+		return nil, fmt.Errorf("unknown compaction strategy '%s'", body.CompactionStrategy)
+	}
+	return opts, nil
+}
+
+// makeColumnFamilyEndpointFunc serves /cf/{name}/get and /cf/{name}/set, which read and write
+// keys in a column family as /get and /set do in the default family, along with PUT /cf/{name}
+// to create the family and DELETE /cf/{name} to drop it
+func makeColumnFamilyEndpointFunc(s store.KvStore) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		families, ok := s.(columnFamilyStore)
+		if !ok {
+			http.Error(w, "the storage engine doesn't support column families", http.StatusNotImplemented)
+			return
+		}
+
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/cf/"), "/")
+		name := parts[0]
+		if name == "" || len(parts) > 2 {
+			http.NotFound(w, r)
+			return
+		}
+
+		if len(parts) == 1 {
+			switch r.Method {
+			case http.MethodPut:
+				var body CreateColumnFamilyRequest
+				decoder := json.NewDecoder(r.Body)
+				decoder.DisallowUnknownFields()
+				err := decoder.Decode(&body)
+				if err != nil && err != io.EOF {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				opts, err := parseColumnFamilyOptions(body)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if _, exists := families.ColumnFamily(name); exists {
+					http.Error(w, fmt.Sprintf("column family '%s' already exists", name), http.StatusConflict)
+					return
+				}
+				_, err = families.CreateColumnFamily(name, opts...)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			case http.MethodDelete:
+				if _, exists := families.ColumnFamily(name); !exists {
+					http.NotFound(w, r)
+					return
+				}
+				err := families.DropColumnFamily(name)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+			default:
+				w.Header().Set("Allow", "PUT, DELETE")
+				http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			}
+			return
+		}
+
+		family, exists := families.ColumnFamily(name)
+		if !exists {
+			http.NotFound(w, r)
+			return
+		}
+		switch parts[1] {
+		case "get":
+			makeGetEndpointFunc(family)(w, r)
+		case "set":
+			makeSetEndpointFunc(family)(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}
+}
+
+func openStore(engine string, file string, dir string, policy durability.Policy) (store.KvStore, error) {
+	switch engine {
+	case "inmemhashmap":
+		return store.NewInMemHashMapKVStorage()
+	case "inmemsorted":
+		return store.NewInMemSortedKVStorage()
+	case "appendonly":
+		return store.NewFsAppendOnlyStorage(file, store.WithDurability(policy))
+	case "hashindexed":
+		return store.NewHashIndexedFsAppendOnlyStorage(file, store.WithDurability(policy))
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %v", err)
+	}
+	fs := afero.NewBasePathFs(afero.NewOsFs(), dir)
+	switch engine {
+	case "sortedfile":
+		return sortedfile.NewSortedFileKvStorage(fs, sortedfile.WithDurability(policy))
+	case "btree":
+		return btree.NewBTreeKvStorage(fs, btree.WithDurability(policy))
+	case "cowbtree":
+		return btree.NewCowBTreeKvStorage(fs, btree.WithDurability(policy))
+	default:
+		return nil, fmt.Errorf("unknown storage engine '%s'", engine)
+	}
+}
+
 func main() {
-	// TODO: Make the storage engine configurable
-	//store, err := store.NewInMemHashMapKVStorage()
-	//store, err := store.NewFsAppendOnlyStorage("data.kvstore")
-	store, err := store.NewHashIndexedFsAppendOnlyStorage("data.kvstore")
-	//store, err := store.NewInMemSortedKVStorage()
+	engine := flag.String("engine", "hashindexed", "storage engine: inmemhashmap, inmemsorted, appendonly, hashindexed, sortedfile, btree or cowbtree")
+	file := flag.String("file", "data.kvstore", "data file for the appendonly and hashindexed engines")
+	dir := flag.String("dir", "data", "data directory for the sortedfile, btree and cowbtree engines")
+	durabilityFlag := flag.String("durability", "never", "when the file backed engines fsync writes: never, always or interval:<duration>")
+	flag.Parse()
+
+	policy, err := durability.Parse(*durabilityFlag)
+	if err != nil {
+		log.Fatalf("Invalid -durability: %v", err)
+	}
+
+	store, err := openStore(*engine, *file, *dir, policy)
 	if err != nil {
 		log.Fatalf("Failed to instantiate storage: %v", err)
 	}
 
 	http.HandleFunc("/get", makeGetEndpointFunc(store))
 	http.HandleFunc("/set", makeSetEndpointFunc(store))
+	http.HandleFunc("/cf/", makeColumnFamilyEndpointFunc(store))
 
 	addr := "127.0.0.1:8080"
+	server := &http.Server{Addr: addr}
+
+	// Give the storage engine a chance to persist anything it needs for a fast restart, once
+	// every request in progress has finished, so that none of them is left using closed files
+	closed := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		if err := server.Shutdown(context.Background()); err != nil {
+			log.Printf("Failed to shut down server cleanly: %v", err)
+		}
+		if err := store.Close(); err != nil {
+			log.Fatalf("Failed to close storage: %v", err)
+		}
+		close(closed)
+	}()
+
 	log.Printf("Server listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-closed
 }